@@ -1,6 +1,7 @@
 package api
 
 import (
+	"context"
 	"encoding/hex"
 	"net/http"
 	"strconv"
@@ -38,38 +39,74 @@ type Transaction struct {
 	Nonce     int64
 }
 
+type Balance struct {
+	Address string
+	Balance uint64
+}
+
+type BannedPeer struct {
+	Addr   string
+	Reason string
+	Until  string
+}
+
 ///////////////////
 
 type APIError struct {
 	Error string
 }
+
+// Chain is what the api is served from; the blockchain of a full node or the headers and proofs a light client checked
+type Chain interface {
+	GetBlock(height uint32) (*core.Block, error)
+	GetBlockByHash(hash core_types.Hash) (*core.Block, error)
+	GetTxByHash(hash core_types.Hash) (*core.Transaction, error)
+	GetBalance(addr core_types.Address) (uint64, error)
+}
+
+// BanList is implemented by the p2p server which keeps track of misbehaving peers
+type BanList interface {
+	BannedPeers() []BannedPeer
+}
+
 type ServerConfig struct {
 	ListenAddr string
 	Logger     log.Logger
+	// optional; without it no peers are reported as banned
+	BanList BanList
 }
 
 type Server struct {
 	ServerConfig
-	bc     *core.Blockchain
+	bc     Chain
 	txChan chan *core.Transaction
+	echo   *echo.Echo
 }
 
-func NewAPIServer(cfg ServerConfig, bc *core.Blockchain, ch chan *core.Transaction) *Server {
-	return &Server{
+func NewAPIServer(cfg ServerConfig, bc Chain, ch chan *core.Transaction) *Server {
+	s := &Server{
 		ServerConfig: cfg,
 		bc:           bc,
 		txChan:       ch,
+		echo:         echo.New(),
 	}
+	s.echo.GET("/blocks/:hashID", s.handleGetBlock)
+	s.echo.GET("/tx/:txHash", s.handleGetTx)
+	s.echo.POST("/tx", s.handlePostTx)
+	s.echo.GET("/accounts/:addr/balance", s.handleGetBalance)
+	s.echo.GET("/peers/banned", s.handleGetBannedPeers)
+
+	return s
 }
 
+// Start serves the api until the server is shut down; http.ErrServerClosed is returned then
 func (s *Server) Start() error {
+	return s.echo.Start(s.ListenAddr)
+}
 
-	echo := echo.New()
-	echo.GET("/blocks/:hashID", s.handleGetBlock)
-	echo.GET("/tx/:txHash", s.handleGetTx)
-	echo.POST("/tx", s.handlePostTx)
-
-	return echo.Start(s.ListenAddr)
+// Shutdown stops taking requests and waits for the ones being served
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.echo.Shutdown(ctx)
 }
 
 func (s *Server) handleGetBlock(c echo.Context) error {
@@ -120,12 +157,40 @@ func (s *Server) handlePostTx(c echo.Context) error {
 	if err := tx.Decode(core.NewGobTxDecoder(c.Request().Body)); err != nil {
 		return c.JSON(http.StatusNotFound, APIError{Error: err.Error()})
 	}
+	// the node hashes the tx right away; one it can't hash is turned down here
+	if err := tx.CheckFormat(); err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
+	}
 
 	s.txChan <- tx
 
 	return nil
 }
 
+func (s *Server) handleGetBalance(c echo.Context) error {
+	b, err := hex.DecodeString(c.Param("addr"))
+	if err != nil || len(b) != len(core_types.Address{}) {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "address must be 20 hex encoded bytes"})
+	}
+
+	addr := core_types.AddressFromBytes(b)
+	balance, err := s.bc.GetBalance(addr)
+	if err != nil {
+		return c.JSON(http.StatusNotFound, APIError{Error: err.Error()})
+	}
+
+	return c.JSON(http.StatusOK, Balance{Address: addr.String(), Balance: balance})
+}
+
+func (s *Server) handleGetBannedPeers(c echo.Context) error {
+	banned := []BannedPeer{}
+	if s.BanList != nil {
+		banned = s.BanList.BannedPeers()
+	}
+
+	return c.JSON(http.StatusOK, banned)
+}
+
 // //utils
 func intoJsonBlock(block *core.Block) *Block {
 	txResponse := &TxResponse{
@@ -1,22 +1,25 @@
 package consensus
 
 import (
+	"context"
+	"fmt"
 	"os"
 	"sync"
 	"time"
+
 	"github.com/EggsyOnCode/xenolith/core"
+	"github.com/EggsyOnCode/xenolith/core_types"
 	"github.com/EggsyOnCode/xenolith/network"
 	"github.com/go-kit/log"
 )
 
 // Both the exec client and the consensus client use the same  underlying TCP
-// Transporter; so both share the same RPC msgs and peers Ch ;
-// we can segregate them by using an identifier so that the msgs FOR Consensus
-// are not received by the Exec and vice versa
+// Transporter; the router of the exec client hands the msgs of the consensus
+// protocol to the consensus client and the rest to the exec client
 
 // committee is a random collection of validators; created at the start of every epoch
 type Committee struct {
-	Validators []*network.Server
+	Validators []*Validator
 }
 
 type ConsensusClientOpts struct {
@@ -30,23 +33,27 @@ type ConsensusClientOpts struct {
 
 type ConsensusClient struct {
 	ConsensusClientOpts
-	mu         *sync.RWMutex
-	validators []*network.Server
-	rpcCh      chan network.RPC
+	mu *sync.RWMutex
+	// validators that announced themselves, by the address of their key
+	validators map[core_types.Address]*Validator
+	msgCh      <-chan *network.DecodedMsg
 	Committees []*Committee
 	ID         string
 	quitCh     chan struct{}
+	// the Start loop; Stop waits for it
+	wg      sync.WaitGroup
+	stopped bool
 }
 
-func NewConsensusClient(opts ConsensusClientOpts) *ConsensusClient {
+func NewConsensusClient(opts ConsensusClientOpts) (*ConsensusClient, error) {
 	if opts.Logger == nil {
 		opts.Logger = log.NewLogfmtLogger(os.Stderr)
 		// opts.Logger = log.With(opts.Logger, "address", opts.ID)
 	}
 	cs := &ConsensusClient{
 		mu:                  &sync.RWMutex{},
-		rpcCh:               make(chan network.RPC),
-		validators:          make([]*network.Server, 0),
+		quitCh:              make(chan struct{}),
+		validators:          make(map[core_types.Address]*Validator),
 		Committees:          make([]*Committee, 0),
 		ConsensusClientOpts: opts,
 		ID:                  opts.ExecutionClient.ID + " consensus",
@@ -55,35 +62,36 @@ func NewConsensusClient(opts ConsensusClientOpts) *ConsensusClient {
 		cs.RPCProcessor = cs
 	}
 
-	return cs
+	msgCh, err := opts.ExecutionClient.Router.Register(network.ProtocolConsensus, network.DecodeMessage)
+	if err != nil {
+		return nil, err
+	}
+	cs.msgCh = msgCh
+
+	return cs, nil
 }
 
 // consensus server start
 func (cs *ConsensusClient) Start() error {
+	cs.mu.Lock()
+	if cs.stopped {
+		cs.mu.Unlock()
+		return network.ErrServerStopped
+	}
+	cs.wg.Add(1)
+	cs.mu.Unlock()
+	defer cs.wg.Done()
 
 	cs.ExecutionClient.Logger.Log("msg", "consensus client started! Execution and Consensus share the same transporter")
 
 free:
 	for {
 		select {
-		case rpc := <-cs.ExecutionClient.RpcCh:
-
-			msg, err := network.DefaultRPCDecodeFunc(rpc)
-			if err != nil {
-				cs.ExecutionClient.Logger.Log("err", err)
-				continue
-			}
-
-			switch msg.Data.(type) {
-			// msg of type ValidatorNotification is to be handled inside the consensus layer
-			case network.ValidatorNotification:
-				if err := cs.RPCProcessor.ProcessMessage(msg); err != nil {
-					if err != core.ErrBlockKnown {
-						cs.ExecutionClient.Logger.Log("err", err)
-					}
+		case msg := <-cs.msgCh:
+			if err := cs.RPCProcessor.ProcessMessage(msg); err != nil {
+				if err != core.ErrBlockKnown {
+					cs.ExecutionClient.Logger.Log("err", err)
 				}
-			default:
-				continue
 			}
 		case <-cs.quitCh:
 			break free
@@ -94,22 +102,63 @@ free:
 	return nil
 }
 
+// Stop ends the Start loop and returns once it exited or ctx is done
+// the execution client is left running; it is stopped on its own
+func (cs *ConsensusClient) Stop(ctx context.Context) error {
+	cs.mu.Lock()
+	if cs.stopped {
+		cs.mu.Unlock()
+		return nil
+	}
+	cs.stopped = true
+	close(cs.quitCh)
+	cs.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		cs.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 func (cs *ConsensusClient) ProcessMessage(msg *network.DecodedMsg) error {
 
 	switch t := msg.Data.(type) {
-	case *network.ValidatorNotification:
+	case *network.ValidatorAnnouncement:
 		//where t is essentially the msg.Data
-		return cs.processNewValidator(t)
+		return cs.processValidatorAnnouncement(msg.From, t)
 	}
 
 	return nil
 }
 
-func (cs *ConsensusClient) processNewValidator(msg *network.ValidatorNotification) error {
+func (cs *ConsensusClient) processValidatorAnnouncement(from network.NetAddr, msg *network.ValidatorAnnouncement) error {
+	if err := msg.Verify(); err != nil {
+		return fmt.Errorf("announcement from %s: %w", from, err)
+	}
+
+	v := &Validator{
+		PublicKey:   msg.PublicKey,
+		ListenAddr:  msg.ListenAddr,
+		Stake:       msg.Stake,
+		AnnouncedAt: time.Unix(0, msg.Timestamp),
+		From:        from,
+	}
+
 	cs.mu.Lock()
+	defer cs.mu.Unlock()
 	//this is to keep track of the validators in the network
-	cs.validators = append(cs.validators, msg.Server)
-	cs.mu.Unlock()
+	// an announcement older than the one we have is a replay; it must not undo a later one
+	if known, ok := cs.validators[v.Address()]; ok && !v.AnnouncedAt.After(known.AnnouncedAt) {
+		return nil
+	}
+	cs.validators[v.Address()] = v
 
 	return nil
 }
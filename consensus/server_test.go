@@ -0,0 +1,90 @@
+package consensus
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/EggsyOnCode/xenolith/crypto_lib"
+	"github.com/EggsyOnCode/xenolith/network"
+	"github.com/go-kit/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestClient(t *testing.T, id string, key *crypto_lib.PrivateKey) *ConsensusClient {
+	s, err := network.NewServer(network.ServerOpts{
+		ID:         id,
+		Transport:  network.NewLocalTransport(network.NetAddr(id)),
+		Logger:     log.NewNopLogger(),
+		PrivateKey: key,
+		BlockTime:  time.Hour,
+		Stake:      5,
+	})
+	assert.Nil(t, err)
+	cs, err := NewConsensusClient(ConsensusClientOpts{ExecutionClient: s, Logger: log.NewNopLogger()})
+	assert.Nil(t, err)
+	return cs
+}
+
+func TestValidatorAnnouncedOnConnect(t *testing.T) {
+	key := crypto_lib.GeneratePrivateKey()
+	a := newTestClient(t, "A", key)
+	b := newTestClient(t, "B", nil)
+	for _, cs := range []*ConsensusClient{a, b} {
+		go cs.ExecutionClient.Start()
+		go cs.Start()
+	}
+	assert.Nil(t, b.ExecutionClient.Transport.Connect(a.ExecutionClient.Transport))
+
+	assert.Eventually(t, func() bool {
+		return b.Validator(key.PublicKey().Address()) != nil
+	}, 5*time.Second, 10*time.Millisecond)
+	v := b.Validator(key.PublicKey().Address())
+	assert.Equal(t, "A", v.ListenAddr)
+	assert.Equal(t, uint64(5), v.Stake)
+	// b isn't a validator
+	assert.Len(t, a.Validators(), 0)
+}
+
+func TestValidatorAnnouncementChecked(t *testing.T) {
+	cs := newTestClient(t, "A", nil)
+	key := crypto_lib.GeneratePrivateKey()
+
+	first, err := network.NewValidatorAnnouncement(key, "B", 1)
+	assert.Nil(t, err)
+	assert.Nil(t, cs.processValidatorAnnouncement("B", first))
+
+	forged := *first
+	forged.Stake = 100
+	assert.ErrorIs(t, cs.processValidatorAnnouncement("B", &forged), network.ErrInvalidAnnouncement)
+	assert.Equal(t, uint64(1), cs.Validator(key.PublicKey().Address()).Stake)
+
+	second, err := network.NewValidatorAnnouncement(key, "B", 2)
+	assert.Nil(t, err)
+	assert.Nil(t, cs.processValidatorAnnouncement("B", second))
+	// the first one replayed doesn't undo the second
+	assert.Nil(t, cs.processValidatorAnnouncement("C", first))
+	assert.Equal(t, uint64(2), cs.Validator(key.PublicKey().Address()).Stake)
+	assert.Len(t, cs.Validators(), 1)
+}
+
+func TestStopEndsStartLoop(t *testing.T) {
+	cs := newTestClient(t, "A", nil)
+	done := make(chan error, 1)
+	go func() { done <- cs.Start() }()
+	assert.Never(t, func() bool {
+		return len(done) > 0
+	}, 50*time.Millisecond, 10*time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.Nil(t, cs.Stop(ctx))
+	select {
+	case err := <-done:
+		assert.Nil(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("start loop still running")
+	}
+	assert.ErrorIs(t, cs.Start(), network.ErrServerStopped)
+	assert.Nil(t, cs.Stop(ctx))
+}
@@ -0,0 +1,46 @@
+package consensus
+
+import (
+	"sort"
+	"time"
+
+	"github.com/EggsyOnCode/xenolith/core_types"
+	"github.com/EggsyOnCode/xenolith/crypto_lib"
+	"github.com/EggsyOnCode/xenolith/network"
+)
+
+// Validator is what the consensus client knows of a validator from its last announcement
+type Validator struct {
+	PublicKey  crypto_lib.PublicKey
+	ListenAddr string
+	Stake      uint64
+	// when the validator signed the announcement
+	AnnouncedAt time.Time
+	// peer the announcement came from
+	From network.NetAddr
+}
+
+func (v *Validator) Address() core_types.Address {
+	return v.PublicKey.Address()
+}
+
+// Validators lists the known validators sorted by address
+func (cs *ConsensusClient) Validators() []*Validator {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	validators := make([]*Validator, 0, len(cs.validators))
+	for _, v := range cs.validators {
+		validators = append(validators, v)
+	}
+	sort.Slice(validators, func(i, j int) bool {
+		return validators[i].Address().String() < validators[j].Address().String()
+	})
+	return validators
+}
+
+// Validator returns the validator with the given address, nil if none announced itself under it
+func (cs *ConsensusClient) Validator(addr core_types.Address) *Validator {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	return cs.validators[addr]
+}
@@ -35,6 +35,21 @@ func NewAccountState() *AccountState {
 	}
 }
 
+// Copy returns a deep copy of the account state
+func (a *AccountState) Copy() *AccountState {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	c := NewAccountState()
+	for addr, account := range a.accounts {
+		c.accounts[addr] = &Account{
+			Address: account.Address,
+			Balance: account.Balance,
+		}
+	}
+	return c
+}
+
 func (a *AccountState) CreateAccount(addr core_types.Address) *Account {
 	a.mu.Lock()
 	defer a.mu.Unlock()
@@ -2,8 +2,6 @@ package core
 
 import (
 	"bytes"
-	"crypto/sha256"
-	"encoding/gob"
 	"fmt"
 	"math/big"
 	"time"
@@ -17,11 +15,12 @@ import (
 type Header struct {
 	//version specifies the version of the header config; if the version changes, it has to updated here
 	Version uint32
-	//hash of all hte tx data
-	//i.e should be merkle root hash of all the tx in the block
+	//merkle root of the TxHasher hashes of all the tx in the block (see merkle.go)
 	DataHash      core_types.Hash
 	PrevBlockHash core_types.Hash
-	Height        uint32
+	// root of the state tree after executing the tx of the block on top of its parent
+	StateRoot core_types.Hash
+	Height    uint32
 	//rep the unix timestamp
 	Timestamp uint64
 	// nonce is a random number generated by the validator/miner to solve the PoW
@@ -30,15 +29,26 @@ type Header struct {
 	NBits  uint32
 }
 
-func (h *Header) Bytes() []byte {
+// canonical encoding of the header; it is what the header hash is calculated over
+func (h *Header) Bytes() ([]byte, error) {
 	buf := &bytes.Buffer{}
 	//buf is the io.Writer in which the encoded data will be written to
-	enc := gob.NewEncoder(buf)
-	if err := enc.Encode(h); err != nil {
-		panic(err)
+	if err := NewCanonicalHeaderEncoder(buf).Encode(h); err != nil {
+		return nil, err
 	}
 
-	return buf.Bytes()
+	return buf.Bytes(), nil
+}
+
+// CheckFormat rejects a header that can't be hashed or can't carry a pow
+// headers from peers are checked with it before anything else is done with them
+func (h *Header) CheckFormat() error {
+	// the genesis block carries no target; any other target has to be positive for the pow to mean anything
+	if h.Target != nil && h.Target.Sign() <= 0 {
+		return fmt.Errorf("header (%d) has a non positive target", h.Height)
+	}
+	_, err := h.Bytes()
+	return err
 }
 
 type Block struct {
@@ -100,8 +110,24 @@ func (b *Block) Decode(dec Decoder[*Block]) error {
 	return dec.Decode(b)
 }
 
+// CheckFormat checks the header and the tx of a block from a peer the way Header.CheckFormat does
+func (b *Block) CheckFormat() error {
+	if b.Header == nil {
+		return fmt.Errorf("block has no header")
+	}
+	if err := b.Header.CheckFormat(); err != nil {
+		return err
+	}
+	return CheckTxFormat(b.Transactions)
+}
+
+// the validator signs the hash of the header, so the signature covers every field of it
 func (b *Block) Sign(priv *crypto_lib.PrivateKey) error {
-	sig, err := priv.Sign(b.Header.Bytes())
+	hash, err := HashHeader(b.Header)
+	if err != nil {
+		return err
+	}
+	sig, err := priv.Sign(hash.ToSlice())
 	if err != nil {
 		return err
 	}
@@ -117,7 +143,11 @@ func (b *Block) Verify() error {
 		return fmt.Errorf("Block not signed")
 	}
 	fmt.Printf("validator is before chaning %+v\n", b.Validator)
-	if !b.Signature.Verify(b.Header.Bytes(), b.Validator) {
+	hash, err := HashHeader(b.Header)
+	if err != nil {
+		return err
+	}
+	if !b.Signature.Verify(hash.ToSlice(), b.Validator) {
 		return fmt.Errorf("invalid signature")
 	}
 
@@ -151,20 +181,6 @@ func (b *Block) AddTx(tx *Transaction) error {
 	return nil
 }
 
-func CalculateDataHash(tx []*Transaction) (hash core_types.Hash, err error) {
-	//hashing all the tx data
-	buf := &bytes.Buffer{}
-	for _, tx := range tx {
-		if err = tx.Encode(NewGobTxEncoder(buf)); err != nil {
-			return
-		}
-	}
-
-	hash = sha256.Sum256(buf.Bytes())
-
-	return
-}
-
 // func (b *Block) HeaderData() []byte {
 // 	buf := &bytes.Buffer{}
 // 	//buf is the io.Writer in which the encoded data will be written to
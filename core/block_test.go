@@ -3,6 +3,7 @@ package core
 import (
 	"bytes"
 	"fmt"
+	"math/big"
 	"testing"
 	"time"
 
@@ -11,12 +12,17 @@ import (
 	"github.com/stretchr/testify/assert"
 )
 
+// every hash is below it; the test blocks pass the pow without being mined
+var testTarget = new(big.Int).Lsh(big.NewInt(1), 256)
+
 func randomBlock(t *testing.T, height uint32, prevHash core_types.Hash) *Block {
 	header := &Header{
 		Version:       1,
 		Height:        height,
 		PrevBlockHash: prevHash,
 		Timestamp:     uint64(time.Now().UnixNano()),
+		Target:        testTarget,
+		NBits:         targetToCompact(testTarget),
 	}
 	tx := randomTxWithSignature(t)
 	block := &Block{
@@ -36,7 +42,8 @@ func randomBlockWithSignatureAndPrevBlock(t *testing.T, height uint32, prevHash
 		Height:        height,
 		PrevBlockHash: prevHash,
 		Timestamp:     uint64(time.Now().UnixNano()),
-		NBits:         0x1d00ffff,
+		Target:        testTarget,
+		NBits:         targetToCompact(testTarget),
 	}
 
 	//generating a private key
@@ -64,10 +71,10 @@ func randomBlockWithSignature(t *testing.T, height uint32, prevHash core_types.H
 		Height:        height,
 		PrevBlockHash: prevHash,
 		Timestamp:     uint64(time.Now().UnixNano()),
-		NBits:         0x1d00ffff,
+		Target:        testTarget,
+		NBits:         targetToCompact(testTarget),
 	}
 
-	header.Target = compactToTarget(header.NBits)
 	//generating a private key
 	priv := crypto_lib.GeneratePrivateKey()
 	block := &Block{
@@ -93,10 +100,10 @@ func genesisBlockWithSig(t *testing.T, height uint32, prevHash core_types.Hash)
 		Height:        height,
 		PrevBlockHash: prevHash,
 		Timestamp:     uint64(time.Now().UnixNano()),
-		NBits:         0x1d00ffff,
+		Target:        testTarget,
+		NBits:         targetToCompact(testTarget),
 	}
 
-	header.Target = compactToTarget(header.NBits)
 	// header.Target = new(big.Int)
 	// _, ok := header.Target.SetString("0x00000000FFFF0000000000000000000000000000000000000000000000000000", 16)
 	// if !ok {
@@ -151,6 +158,74 @@ func TestCodecBlock(t *testing.T) {
 
 }
 
+func TestCanonicalCodecHeader(t *testing.T) {
+	block := randomBlockWithSignature(t, 1, core_types.GenerateRandomHash(32))
+	buf := &bytes.Buffer{}
+	assert.Nil(t, NewCanonicalHeaderEncoder(buf).Encode(block.Header))
+	encoded, err := block.Header.Bytes()
+	assert.Nil(t, err)
+	assert.Equal(t, encoded, buf.Bytes())
+
+	headerDecoded := new(Header)
+	assert.Nil(t, NewCanonicalHeaderDecoder(buf).Decode(headerDecoded))
+	assert.Equal(t, block.Header, headerDecoded)
+
+	// truncated input
+	assert.NotNil(t, NewCanonicalHeaderDecoder(bytes.NewReader(encoded[:40])).Decode(new(Header)))
+}
+
+// the hash of a fixed header must never change; other implementations rely on the layout
+func TestHeaderHashIsStable(t *testing.T) {
+	header := &Header{
+		Version:       1,
+		DataHash:      core_types.Hash{0x01},
+		PrevBlockHash: core_types.Hash{0x02},
+		StateRoot:     core_types.Hash{0x03},
+		Height:        7,
+		Timestamp:     1700000000,
+		Nonce:         42,
+		Target:        big.NewInt(0xffff),
+		NBits:         0x1d00ffff,
+	}
+
+	encoded, err := header.Bytes()
+	assert.Nil(t, err)
+	assert.Equal(t, 4+32*3+4+8+4+4+2+4, len(encoded))
+	assert.Equal(t, "e5d0c39ddf9708939b1ba4ba71077c16c3df8cae2bbef7ddb1c14d1b3da96197", BlockHasher{}.Hash(header).String())
+}
+
+// headers and tx a peer can make up but that have no canonical encoding are errors, not panics
+func TestCheckFormat(t *testing.T) {
+	block := randomBlockWithSignature(t, 1, core_types.GenerateRandomHash(32))
+	assert.Nil(t, block.CheckFormat())
+
+	block.Header.Target = big.NewInt(-5)
+	assert.NotNil(t, block.Header.CheckFormat())
+	_, err := HashHeader(block.Header)
+	assert.NotNil(t, err)
+	assert.NotNil(t, block.Verify())
+	assert.Equal(t, core_types.Hash{}, BlockHasher{}.Hash(block.Header))
+
+	block.Header.Target = new(big.Int)
+	assert.NotNil(t, block.CheckFormat())
+
+	tx := randomTxWithSignature(t)
+	tx.TxInner = struct{ Junk int }{1}
+	assert.NotNil(t, tx.CheckFormat())
+	ok, err := tx.Verify()
+	assert.False(t, ok)
+	assert.NotNil(t, err)
+	assert.NotNil(t, CheckTxFormat([]*Transaction{tx}))
+}
+
+func TestVerifyFailOnHeaderChange(t *testing.T) {
+	block := randomBlockWithSignature(t, 1, core_types.GenerateRandomHash(32))
+	assert.Nil(t, block.Verify())
+
+	block.Header.Height = 2
+	assert.NotNil(t, block.Verify())
+}
+
 func TestVerifyFail(t *testing.T) {
 	block := randomBlockWithSignature(t, 1, core_types.GenerateRandomHash(32))
 	err := block.Verify()
@@ -2,9 +2,11 @@ package core
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"math/big"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/EggsyOnCode/xenolith/core_types"
@@ -34,6 +36,8 @@ type Blockchain struct {
 
 	lock    sync.Mutex
 	headers []*Header
+	// serializes the insertion of blocks; a block is validated and added (a reorg included) in one go
+	insertLock sync.Mutex
 	// blocks  []*Block
 
 	ChainTip  *Block
@@ -59,14 +63,23 @@ type Blockchain struct {
 	//TODO implement an interface for the State
 	contractState *State
 	Target        *big.Int
-	// a channel shared between blockchain and server for sharing orphaned Tx into server's mempool
-	txCh chan *Transaction
+	// hands the tx of the blocks a reorg took off the chain back to the mempool of the server
+	// it is called by AddBlock once the block is in and insertLock is released; the server loop adding blocks is the one taking tx as well
+	orphanedTxHandler func([]*Transaction)
+	// tx orphaned by the block being added; guarded by insertLock
+	orphaned []*Transaction
 }
 
 // Constructor for Blckchain
 func NewBlockchain(genesis *Block, logger log.Logger) (*Blockchain, error) {
+	return NewBlockchainWithStore(genesis, NewMemoryStore(), logger)
+}
+
+// NewBlockchainWithStore reopens the chain kept in store; if the store is empty
+// a fresh chain is started from genesis
+func NewBlockchainWithStore(genesis *Block, store Storage, logger log.Logger) (*Blockchain, error) {
 	//the responsibility of creating and managing the account state falls on the blockchain
-	//read the accountState from Disk (TODO)
+	// when the chain is reopened from the store the state is rebuilt by replaying its blocks
 	accountState := NewAccountState()
 
 	//the default value of Public Key
@@ -77,7 +90,7 @@ func NewBlockchain(genesis *Block, logger log.Logger) (*Blockchain, error) {
 	bc := &Blockchain{
 		contractState: NewState(),
 		headers:       []*Header{},
-		store:         NewMemoryStore(),
+		store:         store,
 		logger:        logger,
 		Version:       1,
 		// blocks:           make([]*Block, 1),
@@ -95,11 +108,18 @@ func NewBlockchain(genesis *Block, logger log.Logger) (*Blockchain, error) {
 		stateLock:        sync.RWMutex{},
 	}
 
-	bc.Target = new(big.Int)
-	bc.Target.SetString(TARGET_GENESIS, 0)
+	bc.Target = genesisTarget()
+	if genesis.Header.Target != nil {
+		bc.Target = genesis.Header.Target
+	}
 
 	bc.Validator = NewBlockValidator(bc)
 
+	// a store that already holds a chain is reopened instead of being written over
+	if _, err := store.GetByHeight(0); err == nil {
+		return bc, bc.loadFromStore(genesis)
+	}
+
 	err := bc.addBlockWithoutValidation(genesis)
 	//--> what the implementation should be!
 	// err := bc.AddBlock(genesis)
@@ -110,18 +130,78 @@ func NewBlockchain(genesis *Block, logger log.Logger) (*Blockchain, error) {
 	return bc, nil
 }
 
+// rebuilds the in memory chain (headers, block stores, linked list and chain tip) from the store
+func (bc *Blockchain) loadFromStore(genesis *Block) error {
+	var prev *Block
+	err := bc.store.Iterate(func(b *Block) error {
+		if prev == nil {
+			if b.Hash(BlockHasher{}) != genesis.Hash(BlockHasher{}) {
+				return fmt.Errorf("stored genesis block (%s) does not match (%s)", b.Hash(BlockHasher{}), genesis.Hash(BlockHasher{}))
+			}
+		} else {
+			// a reorg truncates the chain it abandons, so every stored height links to the one below
+			if b.Header.PrevBlockHash != prev.Hash(BlockHasher{}) {
+				return fmt.Errorf("%w: block (%d) does not link to block (%d)", ErrStoreCorrupt, b.Header.Height, prev.Header.Height)
+			}
+			b.PrevBlock = prev
+			prev.NextBlocks = append(prev.NextBlocks, b)
+		}
+
+		bc.lock.Lock()
+		bc.headers = append(bc.headers, b.Header)
+		bc.blockStore[b.Hash(BlockHasher{})] = b
+		bc.blockStoreHeight[b.Header.Height+1] = b
+		bc.lock.Unlock()
+
+		prev = b
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	bc.block = prev
+	bc.ChainTip = prev
+	if prev.Header.Target != nil {
+		bc.Target = prev.Header.Target
+	}
+
+	if err := bc.replayState(); err != nil {
+		return err
+	}
+
+	bc.logger.Log("msg", "loaded chain from store", "height", prev.Header.Height, "tip", prev.Hash(BlockHasher{}), "stateRoot", bc.StateRoot())
+
+	return nil
+}
+
 // A dynamic setter for Validator
 func (bc *Blockchain) SetValidator(v Validator) {
 	bc.Validator = v
 }
 
-// A dynamic setter for txChan
-func (bc *Blockchain) SetTxChan(t chan *Transaction) {
-	bc.txCh = t
+// A dynamic setter for the handler of orphaned tx
+func (bc *Blockchain) SetOrphanedTxHandler(f func([]*Transaction)) {
+	bc.orphanedTxHandler = f
 }
 
 // adding a new block to the chain
+// blocks come in from the server, the sync manager and the validator at the same time; they are added one at a time
+// the tx of the blocks a reorg removes are handed to the orphaned tx handler after the block is in
 func (bc *Blockchain) AddBlock(b *Block) error {
+	bc.insertLock.Lock()
+	err := bc.insertBlock(b)
+	orphaned := bc.orphaned
+	bc.orphaned = nil
+	bc.insertLock.Unlock()
+
+	if len(orphaned) > 0 && bc.orphanedTxHandler != nil {
+		bc.orphanedTxHandler(orphaned)
+	}
+	return err
+}
+
+func (bc *Blockchain) insertBlock(b *Block) error {
 	//validate block
 
 	err := bc.Validator.ValidateBlock(b)
@@ -130,7 +210,6 @@ func (bc *Blockchain) AddBlock(b *Block) error {
 	}
 
 	return bc.addBlockWithoutValidation(b)
-
 }
 
 // Return height of the Blockchain
@@ -152,6 +231,34 @@ func (bc *Blockchain) GetBlockByHash(hash core_types.Hash) (*Block, error) {
 	return block, nil
 }
 
+// branchBlock finds the block with hash on the chain or on one of the forks
+func (bc *Blockchain) branchBlock(hash core_types.Hash) (*Block, error) {
+	if b, err := bc.GetBlockByHash(hash); err == nil {
+		return b, nil
+	}
+	return bc.ForkSlice.FindBlock(hash)
+}
+
+// targetAfter is the target of the block on top of parent; parent can be on a fork as well
+// the target of a retarget height depends on the headers below it on the branch of parent
+func (bc *Blockchain) targetAfter(parent *Block) (*big.Int, error) {
+	return expectedTarget(parent.Header, func(height uint32) (*Header, error) {
+		b := parent
+		for b.Header.Height > height {
+			// once on the chain the header is looked up by its height
+			if _, err := bc.GetBlockByHash(b.Hash(BlockHasher{})); err == nil {
+				return bc.GetHeaders(height)
+			}
+			prev, err := bc.branchBlock(b.Header.PrevBlockHash)
+			if err != nil {
+				return nil, err
+			}
+			b = prev
+		}
+		return b.Header, nil
+	})
+}
+
 func (bc *Blockchain) GetBlock(height uint32) (*Block, error) {
 	if height > bc.Height() {
 		return nil, fmt.Errorf("Block with height %v is too high", height)
@@ -254,17 +361,19 @@ func (bc *Blockchain) revertTx(tx *Transaction) error {
 }
 
 // / @dev : this internal func gets executed during a chain reorg; this happens when fork confirmations reach >= 3
-func (bc *Blockchain) handleChainReorg(fork *Fork) error {
+// b is the block confirming the fork; it is added on top of the fork once the chain has switched over
+func (bc *Blockchain) handleChainReorg(fork *Fork, b *Block) error {
+	forkPair := bc.ForkSlice.GetForkPair(fork)
+	// our own chain gaining confirmations; there is nothing to reorganise
 	if fork.IsLongestChain {
-		// remove the forkPair from the fork slice ;
-		bc.ForkSlice.RemoveForkPair(bc.ForkSlice[bc.ForkSlice.FindForkPairId(fork)])
+		bc.ForkSlice.RemoveForkPair(forkPair)
+		return nil
 	}
 	// the winning chian is one in the processing queue
 	// put the blocks which are to be removed in an array
-	// iterate thru each block and revert its tx and remove it from blockstore and headers
+	// iterate thru each block and remove it from blockstore and headers
 	// remove the forkPair
 
-	forkPair := bc.ForkSlice[bc.ForkSlice.FindForkPairId(fork)]
 	var toBeRemovedFork *Fork
 	var toBeRemovedBlocks []*Block
 	if forkPair.Forks[0] == fork {
@@ -274,81 +383,98 @@ func (bc *Blockchain) handleChainReorg(fork *Fork) error {
 	}
 	//bock from which the fork started not the one that caused the fork
 	forkingBlock, _ := bc.GetBlockByHash(toBeRemovedFork.ForkingBlock)
-	// forkingBlock.NextBlocks[0] will be the longestChain so [1] will be the forked block
-	startingBlock := forkingBlock.NextBlocks[0]
-
-	forkChainTipBlock := bc.block
-
-	// toBeRemoved Block exists on Chain so normalGetters used
-	toBeRemovedBlocks = append(toBeRemovedBlocks, startingBlock)
 
-	for {
-		// Ensure startingBlock has NextBlocks before accessing
-		if len(startingBlock.NextBlocks) == 0 {
-			fmt.Printf("No next blocks found for block %v\n", startingBlock.Hash(BlockHasher{}))
-			break
+	// the blocks of the fork were never executed; every one of them is checked against the state root it commits to
+	// before anything is switched over, so a fork that doesn't check out is dropped and leaves the chain as it was
+	state, err := bc.replayedState(forkingBlock.Header.Height)
+	if err != nil {
+		return err
+	}
+	for _, block := range fork.blocks {
+		state.applyBlock(block)
+		if root := state.StateRoot(); root != block.Header.StateRoot {
+			bc.ForkSlice.RemoveForkPair(forkPair)
+			return fmt.Errorf("%w: fork block (%s) commits to state root (%s) but re-executing it gives (%s)", ErrInvalidBlock, block.Hash(BlockHasher{}), block.Header.StateRoot, root)
 		}
+	}
+	if root := state.StateRootAfter(b); root != b.Header.StateRoot {
+		bc.ForkSlice.RemoveForkPair(forkPair)
+		return fmt.Errorf("%w: block (%s) commits to state root (%s) but re-executing it gives (%s)", ErrInvalidBlock, b.Hash(BlockHasher{}), b.Header.StateRoot, root)
+	}
 
-		nextBlock := startingBlock.NextBlocks[0]
-		toBeRemovedBlocks = append(toBeRemovedBlocks, nextBlock)
-
-		// Update startingBlock
-		startingBlock = nextBlock
+	// the blocks of our chain above the forking block make way for the ones of the fork
+	// forkingBlock.NextBlocks[0] will be the longestChain so [1] will be the forked block
+	for block := forkingBlock; block != bc.block && len(block.NextBlocks) > 0; {
+		block = block.NextBlocks[0]
+		toBeRemovedBlocks = append(toBeRemovedBlocks, block)
+	}
 
-		// Check if we reached the chain tip block
-		if startingBlock == forkChainTipBlock {
-			break
-		}
+	// the new chain is put together first and swapped in under the locks in one go
+	// readers see the chain either as it was or with the fork in its place, never anything in between
+	bc.lock.Lock()
+	headers := make([]*Header, 0, int(forkingBlock.Header.Height)+1+len(fork.blocks)+1)
+	headers = append(headers, bc.headers[:forkingBlock.Header.Height+1]...)
+	bc.lock.Unlock()
+	for _, block := range fork.blocks {
+		headers = append(headers, block.Header)
 	}
 
-	// forkingBlock, _ := bc.GetBlockByHash(forkingBlockHash)
-	// forkingBlock.NextBlocks[0] = toBeRemovedBlocks[0]
-	// process each block; revert tx; remove from blockstore and headers
+	bc.lock.Lock()
+	bc.stateLock.Lock()
+	bc.headers = headers
 	for _, block := range toBeRemovedBlocks {
-		for _, tx := range block.Transactions {
-			orgTx := tx
-			go bc.revertTx(tx)
-			delete(bc.txStore, tx.hash)
-			// sending this orphaned tx to server's mempool
-			bc.txCh <- orgTx
-		}
-
-		// removing the block from the Headers, blockStore, blockSToreHeihgt
-
-		//removing the block from the headers
-		for i, header := range bc.headers {
-			if header == block.Header {
-				bc.headers = append(bc.headers[:i], bc.headers[i+1:]...)
-				break
-			}
-		}
-		// removing the block from the blockStore
 		delete(bc.blockStore, block.Hash(BlockHasher{}))
-
-		//removing the block from the blockStoreHeight
 		delete(bc.blockStoreHeight, block.Header.Height+1)
-
 	}
+	for _, block := range fork.blocks {
+		bc.blockStore[block.Hash(BlockHasher{})] = block
+		bc.blockStoreHeight[block.Header.Height+1] = block
+	}
+	// their tx are not reverted one by one; the state replayed up to the fork replaces ours
+	bc.accountState = state.accountState
+	bc.contractState = state.contractState
+	bc.txStore = state.txStore
+	bc.collectionStore = state.collectionStore
+	bc.mintStore = state.mintStore
+	bc.stateLock.Unlock()
+	bc.lock.Unlock()
 
 	// attaching the winning fork to the forkingBlock ; the block from which the fork started
-	//re init the nextBlocks of the forkingBlock
-	forkingBlock.NextBlocks = []*Block{}
-	//putting the pointer rolled back to the forkingBlock from where the chain history diverged
-	bc.block = forkingBlock
+	// only the insertion of blocks follows the links and it is held up by insertLock until we are done
+	prev := forkingBlock
 	for _, block := range fork.blocks {
-		block.NextBlocks = []*Block{}
-		bc.addBlockWithoutValidation(block)
+		prev.NextBlocks = []*Block{block}
+		prev = block
 	}
-
+	prev.NextBlocks = []*Block{}
+	bc.block = prev
+	bc.ChainTip = prev
 	bc.ForkSlice.RemoveForkPair(forkPair)
 
-	return nil
+	// the tx of the removed blocks go back to the mempool once AddBlock is done; the ones the fork includes as well are in the chain still
+	for _, block := range toBeRemovedBlocks {
+		for _, tx := range block.Transactions {
+			if _, ok := state.txStore[tx.Hash(TxHasher{})]; !ok {
+				bc.orphaned = append(bc.orphaned, tx)
+			}
+		}
+	}
+
+	bc.logger.Log("msg", "reorganised to fork", "forkingBlock", forkingBlock.Hash(BlockHasher{}), "removed", len(toBeRemovedBlocks), "added", len(fork.blocks), "height", prev.Header.Height)
+
+	// the fork can be shorter than the chain it replaces; the heights above it aren't part of the chain anymore
+	for _, block := range fork.blocks {
+		if err := bc.store.Put(block); err != nil {
+			return err
+		}
+	}
+	return bc.store.Truncate(prev.Header.Height)
 }
 
 // checks to see if the new incoming block is causing any forks in the chain
 // or is attaching itself to a particular forked block etc
 // / @dev returns true if the block is causing a fork or attaching itself to a fork
-func (bc *Blockchain) handleAndTrackForks(b *Block) ReturnTypeForkHandler {
+func (bc *Blockchain) handleAndTrackForks(b *Block) (ReturnTypeForkHandler, error) {
 	// 1st check: if the block is causing a fork --> insertion in forkSlice
 	// false indicates that the block is not causing a fork or becoming part of a fork
 	var prevBlock *Block
@@ -357,7 +483,11 @@ func (bc *Blockchain) handleAndTrackForks(b *Block) ReturnTypeForkHandler {
 	} else {
 		prevBlock, _ = bc.GetBlockByHash(b.Header.PrevBlockHash)
 	}
-	if len(prevBlock.NextBlocks) >= 1 {
+	// blocks from the network aren't linked; their parent could also be on a fork we haven't reorganised to
+	if prevBlock == nil {
+		prevBlock, _ = bc.ForkSlice.GetBlockByHash(b.Header.PrevBlockHash)
+	}
+	if prevBlock != nil && len(prevBlock.NextBlocks) >= 1 {
 		forkingFork := &Fork{
 			ChainTip:       b.Hash(BlockHasher{}),
 			ForkingBlock:   prevBlock.Hash(BlockHasher{}),
@@ -381,11 +511,11 @@ func (bc *Blockchain) handleAndTrackForks(b *Block) ReturnTypeForkHandler {
 		// hence needs to be added to the processingQueue of hte fork
 		bc.ForkSlice[bc.forkCount].AddBlockToProcessingQ(b)
 		bc.ForkSlice[bc.forkCount].AddBlock(forkingFork, b)
-		bc.ForkSlice[bc.forkCount].AddBlock(competitorFork, b.PrevBlock.NextBlocks[0])
+		bc.ForkSlice[bc.forkCount].AddBlock(competitorFork, prevBlock.NextBlocks[0])
 
 		bc.forkLock.Unlock()
 
-		return FORK_NOT_IN_LONGEST_CHAIN
+		return FORK_NOT_IN_LONGEST_CHAIN, nil
 	}
 	// 2nd check: if the block is attaching itself to a forked block (a block in a fork chain temp or otherwise)--> update the forkSlice
 
@@ -393,20 +523,22 @@ func (bc *Blockchain) handleAndTrackForks(b *Block) ReturnTypeForkHandler {
 	// returns errr if its not a doing that
 	_, err := bc.ForkSlice.FindBlock(b.Header.PrevBlockHash)
 	if err != nil {
-		return NOT_FORKING
+		return NOT_FORKING, nil
 	}
 
 	fork, err := bc.ForkSlice.FindBlockFork(b.Header.PrevBlockHash)
 	if err != nil {
-		return NOT_FORKING
+		return NOT_FORKING, nil
 	}
 
 	fork.Confirmations++
 
 	// CHAIN REORG
 	if fork.Confirmations >= 3 {
-		bc.handleChainReorg(fork)
-		return FORK_IN_LONGEST_CHAIN
+		if err := bc.handleChainReorg(fork, b); err != nil {
+			return 0, err
+		}
+		return FORK_IN_LONGEST_CHAIN, nil
 	}
 
 	/// updating the chaintip of the fork
@@ -419,61 +551,50 @@ func (bc *Blockchain) handleAndTrackForks(b *Block) ReturnTypeForkHandler {
 	//check if the incoming block is attaching itself to fork with the longest chain or not
 	// if YES; that means it will be added to the blockStore and hence the chain ; otehrwise; it will be added to the processing queue
 	if fork.IsLongestChain {
-		return FORK_IN_LONGEST_CHAIN
+		return FORK_IN_LONGEST_CHAIN, nil
 	}
 
 	forkId := bc.ForkSlice.FindForkPairId(fork)
 	bc.ForkSlice[forkId].AddBlockToProcessingQ(b)
 	bc.ForkSlice[forkId].AddBlock(fork, b)
 
-	return FORK_NOT_IN_LONGEST_CHAIN
+	return FORK_NOT_IN_LONGEST_CHAIN, nil
 }
 
 func (bc *Blockchain) addBlockWithoutValidation(b *Block) error {
-	// bc.block itself is the head ptr
-	// adding the new block to the next block of the current block
-
-	var forkHandlerRes ReturnTypeForkHandler
 	//handle forks if present
 	// won;t be present for the genesis block
 	if b.Header.Height != 0 {
-		forkHandlerRes = bc.handleAndTrackForks(b)
+		forkHandlerRes, err := bc.handleAndTrackForks(b)
+		if err != nil {
+			return err
+		}
 
 		// if the block is not a fork then we can add the block normally to the ll
 		// if the block attaching itself to non-dominant fork then we can add the block to the processing queue
 		// and hence do nothing here
 		// if the block is attaching itself to the longestChainFork then we can add the block to the chain
-		switch forkHandlerRes {
-		case FORK_NOT_IN_LONGEST_CHAIN:
-			// do nothing
+		if forkHandlerRes == FORK_NOT_IN_LONGEST_CHAIN {
 			return nil
-		default:
-			//bc.block rep the ll of blocks
-			bc.block.NextBlocks = append(bc.block.NextBlocks, b)
-			bc.block = b
 		}
 	}
 
 	// state changes will  only be of those blocks which are part of the longest chain
-	bc.stateLock.Lock()
+	bc.applyBlock(b)
 
-	//run the block data i.e the code on the VM
-	for _, tx := range b.Transactions {
-		if err := bc.handleTx(tx); err != nil {
-			fmt.Printf("error while handling tx %v\n", err)
-			continue
-		}
-		bc.txStore[tx.Hash(&TxHasher{})] = tx
-	}
-
-	bc.stateLock.Unlock()
+	return bc.appendBlock(b)
+}
 
-	fmt.Println("==========>>>ACCOUNT STATE<<<<<===========")
-	fmt.Printf("Account state : %+v\n", bc.accountState.accounts)
-	fmt.Println("==========>>>ACCOUNT STATE<<<<<===========")
+// appendBlock puts b on top of the head of the chain and stores it; its tx are expected to be applied already
+func (bc *Blockchain) appendBlock(b *Block) error {
+	// bc.block itself is the head ptr
+	// adding the new block to the next block of the current block
+	if b.Header.Height != 0 {
+		bc.block.NextBlocks = append(bc.block.NextBlocks, b)
+		bc.block = b
+	}
 
 	bc.lock.Lock()
-
 	bc.headers = append(bc.headers, b.Header)
 	//adding block to the blockStore
 	bc.blockStore[b.Hash(BlockHasher{})] = b
@@ -489,18 +610,179 @@ func (bc *Blockchain) addBlockWithoutValidation(b *Block) error {
 		"transactions", len(b.Transactions),
 	)
 
-	if b.Header.Height != 0 {
-		if err := bc.MineBlock(b); err != nil {
-			bc.logger.Log(
-				"msg", "error mining block",
-				"hash", b.Hash(BlockHasher{}),
-				"height", b.Header.Height,
-				"transactions", len(b.Transactions),
-			)
+	if err := bc.store.Put(b); err != nil {
+		return err
+	}
+	if b.Header.Height%snapshotInterval == 0 {
+		return bc.putSnapshot()
+	}
+	return nil
+}
+
+// runs the tx of a block against the account and contract state
+// tx that fail are skipped and not indexed in the txStore
+func (bc *Blockchain) applyBlock(b *Block) {
+	bc.stateLock.Lock()
+	defer bc.stateLock.Unlock()
+
+	//run the block data i.e the code on the VM
+	for _, tx := range b.Transactions {
+		if err := bc.handleTx(tx); err != nil {
+			fmt.Printf("error while handling tx %v\n", err)
+			continue
+		}
+		bc.txStore[tx.Hash(&TxHasher{})] = tx
+	}
+}
+
+// StateRoot returns the root of the state tree over the current account and contract state
+func (bc *Blockchain) StateRoot() core_types.Hash {
+	bc.stateLock.RLock()
+	defer bc.stateLock.RUnlock()
+
+	return CalculateStateRoot(bc.accountState, bc.contractState)
+}
+
+// StateRootAfter executes the tx of b against a copy of the current state and returns the resulting root
+// the state of the chain is left untouched; b is expected to extend the head of the chain
+func (bc *Blockchain) StateRootAfter(b *Block) core_types.Hash {
+	bc.stateLock.RLock()
+	sim := &Blockchain{
+		logger:          bc.logger,
+		accountState:    bc.accountState.Copy(),
+		contractState:   bc.contractState.Copy(),
+		txStore:         make(map[core_types.Hash]*Transaction),
+		collectionStore: make(map[core_types.Hash]*CollectionTx, len(bc.collectionStore)),
+		mintStore:       make(map[core_types.Hash]*MintTx, len(bc.mintStore)),
+	}
+	for k, v := range bc.collectionStore {
+		sim.collectionStore[k] = v
+	}
+	for k, v := range bc.mintStore {
+		sim.mintStore[k] = v
+	}
+	bc.stateLock.RUnlock()
+
+	sim.applyBlock(b)
+
+	return CalculateStateRoot(sim.accountState, sim.contractState)
+}
+
+// replayedState executes the blocks of the chain up to height against a fresh state; the state of the chain is left untouched
+// a chain switching to a fork needs the state as of the block the fork started from
+func (bc *Blockchain) replayedState(height uint32) (*Blockchain, error) {
+	sim := &Blockchain{
+		logger:          bc.logger,
+		accountState:    NewAccountState(),
+		contractState:   NewState(),
+		txStore:         make(map[core_types.Hash]*Transaction),
+		collectionStore: make(map[core_types.Hash]*CollectionTx),
+		mintStore:       make(map[core_types.Hash]*MintTx),
+	}
+	sim.accountState.CreateAccount(crypto_lib.PublicKey{}.Address())
+
+	for h := uint32(0); h <= height; h++ {
+		b, err := bc.GetBlock(h)
+		if err != nil {
+			return nil, err
 		}
+		sim.applyBlock(b)
 	}
+	return sim, nil
+}
+
+// GetBalance returns the balance of addr in the current state
+func (bc *Blockchain) GetBalance(addr core_types.Address) (uint64, error) {
+	bc.stateLock.RLock()
+	defer bc.stateLock.RUnlock()
+
+	return bc.accountState.GetBalance(addr)
+}
 
-	return bc.store.Put(b)
+// ProveAccount returns the balance of addr along with the proof of it against the state root of the head of the chain
+func (bc *Blockchain) ProveAccount(addr core_types.Address) (*AccountProof, error) {
+	bc.stateLock.RLock()
+	tree := NewStateTreeFromState(bc.accountState, bc.contractState)
+	balance, err := bc.accountState.GetBalance(addr)
+	bc.stateLock.RUnlock()
+
+	// the state of a block is applied before its header is added; the head could be a block behind for a moment
+	height := bc.Height()
+	header, herr := bc.GetHeaders(height)
+	if herr != nil {
+		return nil, herr
+	}
+	if header.StateRoot != tree.Root() {
+		return nil, fmt.Errorf("the head of the chain (%d) does not commit to the current state", height)
+	}
+
+	return &AccountProof{
+		Address: addr,
+		Height:  height,
+		Exists:  err == nil,
+		Balance: balance,
+		Proof:   tree.Prove(AccountStateKey(addr)),
+	}, nil
+}
+
+// GetTxBlock returns the block of the chain the tx with hash is in
+func (bc *Blockchain) GetTxBlock(hash core_types.Hash) (*Block, error) {
+	bc.lock.Lock()
+	defer bc.lock.Unlock()
+
+	if _, ok := bc.txStore[hash]; ok {
+		// newest first; the tx looked up are usually recent ones
+		for height := len(bc.headers) - 1; height >= 0; height-- {
+			b, ok := bc.blockStoreHeight[uint32(height)+1]
+			if !ok {
+				continue
+			}
+			for _, tx := range b.Transactions {
+				if tx.Hash(TxHasher{}) == hash {
+					return b, nil
+				}
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("transaction with hash (%s) not found", hash)
+}
+
+// replays the stored chain through the state transition so that the account and contract state
+// are rebuilt; every replayed root is checked against the one the header of the block commits to
+// the replay starts above the stored snapshot if there is one that checks out, from genesis otherwise
+func (bc *Blockchain) replayState() error {
+	from := uint32(0)
+	snap, err := bc.store.GetSnapshot()
+	if err == nil {
+		err = bc.restoreSnapshot(snap)
+	}
+	switch {
+	case err == nil:
+		from = snap.Height + 1
+		bc.logger.Log("msg", "restored state snapshot", "height", snap.Height, "block", snap.BlockHash)
+	case !errors.Is(err, ErrSnapshotNotFound):
+		// e.g a snapshot of a block a reorg took off the chain; the blocks have everything it had
+		bc.logger.Log("msg", "ignoring state snapshot", "err", err)
+	}
+
+	for height := from; height <= bc.Height(); height++ {
+		b, err := bc.GetBlock(height)
+		if err != nil {
+			return err
+		}
+		bc.applyBlock(b)
+
+		// the genesis block commits to no state
+		if height == 0 {
+			continue
+		}
+		if root := bc.StateRoot(); root != b.Header.StateRoot {
+			return fmt.Errorf("state root mismatch at height %d: replayed (%s) committed (%s)", height, root, b.Header.StateRoot)
+		}
+	}
+
+	return nil
 }
 
 func (bc *Blockchain) handleTransferNativeTokens(tx *Transaction) error {
@@ -514,6 +796,15 @@ func (bc *Blockchain) HasBlock(height uint32) bool {
 	return height <= bc.Height()
 }
 
+// Close snapshots the state, flushes the store the chain is kept in and closes it
+func (bc *Blockchain) Close() error {
+	bc.insertLock.Lock()
+	err := bc.putSnapshot()
+	bc.insertLock.Unlock()
+
+	return errors.Join(err, bc.store.Close())
+}
+
 func (bc *Blockchain) SetLogger(l log.Logger) {
 	bc.logger = l
 }
@@ -536,18 +827,11 @@ func (bc *Blockchain) calcTargetValue(b *Block) (*big.Int, error) {
 		if err != nil {
 			return nil, err
 		}
-		tsCompBlock := comparisonBlock.Header.Timestamp
 		tsCurrentBlock, err1 := bc.GetBlock(currentHeight)
 		if err1 != nil {
 			return nil, err1
 		}
-		// gives us time Diff in sec
-		timeDiff := (tsCurrentBlock.Header.Timestamp - tsCompBlock)
-		new_target := compactToTarget(tsCurrentBlock.Header.NBits)
-		timeBigInt := new(big.Int).SetUint64(timeDiff)
-		actualTimeDiffBigInt := new(big.Int).SetUint64(AVG_TARGET_TIME)
-		new_target.Mul(new_target, timeBigInt)
-		new_target.Div(new_target, actualTimeDiffBigInt)
+		new_target := nextTarget(tsCurrentBlock.Header, comparisonBlock.Header)
 
 		b.Header.NBits = targetToCompact(new_target)
 		fmt.Printf("target %064x \n nBit are %v\n", new_target, b.Header.NBits)
@@ -605,73 +889,90 @@ func targetToCompact(target *big.Int) uint32 {
 	return bits
 }
 
-func (bc *Blockchain) MineBlock(b *Block) error {
+// the search for the nonce was called off before one was found
+var ErrMiningAborted = errors.New("mining aborted")
+
+// MineBlock searches for the nonce of the block; it gives up once quitCh is closed, a nil quitCh never is
+func (bc *Blockchain) MineBlock(b *Block, quitCh <-chan struct{}) error {
 	bc.logger.Log("msg", "mining block..")
 
-	var targetForBlock *big.Int
-	var err error
-	if (bc.Height() % HEIGHT_DIVISOR) == 0 {
+	// the block being mined goes on top of the current head
+	targetForBlock := bc.Target
+	if height := bc.Height(); height != 0 && (height%HEIGHT_DIVISOR) == 0 {
+		var err error
 		targetForBlock, err = bc.calcTargetValue(b)
-		bc.Target = targetForBlock
 		if err != nil {
 			return err
 		}
-	} else {
-		targetForBlock = bc.Target
-		fmt.Printf("target is %x\n", targetForBlock)
+		bc.Target = targetForBlock
 	}
-	fmt.Printf("target for block %x\n", targetForBlock)
+
+	// the header has to be final before the search; changing any field afterwards invalidates the pow
+	b.Header.Timestamp = uint64(time.Now().UnixNano())
+	b.Header.Target = targetForBlock
+	b.Header.NBits = targetToCompact(targetForBlock)
 
 	var mu sync.Mutex
 	var wg sync.WaitGroup
-	found := false
+	var found atomic.Bool
+	var nonce uint32
+	var aborted atomic.Bool
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-quitCh:
+			aborted.Store(true)
+		case <-done:
+		}
+	}()
 
 	numWorkers := 8          // Number of goroutines
 	nonceStep := uint32(1e6) // Nonce range for each worker
 
+	// every worker searches on its own copy of the header; b is only written to once they are all done
+	header := *b.Header
 	for i := 0; i < numWorkers; i++ {
 		wg.Add(1)
-		go func(startNonce uint32) {
+		go func(localHeader Header, startNonce uint32) {
 			defer wg.Done()
-			localBlock := *b
-			localBlock.Header.Nonce = startNonce
+			localHeader.Nonce = startNonce
 			localHashBigInt := new(big.Int)
 
-			for localBlock.Header.Nonce < startNonce+nonceStep {
-				if found {
+			for localHeader.Nonce < startNonce+nonceStep {
+				if found.Load() || aborted.Load() {
 					return
 				}
 
-				bHash := localBlock.HashWithoutCache(BlockHasher{})
-				localHashBigInt.SetString(bHash.String(), 16)
+				bHash := BlockHasher{}.Hash(&localHeader)
+				localHashBigInt.SetBytes(bHash[:])
 
 				if isLowerThanTarget(localHashBigInt, targetForBlock) == -1 {
 					mu.Lock()
-					if !found {
-						found = true
-						b.Header = localBlock.Header
-						fmt.Printf("block mined with hash %s and target %x \n", bHash, targetForBlock)
+					if !found.Load() {
+						found.Store(true)
+						nonce = localHeader.Nonce
 					}
 					mu.Unlock()
 					return
 				}
-				localBlock.Header.Nonce++
+				localHeader.Nonce++
 			}
-		}(uint32(i) * nonceStep)
+		}(header, uint32(i)*nonceStep)
 	}
 
 	wg.Wait()
 
-	if !found {
+	if !found.Load() && aborted.Load() {
+		return ErrMiningAborted
+	}
+	if !found.Load() {
 		return fmt.Errorf("failed to mine block within the nonce range")
 	}
+	b.Header.Nonce = nonce
 
-	// Updating timestamp
-	b.Header.Timestamp = uint64(time.Now().UnixNano())
-	b.Header.Target = targetForBlock
-	b.Header.NBits = targetToCompact(targetForBlock)
-
-	fmt.Printf("block mined with hash %s and target %x \n", b.HashWithoutCache(BlockHasher{}), targetForBlock)
+	bc.logger.Log("msg", "block mined", "hash", b.HashWithoutCache(BlockHasher{}), "nonce", nonce)
 
 	return nil
 }
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"math/big"
 	"os"
+	"sync"
 	"testing"
 
 	"github.com/EggsyOnCode/xenolith/core_types"
@@ -42,6 +43,7 @@ func TestSendNativeTokenTransferSuccess(t *testing.T) {
 	assert.Equal(t, block.Header.DataHash, newDataHash)
 
 	// add the block to the blockchain
+	commitStateRoot(t, bc, block)
 	assert.Nil(t, bc.AddBlock(block))
 	assert.Equal(t, bc.accountState.accounts[addrAlice].Address, addrAlice)
 	assert.Equal(t, bc.accountState.accounts[pkBob.PublicKey().Address()].Address, pkBob.PublicKey().Address())
@@ -74,6 +76,7 @@ func TestSendNativeTransferInsufficientBalance(t *testing.T) {
 	fmt.Printf("bob => %s\n", privKeyBob.PublicKey().Address())
 
 	block.AddTx(tx)
+	commitStateRoot(t, bc, block)
 	assert.Nil(t, bc.AddBlock(block))
 
 	_, err := bc.accountState.GetAccount(privKeyAlice.PublicKey().Address())
@@ -126,6 +129,7 @@ func TestSendNativeTokenTransferWithTampering(t *testing.T) {
 	assert.Equal(t, tx.To.Address(), hackerPk.PublicKey().Address())
 	assert.NotNil(t, block.AddTx(tx))
 	fmt.Printf("block is signed by: %v\n", block.Validator)
+	commitStateRoot(t, bc, block)
 	assert.Nil(t, bc.AddBlock(block))
 	// the hacker account won't exist hence hte below code would throw null ptr exception
 	// assert.NotNil(t, bc.accountState.accounts[hackerPk.PublicKey().Address()].Balance)
@@ -150,6 +154,7 @@ func TestAddBlock(t *testing.T) {
 		prevHash := getPrevBlockHash(t, bc, uint32(i+1))
 		prevBlock, _ := bc.GetBlockByHash(prevHash)
 		block := randomBlockWithSignatureAndPrevBlock(t, uint32(i+1), (prevHash), prevBlock)
+		commitStateRoot(t, bc, block)
 		err := bc.AddBlock(block)
 		assert.Nil(t, err)
 	}
@@ -161,6 +166,36 @@ func TestAddBlock(t *testing.T) {
 	assert.NotNil(t, randBlock)
 }
 
+// the server, the sync manager and the validator add blocks at the same time; only one of them gets it in
+func TestAddBlockConcurrently(t *testing.T) {
+	bc := newBlockchainWithGenesis(t)
+	block := randomBlockWithSignature(t, 1, getPrevBlockHash(t, bc, 1))
+	commitStateRoot(t, bc, block)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- bc.AddBlock(block)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	added := 0
+	for err := range errs {
+		if err == nil {
+			added++
+			continue
+		}
+		assert.ErrorIs(t, err, ErrBlockKnown)
+	}
+	assert.Equal(t, 1, added)
+	assert.Equal(t, uint32(1), bc.Height())
+}
+
 func TestBlockTooHigh(t *testing.T) {
 	_, bc := newBlockchainWithGenesisAndReturnsGenesis(t)
 	block := randomBlockWithSignature(t, 1000, core_types.GenerateRandomHash(32))
@@ -168,11 +203,21 @@ func TestBlockTooHigh(t *testing.T) {
 	block1 := randomBlockWithSignature(t, 1, core_types.GenerateRandomHash(32))
 	assert.NotNil(t, bc.AddBlock(block1))
 }
+func TestAddKnownBlock(t *testing.T) {
+	_, bc := newBlockchainWithGenesisAndReturnsGenesis(t)
+	block := randomBlockWithSignature(t, 1, getPrevBlockHash(t, bc, 1))
+	commitStateRoot(t, bc, block)
+	assert.Nil(t, bc.AddBlock(block))
+	assert.ErrorIs(t, bc.AddBlock(block), ErrBlockKnown)
+	assert.Equal(t, uint32(1), bc.Height())
+}
+
 func TestGetHeaders(t *testing.T) {
 	_, bc := newBlockchainWithGenesisAndReturnsGenesis(t)
 	for i := 0; i < 2; i++ {
 		prevHash := getPrevBlockHash(t, bc, uint32(i+1))
 		block := randomBlockWithSignature(t, uint32(i+1), prevHash)
+		commitStateRoot(t, bc, block)
 		err := bc.AddBlock(block)
 		assert.Nil(t, err)
 		header, err := bc.GetHeaders(block.Header.Height)
@@ -199,6 +244,7 @@ func TestGetBlock(t *testing.T) {
 	for i := 1; i < lenB; i++ {
 		prevHash := getPrevBlockHash(t, bc, uint32(i))
 		block := randomBlockWithSignature(t, uint32(i), (prevHash))
+		commitStateRoot(t, bc, block)
 		err := bc.AddBlock(block)
 		assert.Nil(t, err)
 		block1, err1 := bc.GetBlock(block.Header.Height)
@@ -211,6 +257,7 @@ func TestForkBlockAddition(t *testing.T) {
 	gB, bc := newBlockchainWithGenesisAndReturnsGenesis(t)
 	prevHash := getPrevBlockHash(t, bc, uint32(1))
 	block := randomBlockWithSignature(t, uint32(1), (prevHash))
+	commitStateRoot(t, bc, block)
 	err := bc.AddBlock(block)
 	fmt.Printf("hash of the head ptr in bc is %v\n", bc.block.Hash(BlockHasher{}))
 	fmt.Printf("prev hash of the block is %v\n", block.Header.PrevBlockHash)
@@ -222,19 +269,48 @@ func TestForkBlockAddition(t *testing.T) {
 	assert.Equal(t, forkingBlock.Header.PrevBlockHash, block.Header.PrevBlockHash)
 }
 
+// blocks from the network aren't linked to their parent; the chain has to find it by hash
+func TestForkBlocksWithoutPrevBlock(t *testing.T) {
+	_, bc := newBlockchainWithGenesisAndReturnsGenesis(t)
+	prevHash := getPrevBlockHash(t, bc, uint32(1))
+	block := randomBlockWithSignatureAndPrevBlock(t, uint32(1), prevHash, nil)
+	commitStateRoot(t, bc, block)
+	assert.Nil(t, bc.AddBlock(block))
+
+	forkingBlock := randomBlockWithSignatureAndPrevBlock(t, uint32(1), prevHash, nil)
+	assert.Nil(t, bc.AddBlock(forkingBlock))
+	// e.g relayed to us a second time
+	assert.ErrorIs(t, bc.AddBlock(forkingBlock), ErrBlockKnown)
+
+	blockToFork := randomBlockWithSignatureAndPrevBlock(t, uint32(2), forkingBlock.Hash(BlockHasher{}), nil)
+	assert.Nil(t, bc.AddBlock(blockToFork))
+	fork, err := bc.ForkSlice.FindBlockFork(blockToFork.Hash(BlockHasher{}))
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(1), fork.Confirmations)
+	assert.Equal(t, bc.block, block)
+}
+
 func TestChainReorg(t *testing.T) {
 	gB, bc := newBlockchainWithGenesisAndReturnsGenesis(t)
-	bc.SetTxChan(make(chan *Transaction, 1024))
+	orphaned := []*Transaction{}
+	bc.SetOrphanedTxHandler(func(txx []*Transaction) {
+		orphaned = append(orphaned, txx...)
+	})
 	assert.Equal(t, bc.block, gB)
 	prevHash := getPrevBlockHash(t, bc, uint32(1))
 	block := randomBlockWithSignatureAndPrevBlock(t, uint32(1), (prevHash), gB)
+	commitStateRoot(t, bc, block)
 	err := bc.AddBlock(block)
 	assert.Equal(t, gB.NextBlocks[0], block)
 	fmt.Printf("hash of the head ptr in bc is %v\n", bc.block.Hash(BlockHasher{}))
 	fmt.Printf("prev hash of the block is %v\n", block.Header.PrevBlockHash)
 	assert.Nil(t, err)
 	//block that causes the fork
+	// the fork is executed on top of the genesis block once the chain switches over to it
+	forkState, err := bc.replayedState(0)
+	assert.Nil(t, err)
 	forkingBlock := randomBlockWithSignatureAndPrevBlock(t, uint32(1), (prevHash), gB)
+	commitForkBlock(t, forkState, forkingBlock)
 	fmt.Printf("prev hash of the block is %v\n", forkingBlock.Header.PrevBlockHash)
 	err1 := bc.AddBlock(forkingBlock)
 	assert.Nil(t, err1)
@@ -245,10 +321,12 @@ func TestChainReorg(t *testing.T) {
 
 	BlockToLongestChain1 := randomBlockWithSignatureAndPrevBlock(t, uint32(2), block.Hash(BlockHasher{}), block)
 
+	commitStateRoot(t, bc, BlockToLongestChain1)
 	assert.Nil(t, bc.AddBlock(BlockToLongestChain1))
 	assert.Equal(t, block.NextBlocks[0], BlockToLongestChain1)
 
 	BlockToLongestChain2 := randomBlockWithSignatureAndPrevBlock(t, uint32(3), BlockToLongestChain1.Hash(BlockHasher{}), BlockToLongestChain1)
+	commitStateRoot(t, bc, BlockToLongestChain2)
 	assert.Nil(t, bc.AddBlock(BlockToLongestChain2))
 	assert.Equal(t, BlockToLongestChain1.NextBlocks[0], BlockToLongestChain2)
 	assert.Equal(t, bc.block, BlockToLongestChain2)
@@ -256,16 +334,20 @@ func TestChainReorg(t *testing.T) {
 	// assert.Nil(t, err2)
 
 	blockToFork1 := randomBlockWithSignatureAndPrevBlock(t, uint32(2), forkingBlock.Hash(BlockHasher{}), forkingBlock)
+	commitForkBlock(t, forkState, blockToFork1)
 	assert.Nil(t, bc.AddBlock(blockToFork1))
 	assert.Equal(t, forkingBlock.NextBlocks[0], blockToFork1)
 
 	blockToFork2 := randomBlockWithSignatureAndPrevBlock(t, uint32(3), blockToFork1.Hash(BlockHasher{}), blockToFork1)
+	commitForkBlock(t, forkState, blockToFork2)
 	assert.Nil(t, bc.AddBlock(blockToFork2))
 	assert.Equal(t, blockToFork1.NextBlocks[0], blockToFork2)
 	assert.Equal(t, bc.block, BlockToLongestChain2)
 
 	blockToFork3 := randomBlockWithSignatureAndPrevBlock(t, uint32(4), blockToFork2.Hash(BlockHasher{}), blockToFork2)
+	commitForkBlock(t, forkState, blockToFork3)
 	assert.Nil(t, bc.AddBlock(blockToFork3))
+	assert.Equal(t, forkState.StateRoot(), bc.StateRoot())
 
 	fmt.Printf("bc height %v\n", bc.Height())
 
@@ -289,6 +371,61 @@ func TestChainReorg(t *testing.T) {
 	genesisB, _ := bc.GetBlock(0)
 	assert.Equal(t, genesisB, gB)
 
+	// the tx of the blocks taken off the chain are handed back once the block causing the reorg is in
+	expected := []*Transaction{}
+	for _, b := range []*Block{block, BlockToLongestChain1, BlockToLongestChain2} {
+		_, err := bc.GetBlockByHash(b.Hash(BlockHasher{}))
+		assert.NotNil(t, err)
+		expected = append(expected, b.Transactions...)
+	}
+	assert.ElementsMatch(t, expected, orphaned)
+}
+
+// a fork whose blocks don't reproduce the state roots they commit to is dropped; the chain stays where it was
+func TestChainReorgRejectsForkWithWrongStateRoot(t *testing.T) {
+	gB, bc := newBlockchainWithGenesisAndReturnsGenesis(t)
+	orphaned := []*Transaction{}
+	bc.SetOrphanedTxHandler(func(txx []*Transaction) {
+		orphaned = append(orphaned, txx...)
+	})
+	forkState, err := bc.replayedState(0)
+	assert.Nil(t, err)
+
+	prevHash := getPrevBlockHash(t, bc, 1)
+	block := randomBlockWithSignatureAndPrevBlock(t, 1, prevHash, gB)
+	commitStateRoot(t, bc, block)
+	assert.Nil(t, bc.AddBlock(block))
+	// as long as the fork; the validator takes no block higher than one above our head
+	block2 := randomBlockWithSignatureAndPrevBlock(t, 2, block.Hash(BlockHasher{}), block)
+	commitStateRoot(t, bc, block2)
+	assert.Nil(t, bc.AddBlock(block2))
+	head := randomBlockWithSignatureAndPrevBlock(t, 3, block2.Hash(BlockHasher{}), block2)
+	commitStateRoot(t, bc, head)
+	assert.Nil(t, bc.AddBlock(head))
+	rootBefore := bc.StateRoot()
+
+	forkingBlock := randomBlockWithSignatureAndPrevBlock(t, 1, prevHash, gB)
+	commitForkBlock(t, forkState, forkingBlock)
+	assert.Nil(t, bc.AddBlock(forkingBlock))
+	blockToFork1 := randomBlockWithSignatureAndPrevBlock(t, 2, forkingBlock.Hash(BlockHasher{}), forkingBlock)
+	commitForkBlock(t, forkState, blockToFork1)
+	assert.Nil(t, bc.AddBlock(blockToFork1))
+	// carries a root none of the chains reproduces
+	blockToFork2 := randomBlockWithSignatureAndPrevBlock(t, 3, blockToFork1.Hash(BlockHasher{}), blockToFork1)
+	blockToFork2.Header.StateRoot = core_types.GenerateRandomHash(32)
+	assert.Nil(t, blockToFork2.Sign(crypto_lib.GeneratePrivateKey()))
+	forkState.applyBlock(blockToFork2)
+	assert.Nil(t, bc.AddBlock(blockToFork2))
+
+	blockToFork3 := randomBlockWithSignatureAndPrevBlock(t, 4, blockToFork2.Hash(BlockHasher{}), blockToFork2)
+	commitForkBlock(t, forkState, blockToFork3)
+	assert.ErrorIs(t, bc.AddBlock(blockToFork3), ErrInvalidBlock)
+
+	assert.Equal(t, head, bc.block)
+	assert.Equal(t, uint32(3), bc.Height())
+	assert.Equal(t, rootBefore, bc.StateRoot())
+	assert.Empty(t, bc.ForkSlice)
+	assert.Empty(t, orphaned)
 }
 
 func TestTargetValueForBlock(t *testing.T) {
@@ -297,6 +434,7 @@ func TestTargetValueForBlock(t *testing.T) {
 	for i := 1; i < lenB; i++ {
 		prevHash := getPrevBlockHash(t, bc, uint32(i))
 		block := randomBlockWithSignature(t, uint32(i), (prevHash))
+		commitStateRoot(t, bc, block)
 		err := bc.AddBlock(block)
 		assert.Nil(t, err)
 		block1, err1 := bc.GetBlock(block.Header.Height)
@@ -320,6 +458,7 @@ func TestMineBlockFunc(t *testing.T) {
 	for i := 1; i < lenB; i++ {
 		prevHash := getPrevBlockHash(t, bc, uint32(i))
 		block := randomBlockWithSignature(t, uint32(i), (prevHash))
+		commitStateRoot(t, bc, block)
 		err := bc.AddBlock(block)
 		assert.Nil(t, err)
 		block1, err1 := bc.GetBlock(block.Header.Height)
@@ -330,7 +469,7 @@ func TestMineBlockFunc(t *testing.T) {
 	prevBlock, err := bc.GetBlock(HEIGHT_DIVISOR * 2)
 	assert.Nil(t, err)
 	block := randomBlockWithSignature(t, uint32(6), prevBlock.Hash(BlockHasher{}))
-	err1 := bc.MineBlock(block)
+	err1 := bc.MineBlock(block, nil)
 	assert.Nil(t, err1)
 }
 
@@ -356,6 +495,7 @@ func TestTxRevertion(t *testing.T) {
 
 	block.AddTx(tx)
 	assert.Nil(t, block.Sign(signer))
+	commitStateRoot(t, bc, block)
 	assert.Nil(t, bc.AddBlock(block))
 
 	assert.Equal(t, accountBob.Balance, uint64(20))
@@ -367,6 +507,360 @@ func TestTxRevertion(t *testing.T) {
 	assert.Equal(t, accountAlice.Balance, uint64(0))
 }
 
+func TestBlockchainReopenFromDiskStore(t *testing.T) {
+	dir := t.TempDir()
+	gB := genesisBlockWithSig(t, 0, core_types.Hash{})
+	logger := log.NewLogfmtLogger(os.Stderr)
+
+	store, err := NewDiskStore(dir)
+	assert.Nil(t, err)
+	bc, err := NewBlockchainWithStore(gB, store, logger)
+	assert.Nil(t, err)
+	// an easy target keeps the mining of the test blocks fast
+	bc.Target = new(big.Int).Lsh(big.NewInt(1), 256)
+
+	lenB := 3
+	for i := 1; i <= lenB; i++ {
+		prevHash := getPrevBlockHash(t, bc, uint32(i))
+		block := randomBlockWithSignature(t, uint32(i), prevHash)
+		commitStateRoot(t, bc, block)
+		assert.Nil(t, bc.AddBlock(block))
+	}
+	tipHash := bc.ChainTip.Hash(BlockHasher{})
+	assert.Nil(t, store.Close())
+
+	store, err = NewDiskStore(dir)
+	assert.Nil(t, err)
+	defer store.Close()
+	reopened, err := NewBlockchainWithStore(gB, store, logger)
+	assert.Nil(t, err)
+
+	assert.Equal(t, uint32(lenB), reopened.Height())
+	assert.Equal(t, tipHash, reopened.ChainTip.Hash(BlockHasher{}))
+	assert.Equal(t, reopened.block, reopened.ChainTip)
+	for i := 0; i <= lenB; i++ {
+		block, err := reopened.GetBlock(uint32(i))
+		assert.Nil(t, err)
+		_, err = reopened.GetBlockByHash(block.Hash(BlockHasher{}))
+		assert.Nil(t, err)
+	}
+
+	// the reopened chain keeps accepting blocks on top of the stored tip
+	reopened.Target = new(big.Int).Lsh(big.NewInt(1), 256)
+	prevHash := getPrevBlockHash(t, reopened, uint32(lenB+1))
+	block := randomBlockWithSignature(t, uint32(lenB+1), prevHash)
+	commitStateRoot(t, reopened, block)
+	assert.Nil(t, reopened.AddBlock(block))
+	assert.Equal(t, uint32(lenB+1), reopened.Height())
+}
+
+func TestBlockchainReopenReplaysState(t *testing.T) {
+	dir := t.TempDir()
+	gB := genesisBlockWithSig(t, 0, core_types.Hash{})
+	logger := log.NewLogfmtLogger(os.Stderr)
+
+	store, err := NewDiskStore(dir)
+	assert.Nil(t, err)
+	bc, err := NewBlockchainWithStore(gB, store, logger)
+	assert.Nil(t, err)
+	bc.Target = new(big.Int).Lsh(big.NewInt(1), 256)
+
+	// stores FOO => 7 in the contract state
+	signer := crypto_lib.GeneratePrivateKey()
+	tx := NewTransaction([]byte{0x03, 0x0a, 0x04, 0x0a, 0x0b, 0x46, 0x0c, 0x4f, 0x0c, 0x4f, 0x0c, 0x03, 0x0a, 0x0d, 0x0f})
+	tx.From = signer.PublicKey()
+	assert.Nil(t, tx.Sign(signer))
+
+	block := randomBlockWithSignature(t, 1, getPrevBlockHash(t, bc, 1))
+	assert.Nil(t, block.AddTx(tx))
+	assert.Nil(t, block.Sign(signer))
+	commitStateRoot(t, bc, block)
+	assert.Nil(t, bc.AddBlock(block))
+
+	stateRoot := bc.StateRoot()
+	assert.Nil(t, store.Close())
+
+	store, err = NewDiskStore(dir)
+	assert.Nil(t, err)
+	reopened, err := NewBlockchainWithStore(gB, store, logger)
+	assert.Nil(t, err)
+
+	assert.Equal(t, stateRoot, reopened.StateRoot())
+	value, err := reopened.contractState.Get([]byte("FOO"))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(7), DeserializeInt64(value))
+	_, err = reopened.GetTxByHash(tx.Hash(TxHasher{}))
+	assert.Nil(t, err)
+
+	// a stored block whose header commits to a root the replay does not reproduce stops the node from starting
+	forged := randomBlockWithSignature(t, 2, getPrevBlockHash(t, reopened, 2))
+	forged.Header.StateRoot = core_types.GenerateRandomHash(32)
+	assert.Nil(t, forged.Sign(signer))
+	assert.Nil(t, store.Put(forged))
+	assert.Nil(t, store.Close())
+
+	store, err = NewDiskStore(dir)
+	assert.Nil(t, err)
+	defer store.Close()
+	_, err = NewBlockchainWithStore(gB, store, logger)
+	assert.ErrorContains(t, err, "state root mismatch")
+}
+
+// the state is restored from the snapshot written on close and the blocks above it are replayed on top
+func TestBlockchainReopenFromSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	gB := genesisBlockWithSig(t, 0, core_types.Hash{})
+	logger := log.NewLogfmtLogger(os.Stderr)
+
+	store, err := NewDiskStore(dir)
+	assert.Nil(t, err)
+	bc, err := NewBlockchainWithStore(gB, store, logger)
+	assert.Nil(t, err)
+
+	// stores FOO => 7 in the contract state
+	signer := crypto_lib.GeneratePrivateKey()
+	tx := NewTransaction([]byte{0x03, 0x0a, 0x04, 0x0a, 0x0b, 0x46, 0x0c, 0x4f, 0x0c, 0x4f, 0x0c, 0x03, 0x0a, 0x0d, 0x0f})
+	tx.From = signer.PublicKey()
+	assert.Nil(t, tx.Sign(signer))
+	block := randomBlockWithSignature(t, 1, getPrevBlockHash(t, bc, 1))
+	assert.Nil(t, block.AddTx(tx))
+	commitStateRoot(t, bc, block)
+	assert.Nil(t, bc.AddBlock(block))
+	assert.Nil(t, bc.Close())
+
+	snap, err := store.GetSnapshot()
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(1), snap.Height)
+	assert.Equal(t, block.Hash(BlockHasher{}), snap.BlockHash)
+
+	store, err = NewDiskStore(dir)
+	assert.Nil(t, err)
+	reopened, err := NewBlockchainWithStore(gB, store, logger)
+	assert.Nil(t, err)
+	assert.Equal(t, block.Header.StateRoot, reopened.StateRoot())
+	_, err = reopened.GetTxByHash(tx.Hash(TxHasher{}))
+	assert.Nil(t, err)
+
+	// the node goes down without closing the chain; the block above the snapshot is replayed
+	block2 := randomBlockWithSignature(t, 2, getPrevBlockHash(t, reopened, 2))
+	commitStateRoot(t, reopened, block2)
+	assert.Nil(t, reopened.AddBlock(block2))
+	assert.Nil(t, store.Close())
+
+	store, err = NewDiskStore(dir)
+	assert.Nil(t, err)
+	reopened, err = NewBlockchainWithStore(gB, store, logger)
+	assert.Nil(t, err)
+	assert.Equal(t, block2.Header.StateRoot, reopened.StateRoot())
+	for _, b := range []*Block{block, block2} {
+		for _, tx := range b.Transactions {
+			_, err = reopened.GetTxByHash(tx.Hash(TxHasher{}))
+			assert.Nil(t, err)
+		}
+	}
+
+	// a snapshot that doesn't match the root its block commits to is ignored; the blocks are replayed from genesis
+	snap.Contract["FOO"] = []byte{8}
+	assert.Nil(t, store.PutSnapshot(snap))
+	assert.Nil(t, store.Close())
+
+	store, err = NewDiskStore(dir)
+	assert.Nil(t, err)
+	defer store.Close()
+	reopened, err = NewBlockchainWithStore(gB, store, logger)
+	assert.Nil(t, err)
+	assert.Equal(t, block2.Header.StateRoot, reopened.StateRoot())
+}
+
+func TestBlockchainReopenWithDifferentGenesis(t *testing.T) {
+	dir := t.TempDir()
+	logger := log.NewLogfmtLogger(os.Stderr)
+
+	store, err := NewDiskStore(dir)
+	assert.Nil(t, err)
+	_, err = NewBlockchainWithStore(genesisBlockWithSig(t, 0, core_types.Hash{}), store, logger)
+	assert.Nil(t, err)
+
+	_, err = NewBlockchainWithStore(genesisBlockWithSig(t, 0, core_types.Hash{}), store, logger)
+	assert.NotNil(t, err)
+	assert.Nil(t, store.Close())
+}
+
+// a reorg onto a fork shorter than the chain it replaces leaves nothing of that chain behind in the store
+func TestBlockchainReopenAfterReorg(t *testing.T) {
+	dir := t.TempDir()
+	gB := genesisBlockWithSig(t, 0, core_types.Hash{})
+	logger := log.NewLogfmtLogger(os.Stderr)
+
+	store, err := NewDiskStore(dir)
+	assert.Nil(t, err)
+	bc, err := NewBlockchainWithStore(gB, store, logger)
+	assert.Nil(t, err)
+	forkState, err := bc.replayedState(0)
+	assert.Nil(t, err)
+
+	for i := 1; i <= 5; i++ {
+		block := randomBlockWithSignature(t, uint32(i), getPrevBlockHash(t, bc, uint32(i)))
+		commitStateRoot(t, bc, block)
+		assert.Nil(t, bc.AddBlock(block))
+	}
+	prev := gB
+	for i := 1; i <= 4; i++ {
+		block := randomBlockWithSignatureAndPrevBlock(t, uint32(i), prev.Hash(BlockHasher{}), prev)
+		commitForkBlock(t, forkState, block)
+		assert.Nil(t, bc.AddBlock(block))
+		prev = block
+	}
+	assert.Equal(t, prev, bc.block)
+	assert.Equal(t, uint32(4), bc.Height())
+	stateRoot := bc.StateRoot()
+	assert.Nil(t, store.Close())
+
+	store, err = NewDiskStore(dir)
+	assert.Nil(t, err)
+	reopened, err := NewBlockchainWithStore(gB, store, logger)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(4), reopened.Height())
+	assert.Equal(t, prev.Hash(BlockHasher{}), reopened.ChainTip.Hash(BlockHasher{}))
+	assert.Equal(t, stateRoot, reopened.StateRoot())
+
+	// so a stored height that doesn't link to the one below is corruption, not the end of the chain
+	other := randomBlockWithSignature(t, 5, core_types.GenerateRandomHash(32))
+	assert.Nil(t, store.Put(other))
+	assert.Nil(t, store.Close())
+
+	store, err = NewDiskStore(dir)
+	assert.Nil(t, err)
+	defer store.Close()
+	_, err = NewBlockchainWithStore(gB, store, logger)
+	assert.ErrorIs(t, err, ErrStoreCorrupt)
+}
+
+func TestRejectBlockWithWrongStateRoot(t *testing.T) {
+	_, bc := newBlockchainWithGenesisAndReturnsGenesis(t)
+	rootBefore := bc.StateRoot()
+
+	// stores FOO => 7 in the contract state
+	signer := crypto_lib.GeneratePrivateKey()
+	tx := NewTransaction([]byte{0x03, 0x0a, 0x04, 0x0a, 0x0b, 0x46, 0x0c, 0x4f, 0x0c, 0x4f, 0x0c, 0x03, 0x0a, 0x0d, 0x0f})
+	tx.From = signer.PublicKey()
+	assert.Nil(t, tx.Sign(signer))
+
+	block := randomBlockWithSignature(t, 1, getPrevBlockHash(t, bc, 1))
+	assert.Nil(t, block.AddTx(tx))
+
+	// the root of the parent does not account for the tx of the block
+	block.Header.StateRoot = rootBefore
+	assert.Nil(t, block.Sign(signer))
+	err := bc.AddBlock(block)
+	assert.ErrorIs(t, err, ErrInvalidBlock)
+	assert.ErrorContains(t, err, "state root")
+	assert.Equal(t, uint32(0), bc.Height())
+
+	// re-executing the block must not have touched the state of the chain
+	assert.Equal(t, rootBefore, bc.StateRoot())
+	_, err = bc.contractState.Get([]byte("FOO"))
+	assert.NotNil(t, err)
+
+	bc.Target = new(big.Int).Lsh(big.NewInt(1), 256)
+	commitStateRoot(t, bc, block)
+	assert.Nil(t, bc.AddBlock(block))
+	assert.Equal(t, block.Header.StateRoot, bc.StateRoot())
+}
+
+// the miner can neither pick an easier target nor skip the pow
+func TestRejectBlockWithWrongTarget(t *testing.T) {
+	_, bc := newBlockchainWithGenesisAndReturnsGenesis(t)
+	withHeader := func(change func(*Header)) *Block {
+		block := randomBlockWithSignature(t, 1, getPrevBlockHash(t, bc, 1))
+		commitStateRoot(t, bc, block)
+		change(block.Header)
+		assert.Nil(t, block.Sign(crypto_lib.GeneratePrivateKey()))
+		return block
+	}
+
+	easier := withHeader(func(h *Header) {
+		h.Target = new(big.Int).Lsh(testTarget, 1)
+		h.NBits = targetToCompact(h.Target)
+	})
+	assert.ErrorIs(t, bc.AddBlock(easier), ErrInvalidBlock)
+	// the nbits have to encode the target
+	wrongBits := withHeader(func(h *Header) { h.NBits++ })
+	assert.ErrorIs(t, bc.AddBlock(wrongBits), ErrInvalidBlock)
+	assert.Equal(t, uint32(0), bc.Height())
+
+	assert.Nil(t, bc.AddBlock(withHeader(func(*Header) {})))
+
+	// a block that wasn't mined below the target of the chain
+	gB := genesisBlockWithSig(t, 0, core_types.Hash{})
+	gB.Header.Target = big.NewInt(1)
+	hard, err := NewBlockchain(gB, log.NewNopLogger())
+	assert.Nil(t, err)
+	block := randomBlockWithSignature(t, 1, getPrevBlockHash(t, hard, 1))
+	commitStateRoot(t, hard, block)
+	err = hard.AddBlock(block)
+	assert.ErrorIs(t, err, ErrInvalidBlock)
+	assert.ErrorContains(t, err, "not below its target")
+}
+
+func TestProveAccountAndTx(t *testing.T) {
+	_, bc := newBlockchainWithGenesisAndReturnsGenesis(t)
+	bc.Target = new(big.Int).Lsh(big.NewInt(1), 256)
+	alice := crypto_lib.GeneratePrivateKey()
+	bob := crypto_lib.GeneratePrivateKey().PublicKey()
+	bc.accountState.CreateAccount(alice.PublicKey().Address()).Balance = 150
+
+	tx := NewTransaction([]byte{})
+	tx.From = alice.PublicKey()
+	tx.To = bob
+	tx.Value = 100
+	assert.Nil(t, tx.Sign(alice))
+	block := randomBlockWithSignature(t, 1, getPrevBlockHash(t, bc, 1))
+	assert.Nil(t, block.AddTx(tx))
+	commitStateRoot(t, bc, block)
+	assert.Nil(t, bc.AddBlock(block))
+
+	proof, err := bc.ProveAccount(bob.Address())
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(1), proof.Height)
+	assert.True(t, proof.Exists)
+	assert.Equal(t, uint64(100), proof.Balance)
+	assert.True(t, proof.Verify(block.Header.StateRoot))
+	proof.Balance++
+	assert.False(t, proof.Verify(block.Header.StateRoot))
+
+	// the absence of an account is proven as well
+	proof, err = bc.ProveAccount(crypto_lib.GeneratePrivateKey().PublicKey().Address())
+	assert.Nil(t, err)
+	assert.False(t, proof.Exists)
+	assert.True(t, proof.Verify(block.Header.StateRoot))
+
+	got, err := bc.GetTxBlock(tx.Hash(TxHasher{}))
+	assert.Nil(t, err)
+	assert.Equal(t, block, got)
+	_, err = bc.GetTxBlock(core_types.Hash{1})
+	assert.NotNil(t, err)
+}
+
+// commits block to the state the chain reaches by executing it on top of its head and re-signs it
+// a block on top of the head gets the target the chain expects there as well
+func commitStateRoot(t *testing.T, bc *Blockchain, block *Block) {
+	if bc.block != nil && block.Header.PrevBlockHash == bc.block.Hash(BlockHasher{}) {
+		target, err := bc.targetAfter(bc.block)
+		assert.Nil(t, err)
+		block.Header.Target = target
+		block.Header.NBits = targetToCompact(target)
+	}
+	block.Header.StateRoot = bc.StateRootAfter(block)
+	assert.Nil(t, block.Sign(crypto_lib.GeneratePrivateKey()))
+}
+
+// commits a block of a fork to the state it leaves behind; state is the one of the fork, not of the chain
+func commitForkBlock(t *testing.T, state *Blockchain, block *Block) {
+	commitStateRoot(t, state, block)
+	state.applyBlock(block)
+}
+
 func newBlockchainWithGenesis(t *testing.T) *Blockchain {
 	block := genesisBlockWithSig(t, 1, core_types.Hash{})
 	logger := log.NewLogfmtLogger(os.Stderr)
@@ -0,0 +1,361 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/EggsyOnCode/xenolith/core_types"
+)
+
+const (
+	blockFileName    = "blocks.dat"
+	indexFileName    = "index.dat"
+	snapshotFileName = "state.dat"
+	// hash (32) + height (4) + offset (8) + size (4)
+	indexEntrySize = 48
+	// every block record in the block file is prefixed by its size
+	blockRecordPrefixSize = 4
+)
+
+// location of a block record inside the block file
+type diskRecord struct {
+	height uint32
+	offset int64
+	size   uint32
+}
+
+// DiskStore persists blocks into an append-only block file
+// the index file is an append-only log of (hash, height, offset, size) entries
+// replaying it on open rebuilds the hash and height indexes; an entry with the zero hash truncates the chain at its height
+type DiskStore struct {
+	mu        sync.RWMutex
+	dir       string
+	blockFile *os.File
+	indexFile *os.File
+	// end of the last complete record in the block file
+	size     int64
+	byHash   map[core_types.Hash]diskRecord
+	byHeight map[uint32]core_types.Hash
+}
+
+func NewDiskStore(dir string) (*DiskStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	blockFile, err := os.OpenFile(filepath.Join(dir, blockFileName), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	indexFile, err := os.OpenFile(filepath.Join(dir, indexFileName), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		blockFile.Close()
+		return nil, err
+	}
+
+	s := &DiskStore{
+		dir:       dir,
+		blockFile: blockFile,
+		indexFile: indexFile,
+		byHash:    make(map[core_types.Hash]diskRecord),
+		byHeight:  make(map[uint32]core_types.Hash),
+	}
+
+	if err := s.loadIndex(); err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// loadIndex replays the index file and then indexes any block records that were
+// appended to the block file without making it into the index (e.g after a crash)
+func (s *DiskStore) loadIndex() error {
+	info, err := s.indexFile.Stat()
+	if err != nil {
+		return err
+	}
+	// a torn trailing entry is dropped
+	indexSize := info.Size() - info.Size()%indexEntrySize
+	if err := s.indexFile.Truncate(indexSize); err != nil {
+		return err
+	}
+
+	buf := make([]byte, indexSize)
+	if _, err := s.indexFile.ReadAt(buf, 0); err != nil && err != io.EOF {
+		return err
+	}
+	for i := int64(0); i < indexSize; i += indexEntrySize {
+		hash, rec := decodeIndexEntry(buf[i : i+indexEntrySize])
+		if hash == (core_types.Hash{}) {
+			s.dropAbove(rec.height)
+			continue
+		}
+		s.byHash[hash] = rec
+		s.byHeight[rec.height] = hash
+		if end := rec.offset + blockRecordPrefixSize + int64(rec.size); end > s.size {
+			s.size = end
+		}
+	}
+
+	return s.recoverBlockFile()
+}
+
+func (s *DiskStore) recoverBlockFile() error {
+	info, err := s.blockFile.Stat()
+	if err != nil {
+		return err
+	}
+
+	offset := s.size
+	prefix := make([]byte, blockRecordPrefixSize)
+	for offset+blockRecordPrefixSize <= info.Size() {
+		if _, err := s.blockFile.ReadAt(prefix, offset); err != nil {
+			return err
+		}
+		size := binary.BigEndian.Uint32(prefix)
+		if offset+blockRecordPrefixSize+int64(size) > info.Size() {
+			break
+		}
+
+		b, err := s.readBlock(diskRecord{offset: offset, size: size})
+		if err != nil {
+			break
+		}
+		rec := diskRecord{height: b.Header.Height, offset: offset, size: size}
+		if err := s.writeIndexEntry(b.Hash(BlockHasher{}), rec); err != nil {
+			return err
+		}
+		offset += blockRecordPrefixSize + int64(size)
+	}
+
+	// anything past the last complete record is a torn write
+	s.size = offset
+	return s.blockFile.Truncate(offset)
+}
+
+func (s *DiskStore) Put(b *Block) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	hash := b.Hash(BlockHasher{})
+	if rec, ok := s.byHash[hash]; ok {
+		// the block is already on disk; only the height index has to move to it
+		rec.height = b.Header.Height
+		return s.writeIndexEntry(hash, rec)
+	}
+
+	// the links to other blocks are in memory only and must not be encoded
+	detached := &Block{
+		Header:       b.Header,
+		Transactions: b.Transactions,
+		Validator:    b.Validator,
+		Signature:    b.Signature,
+	}
+	buf := &bytes.Buffer{}
+	buf.Write(make([]byte, blockRecordPrefixSize))
+	if err := detached.Encode(NewGobBlockEncoder(buf)); err != nil {
+		return err
+	}
+	record := buf.Bytes()
+	size := uint32(len(record) - blockRecordPrefixSize)
+	binary.BigEndian.PutUint32(record, size)
+
+	if _, err := s.blockFile.WriteAt(record, s.size); err != nil {
+		return err
+	}
+	if err := s.blockFile.Sync(); err != nil {
+		return err
+	}
+
+	rec := diskRecord{height: b.Header.Height, offset: s.size, size: size}
+	s.size += int64(len(record))
+
+	return s.writeIndexEntry(hash, rec)
+}
+
+func (s *DiskStore) Get(hash core_types.Hash) (*Block, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	rec, ok := s.byHash[hash]
+	if !ok {
+		return nil, fmt.Errorf("%w: hash (%s)", ErrBlockNotFound, hash)
+	}
+	return s.readBlock(rec)
+}
+
+func (s *DiskStore) GetByHeight(height uint32) (*Block, error) {
+	s.mu.RLock()
+	hash, ok := s.byHeight[height]
+	s.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: height (%d)", ErrBlockNotFound, height)
+	}
+	return s.Get(hash)
+}
+
+func (s *DiskStore) Has(hash core_types.Hash) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	_, ok := s.byHash[hash]
+	return ok
+}
+
+func (s *DiskStore) Iterate(fn func(*Block) error) error {
+	for height := uint32(0); ; height++ {
+		b, err := s.GetByHeight(height)
+		if errors.Is(err, ErrBlockNotFound) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("reading block (%d): %w", height, err)
+		}
+		if err := fn(b); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *DiskStore) Truncate(height uint32) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.appendIndexEntry(encodeIndexEntry(core_types.Hash{}, diskRecord{height: height})); err != nil {
+		return err
+	}
+	s.dropAbove(height)
+	return nil
+}
+
+func (s *DiskStore) dropAbove(height uint32) {
+	for h := range s.byHeight {
+		if h > height {
+			delete(s.byHeight, h)
+		}
+	}
+}
+
+// PutSnapshot writes the snapshot next to the blocks; the file is replaced in one go so a crash leaves the old one
+func (s *DiskStore) PutSnapshot(snap *StateSnapshot) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tmp, err := os.CreateTemp(s.dir, snapshotFileName+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := gob.NewEncoder(tmp).Encode(snap); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(s.dir, snapshotFileName))
+}
+
+func (s *DiskStore) GetSnapshot() (*StateSnapshot, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	f, err := os.Open(filepath.Join(s.dir, snapshotFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrSnapshotNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	snap := &StateSnapshot{}
+	if err := gob.NewDecoder(f).Decode(snap); err != nil {
+		return nil, fmt.Errorf("%w: state snapshot: %v", ErrStoreCorrupt, err)
+	}
+	return snap, nil
+}
+
+func (s *DiskStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var firstErr error
+	for _, f := range []*os.File{s.blockFile, s.indexFile} {
+		// whatever was written has to be on disk before the files go away
+		if err := f.Sync(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		if err := f.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (s *DiskStore) readBlock(rec diskRecord) (*Block, error) {
+	buf := make([]byte, rec.size)
+	if _, err := s.blockFile.ReadAt(buf, rec.offset+blockRecordPrefixSize); err != nil {
+		return nil, err
+	}
+
+	b := NewBlock(nil, nil)
+	if err := b.Decode(NewGobBlockDecoder(bytes.NewReader(buf))); err != nil {
+		return nil, fmt.Errorf("corrupt block record at offset %d: %w", rec.offset, err)
+	}
+	return b, nil
+}
+
+func (s *DiskStore) writeIndexEntry(hash core_types.Hash, rec diskRecord) error {
+	if err := s.appendIndexEntry(encodeIndexEntry(hash, rec)); err != nil {
+		return err
+	}
+
+	s.byHash[hash] = rec
+	s.byHeight[rec.height] = hash
+	return nil
+}
+
+// the entry is on disk once this returns; a block Put is only as durable as its index entry
+func (s *DiskStore) appendIndexEntry(entry []byte) error {
+	info, err := s.indexFile.Stat()
+	if err != nil {
+		return err
+	}
+	if _, err := s.indexFile.WriteAt(entry, info.Size()); err != nil {
+		return err
+	}
+	return s.indexFile.Sync()
+}
+
+func encodeIndexEntry(hash core_types.Hash, rec diskRecord) []byte {
+	buf := make([]byte, indexEntrySize)
+	copy(buf[:32], hash[:])
+	binary.BigEndian.PutUint32(buf[32:36], rec.height)
+	binary.BigEndian.PutUint64(buf[36:44], uint64(rec.offset))
+	binary.BigEndian.PutUint32(buf[44:48], rec.size)
+	return buf
+}
+
+func decodeIndexEntry(buf []byte) (core_types.Hash, diskRecord) {
+	hash := core_types.HashFromBytes(buf[:32])
+	return hash, diskRecord{
+		height: binary.BigEndian.Uint32(buf[32:36]),
+		offset: int64(binary.BigEndian.Uint64(buf[36:44])),
+		size:   binary.BigEndian.Uint32(buf[44:48]),
+	}
+}
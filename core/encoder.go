@@ -1,8 +1,14 @@
 package core
 
 import (
+	"encoding/binary"
 	"encoding/gob"
+	"fmt"
 	"io"
+	"math/big"
+
+	"github.com/EggsyOnCode/xenolith/core_types"
+	"github.com/EggsyOnCode/xenolith/crypto_lib"
 )
 
 type Encoder[T any] interface {
@@ -68,3 +74,310 @@ func NewGobTxDecoder(r io.Reader) *GobTxDecoder {
 func (g GobTxDecoder) Decode(tx *Transaction) error {
 	return gob.NewDecoder(g.reader).Decode(tx)
 }
+
+// Canonical Implementation/ Strategy for Header and Transaction
+// the layout is fixed: fields are written in declaration order, integers are big endian
+// and variable length fields are prefixed by their uint32 length; unlike gob the output
+// only depends on the values being encoded, so it is what hashes and signatures are computed over
+
+// upper bound for a single variable length field; guards the decoder against bogus lengths
+const maxCanonicalFieldSize = 1 << 24
+
+// tags identifying the concrete type of Transaction.TxInner
+const (
+	txInnerNone       byte = 0x0
+	txInnerCollection byte = 0x1
+	txInnerMint       byte = 0x2
+)
+
+type CanonicalHeaderEncoder struct {
+	w io.Writer
+}
+
+type CanonicalHeaderDecoder struct {
+	r io.Reader
+}
+
+func NewCanonicalHeaderEncoder(w io.Writer) *CanonicalHeaderEncoder {
+	return &CanonicalHeaderEncoder{
+		w: w,
+	}
+}
+
+func NewCanonicalHeaderDecoder(r io.Reader) *CanonicalHeaderDecoder {
+	return &CanonicalHeaderDecoder{
+		r: r,
+	}
+}
+
+func (e CanonicalHeaderEncoder) Encode(h *Header) error {
+	cw := &canonicalWriter{w: e.w}
+	cw.uint32(h.Version)
+	cw.hash(h.DataHash)
+	cw.hash(h.PrevBlockHash)
+	cw.hash(h.StateRoot)
+	cw.uint32(h.Height)
+	cw.uint64(h.Timestamp)
+	cw.uint32(h.Nonce)
+	cw.bigInt(h.Target)
+	cw.uint32(h.NBits)
+	return cw.err
+}
+
+func (d CanonicalHeaderDecoder) Decode(h *Header) error {
+	cr := &canonicalReader{r: d.r}
+	h.Version = cr.uint32()
+	h.DataHash = cr.hash()
+	h.PrevBlockHash = cr.hash()
+	h.StateRoot = cr.hash()
+	h.Height = cr.uint32()
+	h.Timestamp = cr.uint64()
+	h.Nonce = cr.uint32()
+	h.Target = cr.bigInt()
+	h.NBits = cr.uint32()
+	return cr.err
+}
+
+type CanonicalTxEncoder struct {
+	w io.Writer
+}
+
+type CanonicalTxDecoder struct {
+	r io.Reader
+}
+
+func NewCanonicalTxEncoder(w io.Writer) *CanonicalTxEncoder {
+	return &CanonicalTxEncoder{
+		w: w,
+	}
+}
+
+func NewCanonicalTxDecoder(r io.Reader) *CanonicalTxDecoder {
+	return &CanonicalTxDecoder{
+		r: r,
+	}
+}
+
+func (e CanonicalTxEncoder) Encode(tx *Transaction) error {
+	cw := &canonicalWriter{w: e.w}
+	writeTxBody(cw, tx)
+	cw.signature(tx.Signature)
+	return cw.err
+}
+
+func (d CanonicalTxDecoder) Decode(tx *Transaction) error {
+	cr := &canonicalReader{r: d.r}
+	readTxBody(cr, tx)
+	tx.Signature = cr.signature()
+	return cr.err
+}
+
+// the part of the tx that is hashed and signed; everything but the signature
+func writeTxBody(cw *canonicalWriter, tx *Transaction) {
+	switch t := tx.TxInner.(type) {
+	case nil:
+		cw.byte(txInnerNone)
+	case *CollectionTx:
+		cw.byte(txInnerCollection)
+		cw.uint64(t.Fee)
+		cw.bytes(t.MetaData)
+		cw.uint16(t.Quantity)
+	case *MintTx:
+		cw.byte(txInnerMint)
+		cw.uint64(t.Fee)
+		cw.bytes(t.MetaData)
+		cw.bytes(t.CollectionOwner)
+		cw.signature(&t.Signature)
+		cw.hash(t.Collection)
+		cw.hash(t.NFT)
+	default:
+		cw.fail(fmt.Errorf("unsupported tx inner type %T", t))
+	}
+	cw.bytes(tx.Data)
+	cw.bytes(tx.From)
+	cw.bytes(tx.To)
+	cw.uint64(tx.Value)
+	cw.uint64(uint64(tx.Nonce))
+}
+
+func readTxBody(cr *canonicalReader, tx *Transaction) {
+	switch tag := cr.byte(); tag {
+	case txInnerNone:
+		tx.TxInner = nil
+	case txInnerCollection:
+		t := &CollectionTx{}
+		t.Fee = cr.uint64()
+		t.MetaData = cr.bytes()
+		t.Quantity = cr.uint16()
+		tx.TxInner = t
+	case txInnerMint:
+		t := &MintTx{}
+		t.Fee = cr.uint64()
+		t.MetaData = cr.bytes()
+		t.CollectionOwner = cr.bytes()
+		if sig := cr.signature(); sig != nil {
+			t.Signature = *sig
+		}
+		t.Collection = cr.hash()
+		t.NFT = cr.hash()
+		tx.TxInner = t
+	default:
+		cr.fail(fmt.Errorf("unknown tx inner tag %d", tag))
+	}
+	tx.Data = cr.bytes()
+	tx.From = cr.bytes()
+	tx.To = cr.bytes()
+	tx.Value = cr.uint64()
+	tx.Nonce = int64(cr.uint64())
+}
+
+// canonicalWriter keeps the first error so that a layout can be written out without checking every field
+type canonicalWriter struct {
+	w   io.Writer
+	err error
+	buf [8]byte
+}
+
+func (cw *canonicalWriter) fail(err error) {
+	if cw.err == nil {
+		cw.err = err
+	}
+}
+
+func (cw *canonicalWriter) write(b []byte) {
+	if cw.err != nil {
+		return
+	}
+	_, cw.err = cw.w.Write(b)
+}
+
+func (cw *canonicalWriter) byte(v byte) {
+	cw.buf[0] = v
+	cw.write(cw.buf[:1])
+}
+
+func (cw *canonicalWriter) uint16(v uint16) {
+	binary.BigEndian.PutUint16(cw.buf[:2], v)
+	cw.write(cw.buf[:2])
+}
+
+func (cw *canonicalWriter) uint32(v uint32) {
+	binary.BigEndian.PutUint32(cw.buf[:4], v)
+	cw.write(cw.buf[:4])
+}
+
+func (cw *canonicalWriter) uint64(v uint64) {
+	binary.BigEndian.PutUint64(cw.buf[:8], v)
+	cw.write(cw.buf[:8])
+}
+
+func (cw *canonicalWriter) hash(h core_types.Hash) {
+	cw.write(h[:])
+}
+
+func (cw *canonicalWriter) bytes(b []byte) {
+	if len(b) > maxCanonicalFieldSize {
+		cw.fail(fmt.Errorf("field of %d bytes exceeds the maximum of %d", len(b), maxCanonicalFieldSize))
+		return
+	}
+	cw.uint32(uint32(len(b)))
+	cw.write(b)
+}
+
+// a nil big.Int is written as an empty field and so is zero
+func (cw *canonicalWriter) bigInt(v *big.Int) {
+	if v == nil {
+		cw.bytes(nil)
+		return
+	}
+	if v.Sign() < 0 {
+		cw.fail(fmt.Errorf("negative big int can't be encoded"))
+		return
+	}
+	cw.bytes(v.Bytes())
+}
+
+func (cw *canonicalWriter) signature(sig *crypto_lib.Signature) {
+	if sig == nil || sig.R == nil || sig.S == nil {
+		cw.byte(0)
+		return
+	}
+	cw.byte(1)
+	cw.bigInt(sig.R)
+	cw.bigInt(sig.S)
+}
+
+type canonicalReader struct {
+	r   io.Reader
+	err error
+	buf [8]byte
+}
+
+func (cr *canonicalReader) fail(err error) {
+	if cr.err == nil {
+		cr.err = err
+	}
+}
+
+func (cr *canonicalReader) read(b []byte) {
+	if cr.err != nil {
+		return
+	}
+	_, cr.err = io.ReadFull(cr.r, b)
+}
+
+func (cr *canonicalReader) byte() byte {
+	cr.read(cr.buf[:1])
+	return cr.buf[0]
+}
+
+func (cr *canonicalReader) uint16() uint16 {
+	cr.read(cr.buf[:2])
+	return binary.BigEndian.Uint16(cr.buf[:2])
+}
+
+func (cr *canonicalReader) uint32() uint32 {
+	cr.read(cr.buf[:4])
+	return binary.BigEndian.Uint32(cr.buf[:4])
+}
+
+func (cr *canonicalReader) uint64() uint64 {
+	cr.read(cr.buf[:8])
+	return binary.BigEndian.Uint64(cr.buf[:8])
+}
+
+func (cr *canonicalReader) hash() core_types.Hash {
+	var h core_types.Hash
+	cr.read(h[:])
+	return h
+}
+
+// empty fields are decoded as nil, mirroring how nil slices are written
+func (cr *canonicalReader) bytes() []byte {
+	n := cr.uint32()
+	if cr.err != nil || n == 0 {
+		return nil
+	}
+	if n > maxCanonicalFieldSize {
+		cr.fail(fmt.Errorf("field of %d bytes exceeds the maximum of %d", n, maxCanonicalFieldSize))
+		return nil
+	}
+	b := make([]byte, n)
+	cr.read(b)
+	return b
+}
+
+func (cr *canonicalReader) bigInt() *big.Int {
+	b := cr.bytes()
+	if b == nil {
+		return nil
+	}
+	return new(big.Int).SetBytes(b)
+}
+
+func (cr *canonicalReader) signature() *crypto_lib.Signature {
+	if cr.byte() == 0 {
+		return nil
+	}
+	return &crypto_lib.Signature{R: cr.bigInt(), S: cr.bigInt()}
+}
@@ -3,7 +3,6 @@ package core
 import (
 	"bytes"
 	"crypto/sha256"
-	"encoding/binary"
 
 	"github.com/EggsyOnCode/xenolith/core_types"
 )
@@ -19,29 +18,40 @@ type BlockHasher struct{}
 
 // sha256 implementatin has been used
 // since the type itself is never used in  the implementation, we can use a receiver of type BlockHaser
+// a header without a canonical encoding (see Header.CheckFormat) hashes to the zero hash; use HashHeader to get the error
 func (BlockHasher) Hash(header *Header) core_types.Hash {
-	h := sha256.Sum256(header.Bytes())
-	return core_types.Hash(h)
+	h, _ := HashHeader(header)
+	return h
 }
 
-type TxHasher struct{}
+// HashHeader hashes the canonical encoding of the header; it fails for headers that have none e.g a negative target
+// signatures and the pow are checked against it so a header that can't be encoded never passes for a valid one
+func HashHeader(header *Header) (core_types.Hash, error) {
+	b, err := header.Bytes()
+	if err != nil {
+		return core_types.Hash{}, err
+	}
+	return core_types.Hash(sha256.Sum256(b)), nil
+}
 
-// Data any
-// value 8
-// / from 32
-// to 32
-// nonce 8
+type TxHasher struct{}
 
-// hash sepcific fields that make the tx unique
+// hashes the canonical encoding of the tx without its signature
+// i.e every field that the sender signs over
+// like BlockHasher a tx without a canonical encoding hashes to the zero hash; use HashTx to get the error
 func (TxHasher) Hash(tx *Transaction) core_types.Hash {
-	buf := new(bytes.Buffer)
+	h, _ := HashTx(tx)
+	return h
+}
 
-	binary.Write(buf, binary.LittleEndian, tx.To)
-	binary.Write(buf, binary.LittleEndian, tx.From)
-	binary.Write(buf, binary.LittleEndian, tx.Data)
-	binary.Write(buf, binary.LittleEndian, tx.Nonce)
-	binary.Write(buf, binary.LittleEndian, tx.Value)
+// HashTx is TxHasher.Hash returning the error of a tx that can't be encoded e.g one with a TxInner of an unknown type
+func HashTx(tx *Transaction) (core_types.Hash, error) {
+	buf := new(bytes.Buffer)
+	cw := &canonicalWriter{w: buf}
+	writeTxBody(cw, tx)
+	if cw.err != nil {
+		return core_types.Hash{}, cw.err
+	}
 
-	h := sha256.Sum256(buf.Bytes())
-	return core_types.Hash(h)
+	return core_types.Hash(sha256.Sum256(buf.Bytes())), nil
 }
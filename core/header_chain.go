@@ -0,0 +1,171 @@
+package core
+
+import (
+	"fmt"
+	"math/big"
+	"sync"
+
+	"github.com/EggsyOnCode/xenolith/core_types"
+)
+
+// HeaderChain is the chain as a light client keeps it: the verified headers from genesis up, without any tx
+// the headers carry the DataHash and StateRoot the proofs of tx and accounts are checked against
+// headers of competing forks are kept as well; the chain follows the branch with the most work
+type HeaderChain struct {
+	lock sync.RWMutex
+	// the headers of the branch followed, by height
+	headers []*SignedHeader
+	// every verified header, the ones of the other branches included
+	known map[core_types.Hash]*headerNode
+}
+
+type headerNode struct {
+	header *SignedHeader
+	// work of the branch from genesis up to and including this header
+	work *big.Int
+}
+
+func NewHeaderChain(genesis *SignedHeader) *HeaderChain {
+	return &HeaderChain{
+		headers: []*SignedHeader{genesis},
+		known: map[core_types.Hash]*headerNode{
+			genesis.Hash(): {header: genesis, work: headerWork(genesis.Header)},
+		},
+	}
+}
+
+// headerWork is the number of hashes it takes on average to get below the target of h; 2^256 / (target+1)
+// a header always counts for some work, even one with a target too easy to mean anything (e.g in tests)
+func headerWork(h *Header) *big.Int {
+	if h.Target == nil || h.Target.Sign() <= 0 {
+		return new(big.Int)
+	}
+	work := new(big.Int).Lsh(big.NewInt(1), 256)
+	work.Div(work, new(big.Int).Add(h.Target, big.NewInt(1)))
+	if work.Sign() == 0 {
+		work.SetInt64(1)
+	}
+	return work
+}
+
+func (hc *HeaderChain) Height() uint32 {
+	hc.lock.RLock()
+	defer hc.lock.RUnlock()
+	return uint32(len(hc.headers) - 1)
+}
+
+// GetHeaders returns the header at height; named like the one of Blockchain
+func (hc *HeaderChain) GetHeaders(height uint32) (*Header, error) {
+	h, err := hc.GetSignedHeader(height)
+	if err != nil {
+		return nil, err
+	}
+	return h.Header, nil
+}
+
+func (hc *HeaderChain) GetSignedHeader(height uint32) (*SignedHeader, error) {
+	hc.lock.RLock()
+	defer hc.lock.RUnlock()
+	if int(height) >= len(hc.headers) {
+		return nil, fmt.Errorf("header with height %v is too high", height)
+	}
+	return hc.headers[height], nil
+}
+
+// GetSignedHeaderByHash only finds the headers of the branch followed
+func (hc *HeaderChain) GetSignedHeaderByHash(hash core_types.Hash) (*SignedHeader, error) {
+	hc.lock.RLock()
+	defer hc.lock.RUnlock()
+	node, ok := hc.known[hash]
+	if !ok || !hc.isFollowed(node.header) {
+		return nil, fmt.Errorf("header with hash (%s) not found", hash)
+	}
+	return node.header, nil
+}
+
+// AddHeaders verifies the headers (see VerifyHeaderChain) and adds them on top of the header they link to
+// leading headers we have already are skipped; the rest can extend any header we know, not only the head
+// the chain switches over once a branch has more work than the one followed
+func (hc *HeaderChain) AddHeaders(headers []*SignedHeader) error {
+	hc.lock.Lock()
+	defer hc.lock.Unlock()
+
+	for len(headers) > 0 && headers[0].Header != nil {
+		if _, ok := hc.known[headers[0].Hash()]; !ok {
+			break
+		}
+		headers = headers[1:]
+	}
+	if len(headers) == 0 {
+		return nil
+	}
+	if headers[0].Header == nil {
+		return fmt.Errorf("header missing")
+	}
+
+	parent, ok := hc.known[headers[0].Header.PrevBlockHash]
+	if !ok {
+		return fmt.Errorf("%w: parent (%s) of header (%d) unknown", ErrHeaderNotLinked, headers[0].Header.PrevBlockHash, headers[0].Header.Height)
+	}
+	if err := VerifyHeaderChain(parent.header.Header, headers, hc.branchHeader(parent.header)); err != nil {
+		return err
+	}
+
+	tip := parent
+	for _, h := range headers {
+		tip = &headerNode{
+			header: h,
+			work:   new(big.Int).Add(tip.work, headerWork(h.Header)),
+		}
+		hc.known[h.Hash()] = tip
+	}
+
+	head := hc.known[hc.headers[len(hc.headers)-1].Hash()]
+	if tip.work.Cmp(head.work) > 0 {
+		hc.switchTo(tip.header)
+	}
+	return nil
+}
+
+// switchTo makes the branch ending in tip the one followed; the headers above the fork point are replaced
+func (hc *HeaderChain) switchTo(tip *SignedHeader) {
+	branch := []*SignedHeader{}
+	for h := tip; !hc.isFollowed(h); h = hc.known[h.Header.PrevBlockHash].header {
+		branch = append(branch, h)
+	}
+	forkHeight := tip.Header.Height - uint32(len(branch))
+
+	hc.headers = hc.headers[:forkHeight+1]
+	for i := len(branch) - 1; i >= 0; i-- {
+		hc.headers = append(hc.headers, branch[i])
+	}
+}
+
+func (hc *HeaderChain) isFollowed(h *SignedHeader) bool {
+	height := int(h.Header.Height)
+	return height < len(hc.headers) && hc.headers[height] == h
+}
+
+// branchHeader looks up the headers below tip on its own branch; the targets of a branch depend on its own headers
+func (hc *HeaderChain) branchHeader(tip *SignedHeader) func(uint32) (*Header, error) {
+	return func(height uint32) (*Header, error) {
+		if height > tip.Header.Height {
+			return nil, fmt.Errorf("header with height %v is too high", height)
+		}
+		h := tip
+		for h.Header.Height > height && !hc.isFollowed(h) {
+			h = hc.known[h.Header.PrevBlockHash].header
+		}
+		if hc.isFollowed(h) {
+			return hc.getHeaderWithoutLock(height)
+		}
+		return h.Header, nil
+	}
+}
+
+func (hc *HeaderChain) getHeaderWithoutLock(height uint32) (*Header, error) {
+	if int(height) >= len(hc.headers) {
+		return nil, fmt.Errorf("header with height %v is too high", height)
+	}
+	return hc.headers[height].Header, nil
+}
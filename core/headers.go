@@ -0,0 +1,150 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/EggsyOnCode/xenolith/core_types"
+	"github.com/EggsyOnCode/xenolith/crypto_lib"
+)
+
+// the first header of a chain doesn't attach to the header it is checked against
+// unlike the other header errors this isn't necessarily the sender's fault; e.g it could be following a fork
+var ErrHeaderNotLinked = errors.New("header does not link to the parent")
+
+// SignedHeader is the header of a block along with the validator signature over it
+// it is everything needed to check a chain of headers without the tx of the blocks
+type SignedHeader struct {
+	Header    *Header
+	Validator crypto_lib.PublicKey
+	Signature *crypto_lib.Signature
+}
+
+func (b *Block) SignedHeader() *SignedHeader {
+	return &SignedHeader{
+		Header:    b.Header,
+		Validator: b.Validator,
+		Signature: b.Signature,
+	}
+}
+
+func (h *SignedHeader) Hash() core_types.Hash {
+	return BlockHasher{}.Hash(h.Header)
+}
+
+// Verify checks the validator signature and the pow of the header
+func (h *SignedHeader) Verify() error {
+	if h.Header == nil {
+		return fmt.Errorf("header missing")
+	}
+	if h.Signature == nil || h.Validator == nil {
+		return fmt.Errorf("header (%d) not signed", h.Header.Height)
+	}
+	// nothing is hashed before the header is known to have an encoding and a usable target
+	if err := h.Header.CheckFormat(); err != nil {
+		return err
+	}
+	hash := h.Hash()
+	if !h.Signature.Verify(hash.ToSlice(), h.Validator) {
+		return fmt.Errorf("header (%d) has an invalid signature", h.Header.Height)
+	}
+
+	return h.Header.CheckPoW()
+}
+
+// CheckPoW checks that the hash of the header is below its target and that NBits encodes that target
+func (h *Header) CheckPoW() error {
+	if h.Target == nil || h.Target.Sign() <= 0 {
+		return fmt.Errorf("header (%d) has no target", h.Height)
+	}
+	if targetToCompact(h.Target) != h.NBits {
+		return fmt.Errorf("header (%d) nbits (%d) don't match its target", h.Height, h.NBits)
+	}
+
+	hash, err := HashHeader(h)
+	if err != nil {
+		return err
+	}
+	if isLowerThanTarget(new(big.Int).SetBytes(hash[:]), h.Target) != -1 {
+		return fmt.Errorf("header (%d) hash (%s) is not below its target", h.Height, hash)
+	}
+
+	return nil
+}
+
+// VerifyHeaderChain checks that the headers extend parent one after the other
+// every header has to link to the one before it, carry a valid pow with the target MineBlock would have used and be signed
+// getHeader looks up headers below the ones being checked; the target of a retarget height depends on them
+func VerifyHeaderChain(parent *Header, headers []*SignedHeader, getHeader func(uint32) (*Header, error)) error {
+	for i, h := range headers {
+		if h.Header == nil {
+			return fmt.Errorf("header missing")
+		}
+		if h.Header.Height != parent.Height+1 || h.Header.PrevBlockHash != (BlockHasher{}).Hash(parent) {
+			if i == 0 {
+				return fmt.Errorf("%w: header (%d) does not follow (%d)", ErrHeaderNotLinked, h.Header.Height, parent.Height)
+			}
+			return fmt.Errorf("header (%d) does not follow (%d)", h.Header.Height, parent.Height)
+		}
+		if err := h.Verify(); err != nil {
+			return err
+		}
+
+		expected, err := expectedTarget(parent, func(height uint32) (*Header, error) {
+			// the headers checked so far can be looked up as well
+			if first := headers[0].Header.Height; height >= first && height < h.Header.Height {
+				return headers[height-first].Header, nil
+			}
+			return getHeader(height)
+		})
+		if err != nil {
+			return err
+		}
+		if expected.Cmp(h.Header.Target) != 0 {
+			return fmt.Errorf("header (%d) target %x, expected %x", h.Header.Height, h.Header.Target, expected)
+		}
+
+		parent = h.Header
+	}
+
+	return nil
+}
+
+// expectedTarget is the target of the block on top of parent
+// the target only changes every HEIGHT_DIVISOR blocks and stays the one of the parent in between
+func expectedTarget(parent *Header, getHeader func(uint32) (*Header, error)) (*big.Int, error) {
+	if parent.Height == 0 || parent.Height%HEIGHT_DIVISOR != 0 {
+		// a genesis block without a target of its own starts the chain at TARGET_GENESIS
+		if parent.Target == nil {
+			return genesisTarget(), nil
+		}
+		return parent.Target, nil
+	}
+
+	compHeight := parent.Height - HEIGHT_DIVISOR
+	if compHeight == 0 {
+		compHeight = 1
+	}
+	comp, err := getHeader(compHeight)
+	if err != nil {
+		return nil, err
+	}
+
+	return nextTarget(parent, comp), nil
+}
+
+func genesisTarget() *big.Int {
+	target, _ := new(big.Int).SetString(TARGET_GENESIS, 0)
+	return target
+}
+
+// nextTarget scales the target of parent by the time the last HEIGHT_DIVISOR blocks took compared to AVG_TARGET_TIME
+func nextTarget(parent, comp *Header) *big.Int {
+	timeDiff := parent.Timestamp - comp.Timestamp
+	target := compactToTarget(parent.NBits)
+	target.Mul(target, new(big.Int).SetUint64(timeDiff))
+	target.Div(target, new(big.Int).SetUint64(AVG_TARGET_TIME))
+
+	return target
+}
@@ -0,0 +1,184 @@
+package core
+
+import (
+	"fmt"
+	"math/big"
+	"testing"
+
+	"github.com/EggsyOnCode/xenolith/crypto_lib"
+	"github.com/stretchr/testify/assert"
+)
+
+// half of all hashes are below it so mining is quick
+var minedTarget = new(big.Int).Lsh(big.NewInt(1), 255)
+
+// mines and signs a header on top of parent
+func minedHeader(t *testing.T, parent *Header, priv *crypto_lib.PrivateKey) *SignedHeader {
+	return minedHeaderAt(t, parent, parent.Timestamp+1, priv)
+}
+
+// headers of competing forks on top of the same parent differ by their timestamp
+func minedHeaderAt(t *testing.T, parent *Header, timestamp uint64, priv *crypto_lib.PrivateKey) *SignedHeader {
+	header := &Header{
+		Version:       1,
+		Height:        parent.Height + 1,
+		PrevBlockHash: BlockHasher{}.Hash(parent),
+		Timestamp:     timestamp,
+		Target:        minedTarget,
+		NBits:         targetToCompact(minedTarget),
+	}
+	for header.CheckPoW() != nil {
+		header.Nonce++
+	}
+
+	block := NewBlock(header, nil)
+	assert.Nil(t, block.Sign(priv))
+	return block.SignedHeader()
+}
+
+func minedHeaderChain(t *testing.T, n int) (*Header, []*SignedHeader) {
+	priv := crypto_lib.GeneratePrivateKey()
+	genesis := &Header{Version: 1, Target: minedTarget}
+	headers := []*SignedHeader{}
+	parent := genesis
+	for i := 0; i < n; i++ {
+		h := minedHeader(t, parent, priv)
+		headers = append(headers, h)
+		parent = h.Header
+	}
+	return genesis, headers
+}
+
+func noHeader(height uint32) (*Header, error) {
+	return nil, fmt.Errorf("no header at height (%d)", height)
+}
+
+func TestVerifyHeaderChain(t *testing.T) {
+	genesis, headers := minedHeaderChain(t, 3)
+	assert.Nil(t, VerifyHeaderChain(genesis, headers, noHeader))
+
+	// the first header not attaching to the parent isn't necessarily the sender's fault
+	err := VerifyHeaderChain(headers[0].Header, headers[1:], noHeader)
+	assert.Nil(t, err)
+	err = VerifyHeaderChain(headers[1].Header, headers, noHeader)
+	assert.ErrorIs(t, err, ErrHeaderNotLinked)
+
+	// a gap inside the chain is
+	err = VerifyHeaderChain(genesis, []*SignedHeader{headers[0], headers[2]}, noHeader)
+	assert.NotNil(t, err)
+	assert.NotErrorIs(t, err, ErrHeaderNotLinked)
+}
+
+func TestVerifyHeaderChainRejectsTamperedHeader(t *testing.T) {
+	genesis, headers := minedHeaderChain(t, 2)
+
+	tampered := *headers[1].Header
+	tampered.StateRoot[0]++
+	headers[1] = &SignedHeader{Header: &tampered, Validator: headers[1].Validator, Signature: headers[1].Signature}
+	assert.NotNil(t, VerifyHeaderChain(genesis, headers, noHeader))
+}
+
+func TestVerifyHeaderChainRejectsTargetChange(t *testing.T) {
+	genesis, headers := minedHeaderChain(t, 1)
+
+	// an easier target outside of a retarget height
+	priv := crypto_lib.GeneratePrivateKey()
+	easy := new(big.Int).Lsh(big.NewInt(1), 256)
+	header := &Header{
+		Version:       1,
+		Height:        2,
+		PrevBlockHash: headers[0].Hash(),
+		Timestamp:     headers[0].Header.Timestamp + 1,
+		Target:        easy,
+		NBits:         targetToCompact(easy),
+	}
+	block := NewBlock(header, nil)
+	assert.Nil(t, block.Sign(priv))
+	headers = append(headers, block.SignedHeader())
+
+	assert.NotNil(t, VerifyHeaderChain(genesis, headers, noHeader))
+}
+
+// a genesis block without a target doesn't leave the target of the first block up to its miner
+func TestVerifyHeaderChainGenesisTarget(t *testing.T) {
+	genesis := &Header{Version: 1}
+	header := minedHeader(t, genesis, crypto_lib.GeneratePrivateKey())
+	assert.NotNil(t, VerifyHeaderChain(genesis, []*SignedHeader{header}, noHeader))
+
+	expected, err := expectedTarget(genesis, noHeader)
+	assert.Nil(t, err)
+	assert.Equal(t, genesisTarget(), expected)
+}
+
+func TestCheckPoW(t *testing.T) {
+	_, headers := minedHeaderChain(t, 1)
+	header := *headers[0].Header
+	assert.Nil(t, header.CheckPoW())
+
+	header.NBits++
+	assert.NotNil(t, header.CheckPoW())
+
+	header.Target = big.NewInt(1)
+	header.NBits = targetToCompact(header.Target)
+	assert.NotNil(t, header.CheckPoW())
+}
+
+func TestHeaderChainTakesVerifiedHeaders(t *testing.T) {
+	genesis, headers := minedHeaderChain(t, 3)
+	hc := NewHeaderChain(&SignedHeader{Header: genesis})
+	assert.Nil(t, hc.AddHeaders(headers[:2]))
+	assert.Equal(t, uint32(2), hc.Height())
+
+	// the ones we have already are skipped
+	assert.Nil(t, hc.AddHeaders(headers))
+	assert.Equal(t, uint32(3), hc.Height())
+	h, err := hc.GetSignedHeaderByHash(headers[1].Hash())
+	assert.Nil(t, err)
+	assert.Equal(t, headers[1], h)
+	_, err = hc.GetHeaders(4)
+	assert.NotNil(t, err)
+
+	// a header whose parent we don't know is rejected
+	other := minedHeader(t, &Header{Version: 2, Height: 3}, crypto_lib.GeneratePrivateKey())
+	assert.ErrorIs(t, hc.AddHeaders([]*SignedHeader{other}), ErrHeaderNotLinked)
+	assert.Equal(t, uint32(3), hc.Height())
+}
+
+func TestHeaderChainFollowsMostWork(t *testing.T) {
+	genesis, headers := minedHeaderChain(t, 3)
+	hc := NewHeaderChain(&SignedHeader{Header: genesis})
+	assert.Nil(t, hc.AddHeaders(headers))
+
+	// a fork off the first header; as long as our chain, which isn't enough to switch
+	priv := crypto_lib.GeneratePrivateKey()
+	fork := []*SignedHeader{minedHeaderAt(t, headers[0].Header, 100, priv)}
+	fork = append(fork, minedHeader(t, fork[0].Header, priv))
+	assert.Nil(t, hc.AddHeaders(fork))
+	assert.Equal(t, uint32(3), hc.Height())
+	head, err := hc.GetSignedHeader(3)
+	assert.Nil(t, err)
+	assert.Equal(t, headers[2], head)
+	_, err = hc.GetSignedHeaderByHash(fork[1].Hash())
+	assert.NotNil(t, err)
+
+	// one more header and the fork has more work
+	fork = append(fork, minedHeader(t, fork[1].Header, priv))
+	assert.Nil(t, hc.AddHeaders(fork[2:]))
+	assert.Equal(t, uint32(4), hc.Height())
+	for i, h := range append([]*SignedHeader{headers[0]}, fork...) {
+		got, err := hc.GetSignedHeader(uint32(i + 1))
+		assert.Nil(t, err)
+		assert.Equal(t, h, got)
+	}
+	_, err = hc.GetSignedHeaderByHash(headers[2].Hash())
+	assert.NotNil(t, err)
+
+	// and back once the old branch overtakes it again
+	back := []*SignedHeader{minedHeader(t, headers[2].Header, priv)}
+	back = append(back, minedHeader(t, back[0].Header, priv))
+	assert.Nil(t, hc.AddHeaders(back))
+	assert.Equal(t, uint32(5), hc.Height())
+	head, err = hc.GetSignedHeader(3)
+	assert.Nil(t, err)
+	assert.Equal(t, headers[2], head)
+}
@@ -0,0 +1,125 @@
+package core
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"math/bits"
+
+	"github.com/EggsyOnCode/xenolith/core_types"
+)
+
+// domain separation between leaves and inner nodes of the tx merkle tree
+const (
+	txLeafPrefix = 0x00
+	txNodePrefix = 0x01
+)
+
+// TxProof proves that a tx is part of the block whose header carries the DataHash
+// the path holds the sibling hashes from the leaf up to the root
+type TxProof struct {
+	Index uint32
+	Total uint32
+	Path  []core_types.Hash
+}
+
+// CalculateDataHash is the root of the binary merkle tree over the TxHasher hashes of the tx
+// the tree follows RFC 6962: an unbalanced tree is split at the largest power of two below its size
+// so no leaf is ever duplicated
+func CalculateDataHash(txx []*Transaction) (hash core_types.Hash, err error) {
+	return merkleRoot(txLeaves(txx)), nil
+}
+
+// BuildTxProof returns the inclusion proof of the tx with txHash in b
+func BuildTxProof(b *Block, txHash core_types.Hash) (*TxProof, error) {
+	leaves := txLeaves(b.Transactions)
+	for i, tx := range b.Transactions {
+		if tx.Hash(TxHasher{}) != txHash {
+			continue
+		}
+		return &TxProof{
+			Index: uint32(i),
+			Total: uint32(len(leaves)),
+			Path:  merklePath(leaves, i),
+		}, nil
+	}
+
+	return nil, fmt.Errorf("tx (%s) not found in block (%s)", txHash, b.Hash(BlockHasher{}))
+}
+
+// VerifyTxProof checks that the tx with txHash is included under dataHash
+func VerifyTxProof(dataHash core_types.Hash, txHash core_types.Hash, proof *TxProof) bool {
+	if proof == nil || proof.Index >= proof.Total {
+		return false
+	}
+
+	node := txLeafHash(txHash)
+	index, last := proof.Index, proof.Total-1
+	path := proof.Path
+	// walking up RFC 6962 style; a node without a right sibling is carried up as is
+	for last > 0 {
+		if index%2 == 1 || index < last {
+			if len(path) == 0 {
+				return false
+			}
+			if index%2 == 1 {
+				node = txNodeHash(path[0], node)
+			} else {
+				node = txNodeHash(node, path[0])
+			}
+			path = path[1:]
+		}
+		index /= 2
+		last /= 2
+	}
+
+	return len(path) == 0 && node == dataHash
+}
+
+func txLeaves(txx []*Transaction) []core_types.Hash {
+	leaves := make([]core_types.Hash, len(txx))
+	for i, tx := range txx {
+		leaves[i] = txLeafHash(tx.Hash(TxHasher{}))
+	}
+	return leaves
+}
+
+func merkleRoot(leaves []core_types.Hash) core_types.Hash {
+	switch len(leaves) {
+	case 0:
+		return sha256.Sum256(nil)
+	case 1:
+		return leaves[0]
+	}
+
+	k := splitPoint(len(leaves))
+	return txNodeHash(merkleRoot(leaves[:k]), merkleRoot(leaves[k:]))
+}
+
+func merklePath(leaves []core_types.Hash, index int) []core_types.Hash {
+	if len(leaves) <= 1 {
+		return nil
+	}
+
+	k := splitPoint(len(leaves))
+	if index < k {
+		return append(merklePath(leaves[:k], index), merkleRoot(leaves[k:]))
+	}
+	return append(merklePath(leaves[k:], index-k), merkleRoot(leaves[:k]))
+}
+
+// largest power of two strictly smaller than n
+func splitPoint(n int) int {
+	return 1 << (bits.Len(uint(n-1)) - 1)
+}
+
+func txLeafHash(txHash core_types.Hash) core_types.Hash {
+	return sha256.Sum256(append([]byte{txLeafPrefix}, txHash[:]...))
+}
+
+func txNodeHash(left, right core_types.Hash) core_types.Hash {
+	buf := make([]byte, 0, 1+64)
+	buf = append(buf, txNodePrefix)
+	buf = append(buf, left[:]...)
+	buf = append(buf, right[:]...)
+	return sha256.Sum256(buf)
+}
@@ -0,0 +1,56 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/EggsyOnCode/xenolith/core_types"
+	"github.com/stretchr/testify/assert"
+)
+
+func blockWithTxs(t *testing.T, n int) *Block {
+	b := randomBlock(t, 1, core_types.Hash{})
+	for i := 1; i < n; i++ {
+		assert.Nil(t, b.AddTx(randomTxWithSignature(t)))
+	}
+	return b
+}
+
+func TestDataHashIsMerkleRoot(t *testing.T) {
+	b := blockWithTxs(t, 3)
+	leaves := txLeaves(b.Transactions)
+	root := txNodeHash(txNodeHash(leaves[0], leaves[1]), leaves[2])
+	assert.Equal(t, root, b.Header.DataHash)
+
+	// reordering the tx changes the root
+	b.Transactions[0], b.Transactions[1] = b.Transactions[1], b.Transactions[0]
+	dataHash, err := CalculateDataHash(b.Transactions)
+	assert.Nil(t, err)
+	assert.NotEqual(t, b.Header.DataHash, dataHash)
+}
+
+func TestTxProof(t *testing.T) {
+	for n := 1; n <= 9; n++ {
+		b := blockWithTxs(t, n)
+		for i, tx := range b.Transactions {
+			txHash := tx.Hash(TxHasher{})
+			proof, err := BuildTxProof(b, txHash)
+			assert.Nil(t, err)
+			assert.Equal(t, uint32(i), proof.Index)
+			assert.True(t, VerifyTxProof(b.Header.DataHash, txHash, proof))
+
+			// the proof must not hold for another tx or another position
+			assert.False(t, VerifyTxProof(b.Header.DataHash, randomTxWithSignature(t).Hash(TxHasher{}), proof))
+			if n > 1 {
+				moved := *proof
+				moved.Index = (proof.Index + 1) % proof.Total
+				assert.False(t, VerifyTxProof(b.Header.DataHash, txHash, &moved))
+			}
+		}
+	}
+}
+
+func TestTxProofForMissingTx(t *testing.T) {
+	b := blockWithTxs(t, 2)
+	_, err := BuildTxProof(b, randomTxWithSignature(t).Hash(TxHasher{}))
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,124 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/EggsyOnCode/xenolith/core_types"
+)
+
+// a snapshot is written every this many blocks and when the chain is closed
+const snapshotInterval = 100
+
+// returned by the stores that hold no snapshot yet
+var ErrSnapshotNotFound = errors.New("state snapshot not found in store")
+
+// StateSnapshot is the state of the chain as of the block with BlockHash
+// a chain reopened from its store starts from it and only replays the blocks above it
+type StateSnapshot struct {
+	Height    uint32
+	BlockHash core_types.Hash
+	Accounts  []Account
+	Contract  map[string][]byte
+	// the tx applied to the state; the tx themselves are in the blocks
+	Txs         []core_types.Hash
+	Collections map[core_types.Hash]*CollectionTx
+	Mints       map[core_types.Hash]*MintTx
+}
+
+// snapshot of the state as of the head of the chain; insertLock has to be held so the head doesn't move
+func (bc *Blockchain) snapshot() *StateSnapshot {
+	bc.stateLock.RLock()
+	defer bc.stateLock.RUnlock()
+
+	s := &StateSnapshot{
+		Height:      bc.block.Header.Height,
+		BlockHash:   bc.block.Hash(BlockHasher{}),
+		Contract:    bc.contractState.Copy().data,
+		Collections: make(map[core_types.Hash]*CollectionTx, len(bc.collectionStore)),
+		Mints:       make(map[core_types.Hash]*MintTx, len(bc.mintStore)),
+	}
+	for _, account := range bc.accountState.Copy().accounts {
+		s.Accounts = append(s.Accounts, *account)
+	}
+	for hash := range bc.txStore {
+		s.Txs = append(s.Txs, hash)
+	}
+	for k, v := range bc.collectionStore {
+		s.Collections[k] = v
+	}
+	for k, v := range bc.mintStore {
+		s.Mints[k] = v
+	}
+	return s
+}
+
+// putSnapshot stores the snapshot of the head of the chain; insertLock has to be held
+// the genesis block commits to no state, so there is nothing a snapshot of it could be checked against
+func (bc *Blockchain) putSnapshot() error {
+	if bc.block.Header.Height == 0 {
+		return nil
+	}
+	return bc.store.PutSnapshot(bc.snapshot())
+}
+
+// restoreSnapshot sets the state to the one of s, if s is the state of a block on the chain
+// the state is checked against the root the block commits to before anything is changed
+func (bc *Blockchain) restoreSnapshot(s *StateSnapshot) error {
+	b, err := bc.GetBlock(s.Height)
+	if err != nil {
+		return err
+	}
+	if hash := b.Hash(BlockHasher{}); hash != s.BlockHash {
+		return fmt.Errorf("snapshot of block (%s) at height %d, the chain has (%s)", s.BlockHash, s.Height, hash)
+	}
+
+	accounts := NewAccountState()
+	for _, account := range s.Accounts {
+		account := account
+		accounts.accounts[account.Address] = &account
+	}
+	contract := NewState()
+	for k, v := range s.Contract {
+		contract.data[k] = append([]byte{}, v...)
+	}
+	if root := CalculateStateRoot(accounts, contract); root != b.Header.StateRoot {
+		return fmt.Errorf("snapshot at height %d has state root (%s), block commits to (%s)", s.Height, root, b.Header.StateRoot)
+	}
+
+	applied := make(map[core_types.Hash]bool, len(s.Txs))
+	for _, hash := range s.Txs {
+		applied[hash] = true
+	}
+	txStore := make(map[core_types.Hash]*Transaction, len(s.Txs))
+	for height := uint32(0); height <= s.Height; height++ {
+		b, err := bc.GetBlock(height)
+		if err != nil {
+			return err
+		}
+		for _, tx := range b.Transactions {
+			if hash := tx.Hash(TxHasher{}); applied[hash] {
+				txStore[hash] = tx
+			}
+		}
+	}
+
+	// the snapshot stays as it is; a memory store hands out the very one it was given
+	collections := make(map[core_types.Hash]*CollectionTx, len(s.Collections))
+	for k, v := range s.Collections {
+		collections[k] = v
+	}
+	mints := make(map[core_types.Hash]*MintTx, len(s.Mints))
+	for k, v := range s.Mints {
+		mints[k] = v
+	}
+
+	bc.stateLock.Lock()
+	defer bc.stateLock.Unlock()
+	bc.accountState = accounts
+	bc.contractState = contract
+	bc.txStore = txStore
+	bc.collectionStore = collections
+	bc.mintStore = mints
+	return nil
+}
@@ -14,6 +14,15 @@ func NewState() *State {
 	}
 }
 
+// Copy returns a copy of the state that can be changed without affecting s
+func (s *State) Copy() *State {
+	c := NewState()
+	for k, v := range s.data {
+		c.data[k] = append([]byte{}, v...)
+	}
+	return c
+}
+
 func (s *State) Put(k, value []byte) error {
 	s.data[string(k)] = value
 	return nil
@@ -0,0 +1,246 @@
+package core
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"sort"
+
+	"github.com/EggsyOnCode/xenolith/core_types"
+)
+
+const (
+	stateTreeDepth = 256
+
+	// domain separation between the two kinds of nodes in the tree
+	stateLeafPrefix = 0x00
+	stateNodePrefix = 0x01
+
+	// domain separation between the two kinds of keys in the tree
+	accountKeyPrefix  = 0x00
+	contractKeyPrefix = 0x01
+)
+
+// StateTree is a compact sparse merkle tree over 256 bit keys
+// an empty subtree hashes to the zero hash and a subtree holding a single leaf
+// is collapsed into that leaf, so only the populated paths are ever hashed
+type StateTree struct {
+	leaves map[core_types.Hash]core_types.Hash
+	// cached root; reset whenever a leaf changes
+	root *core_types.Hash
+}
+
+// StateProof proves the value (or the absence) of a key against a state root
+// siblings are ordered from the root downwards
+type StateProof struct {
+	Siblings []core_types.Hash
+	// set when the key is absent but its path ends in the leaf of another key
+	OtherKey       *core_types.Hash
+	OtherValueHash core_types.Hash
+}
+
+// AccountProof is the balance of an account along with the proof of it against the state root of the block at Height
+type AccountProof struct {
+	Address core_types.Address
+	Height  uint32
+	// false if there is no such account; the proof then proves its absence
+	Exists  bool
+	Balance uint64
+	Proof   *StateProof
+}
+
+// Verify checks the proof against the state root of the header at Height
+func (p *AccountProof) Verify(root core_types.Hash) bool {
+	if p.Proof == nil {
+		return false
+	}
+	var value []byte
+	if p.Exists {
+		value = EncodeAccountValue(&Account{Address: p.Address, Balance: p.Balance})
+	}
+	return VerifyStateProof(root, AccountStateKey(p.Address), value, p.Proof)
+}
+
+func NewStateTree() *StateTree {
+	return &StateTree{
+		leaves: make(map[core_types.Hash]core_types.Hash),
+	}
+}
+
+// NewStateTreeFromState builds the tree committing to the accounts and the contract storage
+func NewStateTreeFromState(accounts *AccountState, contract *State) *StateTree {
+	t := NewStateTree()
+
+	accounts.mu.RLock()
+	for addr, account := range accounts.accounts {
+		t.Update(AccountStateKey(addr), EncodeAccountValue(account))
+	}
+	accounts.mu.RUnlock()
+
+	for k, v := range contract.data {
+		t.Update(ContractStateKey([]byte(k)), v)
+	}
+
+	return t
+}
+
+// CalculateStateRoot is the root of the state tree committing to the account state and the contract state
+// every node executing the same blocks ends up with the same root
+func CalculateStateRoot(accounts *AccountState, contract *State) core_types.Hash {
+	return NewStateTreeFromState(accounts, contract).Root()
+}
+
+// AccountStateKey is the key under which an account is committed in the state tree
+func AccountStateKey(addr core_types.Address) core_types.Hash {
+	return sha256.Sum256(append([]byte{accountKeyPrefix}, addr[:]...))
+}
+
+// ContractStateKey is the key under which a contract storage slot is committed in the state tree
+func ContractStateKey(key []byte) core_types.Hash {
+	return sha256.Sum256(append([]byte{contractKeyPrefix}, key...))
+}
+
+// the value committed for an account is its balance
+func EncodeAccountValue(account *Account) []byte {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, account.Balance)
+	return buf
+}
+
+// Update sets the value of key; a nil value removes the key
+func (t *StateTree) Update(key core_types.Hash, value []byte) {
+	t.root = nil
+	if value == nil {
+		delete(t.leaves, key)
+		return
+	}
+	t.leaves[key] = sha256.Sum256(value)
+}
+
+func (t *StateTree) Root() core_types.Hash {
+	if t.root == nil {
+		root := t.subtreeHash(t.sortedKeys(), 0)
+		t.root = &root
+	}
+	return *t.root
+}
+
+// Prove returns the proof for key; it proves absence if the key is not in the tree
+func (t *StateTree) Prove(key core_types.Hash) *StateProof {
+	proof := &StateProof{}
+	keys := t.sortedKeys()
+
+	for depth := 0; len(keys) > 1; depth++ {
+		left, right := splitKeys(keys, depth)
+		if bitAt(key, depth) == 0 {
+			proof.Siblings = append(proof.Siblings, t.subtreeHash(right, depth+1))
+			keys = left
+		} else {
+			proof.Siblings = append(proof.Siblings, t.subtreeHash(left, depth+1))
+			keys = right
+		}
+	}
+
+	if len(keys) == 1 && keys[0] != key {
+		other := keys[0]
+		proof.OtherKey = &other
+		proof.OtherValueHash = t.leaves[other]
+	}
+
+	return proof
+}
+
+// VerifyStateProof checks that key holds value under root; a nil value checks that the key is absent
+func VerifyStateProof(root core_types.Hash, key core_types.Hash, value []byte, proof *StateProof) bool {
+	depth := len(proof.Siblings)
+	if depth > stateTreeDepth {
+		return false
+	}
+
+	var node core_types.Hash
+	switch {
+	case value != nil:
+		if proof.OtherKey != nil {
+			return false
+		}
+		node = stateLeafHash(key, sha256.Sum256(value))
+	case proof.OtherKey != nil:
+		// the other leaf has to sit on the path of key for the proof to say anything about key
+		if *proof.OtherKey == key || !sharesPrefix(*proof.OtherKey, key, depth) {
+			return false
+		}
+		node = stateLeafHash(*proof.OtherKey, proof.OtherValueHash)
+	}
+
+	for i := depth - 1; i >= 0; i-- {
+		if bitAt(key, i) == 0 {
+			node = stateNodeHash(node, proof.Siblings[i])
+		} else {
+			node = stateNodeHash(proof.Siblings[i], node)
+		}
+	}
+
+	return node == root
+}
+
+func (t *StateTree) sortedKeys() []core_types.Hash {
+	keys := make([]core_types.Hash, 0, len(t.leaves))
+	for k := range t.leaves {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return bytes.Compare(keys[i][:], keys[j][:]) < 0
+	})
+	return keys
+}
+
+// keys are sorted and share their first depth bits
+func (t *StateTree) subtreeHash(keys []core_types.Hash, depth int) core_types.Hash {
+	switch len(keys) {
+	case 0:
+		return core_types.Hash{}
+	case 1:
+		return stateLeafHash(keys[0], t.leaves[keys[0]])
+	}
+
+	left, right := splitKeys(keys, depth)
+	return stateNodeHash(t.subtreeHash(left, depth+1), t.subtreeHash(right, depth+1))
+}
+
+// splits sorted keys on the bit at depth
+func splitKeys(keys []core_types.Hash, depth int) ([]core_types.Hash, []core_types.Hash) {
+	i := sort.Search(len(keys), func(i int) bool {
+		return bitAt(keys[i], depth) == 1
+	})
+	return keys[:i], keys[i:]
+}
+
+func stateLeafHash(key core_types.Hash, valueHash core_types.Hash) core_types.Hash {
+	buf := make([]byte, 0, 1+64)
+	buf = append(buf, stateLeafPrefix)
+	buf = append(buf, key[:]...)
+	buf = append(buf, valueHash[:]...)
+	return sha256.Sum256(buf)
+}
+
+func stateNodeHash(left, right core_types.Hash) core_types.Hash {
+	buf := make([]byte, 0, 1+64)
+	buf = append(buf, stateNodePrefix)
+	buf = append(buf, left[:]...)
+	buf = append(buf, right[:]...)
+	return sha256.Sum256(buf)
+}
+
+// bit of h at depth, counting from the most significant bit
+func bitAt(h core_types.Hash, depth int) byte {
+	return (h[depth/8] >> (7 - uint(depth%8))) & 1
+}
+
+func sharesPrefix(a, b core_types.Hash, depth int) bool {
+	for i := 0; i < depth; i++ {
+		if bitAt(a, i) != bitAt(b, i) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,88 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/EggsyOnCode/xenolith/core_types"
+	"github.com/EggsyOnCode/xenolith/crypto_lib"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStateTreeRootIsOrderIndependent(t *testing.T) {
+	keys := []core_types.Hash{}
+	for i := 0; i < 50; i++ {
+		keys = append(keys, core_types.GenerateRandomHash(32))
+	}
+
+	a := NewStateTree()
+	for _, k := range keys {
+		a.Update(k, k[:])
+	}
+	b := NewStateTree()
+	for i := len(keys) - 1; i >= 0; i-- {
+		b.Update(keys[i], keys[i][:])
+	}
+	assert.Equal(t, a.Root(), b.Root())
+
+	// removing a key gives back the root of the tree without it
+	c := NewStateTree()
+	for _, k := range keys[1:] {
+		c.Update(k, k[:])
+	}
+	a.Update(keys[0], nil)
+	assert.Equal(t, c.Root(), a.Root())
+	assert.Equal(t, core_types.Hash{}, NewStateTree().Root())
+}
+
+func TestStateTreeInclusionProof(t *testing.T) {
+	tree := NewStateTree()
+	keys := []core_types.Hash{}
+	for i := 0; i < 20; i++ {
+		k := core_types.GenerateRandomHash(32)
+		keys = append(keys, k)
+		tree.Update(k, []byte{byte(i)})
+	}
+	root := tree.Root()
+
+	for i, k := range keys {
+		proof := tree.Prove(k)
+		assert.True(t, VerifyStateProof(root, k, []byte{byte(i)}, proof))
+		assert.False(t, VerifyStateProof(root, k, []byte{byte(i + 1)}, proof))
+		assert.False(t, VerifyStateProof(root, k, nil, proof))
+	}
+}
+
+func TestStateTreeExclusionProof(t *testing.T) {
+	tree := NewStateTree()
+	present := core_types.GenerateRandomHash(32)
+	tree.Update(present, []byte("value"))
+	for i := 0; i < 10; i++ {
+		tree.Update(core_types.GenerateRandomHash(32), []byte("other"))
+	}
+	root := tree.Root()
+
+	absent := core_types.GenerateRandomHash(32)
+	proof := tree.Prove(absent)
+	assert.True(t, VerifyStateProof(root, absent, nil, proof))
+	assert.False(t, VerifyStateProof(root, absent, []byte("value"), proof))
+
+	// the proof of a present key can't be passed off as its absence
+	assert.False(t, VerifyStateProof(root, present, nil, tree.Prove(present)))
+}
+
+func TestAccountStateProof(t *testing.T) {
+	accounts := NewAccountState()
+	addr := crypto_lib.GeneratePrivateKey().PublicKey().Address()
+	accounts.CreateAccount(addr).Balance = 500
+	accounts.CreateAccount(crypto_lib.GeneratePrivateKey().PublicKey().Address())
+
+	tree := NewStateTreeFromState(accounts, NewState())
+	root := tree.Root()
+	assert.Equal(t, root, CalculateStateRoot(accounts, NewState()))
+
+	account, err := accounts.GetAccount(addr)
+	assert.Nil(t, err)
+	proof := tree.Prove(AccountStateKey(addr))
+	assert.True(t, VerifyStateProof(root, AccountStateKey(addr), EncodeAccountValue(account), proof))
+	assert.False(t, VerifyStateProof(root, AccountStateKey(addr), EncodeAccountValue(&Account{Address: addr, Balance: 501}), proof))
+}
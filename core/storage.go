@@ -1,19 +1,136 @@
 package core
 
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/EggsyOnCode/xenolith/core_types"
+)
+
+// returned by the stores for blocks they don't hold; Iterate stops at the first one
+var ErrBlockNotFound = errors.New("block not found in store")
+
+// the stored blocks don't make up a chain
+var ErrStoreCorrupt = errors.New("store is corrupt")
+
 type Storage interface {
 	Put(*Block) error
+	Get(core_types.Hash) (*Block, error)
+	GetByHeight(uint32) (*Block, error)
+	Has(core_types.Hash) bool
+	// Iterate walks the stored chain from genesis upwards, in height order
+	// it stops at the first missing height; read errors and the ones of fn are returned
+	Iterate(fn func(*Block) error) error
+	// Truncate drops the blocks above height from the chain, e.g once it is reorganised onto a shorter fork
+	// they are still found by their hash
+	Truncate(height uint32) error
+	// PutSnapshot keeps the state snapshot the chain is reopened from; it replaces the one put before
+	PutSnapshot(*StateSnapshot) error
+	// GetSnapshot returns ErrSnapshotNotFound if no snapshot was put
+	GetSnapshot() (*StateSnapshot, error)
+	Close() error
+}
+
+type MemoryStore struct {
+	mu       sync.RWMutex
+	blocks   map[core_types.Hash]*Block
+	byHeight map[uint32]core_types.Hash
+	snapshot *StateSnapshot
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		blocks:   make(map[core_types.Hash]*Block),
+		byHeight: make(map[uint32]core_types.Hash),
+	}
 }
 
+func (m *MemoryStore) Put(b *Block) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
-type MemoryStore struct{
+	hash := b.Hash(BlockHasher{})
+	m.blocks[hash] = b
+	// the latest block written at a height wins; this is what a chain reorg relies on
+	m.byHeight[b.Header.Height] = hash
+	return nil
+}
 
+func (m *MemoryStore) Get(hash core_types.Hash) (*Block, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	b, ok := m.blocks[hash]
+	if !ok {
+		return nil, fmt.Errorf("%w: hash (%s)", ErrBlockNotFound, hash)
+	}
+	return b, nil
 }
 
-func NewMemoryStore() *MemoryStore{
-	return &MemoryStore{}
+func (m *MemoryStore) GetByHeight(height uint32) (*Block, error) {
+	m.mu.RLock()
+	hash, ok := m.byHeight[height]
+	m.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: height (%d)", ErrBlockNotFound, height)
+	}
+	return m.Get(hash)
 }
 
-func (m *MemoryStore) Put(b *Block) error {
+func (m *MemoryStore) Has(hash core_types.Hash) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	_, ok := m.blocks[hash]
+	return ok
+}
+
+func (m *MemoryStore) Iterate(fn func(*Block) error) error {
+	for height := uint32(0); ; height++ {
+		b, err := m.GetByHeight(height)
+		if errors.Is(err, ErrBlockNotFound) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("reading block (%d): %w", height, err)
+		}
+		if err := fn(b); err != nil {
+			return err
+		}
+	}
+}
+
+func (m *MemoryStore) Truncate(height uint32) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for h := range m.byHeight {
+		if h > height {
+			delete(m.byHeight, h)
+		}
+	}
+	return nil
+}
+
+func (m *MemoryStore) PutSnapshot(s *StateSnapshot) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.snapshot = s
 	return nil
 }
 
+func (m *MemoryStore) GetSnapshot() (*StateSnapshot, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if m.snapshot == nil {
+		return nil, ErrSnapshotNotFound
+	}
+	return m.snapshot, nil
+}
+
+func (m *MemoryStore) Close() error {
+	return nil
+}
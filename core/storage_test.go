@@ -0,0 +1,160 @@
+package core
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/EggsyOnCode/xenolith/core_types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiskStorePutGet(t *testing.T) {
+	s, err := NewDiskStore(t.TempDir())
+	assert.Nil(t, err)
+	defer s.Close()
+
+	block := randomBlockWithSignature(t, 0, core_types.Hash{})
+	hash := block.Hash(BlockHasher{})
+	assert.False(t, s.Has(hash))
+	assert.Nil(t, s.Put(block))
+	assert.True(t, s.Has(hash))
+
+	stored, err := s.Get(hash)
+	assert.Nil(t, err)
+	assert.Equal(t, block.Header, stored.Header)
+	assert.Equal(t, len(block.Transactions), len(stored.Transactions))
+	assert.Nil(t, stored.Verify())
+
+	byHeight, err := s.GetByHeight(0)
+	assert.Nil(t, err)
+	assert.Equal(t, hash, byHeight.Hash(BlockHasher{}))
+
+	_, err = s.GetByHeight(1)
+	assert.NotNil(t, err)
+}
+
+func TestDiskStoreReopen(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewDiskStore(dir)
+	assert.Nil(t, err)
+
+	prevHash := core_types.Hash{}
+	hashes := []core_types.Hash{}
+	for i := 0; i < 3; i++ {
+		block := randomBlockWithSignature(t, uint32(i), prevHash)
+		assert.Nil(t, s.Put(block))
+		prevHash = block.Hash(BlockHasher{})
+		hashes = append(hashes, prevHash)
+	}
+	assert.Nil(t, s.Close())
+
+	s, err = NewDiskStore(dir)
+	assert.Nil(t, err)
+	defer s.Close()
+
+	iterated := []core_types.Hash{}
+	assert.Nil(t, s.Iterate(func(b *Block) error {
+		iterated = append(iterated, b.Hash(BlockHasher{}))
+		return nil
+	}))
+	assert.Equal(t, hashes, iterated)
+}
+
+func TestDiskStoreIterateReportsCorruptRecord(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewDiskStore(dir)
+	assert.Nil(t, err)
+
+	prevHash := core_types.Hash{}
+	hashes := []core_types.Hash{}
+	for i := 0; i < 3; i++ {
+		block := randomBlockWithSignature(t, uint32(i), prevHash)
+		assert.Nil(t, s.Put(block))
+		prevHash = block.Hash(BlockHasher{})
+		hashes = append(hashes, prevHash)
+	}
+	rec := s.byHash[hashes[1]]
+	assert.Nil(t, s.Close())
+
+	// garbage in the middle of the chain must not pass for its end
+	f, err := os.OpenFile(filepath.Join(dir, blockFileName), os.O_WRONLY, 0o644)
+	assert.Nil(t, err)
+	_, err = f.WriteAt(bytes.Repeat([]byte{0xff}, int(rec.size)), rec.offset+blockRecordPrefixSize)
+	assert.Nil(t, err)
+	assert.Nil(t, f.Close())
+
+	s, err = NewDiskStore(dir)
+	assert.Nil(t, err)
+	defer s.Close()
+
+	iterated := 0
+	err = s.Iterate(func(b *Block) error {
+		iterated++
+		return nil
+	})
+	assert.NotNil(t, err)
+	assert.NotErrorIs(t, err, ErrBlockNotFound)
+	assert.Equal(t, 1, iterated)
+}
+
+func TestDiskStoreRecoversTornWrite(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewDiskStore(dir)
+	assert.Nil(t, err)
+
+	block := randomBlockWithSignature(t, 0, core_types.Hash{})
+	assert.Nil(t, s.Put(block))
+	assert.Nil(t, s.Close())
+
+	// drop the index and leave a half written record behind the block
+	assert.Nil(t, os.Truncate(filepath.Join(dir, indexFileName), 0))
+	f, err := os.OpenFile(filepath.Join(dir, blockFileName), os.O_APPEND|os.O_WRONLY, 0o644)
+	assert.Nil(t, err)
+	_, err = f.Write([]byte{0x00, 0x00, 0x10, 0x00, 0x01})
+	assert.Nil(t, err)
+	assert.Nil(t, f.Close())
+
+	s, err = NewDiskStore(dir)
+	assert.Nil(t, err)
+	defer s.Close()
+
+	assert.True(t, s.Has(block.Hash(BlockHasher{})))
+	_, err = s.GetByHeight(1)
+	assert.NotNil(t, err)
+}
+
+func TestDiskStoreTruncate(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewDiskStore(dir)
+	assert.Nil(t, err)
+
+	prevHash := core_types.Hash{}
+	hashes := []core_types.Hash{}
+	for i := 0; i < 3; i++ {
+		block := randomBlockWithSignature(t, uint32(i), prevHash)
+		assert.Nil(t, s.Put(block))
+		prevHash = block.Hash(BlockHasher{})
+		hashes = append(hashes, prevHash)
+	}
+	assert.Nil(t, s.Truncate(1))
+	_, err = s.GetByHeight(2)
+	assert.ErrorIs(t, err, ErrBlockNotFound)
+	assert.Nil(t, s.Close())
+
+	// the truncation is in the index as well
+	s, err = NewDiskStore(dir)
+	assert.Nil(t, err)
+	defer s.Close()
+	_, err = s.GetByHeight(2)
+	assert.ErrorIs(t, err, ErrBlockNotFound)
+	assert.True(t, s.Has(hashes[2]))
+
+	// the chain grows again on top of the height truncated at
+	block := randomBlockWithSignature(t, 2, hashes[1])
+	assert.Nil(t, s.Put(block))
+	stored, err := s.GetByHeight(2)
+	assert.Nil(t, err)
+	assert.Equal(t, block.Hash(BlockHasher{}), stored.Hash(BlockHasher{}))
+}
@@ -71,7 +71,10 @@ func (t *Transaction) Sign(priv *crypto_lib.PrivateKey) error {
 
 	// we hash it from the scratch; because the tx can only be signed once
 	// therefore its the right place to calculate the hash of the tx
-	hash := TxHasher{}.Hash(t)
+	hash, err := HashTx(t)
+	if err != nil {
+		return err
+	}
 
 	sig, err := priv.Sign(hash.ToSlice())
 	if err != nil {
@@ -89,10 +92,38 @@ func (t *Transaction) Verify() (bool, error) {
 	}
 
 	//for verification we can't use the cached hash
-	hash := TxHasher{}.Hash(t)
+	hash, err := HashTx(t)
+	if err != nil {
+		return false, err
+	}
 	return t.Signature.Verify(hash.ToSlice(), t.From), nil
 }
 
+// CheckFormat rejects a tx that can't be hashed, e.g one whose TxInner is a type gob knows but the canonical encoding doesn't
+// tx from peers are checked with it before anything else is done with them
+func (t *Transaction) CheckFormat() error {
+	switch inner := t.TxInner.(type) {
+	case nil, *CollectionTx, *MintTx:
+	default:
+		return fmt.Errorf("unsupported tx inner type %T", inner)
+	}
+	_, err := HashTx(t)
+	return err
+}
+
+// CheckTxFormat runs CheckFormat on every tx of txx
+func CheckTxFormat(txx []*Transaction) error {
+	for _, tx := range txx {
+		if tx == nil {
+			return fmt.Errorf("tx missing")
+		}
+		if err := tx.CheckFormat(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 //setters and getters for the timestamp
 
 func (t *Transaction) SetTimeStamp(timeStamp int64) {
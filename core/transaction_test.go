@@ -118,6 +118,46 @@ func TestCodecTx(t *testing.T) {
 
 }
 
+func TestCanonicalCodecTx(t *testing.T) {
+	priv := crypto_lib.GeneratePrivateKey()
+	txx := []*Transaction{
+		{
+			Data: []byte("foo"),
+			From: priv.PublicKey(),
+			To:   crypto_lib.GeneratePrivateKey().PublicKey(),
+		},
+		{
+			TxInner: &CollectionTx{Fee: 10, MetaData: []byte("collection"), Quantity: 5},
+			From:    priv.PublicKey(),
+			Nonce:   3,
+		},
+		{
+			TxInner: &MintTx{Fee: 10, MetaData: []byte("nft"), CollectionOwner: priv.PublicKey(), Collection: core_types.Hash{0x1}},
+			From:    priv.PublicKey(),
+			Value:   1,
+		},
+	}
+
+	for _, tx := range txx {
+		assert.Nil(t, tx.Sign(priv))
+
+		buf := &bytes.Buffer{}
+		assert.Nil(t, NewCanonicalTxEncoder(buf).Encode(tx))
+
+		txDecoded := new(Transaction)
+		assert.Nil(t, NewCanonicalTxDecoder(buf).Decode(txDecoded))
+
+		assert.Equal(t, tx.TxInner, txDecoded.TxInner)
+		assert.Equal(t, tx.Signature, txDecoded.Signature)
+		assert.Equal(t, tx.Hash(TxHasher{}), txDecoded.Hash(TxHasher{}))
+		ok, err := txDecoded.Verify()
+		assert.True(t, ok, err)
+	}
+
+	// tx inner types without a canonical layout can't be encoded
+	assert.NotNil(t, NewCanonicalTxEncoder(&bytes.Buffer{}).Encode(&Transaction{TxInner: "foo"}))
+}
+
 func randomTxWithSignature(t *testing.T) *Transaction {
 	privKey := crypto_lib.GeneratePrivateKey()
 	tx := Transaction{
@@ -7,6 +7,9 @@ import (
 
 var ErrBlockKnown = errors.New("Block already known")
 
+// the block itself is broken (bad signature, bad tx, wrong state root...) as opposed to not fitting onto our chain
+var ErrInvalidBlock = errors.New("invalid block")
+
 type Validator interface {
 	ValidateBlock(*Block) error
 }
@@ -27,10 +30,18 @@ func (v *BlockValidator) ValidateBlock(b *Block) error {
 	if err != nil {
 		belongsToFork = false
 	}
+	// a block we keep on a fork already; counting it again would confirm the fork twice
+	if _, err := v.bc.ForkSlice.FindBlock(b.Hash(BlockHasher{})); err == nil {
+		return ErrBlockKnown
+	}
 	// if the height of the proposed block is not less than the current height, return an error
 	var block *Block
 	if v.bc.HasBlock(b.Header.Height) {
 		block, _ = v.bc.GetBlock(b.Header.Height)
+		// the very same block; e.g a peer relaying it back to us
+		if block.Hash(BlockHasher{}) == b.Hash(BlockHasher{}) {
+			return ErrBlockKnown
+		}
 		// if it returns false then that means a fork has been detected
 		if block.Header.PrevBlockHash != b.Header.PrevBlockHash && !belongsToFork {
 			// return fmt.Errorf("Block with height %v and hash %v already exists", b.Header.Height, b.Hash(BlockHasher{}))
@@ -58,17 +69,41 @@ func (v *BlockValidator) ValidateBlock(b *Block) error {
 		return fmt.Errorf("Block with height %v and hash %v has a different previous block hash %v", b.Header.Height, b.Hash(BlockHasher{}), b.Header.PrevBlockHash)
 	}
 
+	// the target isn't up to the miner; it follows from the headers below the block
+	parent, err := v.bc.branchBlock(b.Header.PrevBlockHash)
+	if err != nil {
+		return err
+	}
+	target, err := v.bc.targetAfter(parent)
+	if err != nil {
+		return err
+	}
+	if b.Header.Target == nil || target.Cmp(b.Header.Target) != 0 {
+		return fmt.Errorf("%w: block (%s) has target %x, expected %x", ErrInvalidBlock, b.Hash(BlockHasher{}), b.Header.Target, target)
+	}
+	if err := b.Header.CheckPoW(); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidBlock, err)
+	}
+
 	//verifies the transactions in the block
 	for _, tx := range b.Transactions {
 		if ans, err := tx.Verify(); err != nil || !ans {
 			fmt.Printf("Error: %v\n", err)
-			return err
+			return fmt.Errorf("%w: tx (%s) not signed: %v", ErrInvalidBlock, tx.Hash(TxHasher{}), err)
 		}
 	}
 
 	//verifies if the block has been signed
 	if err := b.Verify(); err != nil {
-		return err
+		return fmt.Errorf("%w: %v", ErrInvalidBlock, err)
+	}
+
+	// the state root can only be re-executed for blocks extending the head of the chain
+	// blocks of a competing fork are executed once the fork is reorganised into the chain
+	if b.Header.PrevBlockHash == v.bc.block.Hash(BlockHasher{}) {
+		if root := v.bc.StateRootAfter(b); root != b.Header.StateRoot {
+			return fmt.Errorf("%w: block (%s) commits to state root (%s) but re-executing it gives (%s)", ErrInvalidBlock, b.Hash(BlockHasher{}), b.Header.StateRoot, root)
+		}
 	}
 
 	return nil
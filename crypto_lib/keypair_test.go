@@ -32,3 +32,19 @@ func TestSignatureFail(t *testing.T) {
 	verification := sig.Verify([]byte("Hello World2"), pb)
 	assert.False(t, verification)
 }
+
+func TestSignatureBytes(t *testing.T) {
+	priv := GeneratePrivateKey()
+	msg := []byte("Hello World")
+	sig, err := priv.Sign(msg)
+	assert.Nil(t, err)
+
+	b := sig.Bytes()
+	assert.Len(t, b, SignatureSize)
+	decoded, err := SignatureFromBytes(b)
+	assert.Nil(t, err)
+	assert.True(t, decoded.Verify(msg, priv.PublicKey()))
+
+	_, err = SignatureFromBytes(b[1:])
+	assert.NotNil(t, err)
+}
@@ -6,6 +6,7 @@ import (
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/hex"
+	"fmt"
 	"io"
 	"math/big"
 
@@ -68,9 +69,34 @@ func (sig *Signature) String() string {
 	return sig.R.String() + sig.S.String()
 }
 
+// size of a signature in its fixed length encoding; R and S take 32 bytes each
+const SignatureSize = 64
+
+// Bytes encodes the signature as R and S, each left padded to 32 bytes
+func (sig *Signature) Bytes() []byte {
+	b := make([]byte, SignatureSize)
+	sig.R.FillBytes(b[:SignatureSize/2])
+	sig.S.FillBytes(b[SignatureSize/2:])
+	return b
+}
+
+func SignatureFromBytes(b []byte) (*Signature, error) {
+	if len(b) != SignatureSize {
+		return nil, fmt.Errorf("signature is %d bytes long, expected %d", len(b), SignatureSize)
+	}
+	return &Signature{
+		R: new(big.Int).SetBytes(b[:SignatureSize/2]),
+		S: new(big.Int).SetBytes(b[SignatureSize/2:]),
+	}, nil
+}
+
 // msg can be verified with the public key
 func (sig *Signature) Verify(data []byte, p PublicKey) bool {
 	x, y := elliptic.UnmarshalCompressed(elliptic.P256(), p)
+	// a malformed key or signature coming off the wire
+	if x == nil || sig.R == nil || sig.S == nil {
+		return false
+	}
 	pk := &ecdsa.PublicKey{
 		Curve: elliptic.P256(),
 		X:     x,
@@ -2,10 +2,14 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/gob"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/EggsyOnCode/xenolith/core"
@@ -31,11 +35,11 @@ func main() {
 	localNode := makeServer(validatorPk, "LOCAL", ":3000", BootStrapNodes, ":9999")
 	go localNode.Start()
 
+	// made up front so it can be stopped along with the others; it only joins the network later
+	lateNode := makeServer(nil, "LATE", ":6000", []string{":4000"}, "")
 	go func() {
 		time.Sleep(11 * time.Second)
-
-		lateNode := makeServer(nil, "LATE", ":6000", []string{":4000"}, "")
-		go lateNode.Start()
+		lateNode.Start()
 	}()
 
 	time.Sleep(2 * time.Second)
@@ -57,7 +61,18 @@ func main() {
 	// 	panic(err)
 	// }
 
-	select {}
+	// the nodes are shut down cleanly on ctrl-c
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	<-sigCh
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for _, s := range []*network.Server{lateNode, localNode, remoteNode1, remoteNode0} {
+		if err := s.Stop(ctx); err != nil {
+			fmt.Printf("could not stop %s: %v\n", s.ID, err)
+		}
+	}
 }
 
 func makeServer(validatorPk *crypto_lib.PrivateKey, id string, listenAddr string, seedNodes []string, apiListenAddr string) *network.Server {
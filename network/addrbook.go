@@ -0,0 +1,246 @@
+package network
+
+import (
+	"bytes"
+	"encoding/gob"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	addrBookFileName = "peers.dat"
+	// the book stops learning new addresses once it holds this many
+	maxAddrBookSize = 1000
+	// an address is redialed after minDialBackoff, doubling with every failed attempt up to maxDialBackoff
+	minDialBackoff = 5 * time.Second
+	maxDialBackoff = 10 * time.Minute
+)
+
+type KnownAddr struct {
+	Addr string
+	// address of the peer we learned it from; empty for bootstrap nodes
+	Source      string
+	LastSeen    time.Time
+	LastAttempt time.Time
+	// dial attempts since the last successful handshake
+	Attempts int
+	// persistent addresses (i.e bootstrap nodes) are never removed from the book
+	Persistent bool
+}
+
+// AddrBook keeps the addresses of the nodes we know of
+// if it has a path it is written to disk so that a restarted node doesn't depend on its bootstrap nodes
+type AddrBook struct {
+	mu    sync.RWMutex
+	path  string
+	addrs map[string]*KnownAddr
+}
+
+// NewAddrBook loads the book from path; an empty path gives a book that lives in memory only
+func NewAddrBook(path string) (*AddrBook, error) {
+	b := &AddrBook{
+		path:  path,
+		addrs: make(map[string]*KnownAddr),
+	}
+	if len(path) == 0 {
+		return b, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return b, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	known := []*KnownAddr{}
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&known); err != nil {
+		return nil, err
+	}
+	for _, ka := range known {
+		b.addrs[ka.Addr] = ka
+	}
+
+	return b, nil
+}
+
+// Add records addr; it returns false if the address is invalid, known already or the book is full
+func (b *AddrBook) Add(addr string, source string) bool {
+	addr, ok := normalizeAddr(addr)
+	if !ok {
+		return false
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.addrs[addr]; ok || len(b.addrs) >= maxAddrBookSize {
+		return false
+	}
+	b.addrs[addr] = &KnownAddr{
+		Addr:   addr,
+		Source: source,
+	}
+	return true
+}
+
+// AddPersistent records addr as an address that is kept even if dialing it keeps failing
+func (b *AddrBook) AddPersistent(addr string) {
+	b.Add(addr, "")
+	addr, _ = normalizeAddr(addr)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ka, ok := b.addrs[addr]; ok {
+		ka.Persistent = true
+	}
+}
+
+func (b *AddrBook) Remove(addr string) {
+	addr, _ = normalizeAddr(addr)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ka, ok := b.addrs[addr]; ok && !ka.Persistent {
+		delete(b.addrs, addr)
+	}
+}
+
+func (b *AddrBook) Has(addr string) bool {
+	addr, _ = normalizeAddr(addr)
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	_, ok := b.addrs[addr]
+	return ok
+}
+
+func (b *AddrBook) Size() int {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return len(b.addrs)
+}
+
+// MarkAttempt is called whenever we dial addr
+func (b *AddrBook) MarkAttempt(addr string) {
+	addr, _ = normalizeAddr(addr)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ka, ok := b.addrs[addr]; ok {
+		ka.LastAttempt = time.Now()
+		ka.Attempts++
+	}
+}
+
+// MarkGood is called once we completed a handshake with the node at addr
+func (b *AddrBook) MarkGood(addr string) {
+	addr, _ = normalizeAddr(addr)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ka, ok := b.addrs[addr]
+	if !ok {
+		ka = &KnownAddr{Addr: addr}
+		b.addrs[addr] = ka
+	}
+	ka.LastSeen = time.Now()
+	ka.Attempts = 0
+}
+
+// Sample returns up to n random addresses of the book
+func (b *AddrBook) Sample(n int) []string {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	addrs := make([]string, 0, len(b.addrs))
+	for addr := range b.addrs {
+		addrs = append(addrs, addr)
+	}
+	rand.Shuffle(len(addrs), func(i, j int) {
+		addrs[i], addrs[j] = addrs[j], addrs[i]
+	})
+	if len(addrs) > n {
+		addrs = addrs[:n]
+	}
+	return addrs
+}
+
+// Pick returns up to n addresses worth dialing; the ones skip returns true for are left out
+func (b *AddrBook) Pick(n int, skip func(string) bool) []string {
+	picked := []string{}
+	for _, addr := range b.Sample(maxAddrBookSize) {
+		if len(picked) == n {
+			break
+		}
+		if skip(addr) {
+			continue
+		}
+
+		b.mu.RLock()
+		ka, ok := b.addrs[addr]
+		ready := ok && time.Since(ka.LastAttempt) >= dialBackoff(ka.Attempts)
+		b.mu.RUnlock()
+		if ready {
+			picked = append(picked, addr)
+		}
+	}
+	return picked
+}
+
+// time to wait before dialing an address again after attempts failed dials
+func dialBackoff(attempts int) time.Duration {
+	if attempts == 0 {
+		return 0
+	}
+
+	backoff := minDialBackoff
+	for i := 1; i < attempts && backoff < maxDialBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxDialBackoff {
+		backoff = maxDialBackoff
+	}
+	return backoff
+}
+
+// Save writes the book to its path; the file is replaced atomically
+func (b *AddrBook) Save() error {
+	if len(b.path) == 0 {
+		return nil
+	}
+
+	b.mu.RLock()
+	known := make([]*KnownAddr, 0, len(b.addrs))
+	for _, ka := range b.addrs {
+		known = append(known, ka)
+	}
+	buf := &bytes.Buffer{}
+	err := gob.NewEncoder(buf).Encode(known)
+	b.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	tmp := b.path + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, b.path)
+}
+
+// addresses are kept as host:port; an address without a host (e.g ":3000") is on the local machine
+func normalizeAddr(addr string) (string, bool) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || len(port) == 0 || port == "0" {
+		return addr, false
+	}
+	if len(host) == 0 {
+		host = "127.0.0.1"
+	}
+	return net.JoinHostPort(host, port), true
+}
@@ -0,0 +1,77 @@
+package network
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAddrBookAdd(t *testing.T) {
+	b, err := NewAddrBook("")
+	assert.Nil(t, err)
+
+	assert.True(t, b.Add(":3000", ""))
+	// same address once normalized
+	assert.False(t, b.Add("127.0.0.1:3000", ""))
+	assert.True(t, b.Has(":3000"))
+
+	assert.False(t, b.Add("foo", ""))
+	assert.False(t, b.Add("127.0.0.1:0", ""))
+	assert.Equal(t, 1, b.Size())
+
+	b.Remove("127.0.0.1:3000")
+	assert.Equal(t, 0, b.Size())
+
+	// bootstrap nodes stay in the book
+	b.AddPersistent(":4000")
+	b.Remove(":4000")
+	assert.True(t, b.Has(":4000"))
+}
+
+func TestDialBackoff(t *testing.T) {
+	assert.Equal(t, time.Duration(0), dialBackoff(0))
+	assert.Equal(t, minDialBackoff, dialBackoff(1))
+	assert.Equal(t, 2*minDialBackoff, dialBackoff(2))
+	assert.Equal(t, 8*minDialBackoff, dialBackoff(4))
+	assert.Equal(t, maxDialBackoff, dialBackoff(100))
+}
+
+func TestAddrBookPersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), addrBookFileName)
+	b, err := NewAddrBook(path)
+	assert.Nil(t, err)
+	b.Add("10.0.0.1:3000", "10.0.0.2:3000")
+	b.MarkGood("10.0.0.3:3000")
+	assert.Nil(t, b.Save())
+
+	reopened, err := NewAddrBook(path)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, reopened.Size())
+	assert.True(t, reopened.Has("10.0.0.1:3000"))
+	assert.True(t, reopened.Has("10.0.0.3:3000"))
+}
+
+func TestAddrBookPick(t *testing.T) {
+	b, err := NewAddrBook("")
+	assert.Nil(t, err)
+	b.Add("10.0.0.1:3000", "")
+	b.Add("10.0.0.2:3000", "")
+	b.Add("10.0.0.3:3000", "")
+
+	picked := b.Pick(10, func(addr string) bool {
+		return addr == "10.0.0.1:3000"
+	})
+	assert.ElementsMatch(t, []string{"10.0.0.2:3000", "10.0.0.3:3000"}, picked)
+	assert.Len(t, b.Pick(1, func(string) bool { return false }), 1)
+
+	// recently dialed addresses are not picked again
+	b.MarkAttempt("10.0.0.2:3000")
+	picked = b.Pick(10, func(string) bool { return false })
+	assert.NotContains(t, picked, "10.0.0.2:3000")
+
+	b.addrs["10.0.0.2:3000"].LastAttempt = time.Now().Add(-dialBackoff(1))
+	picked = b.Pick(10, func(string) bool { return false })
+	assert.Contains(t, picked, "10.0.0.2:3000")
+}
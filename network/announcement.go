@@ -0,0 +1,62 @@
+package network
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/EggsyOnCode/xenolith/crypto_lib"
+)
+
+var ErrInvalidAnnouncement = errors.New("invalid validator announcement")
+
+// ValidatorAnnouncement is how a validator makes itself known to the consensus clients of its peers
+// it is signed with the validator key so it can't be made up for someone else
+type ValidatorAnnouncement struct {
+	PublicKey  crypto_lib.PublicKey
+	ListenAddr string
+	// weight of the validator in consensus
+	Stake uint64
+	// unix nanos; a newer announcement of the same validator replaces the older one
+	Timestamp int64
+	Signature *crypto_lib.Signature
+}
+
+func NewValidatorAnnouncement(key *crypto_lib.PrivateKey, listenAddr string, stake uint64) (*ValidatorAnnouncement, error) {
+	a := &ValidatorAnnouncement{
+		PublicKey:  key.PublicKey(),
+		ListenAddr: listenAddr,
+		Stake:      stake,
+		Timestamp:  time.Now().UnixNano(),
+	}
+	sig, err := key.Sign(a.signedHash())
+	if err != nil {
+		return nil, err
+	}
+	a.Signature = sig
+	return a, nil
+}
+
+// signedHash covers every field but the signature
+func (a *ValidatorAnnouncement) signedHash() []byte {
+	h := sha256.New()
+	h.Write([]byte("xenolith validator announcement"))
+	h.Write(a.PublicKey)
+	binary.Write(h, binary.BigEndian, uint32(len(a.ListenAddr)))
+	h.Write([]byte(a.ListenAddr))
+	binary.Write(h, binary.BigEndian, a.Stake)
+	binary.Write(h, binary.BigEndian, a.Timestamp)
+	return h.Sum(nil)
+}
+
+func (a *ValidatorAnnouncement) Verify() error {
+	if a.Signature == nil || len(a.PublicKey) == 0 {
+		return fmt.Errorf("%w: not signed", ErrInvalidAnnouncement)
+	}
+	if !a.Signature.Verify(a.signedHash(), a.PublicKey) {
+		return fmt.Errorf("%w: bad signature", ErrInvalidAnnouncement)
+	}
+	return nil
+}
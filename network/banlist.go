@@ -0,0 +1,144 @@
+package network
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/EggsyOnCode/xenolith/api"
+)
+
+const (
+	// a peer whose score drops to this value is disconnected and banned
+	banScoreThreshold  = -100
+	defaultBanDuration = 30 * time.Minute
+
+	// what a peer loses for each kind of misbehaviour
+	penaltyUndecodableMsg = 25
+	penaltyInvalidBlock   = 50
+	penaltyInvalidTx      = 10
+	penaltyInvalidHeaders = 50
+	penaltyInvalidBody    = 50
+	penaltyInvalidProof   = 50
+)
+
+type Ban struct {
+	Addr   string
+	Reason string
+	Until  time.Time
+}
+
+// BanList holds the identity keys and IPs of banned peers
+// unlike the listen address a peer advertises, neither can be changed by reconnecting from another port
+type BanList struct {
+	mu   sync.RWMutex
+	bans map[string]*Ban
+}
+
+func NewBanList() *BanList {
+	return &BanList{
+		bans: make(map[string]*Ban),
+	}
+}
+
+func (l *BanList) Ban(addr string, reason string, d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.bans[addr] = &Ban{
+		Addr:   addr,
+		Reason: reason,
+		Until:  time.Now().Add(d),
+	}
+}
+
+func (l *BanList) IsBanned(addr string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	ban, ok := l.bans[addr]
+	if !ok {
+		return false
+	}
+	if time.Now().After(ban.Until) {
+		delete(l.bans, addr)
+		return false
+	}
+	return true
+}
+
+// List returns the bans that haven't expired yet
+func (l *BanList) List() []Ban {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	bans := make([]Ban, 0, len(l.bans))
+	for _, ban := range l.bans {
+		if time.Now().Before(ban.Until) {
+			bans = append(bans, *ban)
+		}
+	}
+	sort.Slice(bans, func(i, j int) bool {
+		return bans[i].Addr < bans[j].Addr
+	})
+	return bans
+}
+
+// penalizePeer lowers the score of the peer the msg came from; once it hits the threshold the peer is banned
+func (s *Server) penalizePeer(from NetAddr, penalty int32, reason error) {
+	s.mu.RLock()
+	peer, ok := s.peerMap[from]
+	s.mu.RUnlock()
+	if !ok {
+		return
+	}
+
+	score := peer.score.Add(-penalty)
+	s.Logger.Log("msg", "peer misbehaved", "peer", from, "score", score, "reason", reason)
+	if score > banScoreThreshold {
+		return
+	}
+
+	for _, key := range banKeys(peer.Addr, peer.remoteAddr) {
+		s.banList.Ban(key, reason.Error(), s.BanDuration)
+	}
+	s.Logger.Log("msg", "banning peer", "peer", from, "remote", peer.remoteAddr, "until", time.Now().Add(s.BanDuration))
+	s.removePeer(peer)
+}
+
+// banKeys are what a peer is banned by: the address the transport knows it by (its identity key over tcp)
+// and the IP it connected from, if the transport knows it
+func banKeys(addr NetAddr, remoteAddr string) []string {
+	keys := []string{}
+	if len(addr) > 0 {
+		keys = append(keys, string(addr))
+	}
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil && len(host) > 0 {
+		keys = append(keys, host)
+	}
+	return keys
+}
+
+func (s *Server) isBanned(addr NetAddr, remoteAddr string) bool {
+	for _, key := range banKeys(addr, remoteAddr) {
+		if s.banList.IsBanned(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// BannedPeers implements api.BanList
+func (s *Server) BannedPeers() []api.BannedPeer {
+	bans := s.banList.List()
+	peers := make([]api.BannedPeer, 0, len(bans))
+	for _, ban := range bans {
+		peers = append(peers, api.BannedPeer{
+			Addr:   ban.Addr,
+			Reason: ban.Reason,
+			Until:  ban.Until.String(),
+		})
+	}
+	return peers
+}
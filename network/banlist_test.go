@@ -0,0 +1,94 @@
+package network
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/EggsyOnCode/xenolith/core"
+	"github.com/EggsyOnCode/xenolith/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBanListExpiry(t *testing.T) {
+	l := NewBanList()
+	l.Ban("10.0.0.1:3000", "spam", time.Hour)
+	l.Ban("10.0.0.2:3000", "spam", -time.Second)
+
+	assert.True(t, l.IsBanned("10.0.0.1:3000"))
+	assert.False(t, l.IsBanned("10.0.0.2:3000"))
+	assert.False(t, l.IsBanned("10.0.0.3:3000"))
+	assert.Len(t, l.List(), 1)
+}
+
+func TestMisbehavingPeerBanned(t *testing.T) {
+	a := newTestServer(t, "A", 0)
+	b := newTestServer(t, "B", 0)
+	startServers(a, b)
+
+	connectServers(t, b, a)
+	peer := onlyPeer(a)
+	from := peer.Addr
+
+	// a broken block costs the peer but doesn't get it banned right away
+	genesis, err := a.chain.GetHeaders(0)
+	assert.Nil(t, err)
+	block := util.NewRandomBlock(t, 1, core.BlockHasher{}.Hash(genesis))
+	assert.ErrorIs(t, a.processBlock(block, from), core.ErrInvalidBlock)
+	assert.Equal(t, int32(-penaltyInvalidBlock), peer.score.Load())
+	assert.Equal(t, 1, peerCount(a))
+
+	a.processBlock(block, from)
+	assert.Equal(t, 0, peerCount(a))
+	// the local transport knows the peer by its name alone
+	assert.True(t, a.banList.IsBanned("B"))
+
+	banned := a.BannedPeers()
+	assert.Len(t, banned, 1)
+	assert.Equal(t, "B", banned[0].Addr)
+
+	// the banned node can't come back
+	assert.Eventually(t, func() bool {
+		return len(b.Transport.Peers()) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Nil(t, b.Transport.Connect(a.Transport))
+	assert.Eventually(t, func() bool {
+		return len(a.Transport.Peers()) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, 0, peerCount(a))
+}
+
+func TestBanKeys(t *testing.T) {
+	assert.Equal(t, []string{"key", "10.0.0.9"}, banKeys("key", "10.0.0.9:51000"))
+	// a peer without a remote address isn't banned by it; nor is anything banned by an empty key
+	assert.Equal(t, []string{"key"}, banKeys("key", ""))
+	assert.Empty(t, banKeys("", "garbage"))
+}
+
+// over tcp the peer is banned by its key and its IP; a new key or another port doesn't get it back in
+func TestBannedPeerDroppedBeforeHandshake(t *testing.T) {
+	a := newTestTCPServer(t, "A")
+	b := newTestTCPServer(t, "B")
+	startServers(a, b)
+	connectServers(t, b, a)
+
+	peer := onlyPeer(a)
+	a.penalizePeer(peer.Addr, -banScoreThreshold, fmt.Errorf("misbehaved"))
+	assert.True(t, a.banList.IsBanned(string(peer.Addr)))
+	assert.True(t, a.banList.IsBanned("127.0.0.1"))
+	assert.Eventually(t, func() bool {
+		return len(a.Transport.Peers()) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// same IP, another key and port
+	c := newTestTCPServer(t, "C")
+	startServers(c)
+	assert.Nil(t, c.Transport.Connect(a.Transport))
+	// a doesn't send its handshake; c never gets to add it
+	assert.Never(t, func() bool {
+		return peerCount(a) > 0 || peerCount(c) > 0
+	}, 500*time.Millisecond, 10*time.Millisecond)
+	assert.Eventually(t, func() bool {
+		return len(a.Transport.Peers()) == 0 && len(c.Transport.Peers()) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+}
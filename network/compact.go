@@ -0,0 +1,199 @@
+package network
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"fmt"
+	"time"
+
+	"github.com/EggsyOnCode/xenolith/core"
+	"github.com/EggsyOnCode/xenolith/core_types"
+)
+
+// how long the peer that sent a compact block is given to send the tx we are missing
+const blockTxnTimeout = 5 * time.Second
+
+// ShortTxID identifies a tx within a compact block; 6 bytes instead of the 32 of its hash
+type ShortTxID [6]byte
+
+// shortTxID is salted with the hash of the block so a collision between two tx doesn't repeat in every block
+func shortTxID(block core_types.Hash, tx core_types.Hash) ShortTxID {
+	sum := sha256.Sum256(append(block.ToSlice(), tx.ToSlice()...))
+	var id ShortTxID
+	copy(id[:], sum[:])
+	return id
+}
+
+func newCompactBlockMessage(b *core.Block) *CompactBlockMessage {
+	hash := b.Hash(core.BlockHasher{})
+	ids := make([]ShortTxID, 0, len(b.Transactions))
+	for _, tx := range b.Transactions {
+		ids = append(ids, shortTxID(hash, tx.Hash(core.TxHasher{})))
+	}
+	return &CompactBlockMessage{
+		Header:   b.SignedHeader(),
+		ShortIDs: ids,
+	}
+}
+
+// fillCompactBlock puts the tx of the pool in the slots of the block they belong to
+// the indexes of the slots left empty are returned; that includes the short ids matching more than one tx of the pool
+func fillCompactBlock(msg *CompactBlockMessage, pool []*core.Transaction) ([]*core.Transaction, []uint32) {
+	hash := msg.Header.Hash()
+	byID := make(map[ShortTxID]*core.Transaction, len(pool))
+	ambiguous := make(map[ShortTxID]bool)
+	for _, tx := range pool {
+		id := shortTxID(hash, tx.Hash(core.TxHasher{}))
+		if _, ok := byID[id]; ok {
+			ambiguous[id] = true
+		}
+		byID[id] = tx
+	}
+
+	txx := make([]*core.Transaction, len(msg.ShortIDs))
+	missing := []uint32{}
+	for i, id := range msg.ShortIDs {
+		if tx, ok := byID[id]; ok && !ambiguous[id] {
+			txx[i] = tx
+			continue
+		}
+		missing = append(missing, uint32(i))
+	}
+	return txx, missing
+}
+
+// broadcastBlock pushes the block as a compact block to every peer not known to have it
+func (s *Server) broadcastBlock(b *core.Block) error {
+	item := InvItem{Type: InvTypeBlock, Hash: b.Hash(core.BlockHasher{})}
+	buf := &bytes.Buffer{}
+	if err := gob.NewEncoder(buf).Encode(newCompactBlockMessage(b)); err != nil {
+		return err
+	}
+	msg := NewMessage(MessageTypeCompactBlock, buf.Bytes())
+
+	s.mu.RLock()
+	peers := []*Peer{}
+	for _, peer := range s.peerMap {
+		if peer.known.Add(item) {
+			peers = append(peers, peer)
+		}
+	}
+	s.mu.RUnlock()
+
+	for _, peer := range peers {
+		if err := s.Transport.SendMsg(peer.Addr, msg); err != nil {
+			s.Logger.Log("msg", "could not send compact block", "peer", peer.Addr, "err", err)
+		}
+	}
+	return nil
+}
+
+// processCompactBlockMsg rebuilds the block out of our mempool; the tx we don't have are asked from the peer that sent it
+func (s *Server) processCompactBlockMsg(from NetAddr, msg *CompactBlockMessage) error {
+	if msg.Header == nil || msg.Header.Header == nil {
+		err := fmt.Errorf("compact block without a header")
+		s.penalizePeer(from, penaltyInvalidBlock, err)
+		return err
+	}
+	item := InvItem{Type: InvTypeBlock, Hash: msg.Header.Hash()}
+	s.markKnown(from, item)
+	// the block could also be on its way from another peer
+	if s.hasInvItem(item) || !s.invRequests.Ask(item) {
+		return nil
+	}
+	if err := msg.Header.Verify(); err != nil {
+		s.invRequests.Done(item)
+		s.penalizePeer(from, penaltyInvalidBlock, err)
+		return err
+	}
+
+	txx, missing := fillCompactBlock(msg, s.memPool.All())
+	if len(missing) == 0 {
+		return s.completeCompactBlock(from, msg.Header, txx)
+	}
+	// waiting for the peer would hold up every other msg
+	s.spawn(func() {
+		if err := s.fetchBlockTxn(from, msg.Header, txx, missing); err != nil {
+			s.Logger.Log("msg", "could not complete compact block", "peer", from, "err", err)
+		}
+	})
+	return nil
+}
+
+// fetchBlockTxn asks the peer for the tx of the block missing from txx
+func (s *Server) fetchBlockTxn(from NetAddr, header *core.SignedHeader, txx []*core.Transaction, missing []uint32) error {
+	buf := &bytes.Buffer{}
+	if err := gob.NewEncoder(buf).Encode(&GetBlockTxnMessage{Hash: header.Hash(), Indexes: missing}); err != nil {
+		return err
+	}
+	reply, err := s.Request(from, NewMessage(MessageTypeGetBlockTxn, buf.Bytes()), blockTxnTimeout)
+	if err != nil {
+		return s.fetchFullBlock(from, header.Hash(), err)
+	}
+	txn, ok := reply.Data.(*BlockTxnMessage)
+	if !ok || txn.Hash != header.Hash() || len(txn.Transactions) != len(missing) {
+		err := fmt.Errorf("peer sent a reply (%T) not matching the tx asked for block (%s)", reply.Data, header.Hash())
+		s.penalizePeer(from, penaltyInvalidBody, err)
+		return err
+	}
+
+	for i, index := range missing {
+		txx[index] = txn.Transactions[i]
+	}
+	return s.completeCompactBlock(from, header, txx)
+}
+
+// completeCompactBlock adds the rebuilt block to the chain
+// it runs off the server loop once missing tx had to be fetched; the chain takes one block at a time (see Blockchain.AddBlock)
+// tx that don't match the data hash are likely ours to blame (a short id collision); the full block is fetched instead
+func (s *Server) completeCompactBlock(from NetAddr, header *core.SignedHeader, txx []*core.Transaction) error {
+	hash := header.Hash()
+	dataHash, err := core.CalculateDataHash(txx)
+	if err != nil {
+		return err
+	}
+	if dataHash != header.Header.DataHash {
+		return s.fetchFullBlock(from, hash, fmt.Errorf("rebuilt block has data hash (%s), header commits to (%s)", dataHash, header.Header.DataHash))
+	}
+
+	s.invRequests.Done(InvItem{Type: InvTypeBlock, Hash: hash})
+	block := &core.Block{
+		Header:       header.Header,
+		Transactions: txx,
+		Validator:    header.Validator,
+		Signature:    header.Signature,
+	}
+	return s.processBlock(block, from)
+}
+
+// fetchFullBlock falls back to asking for the block with GetData
+func (s *Server) fetchFullBlock(from NetAddr, hash core_types.Hash, reason error) error {
+	s.Logger.Log("msg", "fetching the full block", "peer", from, "block", hash, "reason", reason)
+	item := InvItem{Type: InvTypeBlock, Hash: hash}
+	s.invRequests.Done(item)
+	return s.processInvMsg(from, &InvMessage{Items: []InvItem{item}})
+}
+
+func (s *Server) processGetBlockTxnMsg(req *DecodedMsg, msg *GetBlockTxnMessage) error {
+	block, err := s.chain.GetBlockByHash(msg.Hash)
+	if err != nil {
+		return err
+	}
+
+	txx := make([]*core.Transaction, 0, len(msg.Indexes))
+	for _, index := range msg.Indexes {
+		if int(index) >= len(block.Transactions) {
+			err := fmt.Errorf("block (%s) has no tx at index %d", msg.Hash, index)
+			s.penalizePeer(req.From, penaltyUndecodableMsg, err)
+			return err
+		}
+		txx = append(txx, block.Transactions[index])
+	}
+
+	buf := &bytes.Buffer{}
+	if err := gob.NewEncoder(buf).Encode(&BlockTxnMessage{Hash: msg.Hash, Transactions: txx}); err != nil {
+		return err
+	}
+	return s.reply(req, NewMessage(MessageTypeBlockTxn, buf.Bytes()))
+}
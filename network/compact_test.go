@@ -0,0 +1,118 @@
+package network
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/EggsyOnCode/xenolith/core"
+	"github.com/stretchr/testify/assert"
+)
+
+// passes the msgs on to the server, remembering the indexes asked for with GetBlockTxn
+type blockTxnRecorder struct {
+	*Server
+	mu      sync.Mutex
+	indexes [][]uint32
+}
+
+func recordBlockTxn(s *Server) *blockTxnRecorder {
+	r := &blockTxnRecorder{Server: s}
+	s.RPCProcessor = r
+	return r
+}
+
+func (r *blockTxnRecorder) ProcessMessage(msg *DecodedMsg) error {
+	if req, ok := msg.Data.(*GetBlockTxnMessage); ok {
+		r.mu.Lock()
+		r.indexes = append(r.indexes, req.Indexes)
+		r.mu.Unlock()
+	}
+	return r.Server.ProcessMessage(msg)
+}
+
+func (r *blockTxnRecorder) requests() [][]uint32 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([][]uint32{}, r.indexes...)
+}
+
+func TestFillCompactBlock(t *testing.T) {
+	txx := []*core.Transaction{signedTx(t, "a"), signedTx(t, "b"), signedTx(t, "c")}
+	header := &core.Header{Height: 1}
+	block := core.NewBlock(header, txx)
+	msg := newCompactBlockMessage(block)
+	assert.Len(t, msg.ShortIDs, 3)
+
+	// the pool has the first and the last along with a tx of no interest
+	filled, missing := fillCompactBlock(msg, []*core.Transaction{txx[2], signedTx(t, "other"), txx[0]})
+	assert.Equal(t, []uint32{1}, missing)
+	assert.Equal(t, txx[0], filled[0])
+	assert.Nil(t, filled[1])
+	assert.Equal(t, txx[2], filled[2])
+
+	filled, missing = fillCompactBlock(msg, txx)
+	assert.Empty(t, missing)
+	assert.Equal(t, txx, filled)
+}
+
+func TestCompactBlockRebuiltFromMempool(t *testing.T) {
+	a := newTestValidatorServer(t, "A", 0)
+	b := newTestServer(t, "B", 0)
+	recA := recordBlockTxn(a)
+	startServers(a, b)
+	connectServers(t, b, a)
+
+	gossiped := signedTx(t, "gossiped")
+	hash := gossiped.Hash(core.TxHasher{})
+	a.txCh <- gossiped
+	assert.Eventually(t, func() bool {
+		return b.memPool.Contains(hash)
+	}, 5*time.Second, 10*time.Millisecond)
+
+	assert.Nil(t, a.createNewBlock())
+	assert.Eventually(t, func() bool {
+		return b.chain.Height() == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	// everything was in the mempool of b already
+	assert.Empty(t, recA.requests())
+}
+
+func TestCompactBlockMissingTxFetched(t *testing.T) {
+	a := newTestValidatorServer(t, "A", 0)
+	b := newTestServer(t, "B", 0)
+	recA := recordBlockTxn(a)
+	startServers(a, b)
+	connectServers(t, b, a)
+
+	gossiped := signedTx(t, "gossiped")
+	hash := gossiped.Hash(core.TxHasher{})
+	a.txCh <- gossiped
+	assert.Eventually(t, func() bool {
+		return b.memPool.Contains(hash)
+	}, 5*time.Second, 10*time.Millisecond)
+	// never gossiped; b has to ask for it
+	private := signedTx(t, "private")
+	a.memPool.Add(private)
+
+	assert.Nil(t, a.createNewBlock())
+	block, err := a.chain.GetBlock(1)
+	assert.Nil(t, err)
+	assert.Len(t, block.Transactions, 2)
+
+	assert.Eventually(t, func() bool {
+		return b.chain.Height() == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	got, err := b.chain.GetBlock(1)
+	assert.Nil(t, err)
+	assert.Equal(t, block.Hash(core.BlockHasher{}), got.Hash(core.BlockHasher{}))
+	assert.Equal(t, block.Header.DataHash, got.Header.DataHash)
+
+	requests := recA.requests()
+	assert.Len(t, requests, 1)
+	for i, tx := range block.Transactions {
+		if tx.Hash(core.TxHasher{}) == private.Hash(core.TxHasher{}) {
+			assert.Equal(t, []uint32{uint32(i)}, requests[0])
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package network
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+const (
+	defaultMaxOutboundPeers = 8
+	defaultMaxInboundPeers  = 32
+	// at most this many addresses are exchanged in a single PeersMessage
+	maxPeersPerMessage = 100
+
+	discoveryInterval = 10 * time.Second
+	dialTimeout       = 5 * time.Second
+)
+
+// discoveryLoop keeps the node at its target number of outbound connections
+// dialing addresses from the address book and asking peers for more addresses when it runs short
+func (s *Server) discoveryLoop() {
+	ticker := time.NewTicker(discoveryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.quitCh:
+			return
+		}
+
+		missing := s.MaxOutboundPeers - s.outboundPeerCount()
+		if missing > 0 {
+			addrs := s.addrBook.Pick(missing, s.isKnownPeerAddr)
+			for _, addr := range addrs {
+				addr := addr
+				s.spawn(func() {
+					if err := s.dial(addr); err != nil {
+						s.Logger.Log("msg", "could not dial peer", "addr", addr, "err", err)
+					}
+				})
+			}
+			if len(addrs) < missing {
+				s.broadcast(NewMessage(MessageTypeGetPeers, nil))
+			}
+		}
+
+		if err := s.addrBook.Save(); err != nil {
+			s.Logger.Log("msg", "could not save address book", "err", err)
+		}
+	}
+}
+
+// dial connects to an address from the address book; only transports implementing Dialer can do that
+func (s *Server) dial(addr string) error {
+	dialer, ok := s.Transport.(Dialer)
+	if !ok {
+		return fmt.Errorf("transport %T can't dial addresses", s.Transport)
+	}
+	s.addrBook.MarkAttempt(addr)
+
+	err := dialer.Dial(addr)
+	if errors.Is(err, ErrSelfConnection) {
+		s.markSelfAddr(addr)
+	}
+	return err
+}
+
+func (s *Server) outboundPeerCount() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	n := 0
+	for _, peer := range s.peerMap {
+		if peer.Outgoing {
+			n++
+		}
+	}
+	return n
+}
+
+func (s *Server) markSelfAddr(addr string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.selfAddrs[addr] = true
+}
+
+// whether addr is our own address, a banned one or the one of a peer we are connected to already
+func (s *Server) isKnownPeerAddr(addr string) bool {
+	if self, ok := normalizeAddr(s.ListenAddr); ok && self == addr {
+		return true
+	}
+	if host, _, err := net.SplitHostPort(addr); err == nil && s.banList.IsBanned(host) {
+		return true
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.selfAddrs[addr] {
+		return true
+	}
+	for _, peer := range s.peerMap {
+		if peer.listenAddr == addr {
+			return true
+		}
+	}
+	// a connection we dialed is known by the address dialed while the handshake is still going on
+	for _, peer := range s.handshaking {
+		if len(peer.listenAddr) > 0 && peer.listenAddr == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// address the peer accepts connections on
+// the host is only taken from the handshake if the peer advertised one; otherwise it is the host the peer connected from
+func advertisedAddr(peer *Peer, hs *HandshakeMessage) string {
+	if peer.Outgoing && len(peer.listenAddr) > 0 {
+		return peer.listenAddr
+	}
+
+	host, port, err := net.SplitHostPort(hs.ListenAddr)
+	if err != nil {
+		return ""
+	}
+	if ip := net.ParseIP(host); len(host) == 0 || (ip != nil && ip.IsUnspecified()) {
+		host, _, _ = net.SplitHostPort(peer.remoteAddr)
+	}
+	addr, _ := normalizeAddr(net.JoinHostPort(host, port))
+	return addr
+}
+
+func (s *Server) sendGetPeersMsg(peer *Peer) error {
+	return s.Transport.SendMsg(peer.Addr, NewMessage(MessageTypeGetPeers, nil))
+}
+
+func (s *Server) processGetPeersMsg(req *DecodedMsg) error {
+	s.mu.RLock()
+	peer, ok := s.peerMap[req.From]
+	s.mu.RUnlock()
+	if !ok {
+		return nil
+	}
+
+	peersMsg := &PeersMessage{}
+	for _, addr := range s.addrBook.Sample(maxPeersPerMessage) {
+		// the peer knows its own address
+		if addr != peer.listenAddr {
+			peersMsg.Addrs = append(peersMsg.Addrs, addr)
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	if err := gob.NewEncoder(buf).Encode(peersMsg); err != nil {
+		return err
+	}
+	msg := NewMessage(MessageTypePeers, buf.Bytes())
+	return s.reply(req, msg)
+}
+
+func (s *Server) processPeersMsg(from NetAddr, msg *PeersMessage) error {
+	addrs := msg.Addrs
+	if len(addrs) > maxPeersPerMessage {
+		addrs = addrs[:maxPeersPerMessage]
+	}
+
+	added := 0
+	for _, addr := range addrs {
+		if s.addrBook.Add(addr, string(from)) {
+			added++
+		}
+	}
+	if added > 0 {
+		s.Logger.Log("msg", "learned new peer addresses", "from", from, "count", added)
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package network
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPeerExchange(t *testing.T) {
+	a := newTestServer(t, "A", 0)
+	a.addrBook.Add("10.0.0.1:3000", "")
+	a.addrBook.Add("10.0.0.2:3000", "")
+
+	b := newTestServer(t, "B", 0)
+
+	// the transport of b is connected to a by hand; neither server runs
+	assert.Nil(t, b.Transport.Connect(a.Transport))
+	a.peerMap["B"] = &Peer{Addr: "B", listenAddr: "10.0.0.2:3000"}
+	assert.Nil(t, a.processGetPeersMsg(&DecodedMsg{From: "B"}))
+
+	select {
+	case rpc := <-b.RpcCh:
+		msg, err := DefaultRPCDecodeFunc(rpc)
+		assert.Nil(t, err)
+		peersMsg, ok := msg.Data.(*PeersMessage)
+		assert.True(t, ok)
+		// the peer isn't told about itself
+		assert.Equal(t, []string{"10.0.0.1:3000"}, peersMsg.Addrs)
+
+		assert.Nil(t, b.processPeersMsg(msg.From, peersMsg))
+		assert.True(t, b.addrBook.Has("10.0.0.1:3000"))
+	case <-time.After(5 * time.Second):
+		t.Fatal("peers message not delivered")
+	}
+}
+
+func TestProcessPeersMsgIsBounded(t *testing.T) {
+	s := newTestServer(t, "A", 0)
+
+	msg := &PeersMessage{}
+	for i := 1; i <= maxPeersPerMessage+50; i++ {
+		msg.Addrs = append(msg.Addrs, fmt.Sprintf("10.0.0.1:%d", 3000+i))
+	}
+	assert.Nil(t, s.processPeersMsg("b", msg))
+	assert.Equal(t, maxPeersPerMessage, s.addrBook.Size())
+}
+
+func TestAdvertisedAddr(t *testing.T) {
+	outgoing := &Peer{Addr: "a", Outgoing: true, listenAddr: "10.0.0.1:3000", remoteAddr: "10.0.0.7:51000"}
+	assert.Equal(t, "10.0.0.1:3000", advertisedAddr(outgoing, &HandshakeMessage{ListenAddr: ":4000"}))
+
+	incoming := &Peer{Addr: "b", remoteAddr: "10.0.0.8:51000"}
+	assert.Equal(t, "10.0.0.5:4000", advertisedAddr(incoming, &HandshakeMessage{ListenAddr: "10.0.0.5:4000"}))
+	// no host advertised; it is the one the peer connected from
+	assert.Equal(t, "10.0.0.8:4000", advertisedAddr(incoming, &HandshakeMessage{ListenAddr: ":4000"}))
+}
+
+func TestHandshakingPeerAddrIsKnown(t *testing.T) {
+	s := newTestServer(t, "A", 0)
+	s.handshaking["B"] = newPeer(PeerEvent{Addr: "B", Outgoing: true, DialedAddr: "10.0.0.2:3000"})
+
+	assert.True(t, s.isKnownPeerAddr("10.0.0.2:3000"))
+	assert.False(t, s.isKnownPeerAddr("10.0.0.3:3000"))
+}
@@ -0,0 +1,95 @@
+package network
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// a frame on the wire is laid out as
+// | payload length (4) | message type (1) | protocol (1) | checksum (4) | request id (8) | reply to (8) | payload |
+// the checksum is the first 4 bytes of the sha256 of the payload
+const (
+	frameHeaderSize = 26
+	// upper bound for the payload of a single frame; large enough for a batch of blocks
+	MaxFrameSize = 32 << 20
+)
+
+var (
+	ErrFrameTooLarge = errors.New("frame exceeds the max frame size")
+	ErrFrameChecksum = errors.New("frame checksum mismatch")
+)
+
+func frameChecksum(payload []byte) uint32 {
+	h := sha256.Sum256(payload)
+	return binary.BigEndian.Uint32(h[:4])
+}
+
+// EncodeFrame returns the frame carrying msg
+func EncodeFrame(msg *Message) ([]byte, error) {
+	if len(msg.Data) > MaxFrameSize {
+		return nil, ErrFrameTooLarge
+	}
+
+	buf := make([]byte, frameHeaderSize+len(msg.Data))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(msg.Data)))
+	buf[4] = byte(msg.Headers)
+	buf[5] = byte(msg.Protocol)
+	binary.BigEndian.PutUint32(buf[6:10], frameChecksum(msg.Data))
+	binary.BigEndian.PutUint64(buf[10:18], msg.ID)
+	binary.BigEndian.PutUint64(buf[18:26], msg.ReplyTo)
+	copy(buf[frameHeaderSize:], msg.Data)
+
+	return buf, nil
+}
+
+func WriteFrame(w io.Writer, msg *Message) error {
+	frame, err := EncodeFrame(msg)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(frame)
+	return err
+}
+
+// ReadFrame reads exactly one frame from r; a frame split over several reads is reassembled
+// io.EOF is only returned if the stream ended cleanly between two frames
+func ReadFrame(r io.Reader) (*Message, error) {
+	header := make([]byte, frameHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	size := binary.BigEndian.Uint32(header[0:4])
+	if size > MaxFrameSize {
+		return nil, fmt.Errorf("%w: %d bytes", ErrFrameTooLarge, size)
+	}
+
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	if frameChecksum(payload) != binary.BigEndian.Uint32(header[6:10]) {
+		return nil, ErrFrameChecksum
+	}
+
+	msg := NewMessage(MessageType(header[4]), payload)
+	msg.Protocol = ProtocolID(header[5])
+	msg.ID = binary.BigEndian.Uint64(header[10:18])
+	msg.ReplyTo = binary.BigEndian.Uint64(header[18:26])
+	return msg, nil
+}
+
+// rpc handed over to the server; the payload is the encoded message as expected by the RPCDecodeFunc
+func rpcFromFrame(from NetAddr, msg *Message) RPC {
+	return RPC{
+		From:    from,
+		Payload: bytes.NewReader(msg.Bytes()),
+	}
+}
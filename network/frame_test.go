@@ -0,0 +1,110 @@
+package network
+
+import (
+	"bytes"
+	"encoding/gob"
+	"io"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/EggsyOnCode/xenolith/core"
+	"github.com/EggsyOnCode/xenolith/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	buf := &bytes.Buffer{}
+	msgs := []*Message{
+		NewMessage(MessageTypeTx, []byte("foo")),
+		NewMessage(MessageGetStatusType, nil),
+		NewMessage(MessageTypeBlocks, bytes.Repeat([]byte{0xab}, 100000)),
+		NewMessage(MessageTypeGetPeers, nil),
+		{Headers: MessageStatusType, Data: []byte("bar"), ID: 7, ReplyTo: 1 << 40},
+	}
+	for _, msg := range msgs {
+		assert.Nil(t, WriteFrame(buf, msg))
+	}
+
+	// frames have to be reassembled even if they trickle in one byte at a time
+	r := iotest.OneByteReader(buf)
+	for _, msg := range msgs {
+		decoded, err := ReadFrame(r)
+		assert.Nil(t, err)
+		assert.Equal(t, msg.Headers, decoded.Headers)
+		assert.Equal(t, msg.Protocol, decoded.Protocol)
+		assert.Equal(t, msg.ID, decoded.ID)
+		assert.Equal(t, msg.ReplyTo, decoded.ReplyTo)
+		assert.Equal(t, len(msg.Data), len(decoded.Data))
+		assert.True(t, bytes.Equal(msg.Data, decoded.Data))
+	}
+
+	_, err := ReadFrame(r)
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestFrameRejectsCorruptPayload(t *testing.T) {
+	frame, err := EncodeFrame(NewMessage(MessageTypeTx, []byte("foo")))
+	assert.Nil(t, err)
+	frame[len(frame)-1] ^= 0xff
+
+	_, err = ReadFrame(bytes.NewReader(frame))
+	assert.ErrorIs(t, err, ErrFrameChecksum)
+}
+
+func TestFrameRejectsOversizedFrame(t *testing.T) {
+	frame, err := EncodeFrame(NewMessage(MessageTypeTx, []byte("foo")))
+	assert.Nil(t, err)
+	frame[0] = 0xff
+
+	_, err = ReadFrame(bytes.NewReader(frame))
+	assert.ErrorIs(t, err, ErrFrameTooLarge)
+
+	// a torn frame is not a clean EOF
+	_, err = ReadFrame(bytes.NewReader(frame[:frameHeaderSize+1]))
+	assert.NotNil(t, err)
+}
+
+func TestTCPPeerDeliversLargeMessages(t *testing.T) {
+	sender, receiver := securePipe(t)
+	local := sender.conn
+
+	rpcCh := make(chan RPC)
+	go receiver.readLoop(rpcCh, make(chan struct{}))
+
+	blocksMsg := &BlocksMessage{}
+	for i := 0; i < 50; i++ {
+		blocksMsg.Blocks = append(blocksMsg.Blocks, util.NewRandomBlock(t, uint32(i), util.RandomHash()))
+	}
+	buf := &bytes.Buffer{}
+	assert.Nil(t, gob.NewEncoder(buf).Encode(blocksMsg))
+	assert.Greater(t, buf.Len(), 2048)
+
+	go func() {
+		assert.Nil(t, sender.Send(NewMessage(MessageTypeBlocks, buf.Bytes())))
+		assert.Nil(t, sender.Send(NewMessage(MessageGetStatusType, nil)))
+	}()
+
+	select {
+	case rpc := <-rpcCh:
+		msg, err := DefaultRPCDecodeFunc(rpc)
+		assert.Nil(t, err)
+		decoded, ok := msg.Data.(*BlocksMessage)
+		assert.True(t, ok)
+		assert.Equal(t, len(blocksMsg.Blocks), len(decoded.Blocks))
+		assert.Equal(t, blocksMsg.Blocks[49].Hash(core.BlockHasher{}), decoded.Blocks[49].Hash(core.BlockHasher{}))
+	case <-time.After(5 * time.Second):
+		t.Fatal("blocks message not delivered")
+	}
+
+	select {
+	case rpc := <-rpcCh:
+		msg, err := DefaultRPCDecodeFunc(rpc)
+		assert.Nil(t, err)
+		assert.IsType(t, &GetStatusMessage{}, msg.Data)
+	case <-time.After(5 * time.Second):
+		t.Fatal("status message not delivered")
+	}
+
+	local.Close()
+}
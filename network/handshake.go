@@ -0,0 +1,146 @@
+package network
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/EggsyOnCode/xenolith/core"
+)
+
+const (
+	// version of the wire protocol; peers speaking another version are dropped
+	ProtocolVersion uint32 = 7
+	// network the node joins if none has been configured
+	DefaultNetworkID uint32 = 1
+
+	handshakeTimeout = 5 * time.Second
+)
+
+var (
+	// the peer doesn't speak our protocol or isn't on our chain
+	ErrIncompatiblePeer = errors.New("incompatible peer")
+	// we dialed an address that turned out to be our own
+	ErrSelfConnection = errors.New("connected to ourselves")
+)
+
+// capabilities advertised in the handshake
+const (
+	// the node serves the blocks of its chain
+	CapabilityBlocks uint64 = 1 << iota
+	// the node produces blocks
+	CapabilityValidator
+	// the node answers the proof requests of light clients
+	CapabilityProofs
+)
+
+func (s *Server) newHandshakeMessage() (*HandshakeMessage, error) {
+	genesis, err := s.chain.GetHeaders(0)
+	if err != nil {
+		return nil, err
+	}
+
+	// a light client has nothing to serve
+	var capabilities uint64
+	if !s.Light {
+		capabilities = CapabilityBlocks | CapabilityProofs
+	}
+	if s.isValidator {
+		capabilities |= CapabilityValidator
+	}
+
+	return &HandshakeMessage{
+		ProtocolVersion: ProtocolVersion,
+		NetworkID:       s.NetworkID,
+		GenesisHash:     core.BlockHasher{}.Hash(genesis),
+		NodeID:          s.ID,
+		Nonce:           s.nonce,
+		ListenAddr:      s.ListenAddr,
+		Capabilities:    capabilities,
+	}, nil
+}
+
+// the peer has to be another node on the same protocol version, network and chain
+func (s *Server) checkHandshake(ours, theirs *HandshakeMessage) error {
+	if theirs.Nonce == ours.Nonce {
+		return ErrSelfConnection
+	}
+	if theirs.ProtocolVersion != ours.ProtocolVersion {
+		return fmt.Errorf("%w: peer speaks protocol version %d, we speak %d", ErrIncompatiblePeer, theirs.ProtocolVersion, ours.ProtocolVersion)
+	}
+	if theirs.NetworkID != ours.NetworkID {
+		return fmt.Errorf("%w: peer is on network %d, we are on %d", ErrIncompatiblePeer, theirs.NetworkID, ours.NetworkID)
+	}
+	if theirs.GenesisHash != ours.GenesisHash {
+		return fmt.Errorf("%w: peer has genesis (%s), we have (%s)", ErrIncompatiblePeer, theirs.GenesisHash, ours.GenesisHash)
+	}
+	return nil
+}
+
+// sendHandshake sends our HandshakeMessage to a new connection; both ends send theirs right away
+func (s *Server) sendHandshake(peer *Peer) error {
+	hs, err := s.newHandshakeMessage()
+	if err != nil {
+		return err
+	}
+
+	buf := &bytes.Buffer{}
+	if err := gob.NewEncoder(buf).Encode(hs); err != nil {
+		return err
+	}
+	return s.Transport.SendMsg(peer.Addr, NewMessage(MessageTypeHandshake, buf.Bytes()))
+}
+
+// processHandshakeMsg checks the handshake of a new connection
+// the peer only makes it into the peerMap if it is compatible
+func (s *Server) processHandshakeMsg(from NetAddr, theirs *HandshakeMessage) {
+	s.mu.Lock()
+	peer, ok := s.handshaking[from]
+	if ok {
+		delete(s.handshaking, from)
+		peer.handshakeTimer.Stop()
+	}
+	s.mu.Unlock()
+	// a second handshake or one from a peer that is gone already
+	if !ok {
+		return
+	}
+
+	ours, err := s.newHandshakeMessage()
+	if err == nil {
+		err = s.checkHandshake(ours, theirs)
+	}
+	if err != nil {
+		s.Logger.Log("msg", "dropping peer after failed handshake", "peer", from, "err", err)
+		if peer.Outgoing {
+			if errors.Is(err, ErrSelfConnection) {
+				s.markSelfAddr(peer.listenAddr)
+			}
+			// not worth dialing again; e.g it is on another network or it is us
+			if errors.Is(err, ErrIncompatiblePeer) {
+				s.addrBook.Remove(peer.listenAddr)
+			}
+		}
+		s.Transport.Disconnect(from)
+		return
+	}
+
+	s.addPeer(peer, theirs)
+}
+
+// handshakeTimedOut drops a connection that didn't send its handshake in time
+func (s *Server) handshakeTimedOut(peer *Peer) {
+	s.mu.Lock()
+	pending := s.handshaking[peer.Addr] == peer
+	if pending {
+		delete(s.handshaking, peer.Addr)
+	}
+	s.mu.Unlock()
+
+	if pending {
+		s.Logger.Log("msg", "dropping peer without handshake", "peer", peer.Addr, "timeout", handshakeTimeout)
+		s.Transport.Disconnect(peer.Addr)
+	}
+}
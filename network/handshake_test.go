@@ -0,0 +1,131 @@
+package network
+
+import (
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/EggsyOnCode/xenolith/core_types"
+	"github.com/go-kit/log"
+	"github.com/stretchr/testify/assert"
+)
+
+// an in process server on a LocalTransport named after its id
+func newTestServer(t *testing.T, id string, networkID uint32) *Server {
+	return newTestServerWithOpts(t, ServerOpts{ID: id, NetworkID: networkID})
+}
+
+// every hash is below it, so the blocks of the tests are mined right away
+var testGenesisTarget = new(big.Int).Lsh(big.NewInt(1), 256)
+
+func newTestServerWithOpts(t *testing.T, opts ServerOpts) *Server {
+	if opts.GenesisTarget == nil {
+		opts.GenesisTarget = testGenesisTarget
+	}
+	if opts.Transport == nil {
+		opts.Transport = NewLocalTransport(NetAddr(opts.ID))
+	}
+	opts.Logger = log.NewNopLogger()
+	s, err := NewServer(opts)
+	assert.Nil(t, err)
+	return s
+}
+
+// the handshake the server got from the node with the given id
+func handshakeFrom(s *Server, id string) *HandshakeMessage {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, peer := range s.peerMap {
+		if peer.handshake.NodeID == id {
+			return peer.handshake
+		}
+	}
+	return nil
+}
+
+func TestHandshake(t *testing.T) {
+	a := newTestServer(t, "A", 0)
+	b := newTestServer(t, "B", 0)
+	startServers(a, b)
+	connectServers(t, a, b)
+
+	hs := handshakeFrom(a, "B")
+	assert.Equal(t, DefaultNetworkID, hs.NetworkID)
+	assert.True(t, hs.HasCapability(CapabilityBlocks))
+	assert.False(t, hs.HasCapability(CapabilityValidator))
+	assert.NotNil(t, handshakeFrom(b, "A"))
+}
+
+func TestHandshakeRejectsOtherNetwork(t *testing.T) {
+	a := newTestServer(t, "A", 1)
+	b := newTestServer(t, "B", 2)
+	startServers(a, b)
+	assert.Nil(t, a.Transport.Connect(b.Transport))
+
+	// both ends hang up
+	assert.Eventually(t, func() bool {
+		return len(a.Transport.Peers()) == 0 && len(b.Transport.Peers()) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestCheckHandshake(t *testing.T) {
+	s := newTestServer(t, "A", 0)
+	ours, err := s.newHandshakeMessage()
+	assert.Nil(t, err)
+
+	theirs := *ours
+	theirs.NodeID = "B"
+	theirs.Nonce = ours.Nonce + 1
+	assert.Nil(t, s.checkHandshake(ours, &theirs))
+
+	otherGenesis := theirs
+	otherGenesis.GenesisHash = core_types.Hash{0x1}
+	assert.ErrorIs(t, s.checkHandshake(ours, &otherGenesis), ErrIncompatiblePeer)
+
+	otherVersion := theirs
+	otherVersion.ProtocolVersion = ProtocolVersion + 1
+	assert.ErrorIs(t, s.checkHandshake(ours, &otherVersion), ErrIncompatiblePeer)
+
+	// a node dialing itself; the node id alone doesn't tell
+	self := *ours
+	self.NodeID = "B"
+	assert.ErrorIs(t, s.checkHandshake(ours, &self), ErrSelfConnection)
+}
+
+func TestIncompatiblePeerNotAdded(t *testing.T) {
+	a := newTestServer(t, "A", 1)
+	b := newTestServer(t, "B", 2)
+	startServers(a, b)
+	assert.Nil(t, a.Transport.Connect(b.Transport))
+
+	assert.Never(t, func() bool {
+		return peerCount(a) > 0 || peerCount(b) > 0
+	}, 200*time.Millisecond, 10*time.Millisecond)
+}
+
+func TestMsgsBeforeHandshakeIgnored(t *testing.T) {
+	a := newTestServer(t, "A", 0)
+	startServers(a)
+
+	// a bare transport that never sends its handshake
+	other := NewLocalTransport("X")
+	assert.Nil(t, other.Connect(a.Transport))
+	assert.Nil(t, other.SendMsg("A", NewMessage(MessageGetStatusType, nil)))
+
+	assert.Never(t, func() bool {
+		for {
+			select {
+			case rpc := <-other.Consume():
+				msg, err := DefaultRPCDecodeFunc(rpc)
+				if err == nil {
+					if _, ok := msg.Data.(*StatusMessage); ok {
+						return true
+					}
+				}
+			default:
+				return false
+			}
+		}
+	}, 200*time.Millisecond, 10*time.Millisecond)
+	assert.Equal(t, 0, peerCount(a))
+}
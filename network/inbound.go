@@ -0,0 +1,187 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// msgs of a peer waiting to be routed; a peer filling its queue gets its msgs dropped
+	maxPeerInboundQueue = 128
+	// what a peer loses for each msg over its limits
+	penaltyRateLimited = 5
+)
+
+var (
+	ErrRateLimited       = errors.New("peer exceeded its rate limit")
+	ErrInboundQueueFull  = errors.New("inbound queue of peer is full")
+	DefaultPeerRateLimit = RateLimit{
+		MsgsPerSecond:  200,
+		MsgBurst:       500,
+		BytesPerSecond: 4 << 20,
+		// a frame of the max size has to get through
+		ByteBurst: MaxFrameSize + frameHeaderSize,
+	}
+)
+
+// RateLimit is how much a single peer may send us; fields left zero take the ones of DefaultPeerRateLimit
+type RateLimit struct {
+	MsgsPerSecond  float64
+	MsgBurst       float64
+	BytesPerSecond float64
+	ByteBurst      float64
+}
+
+func (l RateLimit) withDefaults() RateLimit {
+	if l.MsgsPerSecond <= 0 {
+		l.MsgsPerSecond = DefaultPeerRateLimit.MsgsPerSecond
+	}
+	if l.MsgBurst <= 0 {
+		l.MsgBurst = DefaultPeerRateLimit.MsgBurst
+	}
+	if l.BytesPerSecond <= 0 {
+		l.BytesPerSecond = DefaultPeerRateLimit.BytesPerSecond
+	}
+	if l.ByteBurst <= 0 {
+		l.ByteBurst = DefaultPeerRateLimit.ByteBurst
+	}
+	return l
+}
+
+// tokenBucket fills up at rate tokens a second up to burst
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate, burst float64, now time.Time) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: now}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if now.After(b.last) {
+		b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+		b.last = now
+	}
+}
+
+type inboundPeer struct {
+	msgs  *tokenBucket
+	bytes *tokenBucket
+	queue []RPC
+}
+
+// inboundQueues sit between the transport and the router
+// every peer has a rate limit and a bounded queue of its own; the queues are drained round robin
+// so a peer sending a lot only ever holds up its own msgs
+type inboundQueues struct {
+	mu    sync.Mutex
+	limit RateLimit
+	peers map[NetAddr]*inboundPeer
+	// peers with msgs waiting, in the order they are served
+	ready []NetAddr
+	// signalled whenever a msg is queued
+	notify chan struct{}
+	// the clock; swappable for tests
+	now func() time.Time
+}
+
+func newInboundQueues(limit RateLimit) *inboundQueues {
+	return &inboundQueues{
+		limit:  limit.withDefaults(),
+		peers:  make(map[NetAddr]*inboundPeer),
+		notify: make(chan struct{}, 1),
+		now:    time.Now,
+	}
+}
+
+// size of the msg on the wire as far as the rate limit is concerned
+func payloadSize(rpc RPC) int {
+	if r, ok := rpc.Payload.(interface{ Len() int }); ok {
+		return r.Len()
+	}
+	return 0
+}
+
+// push queues the msg unless the peer is over its limits or its queue is full
+func (q *inboundQueues) push(rpc RPC) error {
+	size := float64(payloadSize(rpc))
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := q.now()
+	p, ok := q.peers[rpc.From]
+	if !ok {
+		p = &inboundPeer{
+			msgs:  newTokenBucket(q.limit.MsgsPerSecond, q.limit.MsgBurst, now),
+			bytes: newTokenBucket(q.limit.BytesPerSecond, q.limit.ByteBurst, now),
+		}
+		q.peers[rpc.From] = p
+	}
+
+	p.msgs.refill(now)
+	p.bytes.refill(now)
+	if p.msgs.tokens < 1 || p.bytes.tokens < size {
+		return fmt.Errorf("%w: %d bytes from %s", ErrRateLimited, int(size), rpc.From)
+	}
+	if len(p.queue) >= maxPeerInboundQueue {
+		return fmt.Errorf("%w: %s", ErrInboundQueueFull, rpc.From)
+	}
+	p.msgs.tokens--
+	p.bytes.tokens -= size
+
+	if len(p.queue) == 0 {
+		q.ready = append(q.ready, rpc.From)
+	}
+	p.queue = append(p.queue, rpc)
+
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// pop takes the next msg of the peer whose turn it is
+func (q *inboundQueues) pop() (RPC, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.ready) > 0 {
+		addr := q.ready[0]
+		q.ready = q.ready[1:]
+		p, ok := q.peers[addr]
+		if !ok || len(p.queue) == 0 {
+			continue
+		}
+
+		rpc := p.queue[0]
+		p.queue[0] = RPC{}
+		p.queue = p.queue[1:]
+		// back to the end of the line if it has more
+		if len(p.queue) > 0 {
+			q.ready = append(q.ready, addr)
+		}
+		return rpc, true
+	}
+	return RPC{}, false
+}
+
+// remove forgets the peer along with the msgs it still has queued
+func (q *inboundQueues) remove(addr NetAddr) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.peers, addr)
+}
+
+func (q *inboundQueues) queued(addr NetAddr) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if p, ok := q.peers[addr]; ok {
+		return len(p.queue)
+	}
+	return 0
+}
@@ -0,0 +1,124 @@
+package network
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func inboundRPC(from NetAddr, size int) RPC {
+	return *NewRPCMsg(from, make([]byte, size))
+}
+
+func TestTokenBucketRefills(t *testing.T) {
+	now := time.Now()
+	b := newTokenBucket(10, 5, now)
+	b.tokens = 0
+
+	b.refill(now.Add(200 * time.Millisecond))
+	assert.InDelta(t, 2, b.tokens, 0.001)
+	// never above the burst
+	b.refill(now.Add(time.Hour))
+	assert.Equal(t, float64(5), b.tokens)
+}
+
+func TestInboundQueuesLimitEachPeer(t *testing.T) {
+	now := time.Now()
+	q := newInboundQueues(RateLimit{MsgsPerSecond: 1, MsgBurst: 2, BytesPerSecond: 100, ByteBurst: 100})
+	q.now = func() time.Time { return now }
+
+	assert.Nil(t, q.push(inboundRPC("A", 10)))
+	assert.Nil(t, q.push(inboundRPC("A", 10)))
+	assert.ErrorIs(t, q.push(inboundRPC("A", 10)), ErrRateLimited)
+	// the other peers have limits of their own
+	assert.Nil(t, q.push(inboundRPC("B", 10)))
+	assert.ErrorIs(t, q.push(inboundRPC("B", 101)), ErrRateLimited)
+
+	now = now.Add(time.Second)
+	assert.Nil(t, q.push(inboundRPC("A", 10)))
+	assert.Equal(t, 3, q.queued("A"))
+}
+
+func TestInboundQueueBounded(t *testing.T) {
+	q := newInboundQueues(RateLimit{MsgsPerSecond: 1e6, MsgBurst: 1e6})
+	for i := 0; i < maxPeerInboundQueue; i++ {
+		assert.Nil(t, q.push(inboundRPC("A", 1)))
+	}
+	assert.ErrorIs(t, q.push(inboundRPC("A", 1)), ErrInboundQueueFull)
+	assert.Nil(t, q.push(inboundRPC("B", 1)))
+
+	q.remove("A")
+	assert.Equal(t, 0, q.queued("A"))
+	rpc, ok := q.pop()
+	assert.True(t, ok)
+	assert.Equal(t, NetAddr("B"), rpc.From)
+	_, ok = q.pop()
+	assert.False(t, ok)
+}
+
+func TestInboundQueuesTakeTurns(t *testing.T) {
+	q := newInboundQueues(RateLimit{})
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, q.push(inboundRPC("A", 1)))
+	}
+	assert.Nil(t, q.push(inboundRPC("B", 1)))
+	assert.Nil(t, q.push(inboundRPC("C", 1)))
+
+	order := []NetAddr{}
+	for rpc, ok := q.pop(); ok; rpc, ok = q.pop() {
+		order = append(order, rpc.From)
+	}
+	assert.Equal(t, []NetAddr{"A", "B", "C", "A", "A"}, order)
+}
+
+// a peer flooding us is banned while the other peers are served as before
+func TestFloodingPeerBanned(t *testing.T) {
+	a := newTestServerWithOpts(t, ServerOpts{ID: "A", PeerRateLimit: RateLimit{MsgsPerSecond: 1, MsgBurst: 10}})
+	flooder := newTestServer(t, "F", 0)
+	b := newTestServer(t, "B", 0)
+	startServers(a, flooder, b)
+	connectServers(t, flooder, a)
+	connectServers(t, b, a)
+
+	for i := 0; i < 100; i++ {
+		flooder.Transport.SendMsg("A", NewMessage(MessageGetStatusType, nil))
+	}
+	assert.Eventually(t, func() bool {
+		return len(a.banList.List()) == 1
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, 1, peerCount(a))
+
+	reply, err := b.Request("A", NewMessage(MessageGetStatusType, nil), time.Second)
+	assert.Nil(t, err)
+	assert.IsType(t, &StatusMessage{}, reply.Data)
+}
+
+// while the server falls behind the msgs wait in the queues of the peers; none of them are dropped
+// and a peer sending a few msgs isn't stuck behind the backlog of one sending a lot
+func TestRouteLoopWaitsForRoomTakingTurns(t *testing.T) {
+	s := newTestServerWithOpts(t, ServerOpts{ID: "A", PeerRateLimit: RateLimit{MsgsPerSecond: 1e6, MsgBurst: 1e6}})
+	filler := NewMessage(MessageGetStatusType, nil)
+	for i := 0; i < protocolQueueSize; i++ {
+		assert.Nil(t, s.Router.Route(routedRPC(filler), nil))
+	}
+	for i := 0; i < maxPeerInboundQueue; i++ {
+		assert.Nil(t, s.inbound.push(*NewRPCMsg("flood", filler.Bytes())))
+	}
+	assert.Nil(t, s.inbound.push(*NewRPCMsg("honest", filler.Bytes())))
+	s.spawn(s.routeLoop)
+
+	from := []NetAddr{}
+	for i := 0; i < protocolQueueSize+maxPeerInboundQueue+1; i++ {
+		select {
+		case msg := <-s.executionCh:
+			from = append(from, msg.From)
+		case <-time.After(time.Second):
+			t.Fatalf("only %d msgs routed", i)
+		}
+	}
+	// the first msg of the flood was waiting for room already when the honest one came in
+	assert.Contains(t, from[protocolQueueSize:protocolQueueSize+2], NetAddr("honest"))
+	assert.Equal(t, 0, s.inbound.queued("flood"))
+	stopServer(t, s)
+}
@@ -0,0 +1,276 @@
+package network
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/EggsyOnCode/xenolith/core"
+	"github.com/EggsyOnCode/xenolith/core_types"
+)
+
+const (
+	// items remembered per peer as known to it; the oldest are forgotten first
+	maxKnownInventory = 5000
+	// items in a single Inv or GetData msg; the rest is ignored
+	maxInvItems = 1000
+	// an item asked for with GetData isn't asked from another peer for this long
+	getDataTimeout = 10 * time.Second
+	// how long a new peer is given to send the hashes of its mempool
+	mempoolTimeout = 10 * time.Second
+)
+
+type InvType byte
+
+const (
+	InvTypeTx    InvType = 0x1
+	InvTypeBlock InvType = 0x2
+)
+
+func (t InvType) String() string {
+	switch t {
+	case InvTypeTx:
+		return "tx"
+	case InvTypeBlock:
+		return "block"
+	default:
+		return fmt.Sprintf("InvType(%d)", byte(t))
+	}
+}
+
+type InvItem struct {
+	Type InvType
+	Hash core_types.Hash
+}
+
+// knownInventory is a bounded set of items; once full the oldest item makes room for the new one
+type knownInventory struct {
+	mu    sync.Mutex
+	items map[InvItem]struct{}
+	order []InvItem
+	limit int
+}
+
+func newKnownInventory(limit int) *knownInventory {
+	return &knownInventory{
+		items: make(map[InvItem]struct{}),
+		limit: limit,
+	}
+}
+
+// Add reports whether the item is new
+func (k *knownInventory) Add(item InvItem) bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if _, ok := k.items[item]; ok {
+		return false
+	}
+	if len(k.order) == k.limit {
+		delete(k.items, k.order[0])
+		k.order = k.order[1:]
+	}
+	k.items[item] = struct{}{}
+	k.order = append(k.order, item)
+	return true
+}
+
+func (k *knownInventory) Has(item InvItem) bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	_, ok := k.items[item]
+	return ok
+}
+
+// invRequests keeps track of the items asked for with GetData so the same item isn't fetched from every peer announcing it
+type invRequests struct {
+	mu       sync.Mutex
+	asked    map[InvItem]time.Time
+	lifetime time.Duration
+}
+
+func newInvRequests(lifetime time.Duration) *invRequests {
+	return &invRequests{
+		asked:    make(map[InvItem]time.Time),
+		lifetime: lifetime,
+	}
+}
+
+// Ask reports whether the item should be asked for; an item asked for a while ago without an answer is asked for again
+func (r *invRequests) Ask(item InvItem) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	if at, ok := r.asked[item]; ok && now.Sub(at) < r.lifetime {
+		return false
+	}
+	// dropping the stale ones while we are at it
+	for it, at := range r.asked {
+		if now.Sub(at) >= r.lifetime {
+			delete(r.asked, it)
+		}
+	}
+	r.asked[item] = now
+	return true
+}
+
+func (r *invRequests) Done(item InvItem) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.asked, item)
+}
+
+// markKnown records that the peer the msg came from has the item; it is never announced back to it
+func (s *Server) markKnown(from NetAddr, item InvItem) {
+	s.mu.RLock()
+	peer, ok := s.peerMap[from]
+	s.mu.RUnlock()
+	if ok {
+		peer.known.Add(item)
+	}
+}
+
+// announce sends an Inv for the item to every peer not known to have it
+func (s *Server) announce(item InvItem) error {
+	buf := &bytes.Buffer{}
+	if err := gob.NewEncoder(buf).Encode(&InvMessage{Items: []InvItem{item}}); err != nil {
+		return err
+	}
+	msg := NewMessage(MessageTypeInv, buf.Bytes())
+
+	s.mu.RLock()
+	peers := []*Peer{}
+	for _, peer := range s.peerMap {
+		if peer.known.Add(item) {
+			peers = append(peers, peer)
+		}
+	}
+	s.mu.RUnlock()
+
+	// the transport drops the peers it can't write to
+	for _, peer := range peers {
+		if err := s.Transport.SendMsg(peer.Addr, msg); err != nil {
+			s.Logger.Log("msg", "could not announce", "peer", peer.Addr, "item", item.Type, "err", err)
+		}
+	}
+	return nil
+}
+
+func (s *Server) hasInvItem(item InvItem) bool {
+	switch item.Type {
+	case InvTypeTx:
+		return s.memPool.Contains(item.Hash)
+	case InvTypeBlock:
+		_, err := s.chain.GetBlockByHash(item.Hash)
+		return err == nil
+	default:
+		return false
+	}
+}
+
+// processInvMsg asks the peer for the announced items we don't have yet
+func (s *Server) processInvMsg(from NetAddr, msg *InvMessage) error {
+	items := msg.Items
+	if len(items) > maxInvItems {
+		items = items[:maxInvItems]
+	}
+
+	wanted := []InvItem{}
+	for _, item := range items {
+		s.markKnown(from, item)
+		if s.hasInvItem(item) || !s.invRequests.Ask(item) {
+			continue
+		}
+		wanted = append(wanted, item)
+	}
+	if len(wanted) == 0 {
+		return nil
+	}
+
+	buf := &bytes.Buffer{}
+	if err := gob.NewEncoder(buf).Encode(&GetDataMessage{Items: wanted}); err != nil {
+		return err
+	}
+	return s.sendToPeer(from, NewMessage(MessageTypeGetData, buf.Bytes()))
+}
+
+// processGetDataMsg sends the requested items we have as regular tx and block msgs
+func (s *Server) processGetDataMsg(from NetAddr, msg *GetDataMessage) error {
+	items := msg.Items
+	if len(items) > maxInvItems {
+		items = items[:maxInvItems]
+	}
+
+	for _, item := range items {
+		buf := &bytes.Buffer{}
+		var msgType MessageType
+		switch item.Type {
+		case InvTypeTx:
+			tx := s.memPool.Get(item.Hash)
+			if tx == nil {
+				continue
+			}
+			if err := tx.Encode(core.NewGobTxEncoder(buf)); err != nil {
+				return err
+			}
+			msgType = MessageTypeTx
+		case InvTypeBlock:
+			block, err := s.chain.GetBlockByHash(item.Hash)
+			if err != nil {
+				continue
+			}
+			if err := detachBlock(block).Encode(core.NewGobBlockEncoder(buf)); err != nil {
+				return err
+			}
+			msgType = MessageTypeBlock
+		default:
+			continue
+		}
+
+		s.markKnown(from, item)
+		if err := s.sendToPeer(from, NewMessage(msgType, buf.Bytes())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// requestMempool asks a new peer for the tx pending in its mempool so a node joining late gets
+// the tx gossiped before it came; the ones we are missing are fetched like announced ones
+func (s *Server) requestMempool(peer NetAddr) {
+	reply, err := s.Request(peer, NewMessage(MessageTypeGetMempool, nil), mempoolTimeout)
+	if err != nil {
+		s.Logger.Log("msg", "no mempool from peer", "peer", peer, "err", err)
+		return
+	}
+	inv, ok := reply.Data.(*MempoolInvMessage)
+	if !ok {
+		s.Logger.Log("msg", "unexpected reply to a mempool request", "peer", peer, "type", fmt.Sprintf("%T", reply.Data))
+		return
+	}
+
+	items := make([]InvItem, 0, len(inv.Hashes))
+	for _, hash := range inv.Hashes {
+		items = append(items, InvItem{Type: InvTypeTx, Hash: hash})
+	}
+	if err := s.processInvMsg(peer, &InvMessage{Items: items}); err != nil {
+		s.Logger.Log("err", err)
+	}
+}
+
+func (s *Server) processGetMempoolMsg(req *DecodedMsg) error {
+	hashes := s.memPool.PendingHashes(maxInvItems)
+	for _, hash := range hashes {
+		s.markKnown(req.From, InvItem{Type: InvTypeTx, Hash: hash})
+	}
+
+	buf := &bytes.Buffer{}
+	if err := gob.NewEncoder(buf).Encode(&MempoolInvMessage{Hashes: hashes}); err != nil {
+		return err
+	}
+	return s.reply(req, NewMessage(MessageTypeMempoolInv, buf.Bytes()))
+}
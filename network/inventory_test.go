@@ -0,0 +1,163 @@
+package network
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/EggsyOnCode/xenolith/core"
+	"github.com/EggsyOnCode/xenolith/core_types"
+	"github.com/EggsyOnCode/xenolith/crypto_lib"
+	"github.com/stretchr/testify/assert"
+)
+
+// passes the msgs on to the server, remembering the Inv items and compact blocks that came in
+type invRecorder struct {
+	*Server
+	mu    sync.Mutex
+	items map[InvItem]int
+}
+
+func recordInvs(s *Server) *invRecorder {
+	r := &invRecorder{Server: s, items: make(map[InvItem]int)}
+	s.RPCProcessor = r
+	return r
+}
+
+func (r *invRecorder) ProcessMessage(msg *DecodedMsg) error {
+	if inv, ok := msg.Data.(*InvMessage); ok {
+		r.mu.Lock()
+		for _, item := range inv.Items {
+			r.items[item]++
+		}
+		r.mu.Unlock()
+	}
+	if compact, ok := msg.Data.(*CompactBlockMessage); ok && compact.Header != nil {
+		r.mu.Lock()
+		r.items[InvItem{Type: InvTypeBlock, Hash: compact.Header.Hash()}]++
+		r.mu.Unlock()
+	}
+	return r.Server.ProcessMessage(msg)
+}
+
+func (r *invRecorder) announced(item InvItem) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.items[item]
+}
+
+// a - b - c
+func startLine(t *testing.T, a, b, c *Server) {
+	startServers(a, b, c)
+	connectServers(t, a, b)
+	connectServers(t, b, c)
+	assert.Eventually(t, func() bool {
+		return peerCount(a) == 1 && peerCount(b) == 2 && peerCount(c) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestKnownInventoryForgetsOldest(t *testing.T) {
+	k := newKnownInventory(2)
+	first := InvItem{Type: InvTypeTx, Hash: core_types.Hash{1}}
+	second := InvItem{Type: InvTypeTx, Hash: core_types.Hash{2}}
+	third := InvItem{Type: InvTypeBlock, Hash: core_types.Hash{3}}
+
+	assert.True(t, k.Add(first))
+	assert.False(t, k.Add(first))
+	assert.True(t, k.Add(second))
+	assert.True(t, k.Add(third))
+
+	assert.False(t, k.Has(first))
+	assert.True(t, k.Has(second))
+	assert.True(t, k.Has(third))
+}
+
+func TestInvRequestsAskOnce(t *testing.T) {
+	r := newInvRequests(time.Hour)
+	item := InvItem{Type: InvTypeTx, Hash: core_types.Hash{1}}
+
+	assert.True(t, r.Ask(item))
+	assert.False(t, r.Ask(item))
+	r.Done(item)
+	assert.True(t, r.Ask(item))
+}
+
+func TestTxGossipIsNotEchoed(t *testing.T) {
+	a := newTestServer(t, "A", 0)
+	b := newTestServer(t, "B", 0)
+	c := newTestServer(t, "C", 0)
+	recA := recordInvs(a)
+	startLine(t, a, b, c)
+
+	priv := crypto_lib.GeneratePrivateKey()
+	tx := core.NewTransaction([]byte("gossip"))
+	tx.From = priv.PublicKey()
+	assert.Nil(t, tx.Sign(priv))
+	hash := tx.Hash(core.TxHasher{})
+	a.txCh <- tx
+
+	assert.Eventually(t, func() bool {
+		return c.memPool.Contains(hash)
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.True(t, b.memPool.Contains(hash))
+
+	// the tx came from a; nobody announces it back
+	assert.Never(t, func() bool {
+		return recA.announced(InvItem{Type: InvTypeTx, Hash: hash}) > 0
+	}, 200*time.Millisecond, 10*time.Millisecond)
+}
+
+func TestBlockGossipIsNotEchoed(t *testing.T) {
+	a := newTestValidatorServer(t, "A", 0)
+	b := newTestServer(t, "B", 0)
+	c := newTestServer(t, "C", 0)
+	recA := recordInvs(a)
+	startLine(t, a, b, c)
+
+	assert.Nil(t, a.createNewBlock())
+	block, err := a.chain.GetBlock(1)
+	assert.Nil(t, err)
+
+	assert.Eventually(t, func() bool {
+		return c.chain.Height() == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, uint32(1), b.chain.Height())
+
+	assert.Never(t, func() bool {
+		return recA.announced(InvItem{Type: InvTypeBlock, Hash: block.Hash(core.BlockHasher{})}) > 0
+	}, 200*time.Millisecond, 10*time.Millisecond)
+}
+
+func signedTx(t *testing.T, data string) *core.Transaction {
+	priv := crypto_lib.GeneratePrivateKey()
+	tx := core.NewTransaction([]byte(data))
+	tx.From = priv.PublicKey()
+	assert.Nil(t, tx.Sign(priv))
+	return tx
+}
+
+func TestMempoolFetchedOnConnect(t *testing.T) {
+	a := newTestServer(t, "A", 0)
+	late := newTestServer(t, "LATE", 0)
+	startServers(a, late)
+
+	tx := signedTx(t, "before")
+	// the hash is cached in the tx; it is worked out before the server gets to it
+	hash := tx.Hash(core.TxHasher{})
+	a.txCh <- tx
+	assert.Eventually(t, func() bool {
+		return a.memPool.Contains(hash)
+	}, time.Second, 10*time.Millisecond)
+	// slipped into the mempool without going through processTx; late has to check it itself
+	unsigned := core.NewTransaction([]byte("unsigned"))
+	a.memPool.Add(unsigned)
+
+	connectServers(t, late, a)
+	assert.Eventually(t, func() bool {
+		return late.memPool.Contains(hash)
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Never(t, func() bool {
+		return late.memPool.Contains(unsigned.Hash(core.TxHasher{}))
+	}, 200*time.Millisecond, 10*time.Millisecond)
+	assert.Equal(t, 1, late.memPool.PendingCount())
+}
@@ -0,0 +1,272 @@
+package network
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/EggsyOnCode/xenolith/core"
+	"github.com/EggsyOnCode/xenolith/core_types"
+)
+
+const (
+	// how long a full peer is given to answer a proof request
+	proofTimeout = 5 * time.Second
+	// how many blocks behind our head an account proof may be; the full peer could be a block or two behind us
+	maxAccountProofAge = 2
+)
+
+var (
+	ErrNotLightClient   = errors.New("server is not a light client")
+	ErrProofUnavailable = errors.New("no peer could prove it")
+)
+
+// light clients (see ServerOpts.Light) follow the chain by its headers alone
+// the tx and balances they are asked for are fetched from the peers serving proofs and checked against those headers
+
+// processLightMessage is ProcessMessage of a light client; it has no blocks to serve or tx to gossip
+func (s *Server) processLightMessage(msg *DecodedMsg) error {
+	switch t := msg.Data.(type) {
+	case *CompactBlockMessage:
+		return s.processLightHeader(msg.From, t.Header)
+	case *StatusMessage:
+		return s.processStatusMsg(msg.From, t)
+	case *GetStatusMessage:
+		return s.processGetStatusMsg(msg)
+	// tx posted to our api are announced like on any other node; the peers fetch them from the mempool
+	case *GetDataMessage:
+		return s.processGetDataMsg(msg.From, t)
+	case *GetMempoolMessage:
+		return s.processGetMempoolMsg(msg)
+	}
+
+	return nil
+}
+
+// processLightHeader takes the header of a block relayed to us; it may extend a fork, which we switch to once it has more work
+// the ones whose parent we don't have are left to the sync manager
+func (s *Server) processLightHeader(from NetAddr, header *core.SignedHeader) error {
+	if header == nil || header.Header == nil {
+		err := fmt.Errorf("compact block without a header")
+		s.penalizePeer(from, penaltyInvalidHeaders, err)
+		return err
+	}
+	s.markKnown(from, InvItem{Type: InvTypeBlock, Hash: header.Hash()})
+
+	// a header we don't have the parent of could come from an honest peer ahead of us
+	if err := s.headerChain.AddHeaders([]*core.SignedHeader{header}); err != nil && !errors.Is(err, core.ErrHeaderNotLinked) {
+		s.penalizePeer(from, penaltyInvalidHeaders, err)
+		return err
+	}
+	s.syncManager.UpdatePeerHeight(from, header.Header.Height)
+	return nil
+}
+
+// proofPeers are the peers serving proofs, shuffled so the requests are spread over them
+func (s *Server) proofPeers() []NetAddr {
+	s.mu.RLock()
+	peers := []NetAddr{}
+	for addr, peer := range s.peerMap {
+		if peer.handshake != nil && peer.handshake.HasCapability(CapabilityProofs) {
+			peers = append(peers, addr)
+		}
+	}
+	s.mu.RUnlock()
+
+	rand.Shuffle(len(peers), func(i, j int) { peers[i], peers[j] = peers[j], peers[i] })
+	return peers
+}
+
+// FetchTx asks the peers serving proofs for the tx with hash until one proves it is in a block of our header chain
+// it returns the tx along with the height of its block
+func (s *Server) FetchTx(hash core_types.Hash) (*core.Transaction, uint32, error) {
+	if !s.Light {
+		return nil, 0, ErrNotLightClient
+	}
+
+	errs := []error{}
+	for _, peer := range s.proofPeers() {
+		tx, height, err := s.fetchTx(peer, hash)
+		if err == nil {
+			return tx, height, nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", peer, err))
+	}
+	return nil, 0, fmt.Errorf("%w: tx (%s): %v", ErrProofUnavailable, hash, errors.Join(errs...))
+}
+
+func (s *Server) fetchTx(peer NetAddr, hash core_types.Hash) (*core.Transaction, uint32, error) {
+	reply, err := s.requestProof(peer, MessageTypeGetTxProof, &GetTxProofMessage{Hash: hash})
+	if err != nil {
+		return nil, 0, err
+	}
+	msg, ok := reply.Data.(*TxProofMessage)
+	if !ok {
+		return nil, 0, fmt.Errorf("unexpected reply %T to a tx proof request", reply.Data)
+	}
+	if msg.Tx == nil {
+		return nil, 0, fmt.Errorf("tx not found")
+	}
+
+	header, err := s.provenHeader(peer, msg.Height)
+	if err != nil {
+		return nil, 0, err
+	}
+	if msg.Tx.Hash(core.TxHasher{}) != hash || !core.VerifyTxProof(header.DataHash, hash, msg.Proof) {
+		err := fmt.Errorf("invalid proof of tx (%s) in block (%d)", hash, msg.Height)
+		s.penalizePeer(peer, penaltyInvalidProof, err)
+		return nil, 0, err
+	}
+	return msg.Tx, msg.Height, nil
+}
+
+// FetchAccount asks the peers serving proofs for the account until one proves its balance against a recent header of our chain
+// an account that doesn't exist comes back with Exists unset
+func (s *Server) FetchAccount(addr core_types.Address) (*core.AccountProof, error) {
+	if !s.Light {
+		return nil, ErrNotLightClient
+	}
+
+	errs := []error{}
+	for _, peer := range s.proofPeers() {
+		proof, err := s.fetchAccount(peer, addr)
+		if err == nil {
+			return proof, nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", peer, err))
+	}
+	return nil, fmt.Errorf("%w: account (%s): %v", ErrProofUnavailable, addr, errors.Join(errs...))
+}
+
+func (s *Server) fetchAccount(peer NetAddr, addr core_types.Address) (*core.AccountProof, error) {
+	reply, err := s.requestProof(peer, MessageTypeGetAccountProof, &GetAccountProofMessage{Address: addr})
+	if err != nil {
+		return nil, err
+	}
+	msg, ok := reply.Data.(*AccountProofMessage)
+	if !ok {
+		return nil, fmt.Errorf("unexpected reply %T to an account proof request", reply.Data)
+	}
+	if msg.Proof == nil {
+		return nil, fmt.Errorf("peer can't prove the account right now")
+	}
+
+	proof := msg.Proof
+	// an old balance is a valid one as far as the proof goes
+	if head := s.headerChain.Height(); proof.Height+maxAccountProofAge < head {
+		return nil, fmt.Errorf("proof is for block (%d), our head is (%d)", proof.Height, head)
+	}
+	header, err := s.provenHeader(peer, proof.Height)
+	if err != nil {
+		return nil, err
+	}
+	if proof.Address != addr || !proof.Verify(header.StateRoot) {
+		err := fmt.Errorf("invalid proof of account (%s) in block (%d)", addr, proof.Height)
+		s.penalizePeer(peer, penaltyInvalidProof, err)
+		return nil, err
+	}
+	return proof, nil
+}
+
+func (s *Server) requestProof(peer NetAddr, t MessageType, req any) (*DecodedMsg, error) {
+	buf := &bytes.Buffer{}
+	if err := gob.NewEncoder(buf).Encode(req); err != nil {
+		return nil, err
+	}
+	return s.Request(peer, NewMessage(t, buf.Bytes()), proofTimeout)
+}
+
+// provenHeader is the header of our chain a proof for the block at height is checked against
+// a peer proving against a block we don't have yet is ahead of us; the sync manager is told
+func (s *Server) provenHeader(peer NetAddr, height uint32) (*core.Header, error) {
+	header, err := s.headerChain.GetHeaders(height)
+	if err != nil {
+		s.syncManager.UpdatePeerHeight(peer, height)
+		return nil, fmt.Errorf("header (%d) not synced yet: %w", height, err)
+	}
+	return header, nil
+}
+
+// full nodes answer the proof requests of light clients out of their chain
+func (s *Server) processGetTxProofMsg(req *DecodedMsg, msg *GetTxProofMessage) error {
+	reply := &TxProofMessage{}
+	if block, err := s.chain.GetTxBlock(msg.Hash); err == nil {
+		proof, err := core.BuildTxProof(block, msg.Hash)
+		if err != nil {
+			return err
+		}
+		reply.Tx = block.Transactions[proof.Index]
+		reply.Height = block.Header.Height
+		reply.Proof = proof
+	}
+
+	buf := &bytes.Buffer{}
+	if err := gob.NewEncoder(buf).Encode(reply); err != nil {
+		return err
+	}
+	return s.reply(req, NewMessage(MessageTypeTxProof, buf.Bytes()))
+}
+
+func (s *Server) processGetAccountProofMsg(req *DecodedMsg, msg *GetAccountProofMessage) error {
+	reply := &AccountProofMessage{}
+	proof, err := s.chain.ProveAccount(msg.Address)
+	if err != nil {
+		s.Logger.Log("msg", "could not prove account", "addr", msg.Address, "err", err)
+	} else {
+		reply.Proof = proof
+	}
+
+	buf := &bytes.Buffer{}
+	if err := gob.NewEncoder(buf).Encode(reply); err != nil {
+		return err
+	}
+	return s.reply(req, NewMessage(MessageTypeAccountProof, buf.Bytes()))
+}
+
+// lightChain serves the api of a light client; the blocks come without their tx
+type lightChain struct {
+	s *Server
+}
+
+func headerBlock(h *core.SignedHeader) *core.Block {
+	return &core.Block{
+		Header:    h.Header,
+		Validator: h.Validator,
+		Signature: h.Signature,
+	}
+}
+
+func (c lightChain) GetBlock(height uint32) (*core.Block, error) {
+	h, err := c.s.headerChain.GetSignedHeader(height)
+	if err != nil {
+		return nil, err
+	}
+	return headerBlock(h), nil
+}
+
+func (c lightChain) GetBlockByHash(hash core_types.Hash) (*core.Block, error) {
+	h, err := c.s.headerChain.GetSignedHeaderByHash(hash)
+	if err != nil {
+		return nil, err
+	}
+	return headerBlock(h), nil
+}
+
+func (c lightChain) GetTxByHash(hash core_types.Hash) (*core.Transaction, error) {
+	tx, _, err := c.s.FetchTx(hash)
+	return tx, err
+}
+
+func (c lightChain) GetBalance(addr core_types.Address) (uint64, error) {
+	proof, err := c.s.FetchAccount(addr)
+	if err != nil {
+		return 0, err
+	}
+	if !proof.Exists {
+		return 0, fmt.Errorf("%w: %s", core.ErrAccountNotFound, addr)
+	}
+	return proof.Balance, nil
+}
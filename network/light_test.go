@@ -0,0 +1,156 @@
+package network
+
+import (
+	"bytes"
+	"encoding/gob"
+	"testing"
+	"time"
+
+	"github.com/EggsyOnCode/xenolith/core"
+	"github.com/EggsyOnCode/xenolith/core_types"
+	"github.com/EggsyOnCode/xenolith/crypto_lib"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestLightServer(t *testing.T, id string) *Server {
+	return newTestServerWithOpts(t, ServerOpts{ID: id, Light: true})
+}
+
+// a light client connected to full; returns once the headers are synced
+func newLightPair(t *testing.T, full *Server) *Server {
+	light := newTestLightServer(t, "LIGHT")
+	startServers(full, light)
+	connectServers(t, light, full)
+	assert.Eventually(t, func() bool {
+		return light.headerChain.Height() == full.chain.Height()
+	}, 5*time.Second, 10*time.Millisecond)
+	return light
+}
+
+// answers account proof requests with a balance one higher than the real one
+type lyingProver struct {
+	*Server
+}
+
+func (p *lyingProver) ProcessMessage(msg *DecodedMsg) error {
+	req, ok := msg.Data.(*GetAccountProofMessage)
+	if !ok {
+		return p.Server.ProcessMessage(msg)
+	}
+	proof, err := p.chain.ProveAccount(req.Address)
+	if err != nil {
+		return err
+	}
+	proof.Balance++
+	buf := &bytes.Buffer{}
+	if err := gob.NewEncoder(buf).Encode(&AccountProofMessage{Proof: proof}); err != nil {
+		return err
+	}
+	return p.reply(msg, NewMessage(MessageTypeAccountProof, buf.Bytes()))
+}
+
+func TestLightClientCantValidate(t *testing.T) {
+	_, err := NewServer(ServerOpts{ID: "L", Light: true, PrivateKey: crypto_lib.GeneratePrivateKey(), Transport: NewLocalTransport("L")})
+	assert.NotNil(t, err)
+}
+
+func TestLightClientFollowsHeaders(t *testing.T) {
+	full := newTestValidatorServer(t, "FULL", 5)
+	light := newLightPair(t, full)
+	assert.True(t, handshakeFrom(light, "FULL").HasCapability(CapabilityProofs))
+	assert.False(t, handshakeFrom(full, "LIGHT").HasCapability(CapabilityBlocks))
+	// not a single block was downloaded
+	assert.Equal(t, uint32(0), light.chain.Height())
+
+	// new blocks come in through the relay
+	assert.Nil(t, full.createNewBlock())
+	assert.Eventually(t, func() bool {
+		return light.headerChain.Height() == 6
+	}, 5*time.Second, 10*time.Millisecond)
+
+	block, err := lightChain{light}.GetBlock(6)
+	assert.Nil(t, err)
+	head, err := full.chain.GetBlock(6)
+	assert.Nil(t, err)
+	assert.Equal(t, head.Hash(core.BlockHasher{}), block.Hash(core.BlockHasher{}))
+	assert.Empty(t, block.Transactions)
+}
+
+// the full node switches to a longer fork; the light client follows it through the relayed headers
+func TestLightClientFollowsReorg(t *testing.T) {
+	full := newTestValidatorServer(t, "FULL", 3)
+	// a chain of its own on top of the same genesis block, one block longer
+	other := newTestValidatorServer(t, "OTHER", 4)
+	light := newLightPair(t, full)
+
+	for height := uint32(1); height <= 4; height++ {
+		b, err := other.chain.GetBlock(height)
+		assert.Nil(t, err)
+		block := core.NewBlock(b.Header, b.Transactions)
+		block.Validator = b.Validator
+		block.Signature = b.Signature
+		assert.Nil(t, full.processBlock(block, "OTHER"))
+	}
+	head, err := other.chain.GetBlock(4)
+	assert.Nil(t, err)
+	hash := head.Hash(core.BlockHasher{})
+	assert.Equal(t, hash, full.chain.ChainTip.Hash(core.BlockHasher{}))
+
+	assert.Eventually(t, func() bool {
+		h, err := light.headerChain.GetSignedHeader(4)
+		return err == nil && h.Hash() == hash
+	}, 5*time.Second, 10*time.Millisecond)
+	for height := uint32(1); height <= 4; height++ {
+		ours, err := light.headerChain.GetHeaders(height)
+		assert.Nil(t, err)
+		theirs, err := full.chain.GetHeaders(height)
+		assert.Nil(t, err)
+		assert.Equal(t, core.BlockHasher{}.Hash(theirs), core.BlockHasher{}.Hash(ours))
+	}
+}
+
+func TestLightClientFetchesProvenTx(t *testing.T) {
+	full := newTestValidatorServer(t, "FULL", 2)
+	tx := signedTx(t, "")
+	full.memPool.Add(tx)
+	assert.Nil(t, full.createNewBlock())
+	light := newTestLightServer(t, "LIGHT")
+	startServers(full, light)
+	connectServers(t, light, full)
+
+	hash := tx.Hash(core.TxHasher{})
+	assert.Eventually(t, func() bool {
+		got, height, err := light.FetchTx(hash)
+		return err == nil && height == 3 && got.Hash(core.TxHasher{}) == hash
+	}, 5*time.Second, 50*time.Millisecond)
+
+	_, _, err := light.FetchTx(core_types.Hash{1})
+	assert.ErrorIs(t, err, ErrProofUnavailable)
+	_, _, err = full.FetchTx(hash)
+	assert.ErrorIs(t, err, ErrNotLightClient)
+}
+
+func TestLightClientFetchesProvenBalance(t *testing.T) {
+	light := newLightPair(t, newTestValidatorServer(t, "FULL", 2))
+
+	coinbase := crypto_lib.PublicKey{}.Address()
+	proof, err := light.FetchAccount(coinbase)
+	assert.Nil(t, err)
+	assert.True(t, proof.Exists)
+	balance, err := lightChain{light}.GetBalance(coinbase)
+	assert.Nil(t, err)
+	assert.Equal(t, proof.Balance, balance)
+
+	_, err = lightChain{light}.GetBalance(crypto_lib.GeneratePrivateKey().PublicKey().Address())
+	assert.ErrorIs(t, err, core.ErrAccountNotFound)
+}
+
+func TestLightClientRejectsForgedBalance(t *testing.T) {
+	full := newTestValidatorServer(t, "FULL", 2)
+	full.RPCProcessor = &lyingProver{full}
+	light := newLightPair(t, full)
+
+	_, err := light.FetchAccount(crypto_lib.PublicKey{}.Address())
+	assert.ErrorIs(t, err, ErrProofUnavailable)
+	assert.Equal(t, int32(-penaltyInvalidProof), onlyPeer(light).score.Load())
+}
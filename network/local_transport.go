@@ -1,17 +1,30 @@
 package network
 
 import (
-	"bytes"
 	"fmt"
+	"sort"
 	"sync"
 )
 
+// LinkFunc stands in for the wire between two local transports; it gets every msg sent and decides
+// when and how often it arrives by calling deliver, possibly later and from another goroutine
+type LinkFunc func(from, to NetAddr, msg *Message, deliver func())
+
+// LocalTransport connects nodes in the same process; msgs are handed over through channels
 type LocalTransport struct {
 	addr NetAddr
 	// peers is a map of NetAddr to LocalTransport pointers
 	peers     map[NetAddr]*LocalTransport
 	consumeCh chan RPC
+	eventCh   chan PeerEvent
 	lock      sync.RWMutex
+	// msgs are handed over right away if nil
+	link LinkFunc
+	// a closed transport takes no more connections
+	closed bool
+	// closed by Close; a msg waiting for room in consumeCh is dropped
+	quitCh    chan struct{}
+	closeOnce sync.Once
 }
 
 func NewLocalTransport(addr NetAddr) *LocalTransport {
@@ -19,52 +32,133 @@ func NewLocalTransport(addr NetAddr) *LocalTransport {
 		addr:      addr,
 		peers:     make(map[NetAddr]*LocalTransport),
 		consumeCh: make(chan RPC, 1024),
+		eventCh:   make(chan PeerEvent, 1024),
 		lock:      sync.RWMutex{},
+		quitCh:    make(chan struct{}),
 	}
 }
 
+// there is nothing to listen on
+func (t *LocalTransport) Start() error {
+	return nil
+}
+
 func (t *LocalTransport) Consume() <-chan RPC {
 	return t.consumeCh
 }
 
+func (t *LocalTransport) PeerEvents() <-chan PeerEvent {
+	return t.eventCh
+}
+
 func (t *LocalTransport) Addr() NetAddr {
 	return t.addr
 }
 
-// for now we are providing method for connecting local tranport to another local transport
-func (t *LocalTransport) Connect(tr Transport) error {
+// SetLink routes the msgs we send through link
+func (t *LocalTransport) SetLink(link LinkFunc) {
 	t.lock.Lock()
 	defer t.lock.Unlock()
-	//adding a diff local tranport as peer to our current trasnport
-	//TODO : we could make connection bidirectional?
-	t.peers[tr.Addr()] = tr.(*LocalTransport)
-	tr.AddPeer(t)
-	fmt.Printf("updated list of peers for %s: %v\n", t.addr, t.peers)
+	t.link = link
+}
+
+// lockPair locks both transports; always in the same order so two of them connecting to each other don't deadlock
+func lockPair(a, b *LocalTransport) func() {
+	if b.addr < a.addr {
+		a, b = b, a
+	}
+	a.lock.Lock()
+	b.lock.Lock()
+	return func() {
+		b.lock.Unlock()
+		a.lock.Unlock()
+	}
+}
+
+// Connect connects to another local transport; the connection goes both ways
+func (t *LocalTransport) Connect(tr Transport) error {
+	other, ok := tr.(*LocalTransport)
+	if !ok {
+		return fmt.Errorf("local transport can't connect to %T", tr)
+	}
+	if other == t {
+		return fmt.Errorf("local transport %s can't connect to itself", t.addr)
+	}
+
+	// both ends know about the connection before either can send over it
+	unlock := lockPair(t, other)
+	defer unlock()
+	if t.closed || other.closed {
+		return ErrTransportClosed
+	}
+	if _, ok := t.peers[other.addr]; ok {
+		return fmt.Errorf("already connected to %s", other.addr)
+	}
+	t.peers[other.addr] = other
+	other.peers[t.addr] = t
+	t.eventCh <- PeerEvent{Addr: other.addr, Connected: true, Outgoing: true, DialedAddr: string(other.addr)}
+	other.eventCh <- PeerEvent{Addr: t.addr, Connected: true}
 	return nil
 }
 
-func (t *LocalTransport) SendMsg(addr NetAddr, payload []byte) error {
-	t.lock.Lock()
-	defer t.lock.Unlock()
-	// sending msg to peer
+func (t *LocalTransport) Disconnect(addr NetAddr) error {
+	t.lock.RLock()
+	other, ok := t.peers[addr]
+	t.lock.RUnlock()
+	if !ok {
+		return fmt.Errorf("could not disconnect unknown peer %s", addr)
+	}
+
+	unlock := lockPair(t, other)
+	defer unlock()
+	// the other end could have disconnected in the meantime
+	if t.peers[addr] != other {
+		return nil
+	}
+	delete(t.peers, addr)
+	delete(other.peers, t.addr)
+	t.eventCh <- PeerEvent{Addr: addr}
+	other.eventCh <- PeerEvent{Addr: t.addr}
+	return nil
+}
+
+func (t *LocalTransport) SendMsg(addr NetAddr, msg *Message) error {
+	t.lock.RLock()
 	peer, ok := t.peers[addr]
+	link := t.link
+	t.lock.RUnlock()
 	if !ok {
 		return fmt.Errorf("could not send msg to unknown peer %s", addr)
 	}
-	peer.consumeCh <- RPC{
-		From:    t.addr,
-		Payload: bytes.NewReader(payload),
+
+	if link == nil {
+		return peer.deliver(t.addr, msg)
 	}
+	// a msg that arrives after the peers disconnected is lost like on a real wire
+	link(t.addr, addr, msg, func() { peer.deliver(t.addr, msg) })
 	return nil
+}
 
+func (t *LocalTransport) deliver(from NetAddr, msg *Message) error {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	if _, ok := t.peers[from]; !ok {
+		return fmt.Errorf("peer %s disconnected from %s", t.addr, from)
+	}
+	select {
+	case t.consumeCh <- rpcFromFrame(from, msg):
+		return nil
+	case <-t.quitCh:
+		return ErrTransportClosed
+	}
 }
 
-func (t *LocalTransport) Broadcast(payload []byte, excludedPeer NetAddr) error {
-	for _, peer := range t.peers {
-		if peer.Addr() == excludedPeer {
+func (t *LocalTransport) Broadcast(msg *Message, excludedPeer NetAddr) error {
+	for _, addr := range t.Peers() {
+		if addr == excludedPeer {
 			continue
 		}
-		if err := t.SendMsg(peer.Addr(), payload); err != nil {
+		if err := t.SendMsg(addr, msg); err != nil {
 			return err
 		}
 	}
@@ -72,18 +166,29 @@ func (t *LocalTransport) Broadcast(payload []byte, excludedPeer NetAddr) error {
 	return nil
 }
 
-func (t *LocalTransport) Peers() map[NetAddr]Transport {
+// Close disconnects every peer; msgs still on their way to us are dropped
+func (t *LocalTransport) Close() error {
+	// before taking the lock; a delivery stuck on a full queue holds it
+	t.closeOnce.Do(func() { close(t.quitCh) })
+	t.lock.Lock()
+	t.closed = true
+	t.lock.Unlock()
+
+	for _, addr := range t.Peers() {
+		t.Disconnect(addr)
+	}
+	return nil
+}
+
+func (t *LocalTransport) Peers() []NetAddr {
 	t.lock.RLock()
 	defer t.lock.RUnlock()
-	peers := make(map[NetAddr]Transport)
-	for k, v := range t.peers {
-		peers[k] = v
+	peers := make([]NetAddr, 0, len(t.peers))
+	for addr := range t.peers {
+		peers = append(peers, addr)
 	}
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i] < peers[j]
+	})
 	return peers
 }
-
-func (t *LocalTransport) AddPeer(tr Transport) {
-	t.lock.Lock()
-	defer t.lock.Unlock()
-	t.peers[tr.Addr()] = tr.(*LocalTransport)
-}
@@ -1 +1,33 @@
 package network
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLocalTransportConnect(t *testing.T) {
+	a := NewLocalTransport("A")
+	b := NewLocalTransport("B")
+
+	assert.Nil(t, a.Connect(b))
+	assert.NotNil(t, a.Connect(b))
+	assert.NotNil(t, b.Connect(a))
+	assert.Equal(t, []NetAddr{"B"}, a.Peers())
+	assert.Equal(t, []NetAddr{"A"}, b.Peers())
+	assert.Equal(t, PeerEvent{Addr: "B", Connected: true, Outgoing: true, DialedAddr: "B"}, <-a.PeerEvents())
+	assert.Equal(t, PeerEvent{Addr: "A", Connected: true}, <-b.PeerEvents())
+
+	assert.Nil(t, a.SendMsg("B", NewMessage(MessageGetStatusType, nil)))
+	rpc := <-b.Consume()
+	assert.Equal(t, NetAddr("A"), rpc.From)
+	msg, err := DefaultRPCDecodeFunc(rpc)
+	assert.Nil(t, err)
+	assert.IsType(t, &GetStatusMessage{}, msg.Data)
+
+	assert.Nil(t, b.Disconnect("A"))
+	assert.Equal(t, PeerEvent{Addr: "B"}, <-a.PeerEvents())
+	assert.Equal(t, PeerEvent{Addr: "A"}, <-b.PeerEvents())
+	assert.NotNil(t, a.SendMsg("B", NewMessage(MessageGetStatusType, nil)))
+	assert.Empty(t, a.Peers())
+}
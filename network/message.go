@@ -2,6 +2,7 @@ package network
 
 import (
 	"github.com/EggsyOnCode/xenolith/core"
+	"github.com/EggsyOnCode/xenolith/core_types"
 )
 
 type GetBlockMessage struct {
@@ -10,8 +11,33 @@ type GetBlockMessage struct {
 	To uint32
 }
 
+// first msg exchanged on every connection; peers that don't agree on the protocol and the chain are dropped
+type HandshakeMessage struct {
+	ProtocolVersion uint32
+	NetworkID       uint32
+	GenesisHash     core_types.Hash
+	// identity of the node and the address it accepts connections on
+	NodeID     string
+	ListenAddr string
+	// random per process; tells apart connections to ourselves and duplicate connections to the same node
+	Nonce uint64
+	// Capability* flags
+	Capabilities uint64
+}
+
+func (h *HandshakeMessage) HasCapability(c uint64) bool {
+	return h.Capabilities&c == c
+}
+
 type GetStatusMessage struct{}
 
+type GetPeersMessage struct{}
+
+// addresses (host:port) of nodes accepting connections
+type PeersMessage struct {
+	Addrs []string
+}
+
 type StatusMessage struct {
 	Version       uint32
 	CurrentHeight uint32
@@ -28,7 +54,86 @@ type BlocksMessage struct {
 	Blocks []*core.Block
 }
 
-type ValidatorNotification struct {
-	// PublicKey *crypto_lib.PublicKey
-	Server *Server
+// announces items we have; the receiver asks for the ones it doesn't know with GetData
+type InvMessage struct {
+	Items []InvItem
+}
+
+// asks for announced items; they are sent back as regular tx and block msgs
+type GetDataMessage struct {
+	Items []InvItem
+}
+
+// asks a new peer for the tx waiting in its mempool; answered with a MempoolInvMessage
+type GetMempoolMessage struct{}
+
+// hashes of the pending tx of the mempool; the ones missing are asked for with GetData
+type MempoolInvMessage struct {
+	Hashes []core_types.Hash
+}
+
+// asks for the signed headers of the blocks in [From, To]; To works like in GetBlockMessage
+type GetHeadersMessage struct {
+	From uint32
+	To   uint32
+}
+
+type HeadersMessage struct {
+	Headers []*core.SignedHeader
+}
+
+// asks for the tx of the blocks with the given hashes
+type GetBlockBodiesMessage struct {
+	Hashes []core_types.Hash
+}
+
+// the tx of the block with the given hash; they are checked against the DataHash of its header
+type BlockBody struct {
+	Hash         core_types.Hash
+	Transactions []*core.Transaction
+}
+
+type BlockBodiesMessage struct {
+	Bodies []*BlockBody
+}
+
+// a block as pushed to the peers: the signed header and a short id for each of its tx
+// the receiver fills in the tx from its mempool and asks for the ones it doesn't have with GetBlockTxn
+type CompactBlockMessage struct {
+	Header   *core.SignedHeader
+	ShortIDs []ShortTxID
+}
+
+// asks for the tx at the given indexes of the block with the given hash
+type GetBlockTxnMessage struct {
+	Hash    core_types.Hash
+	Indexes []uint32
+}
+
+// the requested tx, in the order of the indexes they were asked for with
+type BlockTxnMessage struct {
+	Hash         core_types.Hash
+	Transactions []*core.Transaction
+}
+
+// asks a full node for a tx of its chain along with the proof that it is in the block at Height
+type GetTxProofMessage struct {
+	Hash core_types.Hash
+}
+
+// Tx is nil if the node doesn't have the tx in its chain; the proof is checked against the DataHash of the header at Height
+type TxProofMessage struct {
+	Tx     *core.Transaction
+	Height uint32
+	Proof  *core.TxProof
+}
+
+// asks a full node for the balance of an account along with the proof of it
+type GetAccountProofMessage struct {
+	Address core_types.Address
+}
+
+// Proof is nil if the node can't prove the state right now; it is checked against the StateRoot of the header at its Height
+type AccountProofMessage struct {
+	Proof *core.AccountProof
 }
@@ -0,0 +1,71 @@
+package network
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+type PeerState int32
+
+const (
+	// connected but not yet through the handshake
+	PeerStateHandshaking PeerState = iota
+	// in the peerMap and exchanging msgs
+	PeerStateActive
+	PeerStateClosed
+)
+
+func (s PeerState) String() string {
+	switch s {
+	case PeerStateHandshaking:
+		return "handshaking"
+	case PeerStateActive:
+		return "active"
+	case PeerStateClosed:
+		return "closed"
+	default:
+		return fmt.Sprintf("PeerState(%d)", int32(s))
+	}
+}
+
+// Peer is a node we are connected to; the connection itself belongs to the transport
+type Peer struct {
+	// address the transport knows the peer by
+	Addr     NetAddr
+	Outgoing bool
+	state    atomic.Int32
+	// when the connection was established
+	connectedAt time.Time
+	// what the peer told us about itself in the handshake
+	handshake *HandshakeMessage
+	// drops the peer if the handshake doesn't come in time
+	handshakeTimer *time.Timer
+	// address the peer accepts connections on
+	listenAddr string
+	// address the connection comes from; empty if the transport doesn't know it
+	remoteAddr string
+	// reputation of the peer; lowered whenever it misbehaves
+	score atomic.Int32
+	// tx and blocks the peer has or was told about
+	known *knownInventory
+}
+
+func newPeer(ev PeerEvent) *Peer {
+	return &Peer{
+		Addr:        ev.Addr,
+		Outgoing:    ev.Outgoing,
+		connectedAt: time.Now(),
+		listenAddr:  ev.DialedAddr,
+		remoteAddr:  ev.RemoteAddr,
+		known:       newKnownInventory(maxKnownInventory),
+	}
+}
+
+func (p *Peer) State() PeerState {
+	return PeerState(p.state.Load())
+}
+
+func (p *Peer) setState(s PeerState) {
+	p.state.Store(int32(s))
+}
@@ -0,0 +1,122 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrRequestTimeout = errors.New("request timed out")
+	// the connection to the peer went away before it answered
+	ErrPeerGone = errors.New("peer disconnected")
+	// the server was stopped; nothing is sent or waited for anymore
+	ErrServerStopped = errors.New("server stopped")
+)
+
+// how long the status of a new peer is waited for
+const statusTimeout = 10 * time.Second
+
+type pendingRequest struct {
+	peer    NetAddr
+	replyCh chan *DecodedMsg
+}
+
+// requestTracker matches replies to the requests they answer
+type requestTracker struct {
+	mu      sync.Mutex
+	lastID  atomic.Uint64
+	pending map[uint64]*pendingRequest
+}
+
+func newRequestTracker() *requestTracker {
+	return &requestTracker{
+		pending: make(map[uint64]*pendingRequest),
+	}
+}
+
+func (t *requestTracker) add(peer NetAddr) (uint64, *pendingRequest) {
+	req := &pendingRequest{
+		peer:    peer,
+		replyCh: make(chan *DecodedMsg, 1),
+	}
+	id := t.lastID.Add(1)
+
+	t.mu.Lock()
+	t.pending[id] = req
+	t.mu.Unlock()
+	return id, req
+}
+
+func (t *requestTracker) remove(id uint64) {
+	t.mu.Lock()
+	delete(t.pending, id)
+	t.mu.Unlock()
+}
+
+// deliver hands msg to the request it answers; false if it doesn't answer any of ours
+// a reply is only taken from the peer the request went to
+func (t *requestTracker) deliver(msg *DecodedMsg) bool {
+	if msg.ReplyTo == 0 {
+		return false
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	req, ok := t.pending[msg.ReplyTo]
+	if !ok || req.peer != msg.From {
+		return false
+	}
+	delete(t.pending, msg.ReplyTo)
+	req.replyCh <- msg
+	return true
+}
+
+// failPeer fails the requests waiting on a peer that disconnected
+func (t *requestTracker) failPeer(peer NetAddr) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for id, req := range t.pending {
+		if req.peer == peer {
+			delete(t.pending, id)
+			close(req.replyCh)
+		}
+	}
+}
+
+// Request sends msg to the peer and waits for the reply to it
+// it fails once the timeout passes, the peer disconnects or the server stops
+func (s *Server) Request(peer NetAddr, msg *Message, timeout time.Duration) (*DecodedMsg, error) {
+	id, req := s.requests.add(peer)
+	defer s.requests.remove(id)
+
+	msg.ID = id
+	if err := s.sendToPeer(peer, msg); err != nil {
+		return nil, err
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case reply, ok := <-req.replyCh:
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", ErrPeerGone, peer)
+		}
+		return reply, nil
+	case <-timer.C:
+		return nil, fmt.Errorf("%w: no reply from %s after %s", ErrRequestTimeout, peer, timeout)
+	case <-s.quitCh:
+		return nil, ErrServerStopped
+	}
+}
+
+// reply sends msg to the peer as the answer to req
+func (s *Server) reply(req *DecodedMsg, msg *Message) error {
+	msg.ReplyTo = req.ID
+	return s.sendToPeer(req.From, msg)
+}
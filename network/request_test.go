@@ -0,0 +1,96 @@
+package network
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// passes the msgs on to the server but never answers a status request
+type statusDropper struct {
+	*Server
+	dropped chan struct{}
+}
+
+func dropStatusRequests(s *Server) *statusDropper {
+	d := &statusDropper{Server: s, dropped: make(chan struct{}, 16)}
+	s.RPCProcessor = d
+	return d
+}
+
+func (d *statusDropper) ProcessMessage(msg *DecodedMsg) error {
+	if _, ok := msg.Data.(*GetStatusMessage); ok {
+		d.dropped <- struct{}{}
+		return nil
+	}
+	return d.Server.ProcessMessage(msg)
+}
+
+// starts and connects both; the address a knows b by is returned
+func connectedPair(t *testing.T, a, b *Server) NetAddr {
+	startServers(a, b)
+	connectServers(t, a, b)
+	return onlyPeer(a).Addr
+}
+
+func TestRequestTrackerTakesReplyFromPeerAskedOnly(t *testing.T) {
+	tracker := newRequestTracker()
+	id, req := tracker.add("a")
+
+	assert.False(t, tracker.deliver(&DecodedMsg{From: "b", ReplyTo: id}))
+	assert.False(t, tracker.deliver(&DecodedMsg{From: "a", ReplyTo: id + 1}))
+	assert.False(t, tracker.deliver(&DecodedMsg{From: "a"}))
+	assert.True(t, tracker.deliver(&DecodedMsg{From: "a", ReplyTo: id}))
+	assert.Equal(t, NetAddr("a"), (<-req.replyCh).From)
+
+	// answered once only
+	assert.False(t, tracker.deliver(&DecodedMsg{From: "a", ReplyTo: id}))
+}
+
+func TestRequestGetsReply(t *testing.T) {
+	a := newTestServer(t, "A", 0)
+	b := newTestServer(t, "B", 0)
+	peer := connectedPair(t, a, b)
+
+	reply, err := a.Request(peer, NewMessage(MessageGetStatusType, nil), time.Second)
+	assert.Nil(t, err)
+	status, ok := reply.Data.(*StatusMessage)
+	assert.True(t, ok)
+	assert.Equal(t, b.chain.Height(), status.CurrentHeight)
+	assert.NotZero(t, reply.ReplyTo)
+}
+
+func TestRequestTimesOut(t *testing.T) {
+	a := newTestServer(t, "A", 0)
+	b := newTestServer(t, "B", 0)
+	dropStatusRequests(b)
+	peer := connectedPair(t, a, b)
+
+	_, err := a.Request(peer, NewMessage(MessageGetStatusType, nil), 100*time.Millisecond)
+	assert.ErrorIs(t, err, ErrRequestTimeout)
+}
+
+func TestRequestFailsWhenPeerDisconnects(t *testing.T) {
+	a := newTestServer(t, "A", 0)
+	b := newTestServer(t, "B", 0)
+	d := dropStatusRequests(b)
+	peer := connectedPair(t, a, b)
+	// the status request sent on connecting
+	<-d.dropped
+
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := a.Request(peer, NewMessage(MessageGetStatusType, nil), time.Minute)
+		errCh <- err
+	}()
+	<-d.dropped
+	assert.Nil(t, b.Transport.Disconnect(onlyPeer(b).Addr))
+
+	select {
+	case err := <-errCh:
+		assert.ErrorIs(t, err, ErrPeerGone)
+	case <-time.After(5 * time.Second):
+		t.Fatal("request still waiting on a peer that is gone")
+	}
+}
@@ -0,0 +1,131 @@
+package network
+
+import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ProtocolID tells which of the protocols running over the same connections a msg belongs to
+type ProtocolID byte
+
+const (
+	// blocks, tx and chain sync
+	ProtocolExecution ProtocolID = iota
+	// validators telling each other about themselves; handled by the consensus client
+	ProtocolConsensus
+	// the handshake and the exchange of peer addresses
+	ProtocolDiscovery
+)
+
+func (p ProtocolID) String() string {
+	switch p {
+	case ProtocolExecution:
+		return "execution"
+	case ProtocolConsensus:
+		return "consensus"
+	case ProtocolDiscovery:
+		return "discovery"
+	default:
+		return fmt.Sprintf("ProtocolID(%d)", byte(p))
+	}
+}
+
+// msg types outside of the execution protocol
+var msgProtocols = map[MessageType]ProtocolID{
+	MessageTypeValidatorAnnouncement: ProtocolConsensus,
+	MessageTypeHandshake:             ProtocolDiscovery,
+	MessageTypeGetPeers:              ProtocolDiscovery,
+	MessageTypePeers:                 ProtocolDiscovery,
+}
+
+func protocolOf(t MessageType) ProtocolID {
+	if p, ok := msgProtocols[t]; ok {
+		return p
+	}
+	return ProtocolExecution
+}
+
+// msgs of a protocol queued up by the router before they are taken
+const protocolQueueSize = 256
+
+var (
+	ErrUnknownProtocol = errors.New("no handler registered for protocol")
+	// the queue of the protocol stayed full until the wait was called off
+	ErrProtocolBusy = errors.New("protocol queue is full")
+)
+
+// MessageDecodeFunc decodes the data of a msg; every protocol brings its own
+type MessageDecodeFunc func(from NetAddr, msg *Message) (*DecodedMsg, error)
+
+type protocolHandler struct {
+	decode MessageDecodeFunc
+	queue  chan *DecodedMsg
+}
+
+// Router hands the msgs coming in over the transport to the protocol they belong to
+// every protocol has a queue of its own so a slow one doesn't hold up the others
+type Router struct {
+	mu       sync.RWMutex
+	handlers map[ProtocolID]*protocolHandler
+}
+
+func NewRouter() *Router {
+	return &Router{
+		handlers: make(map[ProtocolID]*protocolHandler),
+	}
+}
+
+// Register returns the queue the msgs of the protocol are put in once decoded with decode
+func (r *Router) Register(id ProtocolID, decode MessageDecodeFunc) (<-chan *DecodedMsg, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.handlers[id]; ok {
+		return nil, fmt.Errorf("protocol %s is registered already", id)
+	}
+
+	h := &protocolHandler{
+		decode: decode,
+		queue:  make(chan *DecodedMsg, protocolQueueSize),
+	}
+	r.handlers[id] = h
+	return h.queue, nil
+}
+
+// Route decodes the msg and queues it for its protocol
+// a msg that can't be decoded is an error of the sender; the msgs of a protocol nobody registered for are dropped
+// while the queue of the protocol is full Route waits for room, until quitCh is closed; the wait is what
+// holds back the queues of the peers (see Server.routeLoop) so a protocol has to keep taking its msgs
+func (r *Router) Route(rpc RPC, quitCh <-chan struct{}) error {
+	msg := &Message{}
+	if err := gob.NewDecoder(rpc.Payload).Decode(msg); err != nil {
+		return fmt.Errorf("failed to decode message: %v ; from : %v", err, rpc.From)
+	}
+
+	r.mu.RLock()
+	h, ok := r.handlers[msg.Protocol]
+	r.mu.RUnlock()
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownProtocol, msg.Protocol)
+	}
+
+	decoded, err := h.decode(rpc.From, msg)
+	if err != nil {
+		return err
+	}
+	decoded.ID = msg.ID
+	decoded.ReplyTo = msg.ReplyTo
+
+	select {
+	case h.queue <- decoded:
+		return nil
+	default:
+	}
+	select {
+	case h.queue <- decoded:
+		return nil
+	case <-quitCh:
+		return fmt.Errorf("%w: %s", ErrProtocolBusy, msg.Protocol)
+	}
+}
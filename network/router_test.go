@@ -0,0 +1,100 @@
+package network
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func routedRPC(msg *Message) RPC {
+	return *NewRPCMsg("A", msg.Bytes())
+}
+
+func TestRouterQueuesMsgsByProtocol(t *testing.T) {
+	r := NewRouter()
+	execution, err := r.Register(ProtocolExecution, DecodeMessage)
+	assert.Nil(t, err)
+	discovery, err := r.Register(ProtocolDiscovery, DecodeMessage)
+	assert.Nil(t, err)
+
+	status := NewMessage(MessageGetStatusType, nil)
+	status.ID = 7
+	assert.Nil(t, r.Route(routedRPC(status), nil))
+	assert.Nil(t, r.Route(routedRPC(NewMessage(MessageTypeGetPeers, nil)), nil))
+
+	msg := <-execution
+	assert.IsType(t, &GetStatusMessage{}, msg.Data)
+	assert.Equal(t, NetAddr("A"), msg.From)
+	assert.Equal(t, uint64(7), msg.ID)
+	assert.IsType(t, &GetPeersMessage{}, (<-discovery).Data)
+	assert.Len(t, execution, 0)
+	assert.Len(t, discovery, 0)
+}
+
+func TestRouterRejectsUnknownProtocol(t *testing.T) {
+	r := NewRouter()
+	_, err := r.Register(ProtocolExecution, DecodeMessage)
+	assert.Nil(t, err)
+	_, err = r.Register(ProtocolExecution, DecodeMessage)
+	assert.NotNil(t, err)
+
+	msg := NewMessage(MessageTypeValidatorAnnouncement, nil)
+	assert.Equal(t, ProtocolConsensus, msg.Protocol)
+	assert.ErrorIs(t, r.Route(routedRPC(msg), nil), ErrUnknownProtocol)
+}
+
+func TestRouterWaitsForBusyProtocol(t *testing.T) {
+	r := NewRouter()
+	execution, err := r.Register(ProtocolExecution, DecodeMessage)
+	assert.Nil(t, err)
+	discovery, err := r.Register(ProtocolDiscovery, DecodeMessage)
+	assert.Nil(t, err)
+
+	for i := 0; i < protocolQueueSize; i++ {
+		assert.Nil(t, r.Route(routedRPC(NewMessage(MessageGetStatusType, nil)), nil))
+	}
+	// the msg is held until the protocol takes one off its queue
+	routed := make(chan error, 1)
+	go func() {
+		routed <- r.Route(routedRPC(NewMessage(MessageGetStatusType, nil)), nil)
+	}()
+	select {
+	case <-routed:
+		t.Fatal("msg routed to a full queue")
+	case <-time.After(50 * time.Millisecond):
+	}
+	<-execution
+	assert.Nil(t, <-routed)
+	assert.Len(t, execution, protocolQueueSize)
+
+	// unless the wait is called off
+	quitCh := make(chan struct{})
+	close(quitCh)
+	assert.ErrorIs(t, r.Route(routedRPC(NewMessage(MessageGetStatusType, nil)), quitCh), ErrProtocolBusy)
+
+	// the other protocols have room of their own
+	assert.Nil(t, r.Route(routedRPC(NewMessage(MessageTypeGetPeers, nil)), nil))
+	assert.Len(t, discovery, 1)
+}
+
+// msgs of the consensus protocol never end up with the execution client
+func TestServerLeavesConsensusMsgsToTheirProtocol(t *testing.T) {
+	a := newTestServer(t, "A", 0)
+	b := newTestServer(t, "B", 0)
+	consensus, err := b.Router.Register(ProtocolConsensus, func(from NetAddr, msg *Message) (*DecodedMsg, error) {
+		return &DecodedMsg{From: from, Data: msg.Data}, nil
+	})
+	assert.Nil(t, err)
+	peer := connectedPair(t, b, a)
+
+	msg := NewMessage(MessageTypeValidatorAnnouncement, []byte("foo"))
+	assert.Nil(t, a.Transport.SendMsg(onlyPeer(a).Addr, msg))
+	select {
+	case got := <-consensus:
+		assert.Equal(t, peer, got.From)
+		assert.Equal(t, []byte("foo"), got.Data)
+	case <-time.After(time.Second):
+		t.Fatal("consensus msg not routed")
+	}
+}
@@ -24,24 +24,48 @@ func NewRPCMsg(from NetAddr, payload []byte) *RPC {
 type MessageType byte
 
 const (
-	MessageTypeTx              MessageType = 0x1
-	MessageTypeBlock           MessageType = 0x2
-	MessageTypeGetBlocks       MessageType = 0x3
-	MessageStatusType          MessageType = 0x4
-	MessageGetStatusType       MessageType = 0x5
-	MessageTypeBlocks          MessageType = 0x6
-	MessageTypeValidatorInform MessageType = 0x7
+	MessageTypeTx                    MessageType = 0x1
+	MessageTypeBlock                 MessageType = 0x2
+	MessageTypeGetBlocks             MessageType = 0x3
+	MessageStatusType                MessageType = 0x4
+	MessageGetStatusType             MessageType = 0x5
+	MessageTypeBlocks                MessageType = 0x6
+	MessageTypeValidatorAnnouncement MessageType = 0x7
+	MessageTypeHandshake             MessageType = 0x8
+	MessageTypeGetPeers              MessageType = 0x9
+	MessageTypePeers                 MessageType = 0xa
+	MessageTypeGetHeaders            MessageType = 0xb
+	MessageTypeHeaders               MessageType = 0xc
+	MessageTypeGetBlockBodies        MessageType = 0xd
+	MessageTypeBlockBodies           MessageType = 0xe
+	MessageTypeInv                   MessageType = 0xf
+	MessageTypeGetData               MessageType = 0x10
+	MessageTypeGetMempool            MessageType = 0x11
+	MessageTypeMempoolInv            MessageType = 0x12
+	MessageTypeCompactBlock          MessageType = 0x13
+	MessageTypeGetBlockTxn           MessageType = 0x14
+	MessageTypeBlockTxn              MessageType = 0x15
+	MessageTypeGetTxProof            MessageType = 0x16
+	MessageTypeTxProof               MessageType = 0x17
+	MessageTypeGetAccountProof       MessageType = 0x18
+	MessageTypeAccountProof          MessageType = 0x19
 )
 
 type Message struct {
 	Headers MessageType
-	Data    []byte
+	// the protocol handling the msg on the other end (see Router)
+	Protocol ProtocolID
+	Data     []byte
+	// set on requests expecting a reply; the reply carries it in ReplyTo (see Server.Request)
+	ID      uint64
+	ReplyTo uint64
 }
 
 func NewMessage(t MessageType, data []byte) *Message {
 	return &Message{
-		Headers: t,
-		Data:    data,
+		Headers:  t,
+		Protocol: protocolOf(t),
+		Data:     data,
 	}
 }
 
@@ -63,6 +87,9 @@ type RPCProcessor interface {
 type DecodedMsg struct {
 	From NetAddr
 	Data any
+	// ID and ReplyTo of the Message it was decoded from
+	ID      uint64
+	ReplyTo uint64
 }
 
 type RPCDecodeFunc func(RPC) (*DecodedMsg, error)
@@ -80,6 +107,80 @@ func DefaultRPCDecodeFunc(rpc RPC) (*DecodedMsg, error) {
 		"type": msg.Headers,
 	}).Debug("incoming message")
 
+	decoded, err := DecodeMessage(rpc.From, msg)
+	if err != nil {
+		return nil, err
+	}
+	decoded.ID = msg.ID
+	decoded.ReplyTo = msg.ReplyTo
+	return decoded, nil
+}
+
+// DecodeMessage decodes the data of msg according to its type; it knows the msgs of all the built-in protocols
+// the blocks, headers and tx in it are checked before anything hashes them (see checkMessageData)
+func DecodeMessage(from NetAddr, msg *Message) (*DecodedMsg, error) {
+	decoded, err := decodeMessage(from, msg)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkMessageData(decoded.Data); err != nil {
+		return nil, fmt.Errorf("malformed message from %v: %w", from, err)
+	}
+	return decoded, nil
+}
+
+// checkMessageData rejects the blocks, headers and tx gob lets a peer make up but that can't be hashed
+// e.g a header with a negative target or a tx whose TxInner is some other registered type
+func checkMessageData(data any) error {
+	switch t := data.(type) {
+	case *core.Transaction:
+		return t.CheckFormat()
+	case *core.Block:
+		return t.CheckFormat()
+	case *BlocksMessage:
+		for _, b := range t.Blocks {
+			if b == nil {
+				return fmt.Errorf("block missing")
+			}
+			if err := b.CheckFormat(); err != nil {
+				return err
+			}
+		}
+	case *HeadersMessage:
+		for _, h := range t.Headers {
+			if err := checkSignedHeaderFormat(h); err != nil {
+				return err
+			}
+		}
+	case *CompactBlockMessage:
+		return checkSignedHeaderFormat(t.Header)
+	case *BlockBodiesMessage:
+		for _, body := range t.Bodies {
+			if body == nil {
+				return fmt.Errorf("block body missing")
+			}
+			if err := core.CheckTxFormat(body.Transactions); err != nil {
+				return err
+			}
+		}
+	case *BlockTxnMessage:
+		return core.CheckTxFormat(t.Transactions)
+	case *TxProofMessage:
+		if t.Tx != nil {
+			return t.Tx.CheckFormat()
+		}
+	}
+	return nil
+}
+
+func checkSignedHeaderFormat(h *core.SignedHeader) error {
+	if h == nil || h.Header == nil {
+		return fmt.Errorf("header missing")
+	}
+	return h.Header.CheckFormat()
+}
+
+func decodeMessage(from NetAddr, msg *Message) (*DecodedMsg, error) {
 	switch msg.Headers {
 	case MessageTypeTx:
 		tx := new(core.Transaction)
@@ -89,7 +190,7 @@ func DefaultRPCDecodeFunc(rpc RPC) (*DecodedMsg, error) {
 		}
 
 		return &DecodedMsg{
-			From: rpc.From,
+			From: from,
 			Data: tx,
 		}, nil
 	case MessageTypeGetBlocks:
@@ -98,7 +199,7 @@ func DefaultRPCDecodeFunc(rpc RPC) (*DecodedMsg, error) {
 			return nil, err
 		}
 		return &DecodedMsg{
-			From: rpc.From,
+			From: from,
 			Data: getBlockMsg,
 		}, nil
 	case MessageTypeBlock:
@@ -108,7 +209,7 @@ func DefaultRPCDecodeFunc(rpc RPC) (*DecodedMsg, error) {
 		}
 
 		return &DecodedMsg{
-			From: rpc.From,
+			From: from,
 			Data: block,
 		}, nil
 	case MessageTypeBlocks:
@@ -118,24 +219,179 @@ func DefaultRPCDecodeFunc(rpc RPC) (*DecodedMsg, error) {
 		}
 
 		return &DecodedMsg{
-			From: rpc.From,
+			From: from,
 			Data: blocMsg,
 		}, nil
-	case MessageTypeValidatorInform:
-		validatorMsg := &ValidatorNotification{}
-		if err := gob.NewDecoder(bytes.NewReader(msg.Data)).Decode(validatorMsg); err != nil {
+	case MessageTypeValidatorAnnouncement:
+		announcement := new(ValidatorAnnouncement)
+		if err := gob.NewDecoder(bytes.NewReader(msg.Data)).Decode(announcement); err != nil {
 			return nil, err
 		}
 
 		return &DecodedMsg{
-			From: rpc.From,
-			Data: validatorMsg,
+			From: from,
+			Data: announcement,
 		}, nil
 	case MessageGetStatusType:
 		return &DecodedMsg{
-			From: rpc.From,
+			From: from,
 			Data: &GetStatusMessage{},
 		}, nil
+	case MessageTypeHandshake:
+		hsMsg := new(HandshakeMessage)
+		if err := gob.NewDecoder(bytes.NewReader(msg.Data)).Decode(hsMsg); err != nil {
+			return nil, err
+		}
+		return &DecodedMsg{
+			From: from,
+			Data: hsMsg,
+		}, nil
+	case MessageTypeGetPeers:
+		return &DecodedMsg{
+			From: from,
+			Data: &GetPeersMessage{},
+		}, nil
+	case MessageTypePeers:
+		peersMsg := new(PeersMessage)
+		if err := gob.NewDecoder(bytes.NewReader(msg.Data)).Decode(peersMsg); err != nil {
+			return nil, err
+		}
+
+		return &DecodedMsg{
+			From: from,
+			Data: peersMsg,
+		}, nil
+	case MessageTypeGetHeaders:
+		getHeadersMsg := new(GetHeadersMessage)
+		if err := gob.NewDecoder(bytes.NewReader(msg.Data)).Decode(getHeadersMsg); err != nil {
+			return nil, err
+		}
+		return &DecodedMsg{
+			From: from,
+			Data: getHeadersMsg,
+		}, nil
+	case MessageTypeHeaders:
+		headersMsg := new(HeadersMessage)
+		if err := gob.NewDecoder(bytes.NewReader(msg.Data)).Decode(headersMsg); err != nil {
+			return nil, err
+		}
+		return &DecodedMsg{
+			From: from,
+			Data: headersMsg,
+		}, nil
+	case MessageTypeGetBlockBodies:
+		getBodiesMsg := new(GetBlockBodiesMessage)
+		if err := gob.NewDecoder(bytes.NewReader(msg.Data)).Decode(getBodiesMsg); err != nil {
+			return nil, err
+		}
+		return &DecodedMsg{
+			From: from,
+			Data: getBodiesMsg,
+		}, nil
+	case MessageTypeBlockBodies:
+		bodiesMsg := new(BlockBodiesMessage)
+		if err := gob.NewDecoder(bytes.NewReader(msg.Data)).Decode(bodiesMsg); err != nil {
+			return nil, err
+		}
+		return &DecodedMsg{
+			From: from,
+			Data: bodiesMsg,
+		}, nil
+	case MessageTypeInv:
+		invMsg := new(InvMessage)
+		if err := gob.NewDecoder(bytes.NewReader(msg.Data)).Decode(invMsg); err != nil {
+			return nil, err
+		}
+		return &DecodedMsg{
+			From: from,
+			Data: invMsg,
+		}, nil
+	case MessageTypeGetData:
+		getDataMsg := new(GetDataMessage)
+		if err := gob.NewDecoder(bytes.NewReader(msg.Data)).Decode(getDataMsg); err != nil {
+			return nil, err
+		}
+		return &DecodedMsg{
+			From: from,
+			Data: getDataMsg,
+		}, nil
+	case MessageTypeGetMempool:
+		return &DecodedMsg{
+			From: from,
+			Data: &GetMempoolMessage{},
+		}, nil
+	case MessageTypeMempoolInv:
+		mempoolInvMsg := new(MempoolInvMessage)
+		if err := gob.NewDecoder(bytes.NewReader(msg.Data)).Decode(mempoolInvMsg); err != nil {
+			return nil, err
+		}
+		return &DecodedMsg{
+			From: from,
+			Data: mempoolInvMsg,
+		}, nil
+	case MessageTypeCompactBlock:
+		compactMsg := new(CompactBlockMessage)
+		if err := gob.NewDecoder(bytes.NewReader(msg.Data)).Decode(compactMsg); err != nil {
+			return nil, err
+		}
+		return &DecodedMsg{
+			From: from,
+			Data: compactMsg,
+		}, nil
+	case MessageTypeGetBlockTxn:
+		getTxnMsg := new(GetBlockTxnMessage)
+		if err := gob.NewDecoder(bytes.NewReader(msg.Data)).Decode(getTxnMsg); err != nil {
+			return nil, err
+		}
+		return &DecodedMsg{
+			From: from,
+			Data: getTxnMsg,
+		}, nil
+	case MessageTypeBlockTxn:
+		txnMsg := new(BlockTxnMessage)
+		if err := gob.NewDecoder(bytes.NewReader(msg.Data)).Decode(txnMsg); err != nil {
+			return nil, err
+		}
+		return &DecodedMsg{
+			From: from,
+			Data: txnMsg,
+		}, nil
+	case MessageTypeGetTxProof:
+		getTxProofMsg := new(GetTxProofMessage)
+		if err := gob.NewDecoder(bytes.NewReader(msg.Data)).Decode(getTxProofMsg); err != nil {
+			return nil, err
+		}
+		return &DecodedMsg{
+			From: from,
+			Data: getTxProofMsg,
+		}, nil
+	case MessageTypeTxProof:
+		txProofMsg := new(TxProofMessage)
+		if err := gob.NewDecoder(bytes.NewReader(msg.Data)).Decode(txProofMsg); err != nil {
+			return nil, err
+		}
+		return &DecodedMsg{
+			From: from,
+			Data: txProofMsg,
+		}, nil
+	case MessageTypeGetAccountProof:
+		getAccountProofMsg := new(GetAccountProofMessage)
+		if err := gob.NewDecoder(bytes.NewReader(msg.Data)).Decode(getAccountProofMsg); err != nil {
+			return nil, err
+		}
+		return &DecodedMsg{
+			From: from,
+			Data: getAccountProofMsg,
+		}, nil
+	case MessageTypeAccountProof:
+		accountProofMsg := new(AccountProofMessage)
+		if err := gob.NewDecoder(bytes.NewReader(msg.Data)).Decode(accountProofMsg); err != nil {
+			return nil, err
+		}
+		return &DecodedMsg{
+			From: from,
+			Data: accountProofMsg,
+		}, nil
 	case MessageStatusType:
 		statusMsg := new(StatusMessage)
 		// new decoder takes in a reader
@@ -146,7 +402,7 @@ func DefaultRPCDecodeFunc(rpc RPC) (*DecodedMsg, error) {
 		}
 
 		return &DecodedMsg{
-			From: rpc.From,
+			From: from,
 			Data: statusMsg,
 		}, nil
 
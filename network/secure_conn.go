@@ -0,0 +1,218 @@
+package network
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/EggsyOnCode/xenolith/crypto_lib"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// every TCP connection starts with an authenticated key exchange before any frame goes over it
+// both ends send a hello | ephemeral x25519 key (32) | identity key (33) |
+// followed by | signature (64) | of the transcript (both hellos, the one of the dialing end first) with their identity key
+// the keys for either direction are derived from the shared secret of the ephemeral keys and the transcript
+// from then on every write is sealed into a record | length (4) | ciphertext |
+const (
+	ephemeralKeySize = 32
+	identityKeySize  = 33
+	helloSize        = ephemeralKeySize + identityKeySize
+	// the key exchange has to be done within this time
+	secureHandshakeTimeout = 5 * time.Second
+	// upper bound for a single record; a frame of the max size plus the tag
+	maxRecordSize = frameHeaderSize + MaxFrameSize + chacha20poly1305.Overhead
+)
+
+var (
+	ErrPeerAuthFailed = errors.New("peer authentication failed")
+	ErrRecordTooLarge = errors.New("record exceeds the max record size")
+)
+
+// secureConn seals whatever is written to it; each Write is a record of its own
+// writes must not run concurrently, TCPPeer takes care of that
+type secureConn struct {
+	net.Conn
+	remoteKey crypto_lib.PublicKey
+	sendAEAD  cipher.AEAD
+	recvAEAD  cipher.AEAD
+	// the nonce is a counter per direction; a key is never used for two connections
+	sendNonce uint64
+	recvNonce uint64
+	// what's left of the last record read
+	readBuf []byte
+}
+
+// transcript signed by each end; the role keeps a signature from being reflected back to its sender
+func signedTranscript(transcript []byte, dialer bool) []byte {
+	role := "accepting"
+	if dialer {
+		role = "dialing"
+	}
+	h := sha256.New()
+	h.Write([]byte("xenolith secure connection " + role))
+	h.Write(transcript)
+	return h.Sum(nil)
+}
+
+// exchange writes ours while reading theirs; both ends send first, and over an unbuffered conn a write waits for the read
+func exchange(conn net.Conn, ours []byte, size int) ([]byte, error) {
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := conn.Write(ours)
+		errCh <- err
+	}()
+
+	theirs := make([]byte, size)
+	_, err := io.ReadFull(conn, theirs)
+	if writeErr := <-errCh; err == nil {
+		err = writeErr
+	}
+	return theirs, err
+}
+
+// secureHandshake runs the key exchange on a new connection; the dialer is the end that opened it
+func secureHandshake(conn net.Conn, key *crypto_lib.PrivateKey, dialer bool) (*secureConn, error) {
+	conn.SetDeadline(time.Now().Add(secureHandshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	ourHello := append(ephemeral.PublicKey().Bytes(), key.PublicKey()...)
+	theirHello, err := exchange(conn, ourHello, helloSize)
+	if err != nil {
+		return nil, err
+	}
+
+	theirEphemeral, err := ecdh.X25519().NewPublicKey(theirHello[:ephemeralKeySize])
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrPeerAuthFailed, err)
+	}
+	remoteKey := crypto_lib.PublicKey(theirHello[ephemeralKeySize:])
+
+	transcript := append(append([]byte{}, theirHello...), ourHello...)
+	if dialer {
+		transcript = append(append([]byte{}, ourHello...), theirHello...)
+	}
+
+	sig, err := key.Sign(signedTranscript(transcript, dialer))
+	if err != nil {
+		return nil, err
+	}
+	theirSig, err := exchange(conn, sig.Bytes(), crypto_lib.SignatureSize)
+	if err != nil {
+		return nil, err
+	}
+	decoded, err := crypto_lib.SignatureFromBytes(theirSig)
+	if err != nil || !decoded.Verify(signedTranscript(transcript, !dialer), remoteKey) {
+		return nil, fmt.Errorf("%w: bad transcript signature", ErrPeerAuthFailed)
+	}
+
+	secret, err := ephemeral.ECDH(theirEphemeral)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrPeerAuthFailed, err)
+	}
+	salt := sha256.Sum256(transcript)
+	dialerAEAD, err := deriveAEAD(secret, salt[:], "dialing to accepting")
+	if err != nil {
+		return nil, err
+	}
+	acceptorAEAD, err := deriveAEAD(secret, salt[:], "accepting to dialing")
+	if err != nil {
+		return nil, err
+	}
+
+	c := &secureConn{Conn: conn, remoteKey: remoteKey, sendAEAD: acceptorAEAD, recvAEAD: dialerAEAD}
+	if dialer {
+		c.sendAEAD, c.recvAEAD = dialerAEAD, acceptorAEAD
+	}
+	return c, nil
+}
+
+func deriveAEAD(secret, salt []byte, info string) (cipher.AEAD, error) {
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, salt, []byte(info)), key); err != nil {
+		return nil, err
+	}
+	return chacha20poly1305.New(key)
+}
+
+func nonce(counter uint64) []byte {
+	n := make([]byte, chacha20poly1305.NonceSize)
+	binary.BigEndian.PutUint64(n[chacha20poly1305.NonceSize-8:], counter)
+	return n
+}
+
+// RemoteKey is the identity key the other end proved it holds
+func (c *secureConn) RemoteKey() crypto_lib.PublicKey {
+	return c.remoteKey
+}
+
+func (c *secureConn) Write(p []byte) (int, error) {
+	if len(p)+c.sendAEAD.Overhead() > maxRecordSize {
+		return 0, ErrRecordTooLarge
+	}
+	record := make([]byte, 4, 4+len(p)+c.sendAEAD.Overhead())
+	record = c.sendAEAD.Seal(record, nonce(c.sendNonce), p, nil)
+	binary.BigEndian.PutUint32(record[:4], uint32(len(record)-4))
+	c.sendNonce++
+
+	if _, err := c.Conn.Write(record); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *secureConn) Read(p []byte) (int, error) {
+	if len(c.readBuf) == 0 {
+		if err := c.readRecord(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, c.readBuf)
+	c.readBuf = c.readBuf[n:]
+	return n, nil
+}
+
+// readRecord opens the next record; a record that doesn't open means the stream was tampered with
+func (c *secureConn) readRecord() error {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(c.Conn, header); err != nil {
+		return err
+	}
+	size := binary.BigEndian.Uint32(header)
+	if size > maxRecordSize {
+		return fmt.Errorf("%w: %d bytes", ErrRecordTooLarge, size)
+	}
+
+	sealed := make([]byte, size)
+	if _, err := io.ReadFull(c.Conn, sealed); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	plain, err := c.recvAEAD.Open(sealed[:0], nonce(c.recvNonce), sealed, nil)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrPeerAuthFailed, err)
+	}
+	c.recvNonce++
+	c.readBuf = plain
+	return nil
+}
+
+// whether the key exchange ended up on a connection to ourselves
+func isOwnKey(key *crypto_lib.PrivateKey, remote crypto_lib.PublicKey) bool {
+	return bytes.Equal(key.PublicKey(), remote)
+}
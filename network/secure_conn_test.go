@@ -0,0 +1,89 @@
+package network
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"net"
+	"testing"
+
+	"github.com/EggsyOnCode/xenolith/crypto_lib"
+	"github.com/stretchr/testify/assert"
+)
+
+// two peers at the ends of an in-memory connection, through the key exchange
+func securePipe(t *testing.T) (*TCPPeer, *TCPPeer) {
+	local, remote := net.Pipe()
+	localKey, remoteKey := crypto_lib.GeneratePrivateKey(), crypto_lib.GeneratePrivateKey()
+
+	accepted := make(chan *secureConn, 1)
+	go func() {
+		conn, err := secureHandshake(remote, remoteKey, false)
+		assert.Nil(t, err)
+		accepted <- conn
+	}()
+	dialed, err := secureHandshake(local, localKey, true)
+	assert.Nil(t, err)
+	acceptedConn := <-accepted
+
+	assert.Equal(t, remoteKey.PublicKey(), dialed.RemoteKey())
+	assert.Equal(t, localKey.PublicKey(), acceptedConn.RemoteKey())
+	return NewTCPPeer(dialed, dialed.RemoteKey(), true), NewTCPPeer(acceptedConn, acceptedConn.RemoteKey(), false)
+}
+
+func TestSecureConnRoundTrip(t *testing.T) {
+	sender, receiver := securePipe(t)
+	defer sender.Close()
+
+	go func() {
+		sender.conn.Write([]byte("foo"))
+		sender.conn.Write([]byte("barbaz"))
+	}()
+	buf := make([]byte, 4)
+	n, err := receiver.conn.Read(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "foo", string(buf[:n]))
+	// a record larger than the buffer is read in pieces
+	n, err = receiver.conn.Read(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "barb", string(buf[:n]))
+	n, err = receiver.conn.Read(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "az", string(buf[:n]))
+}
+
+func TestSecureConnRejectsTamperedRecord(t *testing.T) {
+	sender, receiver := securePipe(t)
+	defer sender.Close()
+
+	conn := sender.conn.(*secureConn)
+	record := conn.sendAEAD.Seal(make([]byte, 4), nonce(conn.sendNonce), []byte("foo"), nil)
+	record[0], record[1], record[2], record[3] = 0, 0, 0, byte(len(record)-4)
+	record[len(record)-1] ^= 0xff
+	go conn.Conn.Write(record)
+
+	_, err := receiver.conn.Read(make([]byte, 16))
+	assert.ErrorIs(t, err, ErrPeerAuthFailed)
+}
+
+func TestSecureHandshakeRejectsImpostor(t *testing.T) {
+	local, remote := net.Pipe()
+	defer local.Close()
+	victim, impostor := crypto_lib.GeneratePrivateKey(), crypto_lib.GeneratePrivateKey()
+
+	// claims the identity of victim but can only sign with its own key
+	go func() {
+		ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+		assert.Nil(t, err)
+		hello := append(ephemeral.PublicKey().Bytes(), victim.PublicKey()...)
+		theirHello, err := exchange(remote, hello, helloSize)
+		assert.Nil(t, err)
+
+		transcript := append(append([]byte{}, theirHello...), hello...)
+		sig, err := impostor.Sign(signedTranscript(transcript, false))
+		assert.Nil(t, err)
+		exchange(remote, sig.Bytes(), crypto_lib.SignatureSize)
+	}()
+
+	_, err := secureHandshake(local, crypto_lib.GeneratePrivateKey(), true)
+	assert.ErrorIs(t, err, ErrPeerAuthFailed)
+}
@@ -2,11 +2,17 @@ package network
 
 import (
 	"bytes"
+	"context"
 	"encoding/gob"
+	"errors"
 	"fmt"
 	"io"
-	"net"
+	"math/big"
+	"math/rand"
+	"net/http"
 	"os"
+	"path/filepath"
+	"sort"
 	"sync"
 	"time"
 
@@ -30,22 +36,71 @@ type ServerOpts struct {
 	PrivateKey     *crypto_lib.PrivateKey
 	//time interval after  which the server will fetch Tx from teh Mempool and create a block
 	BlockTime time.Duration
+	// directory where the chain is persisted; if empty the chain is kept in memory only
+	DataDir string
+	// peers on another network are dropped during the handshake
+	NetworkID uint32
+	// number of outgoing connections the node tries to keep up
+	MaxOutboundPeers int
+	// incoming connections beyond this number are dropped
+	MaxInboundPeers int
+	// how long misbehaving peers are banned for
+	BanDuration time.Duration
+	// carries the msgs to and from the peers; a TCPTransport on ListenAddr if not set
+	Transport Transport
+	// identity of the node; the TCPTransport authenticates our end of every connection with it
+	// the validator key if not set, otherwise a fresh one
+	NodeKey *crypto_lib.PrivateKey
+	// weight the node announces itself with as a validator; 1 if not set
+	Stake uint64
+	// how much every peer may send us; msgs over it are dropped and the peer is penalized
+	PeerRateLimit RateLimit
+	// run as a light client: only the headers are synced and checked; tx and balances are fetched
+	// from the peers along with proofs (see FetchTx and FetchAccount). a light client can't be a validator
+	Light bool
+	// target of the genesis block, which the blocks keep up to the first retarget; core.TARGET_GENESIS if not set
+	// it is part of the genesis block so only nodes with the same one can talk to each other
+	GenesisTarget *big.Int
 }
 
 type Server struct {
 	ServerOpts
-	//is the PvK is not nil then the server is a validator
-	peerCh chan *TCPPeer
 
 	mu      *sync.RWMutex
-	peerMap map[NetAddr]*TCPPeer
-
-	isValidator  bool
-	TCPTransport *TCPTransport
-	chain        *core.Blockchain
-	RpcCh        chan RPC
-	memPool      *TxPool
-	quitCh       chan struct{}
+	peerMap map[NetAddr]*Peer
+	// connections we are waiting on the handshake of
+	handshaking map[NetAddr]*Peer
+	// addresses that turned out to be our own
+	selfAddrs map[string]bool
+	// random number identifying this process in handshakes; used to detect connections to ourselves
+	nonce uint64
+
+	//is the PvK is not nil then the server is a validator
+	isValidator bool
+	addrBook    *AddrBook
+	banList     *BanList
+	syncManager *SyncManager
+	// requests waiting for their reply
+	requests *requestTracker
+	// items asked for with GetData
+	invRequests *invRequests
+	chain       *core.Blockchain
+	// the headers of a light client; its chain holds nothing but the genesis block
+	headerChain *core.HeaderChain
+	RpcCh       <-chan RPC
+	// msgs taken from RpcCh wait here, per peer, until routed
+	inbound *inboundQueues
+	// hands the msgs in RpcCh to the protocols; other protocols like consensus register with it as well
+	Router      *Router
+	discoveryCh <-chan *DecodedMsg
+	executionCh <-chan *DecodedMsg
+	memPool     *TxPool
+	quitCh      chan struct{}
+	apiServer   *api.Server
+	// every goroutine of the server; Stop waits for them
+	wg      sync.WaitGroup
+	stopMu  sync.Mutex
+	stopped bool
 	// we;ll be using this chan to receive tx from the json rpc server
 	txCh chan *core.Transaction
 }
@@ -57,44 +112,119 @@ func NewServer(opts ServerOpts) (*Server, error) {
 	if opts.RPCDecodeFunc == nil {
 		opts.RPCDecodeFunc = DefaultRPCDecodeFunc
 	}
+	if opts.MaxOutboundPeers == 0 {
+		opts.MaxOutboundPeers = defaultMaxOutboundPeers
+	}
+	if opts.MaxInboundPeers == 0 {
+		opts.MaxInboundPeers = defaultMaxInboundPeers
+	}
+	if opts.BanDuration == 0 {
+		opts.BanDuration = defaultBanDuration
+	}
+	if opts.NetworkID == 0 {
+		opts.NetworkID = DefaultNetworkID
+	}
 	if opts.Logger == nil {
 		opts.Logger = log.NewLogfmtLogger(os.Stderr)
 		opts.Logger = log.With(opts.Logger, "address", opts.ID)
 	}
+	if opts.Light && opts.PrivateKey != nil {
+		return nil, fmt.Errorf("a light client can't be a validator")
+	}
+	if opts.NodeKey == nil {
+		opts.NodeKey = opts.PrivateKey
+	}
+	if opts.NodeKey == nil {
+		opts.NodeKey = crypto_lib.GeneratePrivateKey()
+	}
+	if opts.Transport == nil {
+		tr := NewTCPTransporter(opts.ListenAddr, opts.NodeKey)
+		tr.SetLogger(opts.Logger)
+		opts.Transport = tr
+	}
+	// the address we tell our peers about in the handshake
+	if len(opts.ListenAddr) == 0 {
+		opts.ListenAddr = string(opts.Transport.Addr())
+	}
 
-	newChain, err := core.NewBlockchain(genesisBlock(), opts.Logger)
+	var store core.Storage = core.NewMemoryStore()
+	if len(opts.DataDir) > 0 {
+		diskStore, err := core.NewDiskStore(opts.DataDir)
+		if err != nil {
+			return nil, err
+		}
+		store = diskStore
+	}
+
+	newChain, err := core.NewBlockchainWithStore(genesisBlock(opts.GenesisTarget), store, opts.Logger)
 	if err != nil {
 		return nil, err
 	}
 
-	peerCh := make(chan *TCPPeer)
-	tr := NewTCPTransporter(opts.ListenAddr, peerCh)
+	addrBookPath := ""
+	if len(opts.DataDir) > 0 {
+		addrBookPath = filepath.Join(opts.DataDir, addrBookFileName)
+	}
+	addrBook, err := NewAddrBook(addrBookPath)
+	if err != nil {
+		return nil, err
+	}
 
 	s := &Server{
-		ServerOpts:   opts,
-		TCPTransport: tr,
-		peerCh:       peerCh,
-		RpcCh:        make(chan RPC),
-		mu:           &sync.RWMutex{},
-		peerMap:      make(map[NetAddr]*TCPPeer),
-		chain:        newChain,
-		isValidator:  opts.PrivateKey != nil,
-		quitCh:       make(chan struct{}),
-		memPool:      NewTxPool(1000),
-		txCh:         make(chan *core.Transaction),
+		ServerOpts:  opts,
+		RpcCh:       opts.Transport.Consume(),
+		Router:      NewRouter(),
+		inbound:     newInboundQueues(opts.PeerRateLimit),
+		mu:          &sync.RWMutex{},
+		peerMap:     make(map[NetAddr]*Peer),
+		handshaking: make(map[NetAddr]*Peer),
+		chain:       newChain,
+		isValidator: opts.PrivateKey != nil,
+		addrBook:    addrBook,
+		banList:     NewBanList(),
+		invRequests: newInvRequests(getDataTimeout),
+		requests:    newRequestTracker(),
+		nonce:       rand.Uint64(),
+		selfAddrs:   make(map[string]bool),
+		quitCh:      make(chan struct{}),
+		memPool:     NewTxPool(1000),
+		txCh:        make(chan *core.Transaction),
+	}
+
+	if s.discoveryCh, err = s.Router.Register(ProtocolDiscovery, DecodeMessage); err != nil {
+		return nil, err
+	}
+	if s.executionCh, err = s.Router.Register(ProtocolExecution, DecodeMessage); err != nil {
+		return nil, err
 	}
 
-	newChain.SetTxChan(s.txCh)
+	newChain.SetOrphanedTxHandler(s.addOrphanedTx)
+	var apiChain api.Chain = newChain
+	if opts.Light {
+		genesis, err := newChain.GetBlock(0)
+		if err != nil {
+			return nil, err
+		}
+		s.headerChain = core.NewHeaderChain(genesis.SignedHeader())
+		s.syncManager = NewLightSyncManager(s.headerChain, s.Request, s.penalizePeer, opts.Logger)
+		apiChain = lightChain{s}
+	} else {
+		s.syncManager = NewSyncManager(newChain, s.Request, s.penalizePeer, opts.Logger)
+	}
 
 	// only if the api listen addr port has been specified
 	if len(opts.APIListenAddr) > 0 {
 		cfg := api.ServerConfig{
 			ListenAddr: opts.APIListenAddr,
 			Logger:     opts.Logger,
+			BanList:    s,
 		}
-		apiServer := api.NewAPIServer(cfg, newChain, s.txCh)
-
-		go apiServer.Start()
+		s.apiServer = api.NewAPIServer(cfg, apiChain, s.txCh)
+		s.spawn(func() {
+			if err := s.apiServer.Start(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				s.Logger.Log("msg", "API server failed", "err", err)
+			}
+		})
 
 		opts.Logger.Log("msg", "API server started at port", "port", opts.APIListenAddr)
 	}
@@ -104,56 +234,88 @@ func NewServer(opts ServerOpts) (*Server, error) {
 		s.RPCProcessor = s
 	}
 
+	if len(opts.DataDir) > 0 {
+		if err := s.memPool.Load(filepath.Join(opts.DataDir, mempoolFileName)); err != nil {
+			return nil, err
+		}
+	}
+
 	if s.isValidator {
-		go s.validatorLoop()
+		s.spawn(s.validatorLoop)
 	}
 
 	return s, nil
 }
 
+// track counts a goroutine in for Stop to wait for; none are started once the server stops
+func (s *Server) track() bool {
+	s.stopMu.Lock()
+	defer s.stopMu.Unlock()
+	if s.stopped {
+		return false
+	}
+	s.wg.Add(1)
+	return true
+}
+
+// spawn runs f in a goroutine Stop waits for
+func (s *Server) spawn(f func()) {
+	if !s.track() {
+		return
+	}
+	go func() {
+		defer s.wg.Done()
+		f()
+	}()
+}
+
 func (s *Server) Start() error {
-	s.TCPTransport.Start()
+	if !s.track() {
+		return ErrServerStopped
+	}
+	defer s.wg.Done()
+
+	if err := s.Transport.Start(); err != nil {
+		return err
+	}
 	//infinite loop reading the rpc msgs from the transporters
 	// free label used
 
-	s.Logger.Log("msg", "accepting TCP connections on", "address", s.ListenAddr)
+	s.Logger.Log("msg", "accepting connections on", "address", s.Transport.Addr())
 	if len(s.BootStrapNodes) > 0 {
-		go s.bootstrapNodes()
-
+		s.spawn(s.bootstrapNodes)
 	}
+	s.spawn(s.discoveryLoop)
+	s.spawn(func() { s.syncManager.loop(s.quitCh) })
+	s.spawn(s.intakeLoop)
+	s.spawn(s.routeLoop)
 free:
 	for {
 		select {
-		case peer := <-s.peerCh:
-			s.mu.RLock()
-			s.peerMap[NetAddr(peer.conn.RemoteAddr().String())] = peer
-			s.mu.RUnlock()
-
-			go peer.readLoop(s.RpcCh)
+		case ev := <-s.Transport.PeerEvents():
+			s.processPeerEvent(ev)
 
-			if err := s.sendGetStatusMsg(peer); err != nil {
-				s.Logger.Log("err", err)
-				continue
-		}
+		case msg := <-s.discoveryCh:
+			// the connection a msg came in on has to be known before the msg is looked at
+			s.processPendingPeerEvents()
+			s.processDiscoveryMsg(msg)
 
-			s.Logger.Log("msg", "peer added to the server", "peer", peer.conn.RemoteAddr(), "outgoing", peer.Outgoing)
+		case msg := <-s.executionCh:
+			s.processPendingPeerEvents()
+			// the handshake of the peer came in before any of its other msgs; it has to be looked at first
+			s.processPendingDiscoveryMsgs()
 
-		case rpc := <-s.RpcCh:
-			msg, err := DefaultRPCDecodeFunc(rpc)
-			if err != nil {
-				s.Logger.Log("err", err)
+			// nothing but the handshake is taken from a peer before it went through it
+			if !s.isPeer(msg.From) {
 				continue
 			}
-
-			switch msg.Data.(type) {
-			// msg of type ValidatorNotification is to be handled inside the consensus layer
-			case ValidatorNotification:
+			// replies go to whoever is waiting for them in Request
+			if s.requests.deliver(msg) {
 				continue
-			default:
-				if err := s.RPCProcessor.ProcessMessage(msg); err != nil {
-					if err != core.ErrBlockKnown {
-						s.Logger.Log("err", err)
-					}
+			}
+			if err := s.RPCProcessor.ProcessMessage(msg); err != nil {
+				if err != core.ErrBlockKnown {
+					s.Logger.Log("err", err)
 				}
 			}
 
@@ -172,13 +334,180 @@ free:
 	return nil
 }
 
+// Stop shuts the node down: block production and the api stop, the peers are dropped, the msgs
+// still queued are thrown away and the chain and the mempool are written out
+// it waits for every goroutine of the server to exit or ctx to be done, whichever comes first;
+// the chain is closed either way, whatever is still running after that finds its store closed
+func (s *Server) Stop(ctx context.Context) error {
+	s.stopMu.Lock()
+	if s.stopped {
+		s.stopMu.Unlock()
+		return nil
+	}
+	s.stopped = true
+	s.stopMu.Unlock()
+
+	var errs []error
+	// while the server loop still runs, so tx posted in the meantime aren't stuck on the way to it
+	if s.apiServer != nil {
+		if err := s.apiServer.Shutdown(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("shutting down api: %w", err))
+		}
+	}
+
+	close(s.quitCh)
+	if err := s.Transport.Close(); err != nil {
+		errs = append(errs, fmt.Errorf("closing transport: %w", err))
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		s.syncManager.wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		s.stopHandshakeTimers()
+		s.drain()
+	case <-ctx.Done():
+		errs = append(errs, ctx.Err())
+	}
+
+	if err := s.addrBook.Save(); err != nil {
+		errs = append(errs, fmt.Errorf("saving address book: %w", err))
+	}
+	if len(s.DataDir) > 0 {
+		if err := s.memPool.Save(filepath.Join(s.DataDir, mempoolFileName)); err != nil {
+			errs = append(errs, fmt.Errorf("saving mempool: %w", err))
+		}
+	}
+	if err := s.chain.Close(); err != nil {
+		errs = append(errs, fmt.Errorf("closing chain store: %w", err))
+	}
+
+	s.Logger.Log("msg", "server stopped")
+	return errors.Join(errs...)
+}
+
+// drain empties the queues nobody reads from anymore; tx posted to the api are kept in the mempool
+func (s *Server) drain() {
+	for {
+		select {
+		case <-s.discoveryCh:
+		case <-s.executionCh:
+		case <-s.RpcCh:
+		case <-s.Transport.PeerEvents():
+		case tx := <-s.txCh:
+			s.memPool.Add(tx)
+		default:
+			return
+		}
+	}
+}
+
+func (s *Server) stopHandshakeTimers() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, peer := range s.handshaking {
+		if peer.handshakeTimer != nil {
+			peer.handshakeTimer.Stop()
+		}
+	}
+}
+
+// intakeLoop takes the msgs off the transport as they come in and queues them per peer
+// it never waits on a peer, so RpcCh keeps moving however much a single peer sends
+// a peer going over its rate limit is penalized; a full queue only means we are slow and its msgs are dropped
+func (s *Server) intakeLoop() {
+	for {
+		select {
+		case rpc := <-s.RpcCh:
+			err := s.inbound.push(rpc)
+			if errors.Is(err, ErrRateLimited) {
+				s.penalizePeer(rpc.From, penaltyRateLimited, err)
+			} else if err != nil {
+				s.Logger.Log("msg", "dropping msg", "from", rpc.From, "err", err)
+			}
+		case <-s.quitCh:
+			return
+		}
+	}
+}
+
+// routeLoop hands the queued msgs to the router, taking turns between the peers
+// the router holds on to a msg until its protocol has room for it, so while the server falls behind
+// the msgs wait in the queues of the peers and every peer gets its turn once there is room again
+func (s *Server) routeLoop() {
+	for {
+		select {
+		case <-s.inbound.notify:
+		case <-s.quitCh:
+			return
+		}
+
+		for rpc, ok := s.inbound.pop(); ok; rpc, ok = s.inbound.pop() {
+			err := s.Router.Route(rpc, s.quitCh)
+			if err == nil {
+				continue
+			}
+			if errors.Is(err, ErrProtocolBusy) {
+				return
+			}
+			s.Logger.Log("msg", "dropping msg", "from", rpc.From, "err", err)
+			// a protocol we don't run is our problem, not the one of the peer
+			if !errors.Is(err, ErrUnknownProtocol) {
+				s.penalizePeer(rpc.From, penaltyUndecodableMsg, err)
+			}
+		}
+	}
+}
+
+// processDiscoveryMsg handles the handshake and the exchange of peer addresses
+func (s *Server) processDiscoveryMsg(msg *DecodedMsg) {
+	if hs, ok := msg.Data.(*HandshakeMessage); ok {
+		s.processHandshakeMsg(msg.From, hs)
+		return
+	}
+	if !s.isPeer(msg.From) || s.requests.deliver(msg) {
+		return
+	}
+
+	var err error
+	switch t := msg.Data.(type) {
+	case *GetPeersMessage:
+		err = s.processGetPeersMsg(msg)
+	case *PeersMessage:
+		err = s.processPeersMsg(msg.From, t)
+	}
+	if err != nil {
+		s.Logger.Log("err", err)
+	}
+}
+
+func (s *Server) processPendingDiscoveryMsgs() {
+	for {
+		select {
+		case msg := <-s.discoveryCh:
+			s.processDiscoveryMsg(msg)
+		default:
+			return
+		}
+	}
+}
+
 func (s *Server) validatorLoop() {
 	ticker := time.NewTicker(s.BlockTime)
+	defer ticker.Stop()
 
 	s.Logger.Log("msg", "server validator loop staring...", "blockTime", s.BlockTime)
 	for {
 		//whenever the ticker value is decremented
-		<-ticker.C
+		select {
+		case <-ticker.C:
+		case <-s.quitCh:
+			return
+		}
 		if err := s.createNewBlock(); err != nil {
 			s.Logger.Log("msg", "err creating block", "error", err)
 			continue
@@ -190,33 +519,212 @@ func (s *Server) bootstrapNodes() {
 	//these are outgoing connection to remote nodes/servers
 	// we are dialing connections to them and adding them as outgoing peers
 	for _, addr := range s.BootStrapNodes {
-		conn, err := net.Dial("tcp", (addr))
-		if err != nil {
+		s.addrBook.AddPersistent(addr)
+		if err := s.dial(addr); err != nil {
 			fmt.Printf("could not connect to %v: %v\n", addr, err)
 			continue
 		}
-		peer := NewTCPPeer(conn, true)
-		s.peerCh <- peer
-
-		// if we are a validator then we inform the other nodes about this
-		if s.isValidator {
-			buf := &bytes.Buffer{}
-			validatorNotifMsg := &ValidatorNotification{
-				Server: s,
-			}
-			if err := gob.NewEncoder(buf).Encode(validatorNotifMsg); err != nil {
-				s.Logger.Log("msg", "error encoding validator notification msg", "err", err)
-			}
-			msg := NewMessage(MessageTypeValidatorInform, buf.Bytes())
-			buffer := &bytes.Buffer{}
-			if err := gob.NewEncoder(buffer).Encode(msg); err != nil {
-				s.Logger.Log("msg", "error encoding rpc msg fro validator notification msg", "err", err)
-			}
+	}
+
+}
 
-			peer.Send(msg.Bytes())
+// processPeerEvent keeps track of the connections the transport reports
+// a new connection has to go through the handshake before it becomes a peer
+func (s *Server) processPeerEvent(ev PeerEvent) {
+	if !ev.Connected {
+		s.inbound.remove(ev.Addr)
+		s.mu.RLock()
+		peer, ok := s.peerMap[ev.Addr]
+		if !ok {
+			peer, ok = s.handshaking[ev.Addr]
 		}
+		s.mu.RUnlock()
+		if ok {
+			s.removePeer(peer)
+		}
+		return
 	}
 
+	// a banned node doesn't get as far as the handshake
+	if s.isBanned(ev.Addr, ev.RemoteAddr) {
+		s.Logger.Log("msg", "dropping banned peer", "peer", ev.Addr, "remote", ev.RemoteAddr)
+		s.Transport.Disconnect(ev.Addr)
+		return
+	}
+
+	peer := newPeer(ev)
+	s.mu.Lock()
+	s.handshaking[ev.Addr] = peer
+	peer.handshakeTimer = time.AfterFunc(handshakeTimeout, func() { s.handshakeTimedOut(peer) })
+	s.mu.Unlock()
+
+	if err := s.sendHandshake(peer); err != nil {
+		s.Logger.Log("msg", "could not send handshake", "peer", ev.Addr, "err", err)
+		s.removePeer(peer)
+	}
+}
+
+func (s *Server) processPendingPeerEvents() {
+	for {
+		select {
+		case ev := <-s.Transport.PeerEvents():
+			s.processPeerEvent(ev)
+		default:
+			return
+		}
+	}
+}
+
+// isPeer reports whether the peer is through the handshake
+func (s *Server) isPeer(addr NetAddr) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.peerMap[addr]
+	return ok
+}
+
+// addPeer puts a peer whose handshake checked out into the peerMap
+func (s *Server) addPeer(peer *Peer, hs *HandshakeMessage) {
+	peer.handshake = hs
+	peer.listenAddr = advertisedAddr(peer, hs)
+
+	if err := s.registerPeer(peer); err != nil {
+		s.Logger.Log("msg", "dropping peer", "peer", peer.Addr, "err", err)
+		s.Transport.Disconnect(peer.Addr)
+		return
+	}
+	s.addrBook.MarkGood(peer.listenAddr)
+
+	// if we are a validator then we inform the other nodes about this
+	if s.isValidator {
+		if err := s.sendValidatorAnnouncement(peer); err != nil {
+			s.Logger.Log("msg", "failed to announce validator", "peer", peer.Addr, "err", err)
+		}
+	}
+
+	s.spawn(func() { s.requestStatus(peer.Addr) })
+	// a light client doesn't gossip tx
+	if !s.Light {
+		s.spawn(func() { s.requestMempool(peer.Addr) })
+	}
+	if err := s.sendGetPeersMsg(peer); err != nil {
+		s.Logger.Log("err", err)
+		return
+	}
+
+	s.Logger.Log("msg", "peer added to the server", "peer", peer.Addr, "id", hs.NodeID, "outgoing", peer.Outgoing)
+}
+
+// registerPeer puts a peer that went through the handshake into the peerMap
+// unless we hold a connection to the same node already or we are at the limit for its direction
+func (s *Server) registerPeer(peer *Peer) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	inbound, outbound := 0, 0
+	for _, p := range s.peerMap {
+		if p.handshake.Nonce == peer.handshake.Nonce {
+			return fmt.Errorf("already connected to node %s", peer.handshake.NodeID)
+		}
+		if p.Outgoing {
+			outbound++
+		} else {
+			inbound++
+		}
+	}
+	if peer.Outgoing && outbound >= s.MaxOutboundPeers {
+		return fmt.Errorf("max outbound peers (%d) reached", s.MaxOutboundPeers)
+	}
+	if !peer.Outgoing && inbound >= s.MaxInboundPeers {
+		return fmt.Errorf("max inbound peers (%d) reached", s.MaxInboundPeers)
+	}
+
+	peer.setState(PeerStateActive)
+	s.peerMap[peer.Addr] = peer
+	return nil
+}
+
+// removePeer drops a peer and closes the connection to it
+// outgoing peers are redialed by the discovery loop once their backoff has passed
+func (s *Server) removePeer(peer *Peer) {
+	s.mu.Lock()
+	active := s.peerMap[peer.Addr] == peer
+	if active {
+		delete(s.peerMap, peer.Addr)
+	}
+	if p, ok := s.handshaking[peer.Addr]; ok && p == peer {
+		delete(s.handshaking, peer.Addr)
+		peer.handshakeTimer.Stop()
+	}
+	s.mu.Unlock()
+
+	if peer.State() == PeerStateClosed {
+		return
+	}
+	peer.setState(PeerStateClosed)
+	// the transport could have dropped the connection already
+	s.Transport.Disconnect(peer.Addr)
+	if !active {
+		return
+	}
+
+	s.requests.failPeer(peer.Addr)
+	s.syncManager.RemovePeer(peer.Addr)
+	s.Logger.Log("msg", "peer removed from the server", "peer", peer.Addr, "outgoing", peer.Outgoing, "uptime", time.Since(peer.connectedAt).Round(time.Second))
+}
+
+func (s *Server) sendValidatorAnnouncement(peer *Peer) error {
+	stake := s.Stake
+	if stake == 0 {
+		stake = 1
+	}
+	// nodes on a local transport don't listen anywhere; they are reached by their transport address
+	listenAddr := s.ListenAddr
+	if listenAddr == "" {
+		listenAddr = string(s.Transport.Addr())
+	}
+	announcement, err := NewValidatorAnnouncement(s.PrivateKey, listenAddr, stake)
+	if err != nil {
+		return err
+	}
+
+	buf := &bytes.Buffer{}
+	if err := gob.NewEncoder(buf).Encode(announcement); err != nil {
+		return err
+	}
+	return s.Transport.SendMsg(peer.Addr, NewMessage(MessageTypeValidatorAnnouncement, buf.Bytes()))
+}
+
+// Chain is the chain the server keeps in sync with its peers
+func (s *Server) Chain() *core.Blockchain {
+	return s.chain
+}
+
+// Mempool is the pool of tx waiting to be included in a block
+func (s *Server) Mempool() *TxPool {
+	return s.memPool
+}
+
+// Peers lists the peers that are through the handshake
+func (s *Server) Peers() []NetAddr {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	peers := make([]NetAddr, 0, len(s.peerMap))
+	for addr := range s.peerMap {
+		peers = append(peers, addr)
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i] < peers[j]
+	})
+	return peers
+}
+
+// ProduceBlock creates a block on top of the chain and announces it without waiting for the validator loop
+func (s *Server) ProduceBlock() error {
+	if !s.isValidator {
+		return fmt.Errorf("server %s is not a validator", s.ID)
+	}
+	return s.createNewBlock()
 }
 
 func (s *Server) createNewBlock() error {
@@ -234,6 +742,13 @@ func (s *Server) createNewBlock() error {
 	if err != nil {
 		return err
 	}
+	// committing to the state the block leaves behind
+	block.Header.StateRoot = s.chain.StateRootAfter(block)
+
+	// the header must not change after mining and signing
+	if err := s.chain.MineBlock(block, s.quitCh); err != nil {
+		return err
+	}
 
 	//signing the block
 	block.Sign(s.PrivateKey)
@@ -246,192 +761,229 @@ func (s *Server) createNewBlock() error {
 		return err
 	}
 
-
 	return s.broadcastBlock(block)
 }
 
 // process Msg acts as the router routing the deocded msg to their appropriate handlers
 func (s *Server) ProcessMessage(msg *DecodedMsg) error {
+	// DecodeMessage checks the msgs it decodes already; the ones handed over by other means are checked here
+	if err := checkMessageData(msg.Data); err != nil {
+		s.penalizePeer(msg.From, penaltyUndecodableMsg, err)
+		return err
+	}
+	if s.Light {
+		return s.processLightMessage(msg)
+	}
+
 	switch t := msg.Data.(type) {
 	case *core.Transaction:
+		item := InvItem{Type: InvTypeTx, Hash: t.Hash(core.TxHasher{})}
+		s.markKnown(msg.From, item)
+		s.invRequests.Done(item)
 		//where t is essentially the msg.Data
-		return s.processTx(t)
+		if err := s.processTx(t); err != nil {
+			s.penalizePeer(msg.From, penaltyInvalidTx, err)
+			return err
+		}
+		return nil
 	case *core.Block:
+		item := InvItem{Type: InvTypeBlock, Hash: t.Hash(core.BlockHasher{})}
+		s.markKnown(msg.From, item)
+		s.invRequests.Done(item)
 		return s.processBlock(t, msg.From)
+	case *CompactBlockMessage:
+		return s.processCompactBlockMsg(msg.From, t)
+	case *GetBlockTxnMessage:
+		return s.processGetBlockTxnMsg(msg, t)
+	case *InvMessage:
+		return s.processInvMsg(msg.From, t)
+	case *GetDataMessage:
+		return s.processGetDataMsg(msg.From, t)
 	case *StatusMessage:
 		return s.processStatusMsg(msg.From, t)
 	case *GetStatusMessage:
-		return s.processGetStatusMsg(msg.From)
+		return s.processGetStatusMsg(msg)
 	case *GetBlockMessage:
-		return s.processBlockRequestedMsg(msg.From, t)
+		return s.processBlockRequestedMsg(msg, t)
 	case *BlocksMessage:
 		return s.processBlockReceipt(msg.From, t)
+	case *GetHeadersMessage:
+		return s.processGetHeadersMsg(msg, t)
+	case *GetBlockBodiesMessage:
+		return s.processGetBlockBodiesMsg(msg, t)
+	case *GetMempoolMessage:
+		return s.processGetMempoolMsg(msg)
+	case *GetTxProofMessage:
+		return s.processGetTxProofMsg(msg, t)
+	case *GetAccountProofMessage:
+		return s.processGetAccountProofMsg(msg, t)
+	// headers and bodies only make sense as the reply to the request of the sync manager; the mempool inv and
+	// the block txn as the ones to ours. these are unsolicited or came in after the request timed out
+	case *HeadersMessage, *BlockBodiesMessage, *MempoolInvMessage, *BlockTxnMessage, *TxProofMessage, *AccountProofMessage:
+		return nil
 	}
 
 	return nil
 }
 
-// send req msgs to the peer that;s just been added to teh peermap
-func (s *Server) sendGetStatusMsg(peer *TCPPeer) error {
-	s.Logger.Log("msg", "sending get status msg request to ", "to", peer.conn.RemoteAddr(), "us", s.ListenAddr)
-	msg := new(GetStatusMessage)
+// requestStatus asks the peer that;s just been added to the peermap for its status
+func (s *Server) requestStatus(peer NetAddr) {
+	s.Logger.Log("msg", "sending get status msg request to ", "to", peer, "us", s.ListenAddr)
 	buf := &bytes.Buffer{}
-	if err := gob.NewEncoder(buf).Encode(msg); err != nil {
-		return err
+	if err := gob.NewEncoder(buf).Encode(new(GetStatusMessage)); err != nil {
+		s.Logger.Log("err", err)
+		return
+	}
+
+	reply, err := s.Request(peer, NewMessage(MessageGetStatusType, buf.Bytes()), statusTimeout)
+	if err != nil {
+		s.Logger.Log("msg", "no status from peer", "peer", peer, "err", err)
+		return
+	}
+	status, ok := reply.Data.(*StatusMessage)
+	if !ok {
+		s.Logger.Log("msg", "unexpected reply to a status request", "peer", peer, "type", fmt.Sprintf("%T", reply.Data))
+		return
+	}
+	if err := s.processStatusMsg(peer, status); err != nil {
+		s.Logger.Log("err", err)
 	}
-	rpcMsg := NewMessage(MessageGetStatusType, buf.Bytes())
-	return peer.Send(rpcMsg.Bytes())
 }
 
 // // when the server receives a req from another node to send its status msg
-func (s *Server) processGetStatusMsg(from NetAddr) error {
-	s.Logger.Log("server", s.ID, "msg", "received get status msg request from ", "from", from)
-	if s.TCPTransport.listenAddr != from {
-		statusMsg := NewStatusMessage(s.chain.Height(), s.chain.Version)
+func (s *Server) processGetStatusMsg(req *DecodedMsg) error {
+	s.Logger.Log("server", s.ID, "msg", "received get status msg request from ", "from", req.From)
+	if s.Transport.Addr() != req.From {
+		statusMsg := NewStatusMessage(s.chain.Version, s.chain.Height())
 		buf := &bytes.Buffer{}
 		if err := gob.NewEncoder(buf).Encode(statusMsg); err != nil {
 			return err
 		}
-		msg := NewMessage(MessageStatusType, buf.Bytes())
-		buffer := &bytes.Buffer{}
-		if err := gob.NewEncoder(buffer).Encode(msg); err != nil {
-			return err
-		}
-
-		s.mu.RLock()
-		defer s.mu.RUnlock()
-
-		peer, ok := s.peerMap[from]
-		if !ok {
-			return fmt.Errorf("peer %s not found", peer.conn.RemoteAddr())
-		}
 
-		return peer.Send(msg.Bytes())
+		return s.reply(req, NewMessage(MessageStatusType, buf.Bytes()))
 	}
 	return nil
 }
 
 // when the server receives a status msg response back from the nodes
 func (s *Server) processStatusMsg(from NetAddr, msg *StatusMessage) error {
-	fmt.Printf("%s received status msg response %v from => server at address %v\n", s.ID, msg, from)
+	s.Logger.Log("msg", "received status", "from", from, "peer height", msg.CurrentHeight, "our height", s.chain.Height())
 
-	// compare the msg data with the node's own bc; its height and version say
-	// cal the differences adn request the missing bits from the peer
-	if msg.CurrentHeight <= s.chain.Height() {
-		s.Logger.Log("msg", "peer is behind", "peer height", msg.CurrentHeight, "our height", s.chain.Height(), "peer address", from)
-	}
-
-	//now we are certain that we are behind peer; so we need to fetch the missing blocks
-	go s.reqBlockLoop(from)
+	// the sync manager decides whether and from whom blocks have to be fetched
+	s.syncManager.UpdatePeerHeight(from, msg.CurrentHeight)
 	return nil
 }
 
-// loop to keep requesting a peer for blocks until we are in sync
-// TODO: find a conditoin to detect that we indeed are synced and terminate the loop
-// cuz this way we will be congesting the network!!!
-func (s *Server) reqBlockLoop(peer NetAddr) error {
-	ticker := time.NewTicker(3 * time.Second)
-	for {
-		ourHeight := s.chain.Height()
-		s.Logger.Log("msg", "requesting blocks from peer", "peer", peer, "requesting height", ourHeight+1)
-
-		getBlockMsg := &GetBlockMessage{
-			From: s.chain.Height() + 1,
-			//0 would signal the remote node to send max no of blocks that they have
-			To: 0,
-		}
-		buf := &bytes.Buffer{}
+// when some other nodes requests us for our blocks
+// the range is capped at the height of our chain and at maxBlocksPerResponse blocks
+func (s *Server) processBlockRequestedMsg(req *DecodedMsg, msg *GetBlockMessage) error {
+	to := msg.To
+	//0 asks for everything we have
+	if to == 0 || to > s.chain.Height() {
+		to = s.chain.Height()
+	}
+	if msg.From <= to && to-msg.From >= maxBlocksPerResponse {
+		to = msg.From + maxBlocksPerResponse - 1
+	}
+	s.Logger.Log("msg", "received get blocks request", "from", req.From, "range from", msg.From, "range to", to)
 
-		if err := gob.NewEncoder(buf).Encode(getBlockMsg); err != nil {
+	blocks := []*core.Block{}
+	for i := msg.From; i <= to && msg.From <= to; i++ {
+		block, err := s.chain.GetBlock(i)
+		if err != nil {
 			return err
 		}
 
-		rpcMsg := NewMessage(MessageTypeGetBlocks, buf.Bytes())
-
-		s.mu.RLock()
-		defer s.mu.RUnlock()
-
-		//to whom we have to send our data
-		peer, ok := s.peerMap[peer]
-		if !ok {
-			return fmt.Errorf("peer %s not found", peer.conn.RemoteAddr())
-		}
-		if err := peer.Send(rpcMsg.Bytes()); err != nil {
-			s.Logger.Log("msg", "failed to send get block msg", "err", err)
-		}
+		blocks = append(blocks, detachBlock(block))
+	}
 
-		<-ticker.C
+	blocksMsg := &BlocksMessage{
+		Blocks: blocks,
+	}
+	buf := &bytes.Buffer{}
 
+	if err := gob.NewEncoder(buf).Encode(blocksMsg); err != nil {
+		return err
 	}
+
+	return s.reply(req, NewMessage(MessageTypeBlocks, buf.Bytes()))
 }
 
-// when some other nodes requests us for our blocks
-func (s *Server) processBlockRequestedMsg(from NetAddr, msg *GetBlockMessage) error {
-	fmt.Printf("server %v received get block request msg from %v\n", s.ID, from)
+func (s *Server) processGetHeadersMsg(req *DecodedMsg, msg *GetHeadersMessage) error {
 	to := msg.To
-	if msg.To == 0 {
+	if to == 0 || to > s.chain.Height() {
 		to = s.chain.Height()
 	}
-	fmt.Printf("blocks requested are from %v to %v\n", msg.From, to)
-
-	//gonna return block headers
-	blocks := []*core.Block{}
-
-	//if the remote node is asking for all the blocks
-	if msg.To == 0 {
-		for i := int(msg.From); i <= int(s.chain.Height()); i++ {
-			block, err := s.chain.GetBlock(uint32(i))
-			if err != nil {
-				return err
-			}
-
-			blocks = append(blocks, block)
-		}
+	if msg.From <= to && to-msg.From >= maxHeadersPerResponse {
+		to = msg.From + maxHeadersPerResponse - 1
 	}
 
-	//if the remote node is asking for a specific no of blocks then
-	for i := msg.From; i <= s.chain.Height(); i++ {
-		block, err := s.chain.GetBlock(uint32(i))
+	headers := []*core.SignedHeader{}
+	for i := msg.From; i <= to && msg.From <= to; i++ {
+		block, err := s.chain.GetBlock(i)
 		if err != nil {
 			return err
 		}
 
-		blocks = append(blocks, block)
+		headers = append(headers, block.SignedHeader())
+	}
+
+	buf := &bytes.Buffer{}
+	if err := gob.NewEncoder(buf).Encode(&HeadersMessage{Headers: headers}); err != nil {
+		return err
 	}
 
-	fmt.Printf("sending %v blocks to %v\n", (blocks), from)
+	return s.reply(req, NewMessage(MessageTypeHeaders, buf.Bytes()))
+}
 
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+func (s *Server) processGetBlockBodiesMsg(req *DecodedMsg, msg *GetBlockBodiesMessage) error {
+	hashes := msg.Hashes
+	if len(hashes) > maxBodiesPerResponse {
+		hashes = hashes[:maxBodiesPerResponse]
+	}
 
-	gob.Register(&BlocksMessage{})
+	bodies := []*BlockBody{}
+	for _, hash := range hashes {
+		block, err := s.chain.GetBlockByHash(hash)
+		// the peer will ask someone else for the ones we don't have
+		if err != nil {
+			continue
+		}
 
-	blocksMsg := &BlocksMessage{
-		Blocks: blocks,
+		bodies = append(bodies, &BlockBody{Hash: hash, Transactions: block.Transactions})
 	}
-	buf := &bytes.Buffer{}
 
-	if err := gob.NewEncoder(buf).Encode(blocksMsg); err != nil {
+	buf := &bytes.Buffer{}
+	if err := gob.NewEncoder(buf).Encode(&BlockBodiesMessage{Bodies: bodies}); err != nil {
 		return err
 	}
 
-	rpcMsg := NewMessage(MessageTypeBlocks, buf.Bytes())
+	return s.reply(req, NewMessage(MessageTypeBlockBodies, buf.Bytes()))
+}
 
-	peer, ok := s.peerMap[from]
-	if !ok {
-		return fmt.Errorf("peer %s not found", peer.conn.RemoteAddr())
+// detachBlock copies a block of our chain without its links to the neighbouring blocks;
+// gob would otherwise encode the rest of the chain along with it
+func detachBlock(b *core.Block) *core.Block {
+	return &core.Block{
+		Header:       b.Header,
+		Transactions: b.Transactions,
+		Validator:    b.Validator,
+		Signature:    b.Signature,
+	}
+}
+
+func (s *Server) sendToPeer(addr NetAddr, msg *Message) error {
+	if !s.isPeer(addr) {
+		return fmt.Errorf("peer %s not found", addr)
 	}
 
-	return peer.Send(rpcMsg.Bytes())
+	return s.Transport.SendMsg(addr, msg)
 }
 
 // func to process the blocks received from the remote nodes
 func (s *Server) processBlockReceipt(from NetAddr, msg *BlocksMessage) error {
-	if s.ID == "LATE" {
-		fmt.Printf("server %v received blocks from %v\n", s.ID, from)
-	}
 	for _, block := range msg.Blocks {
-		if err := s.processBlock(block, from); err != nil {
+		if err := s.processBlock(block, from); err != nil && err != core.ErrBlockKnown {
 			return err
 		}
 	}
@@ -441,12 +993,22 @@ func (s *Server) processBlockReceipt(from NetAddr, msg *BlocksMessage) error {
 func (s *Server) processBlock(b *core.Block, origin NetAddr) error {
 	//when the block is received from the peers, we need to add it to the local chain
 	//this way the incoming block gets validated as well
+	// the links are ours to set; whatever the peer put there points into its chain, not ours
+	b.PrevBlock, b.NextBlocks = nil, nil
 	if err := s.chain.AddBlock(b); err != nil {
+		// a block that doesn't fit onto our chain could be an honest mistake, a broken one is not
+		if errors.Is(err, core.ErrInvalidBlock) {
+			s.penalizePeer(origin, penaltyInvalidBlock, err)
+			return err
+		}
+		// e.g the block is too high; the peer is ahead of us
+		s.syncManager.UpdatePeerHeight(origin, b.Header.Height)
 		return err
 	}
+	s.syncManager.UpdatePeerHeight(origin, b.Header.Height)
 
 	s.Logger.Log("msg", "received block from peers", "block hash", core.BlockHasher{}.Hash(b.Header), "chain height", s.chain.Height())
-	go s.broadcastBlock(b)
+	s.spawn(func() { s.broadcastBlock(b) })
 
 	return nil
 }
@@ -469,43 +1031,32 @@ func (s *Server) processTx(tx *core.Transaction) error {
 
 	// s.Logger.Log("msg", "adding new tx to the mempool", "hash", hash, "memPool pending", s.memPool.PendingCount())
 
-	go s.broadcastTx(tx)
+	s.spawn(func() { s.broadcastTx(tx) })
 
 	s.memPool.Add(tx)
 	return nil
 }
 
-func (s *Server) broadcast(payload []byte) error {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-	for _, peer := range s.peerMap {
-		if err := peer.Send(payload); err != nil {
-			fmt.Printf("error sending to %v: %v\n", peer, err)
-			continue
-		}
+// addOrphanedTx puts the tx of the blocks a reorg took off the chain back into the mempool to be included again
+// the chain calls it from AddBlock, i.e from whichever goroutine added the block; it must not wait on the server loop
+func (s *Server) addOrphanedTx(txx []*core.Transaction) {
+	for _, tx := range txx {
+		tx.SetTimeStamp(time.Now().Unix())
+		s.memPool.Add(tx)
 	}
-	return nil
+	s.Logger.Log("msg", "orphaned tx back in the mempool", "count", len(txx))
 }
 
-// broadcast block to peers to share the updated state of the chain
-func (s *Server) broadcastBlock(b *core.Block) error {
-	buf := &bytes.Buffer{}
-	if err := b.Encode(core.NewGobBlockEncoder(buf)); err != nil {
-		return err
+// broadcast sends msg to every peer; the transport drops the ones it can't write to
+func (s *Server) broadcast(msg *Message) error {
+	if err := s.Transport.Broadcast(msg, ""); err != nil {
+		s.Logger.Log("msg", "broadcast failed for some peers", "err", err)
 	}
-
-	msg := NewMessage(MessageTypeBlock, buf.Bytes())
-	return s.broadcast(msg.Bytes())
+	return nil
 }
 
 func (s *Server) broadcastTx(tx *core.Transaction) error {
-	buf := &bytes.Buffer{}
-	if err := tx.Encode(core.NewGobTxEncoder(buf)); err != nil {
-		return err
-	}
-
-	msg := NewMessage(MessageTypeTx, buf.Bytes())
-	return s.broadcast(msg.Bytes())
+	return s.announce(InvItem{Type: InvTypeTx, Hash: tx.Hash(core.TxHasher{})})
 }
 
 func readerToString(r io.Reader) string {
@@ -514,13 +1065,14 @@ func readerToString(r io.Reader) string {
 	return buffer.String()
 }
 
-func genesisBlock() *core.Block {
+func genesisBlock(target *big.Int) *core.Block {
 	headers := &core.Header{
 		Version:  1,
 		Height:   0,
 		DataHash: core_types.Hash{},
 		//can't do time.Now cuz the hash of the genesisBlock will change
 		Timestamp: 0000,
+		Target:    target,
 	}
 
 	block := core.NewBlock(headers, nil)
@@ -540,8 +1092,3 @@ func genesisBlock() *core.Block {
 
 	return block
 }
-
-func init() {
-	gob.Register(&Server{})
-	gob.Register(&ServerOpts{})
-}
@@ -0,0 +1,244 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/EggsyOnCode/xenolith/core"
+	"github.com/EggsyOnCode/xenolith/crypto_lib"
+	"github.com/EggsyOnCode/xenolith/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func startServers(servers ...*Server) {
+	for _, s := range servers {
+		go s.Start()
+	}
+}
+
+// connects a to b and waits until both ends are through the handshake
+func connectServers(t *testing.T, a, b *Server) {
+	assert.Nil(t, a.Transport.Connect(b.Transport))
+	assert.Eventually(t, func() bool {
+		return handshakeFrom(a, b.ID) != nil && handshakeFrom(b, a.ID) != nil
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func peerCount(s *Server) int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.peerMap)
+}
+
+func onlyPeer(s *Server) *Peer {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, peer := range s.peerMap {
+		return peer
+	}
+	return nil
+}
+
+func TestPeerRemovedOnDisconnect(t *testing.T) {
+	a := newTestServer(t, "A", 0)
+	b := newTestServer(t, "B", 0)
+	startServers(a, b)
+
+	connectServers(t, a, b)
+	assert.Equal(t, 1, peerCount(a))
+	assert.Equal(t, 1, peerCount(b))
+	peer := onlyPeer(a)
+	assert.Equal(t, PeerStateActive, peer.State())
+
+	assert.Nil(t, a.Transport.Disconnect(peer.Addr))
+
+	// both ends notice the connection is gone
+	assert.Eventually(t, func() bool {
+		return peerCount(a) == 0 && peerCount(b) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, PeerStateClosed, peer.State())
+}
+
+func TestInboundPeerLimit(t *testing.T) {
+	s := newTestServer(t, "S", 0)
+	s.MaxInboundPeers = 1
+	a := newTestServer(t, "A", 0)
+	b := newTestServer(t, "B", 0)
+	startServers(s, a, b)
+
+	connectServers(t, a, s)
+	assert.Nil(t, b.Transport.Connect(s.Transport))
+
+	assert.Eventually(t, func() bool {
+		return len(b.Transport.Peers()) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, 1, peerCount(s))
+}
+
+func TestServersOnLocalTransport(t *testing.T) {
+	a := newTestValidatorServer(t, "A", 3)
+	b := newTestServer(t, "B", 0)
+	c := newTestServer(t, "C", 0)
+	startServers(a, b, c)
+
+	// a - b - c; c only hears of the blocks of a through b
+	connectServers(t, a, b)
+	assert.Eventually(t, func() bool {
+		return b.chain.Height() == 3
+	}, 10*time.Second, 10*time.Millisecond)
+	connectServers(t, b, c)
+	assert.Eventually(t, func() bool {
+		return c.chain.Height() == 3
+	}, 10*time.Second, 10*time.Millisecond)
+
+	assert.Nil(t, a.createNewBlock())
+	assert.Eventually(t, func() bool {
+		return c.chain.Height() == 4
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func stopServer(t *testing.T, s *Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.Nil(t, s.Stop(ctx))
+}
+
+func TestStopDropsPeers(t *testing.T) {
+	a := newTestServerWithOpts(t, ServerOpts{ID: "A", PrivateKey: crypto_lib.GeneratePrivateKey(), BlockTime: time.Millisecond})
+	b := newTestServer(t, "B", 0)
+	startServers(a, b)
+	connectServers(t, a, b)
+
+	stopServer(t, a)
+	assert.Eventually(t, func() bool {
+		return peerCount(b) == 0
+	}, time.Second, 10*time.Millisecond)
+	assert.Empty(t, a.Transport.Peers())
+	// block production stopped with the server
+	height := a.chain.Height()
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, height, a.chain.Height())
+
+	assert.ErrorIs(t, a.Start(), ErrServerStopped)
+	assert.ErrorIs(t, a.Transport.Connect(b.Transport), ErrTransportClosed)
+	// stopping twice is harmless
+	stopServer(t, a)
+}
+
+func TestStopOverTCP(t *testing.T) {
+	a := newTestTCPServer(t, "A")
+	b := newTestTCPServer(t, "B")
+	startServers(a, b)
+	connectServers(t, a, b)
+
+	addr := string(a.Transport.Addr())
+	stopServer(t, a)
+	assert.Eventually(t, func() bool {
+		return peerCount(b) == 0
+	}, time.Second, 10*time.Millisecond)
+	_, err := net.Dial("tcp", addr)
+	assert.NotNil(t, err)
+	stopServer(t, b)
+}
+
+func TestMempoolKeptAcrossRestart(t *testing.T) {
+	dir := t.TempDir()
+	a := newTestServerWithOpts(t, ServerOpts{ID: "A", DataDir: dir})
+	startServers(a)
+
+	priv := crypto_lib.GeneratePrivateKey()
+	tx := core.NewTransaction([]byte("foo"))
+	tx.From = priv.PublicKey()
+	assert.Nil(t, tx.Sign(priv))
+	hash := tx.Hash(core.TxHasher{})
+	a.txCh <- tx
+	assert.Eventually(t, func() bool {
+		return a.memPool.Contains(hash)
+	}, time.Second, 10*time.Millisecond)
+	stopServer(t, a)
+
+	restarted := newTestServerWithOpts(t, ServerOpts{ID: "A", DataDir: dir})
+	assert.True(t, restarted.memPool.Contains(hash))
+	stopServer(t, restarted)
+}
+
+// a goroutine that doesn't exit in time doesn't keep the chain and the mempool from being written out
+func TestStopClosesChainOnTimeout(t *testing.T) {
+	dir := t.TempDir()
+	a := newTestServerWithOpts(t, ServerOpts{ID: "A", DataDir: dir, PrivateKey: crypto_lib.GeneratePrivateKey(), BlockTime: time.Hour})
+	assert.Nil(t, a.createNewBlock())
+	priv := crypto_lib.GeneratePrivateKey()
+	tx := core.NewTransaction([]byte("foo"))
+	tx.From = priv.PublicKey()
+	assert.Nil(t, tx.Sign(priv))
+	a.memPool.Add(tx)
+
+	stuck := make(chan struct{})
+	defer close(stuck)
+	a.spawn(func() { <-stuck })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, a.Stop(ctx), context.DeadlineExceeded)
+	// the store of the chain is closed
+	assert.NotNil(t, a.createNewBlock())
+
+	restarted := newTestServerWithOpts(t, ServerOpts{ID: "A", DataDir: dir})
+	assert.Equal(t, uint32(1), restarted.chain.Height())
+	assert.True(t, restarted.memPool.Contains(tx.Hash(core.TxHasher{})))
+	stopServer(t, restarted)
+}
+
+// blocks, headers and tx a peer made up so they can't be hashed cost it its score; they don't bring the node down
+func TestUnhashableMsgsPenalized(t *testing.T) {
+	a := newTestServer(t, "A", 0)
+	b := newTestServer(t, "B", 0)
+	startServers(a, b)
+	connectServers(t, b, a)
+	peer := onlyPeer(a)
+
+	genesis, err := a.chain.GetHeaders(0)
+	assert.Nil(t, err)
+	block := util.NewRandomBlockWithSignature(t, crypto_lib.GeneratePrivateKey(), 1, core.BlockHasher{}.Hash(genesis))
+	block.Header.Target = big.NewInt(-5)
+
+	priv := crypto_lib.GeneratePrivateKey()
+	tx := util.NewRandomTransactionWithSignature(t, priv, 10)
+	// registered with gob, unknown to the canonical encoding
+	tx.TxInner = Message{}
+
+	// gob carries both just fine; they are turned down once decoded
+	for _, msg := range []*Message{encodedMsg(t, MessageTypeBlock, block), encodedMsg(t, MessageTypeTx, tx)} {
+		_, err := DecodeMessage(peer.Addr, msg)
+		assert.NotNil(t, err)
+	}
+
+	bad := []any{
+		block,
+		tx,
+		&CompactBlockMessage{Header: block.SignedHeader()},
+		&HeadersMessage{Headers: []*core.SignedHeader{block.SignedHeader()}},
+	}
+	for i, data := range bad {
+		assert.NotPanics(t, func() {
+			assert.NotNil(t, a.ProcessMessage(&DecodedMsg{From: peer.Addr, Data: data}))
+		})
+		if i < len(bad)-1 {
+			assert.Equal(t, int32(-penaltyUndecodableMsg*(i+1)), peer.score.Load())
+		}
+	}
+	// the last one got it banned
+	assert.Equal(t, 0, peerCount(a))
+	assert.True(t, a.banList.IsBanned("B"))
+}
+
+func encodedMsg(t *testing.T, msgType MessageType, data any) *Message {
+	buf := &bytes.Buffer{}
+	assert.Nil(t, gob.NewEncoder(buf).Encode(data))
+	return NewMessage(msgType, buf.Bytes())
+}
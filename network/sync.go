@@ -0,0 +1,678 @@
+package network
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/EggsyOnCode/xenolith/core"
+	"github.com/EggsyOnCode/xenolith/core_types"
+	"github.com/go-kit/log"
+)
+
+const (
+	// headers requested in a single GetHeadersMessage
+	headerBatchSize = 200
+	// upper bound of headers sent in reply to a single GetHeadersMessage
+	maxHeadersPerResponse = 500
+	// verified headers waiting for their bodies; no more headers are requested beyond this
+	maxPendingHeaders = 1000
+	// bodies requested from a single peer at once
+	bodyBatchSize = 16
+	// upper bound of bodies sent in reply to a single GetBlockBodiesMessage
+	maxBodiesPerResponse = 64
+	// upper bound of blocks sent in reply to a single GetBlockMessage
+	maxBlocksPerResponse = 100
+	// a request not answered within this time is given up and sent to another peer
+	syncRequestTimeout = 10 * time.Second
+	// a peer that timed out or sent a useless batch isn't asked again for this long
+	syncPeerCooldown = 30 * time.Second
+	// bodies requested this long ago are asked from an idle peer as well; whichever answers first wins
+	// the blocks above them can't be added until they are in, so a slow peer would hold up the whole sync
+	slowBodyRequestAge = 3 * time.Second
+	syncTickInterval   = time.Second
+	// light clients ask for this many of the headers below their head again
+	// a fork they missed some headers of links to one of them, so they can switch to it
+	lightSyncOverlap = 16
+)
+
+type SyncState int
+
+const (
+	// no peer reported its height yet
+	SyncStateIdle SyncState = iota
+	SyncStateSyncing
+	SyncStateSynced
+)
+
+func (s SyncState) String() string {
+	switch s {
+	case SyncStateIdle:
+		return "idle"
+	case SyncStateSyncing:
+		return "syncing"
+	case SyncStateSynced:
+		return "synced"
+	default:
+		return fmt.Sprintf("SyncState(%d)", int(s))
+	}
+}
+
+// range of headers requested from a peer
+type syncRequest struct {
+	peer NetAddr
+	from uint32
+	to   uint32
+}
+
+// bodies requested from a peer
+type bodyRequest struct {
+	hashes []core_types.Hash
+	sentAt time.Time
+	// the missing bodies were asked from another peer already
+	reassigned bool
+}
+
+// SyncManager brings the chain up to the height of the best peer, headers first
+// the header chain is downloaded from the best peer and checked (links, pow, signatures) before any tx are fetched
+// the bodies of the verified headers are then requested in batches from every peer high enough to have them
+// and added to the chain in height order once they match the DataHash of their header
+// the batches of peers that fail are handed out again; the ones of slow peers are asked from idle peers as well
+// light clients (see NewLightSyncManager) stop after the headers
+type SyncManager struct {
+	mu sync.Mutex
+	// serializes applyBlocks; the blocks are added to the chain without holding mu
+	applyLock sync.Mutex
+	chain     *core.Blockchain
+	// set for light clients instead of chain; the verified headers go straight into it and no bodies are fetched
+	headerChain *core.HeaderChain
+	logger      log.Logger
+	// sends a request to a connected peer and waits for the reply (see Server.Request)
+	request func(NetAddr, *Message, time.Duration) (*DecodedMsg, error)
+	// reports a peer that sent us invalid headers or bodies
+	penalize func(NetAddr, int32, error)
+	// the clock; swappable for tests
+	now func() time.Time
+
+	state       SyncState
+	peerHeights map[NetAddr]uint32
+	// peers that failed us and when they may be asked again
+	cooldown map[NetAddr]time.Time
+	// the headers request in flight
+	inFlight *syncRequest
+
+	// verified headers above our chain in height order
+	headers []*core.SignedHeader
+	// downloaded bodies of the headers waiting for the blocks below them
+	bodies       map[core_types.Hash][]*core.Transaction
+	bodyRequests map[NetAddr]*bodyRequest
+	// the peer the body of a header was requested from
+	assigned map[core_types.Hash]NetAddr
+	// the requests running in their own goroutines
+	wg sync.WaitGroup
+}
+
+func NewSyncManager(chain *core.Blockchain, request func(NetAddr, *Message, time.Duration) (*DecodedMsg, error), penalize func(NetAddr, int32, error), logger log.Logger) *SyncManager {
+	return &SyncManager{
+		chain:        chain,
+		logger:       logger,
+		request:      request,
+		penalize:     penalize,
+		now:          time.Now,
+		peerHeights:  make(map[NetAddr]uint32),
+		cooldown:     make(map[NetAddr]time.Time),
+		bodies:       make(map[core_types.Hash][]*core.Transaction),
+		bodyRequests: make(map[NetAddr]*bodyRequest),
+		assigned:     make(map[core_types.Hash]NetAddr),
+	}
+}
+
+// NewLightSyncManager syncs the headers of a light client; they are verified the same way but no bodies are fetched
+func NewLightSyncManager(headers *core.HeaderChain, request func(NetAddr, *Message, time.Duration) (*DecodedMsg, error), penalize func(NetAddr, int32, error), logger log.Logger) *SyncManager {
+	m := NewSyncManager(nil, request, penalize, logger)
+	m.headerChain = headers
+	return m
+}
+
+// the height and the headers of whatever we sync; the blocks of the chain or the headers of a light client
+func (m *SyncManager) syncedHeight() uint32 {
+	if m.headerChain != nil {
+		return m.headerChain.Height()
+	}
+	return m.chain.Height()
+}
+
+func (m *SyncManager) syncedHeader(height uint32) (*core.Header, error) {
+	if m.headerChain != nil {
+		return m.headerChain.GetHeaders(height)
+	}
+	return m.chain.GetHeaders(height)
+}
+
+func (m *SyncManager) State() SyncState {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.state
+}
+
+// UpdatePeerHeight records the height a peer reported; heights only ever go up
+func (m *SyncManager) UpdatePeerHeight(peer NetAddr, height uint32) {
+	m.mu.Lock()
+	if height > m.peerHeights[peer] {
+		m.peerHeights[peer] = height
+	} else if _, ok := m.peerHeights[peer]; !ok {
+		m.peerHeights[peer] = height
+	}
+	m.mu.Unlock()
+
+	m.Tick()
+}
+
+func (m *SyncManager) RemovePeer(peer NetAddr) {
+	m.mu.Lock()
+	delete(m.peerHeights, peer)
+	delete(m.cooldown, peer)
+	if m.inFlight != nil && m.inFlight.peer == peer {
+		m.inFlight = nil
+	}
+	m.releaseBodies(peer)
+	m.mu.Unlock()
+
+	m.Tick()
+}
+
+// fetchHeaders runs a headers request; the reply is handled by onHeaders
+func (m *SyncManager) fetchHeaders(req *syncRequest) {
+	fail := func() bool {
+		if m.inFlight != req {
+			return false
+		}
+		m.inFlight = nil
+		return true
+	}
+
+	reply, err := m.sendRequest(req.peer, MessageTypeGetHeaders, &GetHeadersMessage{From: req.from, To: req.to})
+	if err != nil {
+		m.onRequestFailed(req.peer, err, fail)
+		return
+	}
+	headersMsg, ok := reply.Data.(*HeadersMessage)
+	if !ok {
+		m.onRequestFailed(req.peer, fmt.Errorf("unexpected reply %T to a headers request", reply.Data), fail)
+		return
+	}
+	m.onHeaders(req, headersMsg.Headers)
+}
+
+func (m *SyncManager) onHeaders(req *syncRequest, headers []*core.SignedHeader) {
+	m.mu.Lock()
+	// the peer went away in the meantime
+	if m.inFlight != req {
+		m.mu.Unlock()
+		return
+	}
+	m.inFlight = nil
+
+	var err error
+	if m.headerChain != nil {
+		err = m.addLightHeaders(req, headers)
+	} else {
+		err = m.addHeaders(req, headers)
+	}
+	if err != nil || len(headers) == 0 {
+		m.logger.Log("msg", "headers rejected", "peer", req.peer, "from", req.from, "to", req.to, "count", len(headers), "err", err)
+		m.cooldown[req.peer] = m.now().Add(syncPeerCooldown)
+	}
+	m.mu.Unlock()
+
+	// headers that don't attach to our chain could come from an honest peer on another fork
+	if err != nil && !errors.Is(err, core.ErrHeaderNotLinked) {
+		m.penalize(req.peer, penaltyInvalidHeaders, err)
+	}
+	m.Tick()
+}
+
+// fetchBodies runs a bodies request; the reply is handled by onBodies
+func (m *SyncManager) fetchBodies(peer NetAddr, req *bodyRequest) {
+	fail := func() bool {
+		if m.bodyRequests[peer] != req {
+			return false
+		}
+		m.releaseBodies(peer)
+		return true
+	}
+
+	reply, err := m.sendRequest(peer, MessageTypeGetBlockBodies, &GetBlockBodiesMessage{Hashes: req.hashes})
+	if err != nil {
+		m.onRequestFailed(peer, err, fail)
+		return
+	}
+	bodiesMsg, ok := reply.Data.(*BlockBodiesMessage)
+	if !ok {
+		m.onRequestFailed(peer, fmt.Errorf("unexpected reply %T to a bodies request", reply.Data), fail)
+		return
+	}
+	m.onBodies(peer, req, bodiesMsg.Bodies)
+}
+
+func (m *SyncManager) onBodies(peer NetAddr, req *bodyRequest, bodies []*BlockBody) {
+	m.mu.Lock()
+	if m.bodyRequests[peer] != req {
+		m.mu.Unlock()
+		return
+	}
+	// whatever didn't come with this reply is requested again
+	m.releaseBodies(peer)
+
+	err := m.addBodies(req, bodies)
+	if err != nil {
+		m.logger.Log("msg", "bodies rejected", "peer", peer, "err", err)
+		m.cooldown[peer] = m.now().Add(syncPeerCooldown)
+	}
+	m.mu.Unlock()
+
+	m.applyBlocks()
+	if err != nil {
+		m.penalize(peer, penaltyInvalidBody, err)
+	}
+	m.Tick()
+}
+
+// onRequestFailed puts the peer in cooldown; a peer that timed out or went away isn't penalized
+// release drops the request; false if it was dropped already
+func (m *SyncManager) onRequestFailed(peer NetAddr, err error, release func() bool) {
+	m.mu.Lock()
+	if !release() {
+		m.mu.Unlock()
+		return
+	}
+	m.logger.Log("msg", "sync request failed", "peer", peer, "err", err)
+	m.cooldown[peer] = m.now().Add(syncPeerCooldown)
+	m.mu.Unlock()
+
+	m.Tick()
+}
+
+// Tick sends out the next requests
+func (m *SyncManager) Tick() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+	m.pruneHeaders()
+
+	if len(m.peerHeights) == 0 {
+		return
+	}
+
+	ourHeight := m.syncedHeight()
+	if !m.hasPeerAbove(ourHeight) && len(m.headers) == 0 {
+		if m.state != SyncStateSynced {
+			m.logger.Log("msg", "chain synced", "height", ourHeight)
+		}
+		m.state = SyncStateSynced
+		return
+	}
+
+	m.requestHeaders(now)
+	m.requestBodies(now)
+}
+
+// pruneHeaders drops the pending headers the chain caught up with some other way; e.g through gossip
+// if the chain took another block at one of their heights all of them are dropped
+func (m *SyncManager) pruneHeaders() {
+	height := m.syncedHeight()
+	for len(m.headers) > 0 && m.headers[0].Header.Height <= height {
+		h := m.headers[0]
+		ours, err := m.syncedHeader(h.Header.Height)
+		if err != nil || (core.BlockHasher{}).Hash(ours) != h.Hash() {
+			m.logger.Log("msg", "chain moved away from the downloaded headers", "height", h.Header.Height)
+			m.resetHeaders()
+			return
+		}
+		delete(m.bodies, h.Hash())
+		m.headers = m.headers[1:]
+	}
+}
+
+func (m *SyncManager) resetHeaders() {
+	m.headers = nil
+	m.bodies = make(map[core_types.Hash][]*core.Transaction)
+	m.bodyRequests = make(map[NetAddr]*bodyRequest)
+	m.assigned = make(map[core_types.Hash]NetAddr)
+}
+
+// the highest header we know of; pending ones included
+func (m *SyncManager) tipHeader() (*core.Header, error) {
+	if len(m.headers) > 0 {
+		return m.headers[len(m.headers)-1].Header, nil
+	}
+	return m.syncedHeader(m.syncedHeight())
+}
+
+func (m *SyncManager) headerAt(height uint32) (*core.Header, error) {
+	if height <= m.syncedHeight() {
+		return m.syncedHeader(height)
+	}
+	for _, h := range m.headers {
+		if h.Header.Height == height {
+			return h.Header, nil
+		}
+	}
+	return nil, fmt.Errorf("no header at height (%d)", height)
+}
+
+func (m *SyncManager) addHeaders(req *syncRequest, headers []*core.SignedHeader) error {
+	if len(headers) > int(req.to-req.from+1) {
+		return fmt.Errorf("got %d headers, asked for [%d, %d]", len(headers), req.from, req.to)
+	}
+	m.pruneHeaders()
+
+	parent, err := m.tipHeader()
+	if err != nil {
+		return err
+	}
+	// the chain could have taken some of the blocks through gossip while the request was out
+	for len(headers) > 0 && headers[0].Header.Height <= parent.Height {
+		ours, err := m.headerAt(headers[0].Header.Height)
+		if err != nil || (core.BlockHasher{}).Hash(ours) != headers[0].Hash() {
+			break
+		}
+		headers = headers[1:]
+	}
+	if err := core.VerifyHeaderChain(parent, headers, m.headerAt); err != nil {
+		return err
+	}
+
+	m.headers = append(m.headers, headers...)
+	if len(headers) > 0 {
+		m.logger.Log("msg", "headers verified", "from", headers[0].Header.Height, "to", headers[len(headers)-1].Header.Height)
+	}
+	return nil
+}
+
+func (m *SyncManager) addBodies(req *bodyRequest, bodies []*BlockBody) error {
+	requested := make(map[core_types.Hash]bool, len(req.hashes))
+	for _, hash := range req.hashes {
+		requested[hash] = true
+	}
+
+	for _, body := range bodies {
+		if !requested[body.Hash] {
+			return fmt.Errorf("body (%s) was not requested", body.Hash)
+		}
+		header := m.pendingHeader(body.Hash)
+		// the headers were dropped in the meantime
+		if header == nil {
+			continue
+		}
+
+		dataHash, err := core.CalculateDataHash(body.Transactions)
+		if err != nil {
+			return err
+		}
+		if dataHash != header.Header.DataHash {
+			return fmt.Errorf("body of block (%d) has data hash (%s), header commits to (%s)", header.Header.Height, dataHash, header.Header.DataHash)
+		}
+		m.bodies[body.Hash] = body.Transactions
+	}
+
+	return nil
+}
+
+func (m *SyncManager) pendingHeader(hash core_types.Hash) *core.SignedHeader {
+	for _, h := range m.headers {
+		if h.Hash() == hash {
+			return h
+		}
+	}
+	return nil
+}
+
+// applyBlocks adds the blocks whose bodies are in to the chain; strictly in height order
+// mu isn't held while the chain takes them, a reorg can keep AddBlock busy; the ones added are pruned afterwards
+func (m *SyncManager) applyBlocks() {
+	m.applyLock.Lock()
+	defer m.applyLock.Unlock()
+
+	m.mu.Lock()
+	ready := []*core.SignedHeader{}
+	txs := [][]*core.Transaction{}
+	for _, h := range m.headers {
+		txx, ok := m.bodies[h.Hash()]
+		if !ok {
+			break
+		}
+		ready = append(ready, h)
+		txs = append(txs, txx)
+	}
+	m.mu.Unlock()
+
+	for i, h := range ready {
+		block := core.NewBlock(h.Header, txs[i])
+		block.Validator = h.Validator
+		block.Signature = h.Signature
+		if err := m.chain.AddBlock(block); err != nil && !errors.Is(err, core.ErrBlockKnown) {
+			m.mu.Lock()
+			// unless the headers were dropped in the meantime
+			if m.pendingHeader(h.Hash()) != nil {
+				m.logger.Log("msg", "synced block rejected, dropping the downloaded headers", "height", h.Header.Height, "err", err)
+				m.resetHeaders()
+			}
+			m.mu.Unlock()
+			return
+		}
+	}
+
+	m.mu.Lock()
+	m.pruneHeaders()
+	m.mu.Unlock()
+}
+
+// addLightHeaders hands the headers to the header chain of a light client; there are no bodies to wait for
+// unlike addHeaders they can link to any header the header chain knows, the ones of the forks it keeps included
+func (m *SyncManager) addLightHeaders(req *syncRequest, headers []*core.SignedHeader) error {
+	if len(headers) > int(req.to-req.from+1) {
+		return fmt.Errorf("got %d headers, asked for [%d, %d]", len(headers), req.from, req.to)
+	}
+	if err := m.headerChain.AddHeaders(headers); err != nil {
+		return err
+	}
+	if len(headers) > 0 {
+		m.logger.Log("msg", "headers verified", "from", headers[0].Header.Height, "to", headers[len(headers)-1].Header.Height)
+	}
+	return nil
+}
+
+func (m *SyncManager) releaseBodies(peer NetAddr) {
+	req, ok := m.bodyRequests[peer]
+	if !ok {
+		return
+	}
+	for _, hash := range req.hashes {
+		if m.assigned[hash] == peer {
+			delete(m.assigned, hash)
+		}
+	}
+	delete(m.bodyRequests, peer)
+}
+
+func (m *SyncManager) requestHeaders(now time.Time) {
+	if m.inFlight != nil || len(m.headers) >= maxPendingHeaders {
+		return
+	}
+
+	tip, err := m.tipHeader()
+	if err != nil {
+		return
+	}
+	peer, height, ok := m.bestPeer(now)
+	// the peers ahead of us are all in cooldown
+	if !ok || height <= tip.Height {
+		return
+	}
+
+	from := tip.Height + 1
+	if m.headerChain != nil {
+		from -= min(lightSyncOverlap, tip.Height)
+	}
+	req := &syncRequest{
+		peer: peer,
+		from: from,
+		to:   min(from+headerBatchSize-1, height),
+	}
+	m.inFlight = req
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		m.fetchHeaders(req)
+	}()
+	m.state = SyncStateSyncing
+	m.logger.Log("msg", "requesting headers", "peer", peer, "from", req.from, "to", req.to, "peer height", height)
+}
+
+// requestBodies hands out the missing bodies in batches; every idle peer high enough gets one
+func (m *SyncManager) requestBodies(now time.Time) {
+	for _, peer := range m.availablePeers(now) {
+		if _, busy := m.bodyRequests[peer]; busy {
+			continue
+		}
+
+		hashes := []core_types.Hash{}
+		for _, h := range m.headers {
+			if len(hashes) == bodyBatchSize || h.Header.Height > m.peerHeights[peer] {
+				break
+			}
+			hash := h.Hash()
+			if _, ok := m.bodies[hash]; ok {
+				continue
+			}
+			if _, ok := m.assigned[hash]; ok {
+				continue
+			}
+			hashes = append(hashes, hash)
+		}
+		if len(hashes) == 0 {
+			hashes = m.takeOverSlowBodies(now, peer)
+		}
+		if len(hashes) == 0 {
+			continue
+		}
+
+		req := &bodyRequest{hashes: hashes, sentAt: now}
+		m.bodyRequests[peer] = req
+		for _, hash := range hashes {
+			m.assigned[hash] = peer
+		}
+		m.wg.Add(1)
+		go func(peer NetAddr) {
+			defer m.wg.Done()
+			m.fetchBodies(peer, req)
+		}(peer)
+		m.state = SyncStateSyncing
+		m.logger.Log("msg", "requesting bodies", "peer", peer, "count", len(hashes))
+	}
+}
+
+// takeOverSlowBodies picks the oldest request out for longer than slowBodyRequestAge and returns the bodies
+// of it that are still missing for peer to fetch as well; a request is taken over once only
+func (m *SyncManager) takeOverSlowBodies(now time.Time, peer NetAddr) []core_types.Hash {
+	var slow *bodyRequest
+	var slowPeer NetAddr
+	for other, req := range m.bodyRequests {
+		if other == peer || req.reassigned || now.Sub(req.sentAt) < slowBodyRequestAge {
+			continue
+		}
+		if slow == nil || req.sentAt.Before(slow.sentAt) || (req.sentAt.Equal(slow.sentAt) && other < slowPeer) {
+			slow, slowPeer = req, other
+		}
+	}
+	if slow == nil {
+		return nil
+	}
+
+	hashes := []core_types.Hash{}
+	for _, hash := range slow.hashes {
+		if _, ok := m.bodies[hash]; ok {
+			continue
+		}
+		h := m.pendingHeader(hash)
+		if h == nil || h.Header.Height > m.peerHeights[peer] {
+			continue
+		}
+		hashes = append(hashes, hash)
+	}
+	if len(hashes) > 0 {
+		slow.reassigned = true
+		m.logger.Log("msg", "bodies request is slow, asking another peer", "slow peer", slowPeer, "peer", peer, "count", len(hashes))
+	}
+	return hashes
+}
+
+func (m *SyncManager) sendRequest(peer NetAddr, t MessageType, data any) (*DecodedMsg, error) {
+	buf := &bytes.Buffer{}
+	if err := gob.NewEncoder(buf).Encode(data); err != nil {
+		return nil, err
+	}
+	return m.request(peer, NewMessage(t, buf.Bytes()), syncRequestTimeout)
+}
+
+// the peers not in cooldown; highest first, ties go to the lowest address so the choice is deterministic
+func (m *SyncManager) availablePeers(now time.Time) []NetAddr {
+	peers := make([]NetAddr, 0, len(m.peerHeights))
+	for peer := range m.peerHeights {
+		if until, ok := m.cooldown[peer]; ok && now.Before(until) {
+			continue
+		}
+		peers = append(peers, peer)
+	}
+
+	sort.Slice(peers, func(i, j int) bool {
+		hi, hj := m.peerHeights[peers[i]], m.peerHeights[peers[j]]
+		if hi != hj {
+			return hi > hj
+		}
+		return peers[i] < peers[j]
+	})
+	return peers
+}
+
+func (m *SyncManager) bestPeer(now time.Time) (NetAddr, uint32, bool) {
+	peers := m.availablePeers(now)
+	if len(peers) == 0 {
+		return "", 0, false
+	}
+	return peers[0], m.peerHeights[peers[0]], true
+}
+
+func (m *SyncManager) hasPeerAbove(height uint32) bool {
+	for _, h := range m.peerHeights {
+		if h > height {
+			return true
+		}
+	}
+	return false
+}
+
+// wait returns once the requests in flight are done; they end early once the server stopped
+func (m *SyncManager) wait() {
+	m.wg.Wait()
+}
+
+func (m *SyncManager) loop(quitCh chan struct{}) {
+	ticker := time.NewTicker(syncTickInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			m.Tick()
+		case <-quitCh:
+			return
+		}
+	}
+}
@@ -0,0 +1,441 @@
+package network
+
+import (
+	"bytes"
+	"encoding/gob"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/EggsyOnCode/xenolith/core"
+	"github.com/EggsyOnCode/xenolith/core_types"
+	"github.com/EggsyOnCode/xenolith/crypto_lib"
+	"github.com/go-kit/log"
+	"github.com/stretchr/testify/assert"
+)
+
+// a request the sync manager made; the test answers it
+type syncCall struct {
+	to    NetAddr
+	msg   *Message
+	reply chan syncReply
+}
+
+type syncReply struct {
+	msg *DecodedMsg
+	err error
+}
+
+func (c *syncCall) respond(data any) {
+	c.reply <- syncReply{msg: &DecodedMsg{From: c.to, Data: data}}
+}
+
+func (c *syncCall) fail(err error) {
+	c.reply <- syncReply{err: err}
+}
+
+type testSyncManager struct {
+	*SyncManager
+	calls     chan *syncCall
+	mu        sync.Mutex
+	penalties map[NetAddr]int32
+	clock     time.Time
+}
+
+func newTestSyncManager(t *testing.T) *testSyncManager {
+	bc, err := core.NewBlockchain(genesisBlock(testGenesisTarget), log.NewNopLogger())
+	assert.Nil(t, err)
+
+	tm := &testSyncManager{
+		calls:     make(chan *syncCall, 64),
+		penalties: make(map[NetAddr]int32),
+		clock:     time.Now(),
+	}
+	request := func(to NetAddr, msg *Message, timeout time.Duration) (*DecodedMsg, error) {
+		call := &syncCall{to: to, msg: msg, reply: make(chan syncReply, 1)}
+		tm.calls <- call
+		r := <-call.reply
+		return r.msg, r.err
+	}
+	penalize := func(peer NetAddr, penalty int32, reason error) {
+		tm.mu.Lock()
+		tm.penalties[peer] += penalty
+		tm.mu.Unlock()
+	}
+	tm.SyncManager = NewSyncManager(bc, request, penalize, log.NewNopLogger())
+	tm.now = func() time.Time { return tm.clock }
+	return tm
+}
+
+// the next request the manager made; it has to be of the given type
+func (tm *testSyncManager) next(t *testing.T, msgType MessageType) *syncCall {
+	select {
+	case call := <-tm.calls:
+		assert.Equal(t, msgType, call.msg.Headers)
+		return call
+	case <-time.After(2 * time.Second):
+		t.Fatalf("no %v request made", msgType)
+		return nil
+	}
+}
+
+func (tm *testSyncManager) noCall(t *testing.T) {
+	select {
+	case call := <-tm.calls:
+		t.Fatalf("unexpected %v request to %s", call.msg.Headers, call.to)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func (tm *testSyncManager) penalty(peer NetAddr) int32 {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	return tm.penalties[peer]
+}
+
+// the clock is read under the lock of the manager
+func (tm *testSyncManager) advance(d time.Duration) {
+	tm.SyncManager.mu.Lock()
+	tm.clock = tm.clock.Add(d)
+	tm.SyncManager.mu.Unlock()
+}
+
+// the bodies downloaded but not applied yet
+func (tm *testSyncManager) waitingBodies() int {
+	tm.SyncManager.mu.Lock()
+	defer tm.SyncManager.mu.Unlock()
+	return len(tm.bodies)
+}
+
+func decodeMsg(t *testing.T, msg *Message, v any) {
+	assert.Nil(t, gob.NewDecoder(bytes.NewReader(msg.Data)).Decode(v))
+}
+
+// a validator that produced n blocks; mining is instant
+func newTestValidatorServer(t *testing.T, id string, n int) *Server {
+	s := newTestServerWithOpts(t, ServerOpts{
+		ID:         id,
+		PrivateKey: crypto_lib.GeneratePrivateKey(),
+		BlockTime:  time.Hour,
+	})
+	for i := 0; i < n; i++ {
+		assert.Nil(t, s.createNewBlock())
+	}
+	return s
+}
+
+func signedHeaders(t *testing.T, s *Server, from, to uint32) []*core.SignedHeader {
+	headers := []*core.SignedHeader{}
+	for i := from; i <= to; i++ {
+		block, err := s.chain.GetBlock(i)
+		assert.Nil(t, err)
+		headers = append(headers, block.SignedHeader())
+	}
+	return headers
+}
+
+func blockBodies(t *testing.T, s *Server, hashes []core_types.Hash) []*BlockBody {
+	bodies := []*BlockBody{}
+	for _, hash := range hashes {
+		block, err := s.chain.GetBlockByHash(hash)
+		assert.Nil(t, err)
+		bodies = append(bodies, &BlockBody{Hash: hash, Transactions: block.Transactions})
+	}
+	return bodies
+}
+
+func TestSyncDownloadsHeadersThenBodiesFromSeveralPeers(t *testing.T) {
+	src := newTestValidatorServer(t, "SRC", 20)
+	m := newTestSyncManager(t)
+
+	m.UpdatePeerHeight("a", 20)
+	m.UpdatePeerHeight("b", 20)
+	m.UpdatePeerHeight("c", 20)
+
+	// a single headers request; nothing else until the headers are in
+	call := m.next(t, MessageTypeGetHeaders)
+	assert.Equal(t, NetAddr("a"), call.to)
+	getHeaders := new(GetHeadersMessage)
+	decodeMsg(t, call.msg, getHeaders)
+	assert.Equal(t, uint32(1), getHeaders.From)
+	assert.Equal(t, uint32(20), getHeaders.To)
+	m.noCall(t)
+
+	call.respond(&HeadersMessage{Headers: signedHeaders(t, src, 1, 20)})
+
+	// the bodies are spread over the peers
+	calls := map[NetAddr]*syncCall{}
+	requested := map[NetAddr][]core_types.Hash{}
+	for i := 0; i < 2; i++ {
+		call := m.next(t, MessageTypeGetBlockBodies)
+		getBodies := new(GetBlockBodiesMessage)
+		decodeMsg(t, call.msg, getBodies)
+		calls[call.to] = call
+		requested[call.to] = getBodies.Hashes
+	}
+	assert.Len(t, requested["a"], bodyBatchSize)
+	assert.Len(t, requested["b"], 20-bodyBatchSize)
+	assert.Equal(t, uint32(0), m.chain.Height())
+
+	// bodies arriving out of order wait for the blocks below them
+	calls["b"].respond(&BlockBodiesMessage{Bodies: blockBodies(t, src, requested["b"])})
+	assert.Eventually(t, func() bool {
+		return m.waitingBodies() == 20-bodyBatchSize
+	}, 2*time.Second, 10*time.Millisecond)
+	assert.Equal(t, uint32(0), m.chain.Height())
+
+	calls["a"].respond(&BlockBodiesMessage{Bodies: blockBodies(t, src, requested["a"])})
+	assert.Eventually(t, func() bool {
+		return m.State() == SyncStateSynced
+	}, 2*time.Second, 10*time.Millisecond)
+	assert.Equal(t, uint32(20), m.chain.Height())
+	assert.Zero(t, m.penalty("a")+m.penalty("b")+m.penalty("c"))
+
+	ours, err := m.chain.GetBlock(20)
+	assert.Nil(t, err)
+	theirs, err := src.chain.GetBlock(20)
+	assert.Nil(t, err)
+	assert.Equal(t, theirs.Hash(core.BlockHasher{}), ours.Hash(core.BlockHasher{}))
+}
+
+func TestSyncSkipsHeadersOfBlocksGotThroughGossip(t *testing.T) {
+	src := newTestValidatorServer(t, "SRC", 5)
+	m := newTestSyncManager(t)
+
+	m.UpdatePeerHeight("a", 5)
+	call := m.next(t, MessageTypeGetHeaders)
+
+	// the first two blocks are announced while the headers are on their way
+	for i := uint32(1); i <= 2; i++ {
+		block, err := src.chain.GetBlock(i)
+		assert.Nil(t, err)
+		gossiped := *block
+		gossiped.PrevBlock, gossiped.NextBlocks = nil, nil
+		assert.Nil(t, m.chain.AddBlock(&gossiped))
+	}
+	call.respond(&HeadersMessage{Headers: signedHeaders(t, src, 1, 5)})
+
+	call = m.next(t, MessageTypeGetBlockBodies)
+	assert.Equal(t, NetAddr("a"), call.to)
+	getBodies := new(GetBlockBodiesMessage)
+	decodeMsg(t, call.msg, getBodies)
+	assert.Len(t, getBodies.Hashes, 3)
+
+	call.respond(&BlockBodiesMessage{Bodies: blockBodies(t, src, getBodies.Hashes)})
+	assert.Eventually(t, func() bool {
+		return m.chain.Height() == 5
+	}, 2*time.Second, 10*time.Millisecond)
+	assert.Zero(t, m.penalty("a"))
+}
+
+func TestSyncRejectsInvalidHeaders(t *testing.T) {
+	src := newTestValidatorServer(t, "SRC", 3)
+	m := newTestSyncManager(t)
+
+	m.UpdatePeerHeight("a", 3)
+	m.UpdatePeerHeight("b", 3)
+	call := m.next(t, MessageTypeGetHeaders)
+	assert.Equal(t, NetAddr("a"), call.to)
+
+	// a header that doesn't match its signature and pow anymore
+	headers := signedHeaders(t, src, 1, 3)
+	tampered := *headers[1].Header
+	tampered.Timestamp++
+	headers[1] = &core.SignedHeader{Header: &tampered, Validator: headers[1].Validator, Signature: headers[1].Signature}
+	call.respond(&HeadersMessage{Headers: headers})
+
+	// no bodies for headers that didn't check out; the headers are asked from b instead
+	call = m.next(t, MessageTypeGetHeaders)
+	assert.Equal(t, NetAddr("b"), call.to)
+	assert.Equal(t, int32(penaltyInvalidHeaders), m.penalty("a"))
+	call.fail(ErrPeerGone)
+}
+
+func TestSyncRejectsBodyNotMatchingDataHash(t *testing.T) {
+	src := newTestValidatorServer(t, "SRC", 3)
+	m := newTestSyncManager(t)
+
+	m.UpdatePeerHeight("a", 3)
+	m.next(t, MessageTypeGetHeaders).respond(&HeadersMessage{Headers: signedHeaders(t, src, 1, 3)})
+	call := m.next(t, MessageTypeGetBlockBodies)
+	getBodies := new(GetBlockBodiesMessage)
+	decodeMsg(t, call.msg, getBodies)
+
+	bodies := blockBodies(t, src, getBodies.Hashes)
+	bodies[0].Transactions = append(bodies[0].Transactions, core.NewTransaction([]byte("junk")))
+	call.respond(&BlockBodiesMessage{Bodies: bodies})
+	assert.Eventually(t, func() bool {
+		return m.penalty("a") == penaltyInvalidBody
+	}, 2*time.Second, 10*time.Millisecond)
+	assert.Equal(t, uint32(0), m.chain.Height())
+
+	// the bodies go to the next peer showing up
+	m.UpdatePeerHeight("b", 3)
+	call = m.next(t, MessageTypeGetBlockBodies)
+	assert.Equal(t, NetAddr("b"), call.to)
+	call.respond(&BlockBodiesMessage{Bodies: blockBodies(t, src, getBodies.Hashes)})
+	assert.Eventually(t, func() bool {
+		return m.chain.Height() == 3
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestSyncRetriesAfterTimeout(t *testing.T) {
+	src := newTestValidatorServer(t, "SRC", 3)
+	m := newTestSyncManager(t)
+
+	m.UpdatePeerHeight("a", 3)
+	m.UpdatePeerHeight("b", 3)
+	call := m.next(t, MessageTypeGetHeaders)
+	assert.Equal(t, NetAddr("a"), call.to)
+
+	call.fail(ErrRequestTimeout)
+	call = m.next(t, MessageTypeGetHeaders)
+	assert.Equal(t, NetAddr("b"), call.to)
+
+	call.respond(&HeadersMessage{Headers: signedHeaders(t, src, 1, 3)})
+	call = m.next(t, MessageTypeGetBlockBodies)
+	assert.Equal(t, NetAddr("b"), call.to)
+
+	// b times out as well; a is still cooling down
+	call.fail(ErrRequestTimeout)
+	m.noCall(t)
+
+	m.advance(syncPeerCooldown)
+	m.Tick()
+	call = m.next(t, MessageTypeGetBlockBodies)
+	assert.Equal(t, NetAddr("a"), call.to)
+	call.fail(ErrPeerGone)
+	assert.Zero(t, m.penalty("a")+m.penalty("b"))
+}
+
+func TestSyncAsksIdlePeerForBodiesOfSlowPeer(t *testing.T) {
+	src := newTestValidatorServer(t, "SRC", 20)
+	m := newTestSyncManager(t)
+
+	m.UpdatePeerHeight("a", 20)
+	m.UpdatePeerHeight("b", 20)
+	m.next(t, MessageTypeGetHeaders).respond(&HeadersMessage{Headers: signedHeaders(t, src, 1, 20)})
+
+	calls := map[NetAddr]*syncCall{}
+	requested := map[NetAddr][]core_types.Hash{}
+	for i := 0; i < 2; i++ {
+		call := m.next(t, MessageTypeGetBlockBodies)
+		getBodies := new(GetBlockBodiesMessage)
+		decodeMsg(t, call.msg, getBodies)
+		calls[call.to] = call
+		requested[call.to] = getBodies.Hashes
+	}
+	calls["b"].respond(&BlockBodiesMessage{Bodies: blockBodies(t, src, requested["b"])})
+	assert.Eventually(t, func() bool {
+		return m.waitingBodies() == 20-bodyBatchSize
+	}, 2*time.Second, 10*time.Millisecond)
+
+	// a holds up the blocks above its batch; not for longer than slowBodyRequestAge
+	m.Tick()
+	m.noCall(t)
+	m.advance(slowBodyRequestAge)
+	m.Tick()
+	call := m.next(t, MessageTypeGetBlockBodies)
+	assert.Equal(t, NetAddr("b"), call.to)
+	getBodies := new(GetBlockBodiesMessage)
+	decodeMsg(t, call.msg, getBodies)
+	assert.Equal(t, requested["a"], getBodies.Hashes)
+
+	call.respond(&BlockBodiesMessage{Bodies: blockBodies(t, src, getBodies.Hashes)})
+	assert.Eventually(t, func() bool {
+		return m.chain.Height() == 20
+	}, 2*time.Second, 10*time.Millisecond)
+
+	// the late answer of a is of no use anymore but doesn't count against it
+	calls["a"].respond(&BlockBodiesMessage{Bodies: blockBodies(t, src, requested["a"])})
+	m.noCall(t)
+	assert.Zero(t, m.penalty("a")+m.penalty("b"))
+	assert.Equal(t, SyncStateSynced, m.State())
+}
+
+func TestSyncRemovedPeerIsNotWaitedFor(t *testing.T) {
+	m := newTestSyncManager(t)
+
+	m.UpdatePeerHeight("a", 20)
+	m.UpdatePeerHeight("b", 10)
+	stale := m.next(t, MessageTypeGetHeaders)
+	assert.Equal(t, NetAddr("a"), stale.to)
+
+	m.RemovePeer("a")
+	call := m.next(t, MessageTypeGetHeaders)
+	assert.Equal(t, NetAddr("b"), call.to)
+	getHeaders := new(GetHeadersMessage)
+	decodeMsg(t, call.msg, getHeaders)
+	assert.Equal(t, uint32(10), getHeaders.To)
+
+	// the request to a failing once it is gone doesn't disturb the one to b
+	stale.fail(ErrPeerGone)
+	m.noCall(t)
+	call.fail(ErrPeerGone)
+}
+
+func TestSyncedWhenNoPeerIsAhead(t *testing.T) {
+	m := newTestSyncManager(t)
+	assert.Equal(t, SyncStateIdle, m.State())
+
+	m.UpdatePeerHeight("a", 0)
+	m.noCall(t)
+	assert.Equal(t, SyncStateSynced, m.State())
+}
+
+func TestServersSync(t *testing.T) {
+	a := newTestValidatorServer(t, "A", 12)
+
+	b := newTestServer(t, "B", 0)
+	startServers(a, b)
+
+	connectServers(t, b, a)
+
+	assert.Eventually(t, func() bool {
+		return b.chain.Height() == a.chain.Height() && b.syncManager.State() == SyncStateSynced
+	}, 10*time.Second, 10*time.Millisecond)
+
+	headA, err := a.chain.GetBlock(12)
+	assert.Nil(t, err)
+	headB, err := b.chain.GetBlock(12)
+	assert.Nil(t, err)
+	assert.Equal(t, headA.Hash(core.BlockHasher{}), headB.Hash(core.BlockHasher{}))
+}
+
+// reads the state of the manager while a block is being added; it blocks for good if the manager lock is held
+type stateReadingValidator struct {
+	core.Validator
+	m    *SyncManager
+	read chan SyncState
+}
+
+func (v *stateReadingValidator) ValidateBlock(b *core.Block) error {
+	v.read <- v.m.State()
+	return v.Validator.ValidateBlock(b)
+}
+
+func TestSyncAddsBlocksWithoutHoldingTheLock(t *testing.T) {
+	src := newTestValidatorServer(t, "SRC", 3)
+	m := newTestSyncManager(t)
+	read := make(chan SyncState, 3)
+	m.chain.SetValidator(&stateReadingValidator{Validator: core.NewBlockValidator(m.chain), m: m.SyncManager, read: read})
+
+	m.UpdatePeerHeight("a", 3)
+	call := m.next(t, MessageTypeGetHeaders)
+	call.respond(&HeadersMessage{Headers: signedHeaders(t, src, 1, 3)})
+	call = m.next(t, MessageTypeGetBlockBodies)
+	getBodies := new(GetBlockBodiesMessage)
+	decodeMsg(t, call.msg, getBodies)
+	call.respond(&BlockBodiesMessage{Bodies: blockBodies(t, src, getBodies.Hashes)})
+
+	for i := 0; i < 3; i++ {
+		select {
+		case <-read:
+		case <-time.After(2 * time.Second):
+			t.Fatal("the manager lock is held while the block is added")
+		}
+	}
+	assert.Eventually(t, func() bool {
+		return m.chain.Height() == 3
+	}, 2*time.Second, 10*time.Millisecond)
+}
@@ -1,62 +1,147 @@
 package network
 
 import (
-	"bytes"
+	"bufio"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/EggsyOnCode/xenolith/crypto_lib"
+	"github.com/go-kit/log"
 )
 
+// TCPTransport keeps an encrypted TCP connection per peer; msgs are sent as frames over it
+// peers are known by the identity key they proved to hold, so there is one connection per node at most
 type TCPTransport struct {
 	listenAddr NetAddr
-	listener   net.Listener
-	peerCh     chan *TCPPeer
+	// identity key of the node; authenticates our end of every connection
+	key       *crypto_lib.PrivateKey
+	mu        sync.RWMutex
+	listener  net.Listener
+	peers     map[NetAddr]*TCPPeer
+	consumeCh chan RPC
+	eventCh   chan PeerEvent
+	// closed by Close; whatever is waiting to hand over a msg or event gives up
+	quitCh chan struct{}
+	closed bool
+	// the accept loop, the connections in their key exchange and the read loops
+	wg     sync.WaitGroup
+	logger log.Logger
 }
 
+var errPeerClosed = errors.New("peer connection closed")
+
 // /TCP PEER
 type TCPPeer struct {
+	// the connection after the key exchange; frames are sealed on the way
 	conn     net.Conn
+	key      crypto_lib.PublicKey
 	Outgoing bool
+	closed   atomic.Bool
+	// a frame has to be written in one go, otherwise concurrent sends interleave on the wire
+	sendLock sync.Mutex
+}
+
+func NewTCPPeer(conn net.Conn, key crypto_lib.PublicKey, outgoing bool) *TCPPeer {
+	return &TCPPeer{
+		conn:     conn,
+		key:      key,
+		Outgoing: outgoing,
+	}
 }
 
-func NewTCPPeer(conn net.Conn, outgoing bool) *TCPPeer {
-	return &TCPPeer{conn: conn, Outgoing: outgoing}
+// Addr is the identity key of the peer
+func (p *TCPPeer) Addr() NetAddr {
+	return NetAddr(p.key.String())
 }
 
-func (p *TCPPeer) Send(b []byte) error {
-	_, err := p.conn.Write(b)
+func (p *TCPPeer) RemoteAddr() string {
+	return p.conn.RemoteAddr().String()
+}
+
+// Close closes the connection; closing a peer more than once is harmless
+func (p *TCPPeer) Close() error {
+	p.closed.Store(true)
+	return p.conn.Close()
+}
+
+func (p *TCPPeer) Send(msg *Message) error {
+	if p.closed.Load() {
+		return errPeerClosed
+	}
+
+	frame, err := EncodeFrame(msg)
+	if err != nil {
+		return err
+	}
+
+	p.sendLock.Lock()
+	defer p.sendLock.Unlock()
+	_, err = p.conn.Write(frame)
 	return err
 }
 
-func (p *TCPPeer) readLoop(rpcCh chan RPC) {
-	buf := make([]byte, 2048)
+// readLoop returns once the connection is gone; the peer is closed by then
+func (p *TCPPeer) readLoop(rpcCh chan RPC, quitCh chan struct{}) {
+	defer p.Close()
+
+	from := p.Addr()
+	r := bufio.NewReader(p.conn)
 	for {
-		n, err := p.conn.Read(buf)
+		msg, err := ReadFrame(r)
 		if err != nil {
 			if err == io.EOF {
 				fmt.Printf("Connection closed with %v\n", p.conn.RemoteAddr())
 			} else {
+				// the stream can't be resynchronised after a bad frame; dropping the connection
 				fmt.Println("Error reading:", err)
 			}
 			return
 		}
-		msg := buf[:n]
-		rpcCh <- RPC{
-			From:    NetAddr(p.conn.RemoteAddr().String()),
-			Payload: bytes.NewReader(msg),
+		select {
+		case rpcCh <- rpcFromFrame(from, msg):
+		case <-quitCh:
+			return
 		}
 	}
 }
 
-// //
-func NewTCPTransporter(addr string, peerCh chan *TCPPeer) *TCPTransport {
+// NewTCPTransporter listens on addr; connections are authenticated with key, a fresh one if nil
+func NewTCPTransporter(addr string, key *crypto_lib.PrivateKey) *TCPTransport {
+	if key == nil {
+		key = crypto_lib.GeneratePrivateKey()
+	}
 	return &TCPTransport{
 		listenAddr: NetAddr(addr),
-		peerCh:     peerCh,
+		key:        key,
+		peers:      make(map[NetAddr]*TCPPeer),
+		consumeCh:  make(chan RPC),
+		eventCh:    make(chan PeerEvent, 64),
+		quitCh:     make(chan struct{}),
+		logger:     log.NewNopLogger(),
 	}
 }
 
+// SetLogger sets the logger the transport reports the connections it drops to; set it before Start
+func (t *TCPTransport) SetLogger(l log.Logger) {
+	t.logger = l
+}
+
+// Start listens for incoming connections; starting a transport that listens already is a no-op
 func (t *TCPTransport) Start() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return ErrTransportClosed
+	}
+	if t.listener != nil {
+		return nil
+	}
+
 	ln, err := net.Listen("tcp", string(t.listenAddr))
 	if err != nil {
 		return err
@@ -64,22 +149,209 @@ func (t *TCPTransport) Start() error {
 
 	t.listener = ln
 
-	go t.acceptLoop()
+	t.wg.Add(1)
+	go t.acceptLoop(ln)
 
 	return nil
 }
 
-func (t *TCPTransport) acceptLoop() {
+func (t *TCPTransport) acceptLoop(ln net.Listener) {
+	defer t.wg.Done()
 	for {
-		conn, err := t.listener.Accept()
+		conn, err := ln.Accept()
 		if err != nil {
-			fmt.Printf("error accepting connection: %v\n", err)
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			t.logger.Log("msg", "error accepting connection", "err", err)
 			continue
 		}
-		peer := NewTCPPeer(conn, false)
 
-		// accepting new peers
+		// accepting new peers; the key exchange must not hold up the next connection
+		// Close waits for it; it is bounded by the timeout of the key exchange
+		t.wg.Add(1)
+		go func() {
+			defer t.wg.Done()
+			if err := t.addConn(conn, false, ""); err != nil {
+				t.logger.Log("msg", "dropping incoming connection", "err", err)
+			}
+		}()
+	}
+}
+
+// addConn runs the key exchange on a new connection and adds the peer behind it; the connection is closed on error
+func (t *TCPTransport) addConn(conn net.Conn, outgoing bool, dialedAddr string) error {
+	secure, err := secureHandshake(conn, t.key, outgoing)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("key exchange with %s: %w", conn.RemoteAddr(), err)
+	}
+	if isOwnKey(t.key, secure.RemoteKey()) {
+		conn.Close()
+		return ErrSelfConnection
+	}
+	if err := t.addPeer(NewTCPPeer(secure, secure.RemoteKey(), outgoing), dialedAddr); err != nil {
+		conn.Close()
+		return err
+	}
+	return nil
+}
+
+// Key is the identity key of the node
+func (t *TCPTransport) Key() crypto_lib.PublicKey {
+	return t.key.PublicKey()
+}
+
+// Addr is the address we listen on; once listening the port picked for ":0" is filled in
+func (t *TCPTransport) Addr() NetAddr {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if t.listener != nil {
+		return NetAddr(t.listener.Addr().String())
+	}
+	return t.listenAddr
+}
+
+func (t *TCPTransport) Consume() <-chan RPC {
+	return t.consumeCh
+}
+
+func (t *TCPTransport) PeerEvents() <-chan PeerEvent {
+	return t.eventCh
+}
+
+// Dial connects to addr and authenticates the node behind it; dialing a node we are connected to already fails
+func (t *TCPTransport) Dial(addr string) error {
+	conn, err := net.DialTimeout("tcp", addr, dialTimeout)
+	if err != nil {
+		return err
+	}
+	return t.addConn(conn, true, addr)
+}
+
+// Connect dials the address tr listens on
+func (t *TCPTransport) Connect(tr Transport) error {
+	return t.Dial(string(tr.Addr()))
+}
+
+// addPeer reads from the connection until it goes away; the peer is reported on either end
+func (t *TCPTransport) addPeer(peer *TCPPeer, dialedAddr string) error {
+	addr := peer.Addr()
+
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return ErrTransportClosed
+	}
+	if _, ok := t.peers[addr]; ok {
+		t.mu.Unlock()
+		return fmt.Errorf("already connected to %s", addr)
+	}
+	t.peers[addr] = peer
+	// added while holding the lock so Close can't be waiting already
+	t.wg.Add(1)
+	t.mu.Unlock()
+	t.sendEvent(PeerEvent{Addr: addr, Connected: true, Outgoing: peer.Outgoing, DialedAddr: dialedAddr, RemoteAddr: peer.RemoteAddr()})
+
+	go func() {
+		defer t.wg.Done()
+		peer.readLoop(t.consumeCh, t.quitCh)
+
+		t.mu.Lock()
+		if t.peers[addr] == peer {
+			delete(t.peers, addr)
+		}
+		t.mu.Unlock()
+		t.sendEvent(PeerEvent{Addr: addr, Outgoing: peer.Outgoing})
+	}()
+	return nil
+}
+
+func (t *TCPTransport) sendEvent(ev PeerEvent) {
+	select {
+	case t.eventCh <- ev:
+	case <-t.quitCh:
+	}
+}
+
+// Close stops accepting connections, closes the ones we have and waits for their read loops to return
+func (t *TCPTransport) Close() error {
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return nil
+	}
+	t.closed = true
+	close(t.quitCh)
+	ln := t.listener
+	peers := make([]*TCPPeer, 0, len(t.peers))
+	for _, peer := range t.peers {
+		peers = append(peers, peer)
+	}
+	t.mu.Unlock()
+
+	var err error
+	if ln != nil {
+		err = ln.Close()
+	}
+	for _, peer := range peers {
+		peer.Close()
+	}
+	t.wg.Wait()
+	return err
+}
+
+func (t *TCPTransport) peer(addr NetAddr) (*TCPPeer, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	peer, ok := t.peers[addr]
+	return peer, ok
+}
+
+// Disconnect closes the connection; the peer is reported gone once its read loop has returned
+func (t *TCPTransport) Disconnect(addr NetAddr) error {
+	peer, ok := t.peer(addr)
+	if !ok {
+		return fmt.Errorf("could not disconnect unknown peer %s", addr)
+	}
+	return peer.Close()
+}
+
+// SendMsg writes msg to the peer; a peer we can't write to is dead and gets disconnected
+func (t *TCPTransport) SendMsg(addr NetAddr, msg *Message) error {
+	peer, ok := t.peer(addr)
+	if !ok {
+		return fmt.Errorf("could not send msg to unknown peer %s", addr)
+	}
+	if err := peer.Send(msg); err != nil {
+		peer.Close()
+		return fmt.Errorf("sending to %s: %w", addr, err)
+	}
+	return nil
+}
+
+func (t *TCPTransport) Broadcast(msg *Message, excludedPeer NetAddr) error {
+	errs := []error{}
+	for _, addr := range t.Peers() {
+		if addr == excludedPeer {
+			continue
+		}
+		if err := t.SendMsg(addr, msg); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
 
-		t.peerCh <- peer
+func (t *TCPTransport) Peers() []NetAddr {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	peers := make([]NetAddr, 0, len(t.peers))
+	for addr := range t.peers {
+		peers = append(peers, addr)
 	}
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i] < peers[j]
+	})
+	return peers
 }
@@ -0,0 +1,120 @@
+package network
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// a transport listening on a free loopback port
+func newTestTCPTransport(t *testing.T) *TCPTransport {
+	tr := NewTCPTransporter("127.0.0.1:0", nil)
+	assert.Nil(t, tr.Start())
+	return tr
+}
+
+func nextPeerEvent(t *testing.T, tr Transport) PeerEvent {
+	select {
+	case ev := <-tr.PeerEvents():
+		return ev
+	case <-time.After(5 * time.Second):
+		t.Fatal("no peer event")
+		return PeerEvent{}
+	}
+}
+
+func TestTCPTransportConnect(t *testing.T) {
+	a := newTestTCPTransport(t)
+	b := newTestTCPTransport(t)
+
+	assert.Nil(t, a.Connect(b))
+	evA := nextPeerEvent(t, a)
+	assert.True(t, evA.Connected)
+	assert.True(t, evA.Outgoing)
+	assert.Equal(t, string(b.Addr()), evA.DialedAddr)
+	assert.Equal(t, string(b.Addr()), evA.RemoteAddr)
+	evB := nextPeerEvent(t, b)
+	assert.True(t, evB.Connected)
+	assert.False(t, evB.Outgoing)
+	// peers are known by their key, not the address they connect from
+	assert.Equal(t, NetAddr(b.Key().String()), evA.Addr)
+	assert.Equal(t, NetAddr(a.Key().String()), evB.Addr)
+
+	assert.Nil(t, a.SendMsg(evA.Addr, NewMessage(MessageGetStatusType, nil)))
+	select {
+	case rpc := <-b.Consume():
+		assert.Equal(t, evB.Addr, rpc.From)
+		msg, err := DefaultRPCDecodeFunc(rpc)
+		assert.Nil(t, err)
+		assert.IsType(t, &GetStatusMessage{}, msg.Data)
+	case <-time.After(5 * time.Second):
+		t.Fatal("msg not delivered")
+	}
+
+	// both ends notice the connection is gone
+	assert.Nil(t, a.Disconnect(evA.Addr))
+	assert.False(t, nextPeerEvent(t, a).Connected)
+	assert.False(t, nextPeerEvent(t, b).Connected)
+	assert.Empty(t, a.Peers())
+	assert.Empty(t, b.Peers())
+}
+
+func TestTCPTransportDropsDeadPeers(t *testing.T) {
+	a := newTestTCPTransport(t)
+	b := newTestTCPTransport(t)
+	assert.Nil(t, a.Connect(b))
+	ev := nextPeerEvent(t, a)
+	nextPeerEvent(t, b)
+
+	// the connection dies under the peer without its read loop noticing yet
+	peer, ok := a.peer(ev.Addr)
+	assert.True(t, ok)
+	peer.closed.Store(true)
+	assert.Equal(t, errPeerClosed, peer.Send(NewMessage(MessageGetStatusType, nil)))
+
+	assert.NotNil(t, a.Broadcast(NewMessage(MessageGetStatusType, nil), ""))
+	assert.False(t, nextPeerEvent(t, a).Connected)
+	assert.Empty(t, a.Peers())
+}
+
+func newTestTCPServer(t *testing.T, id string) *Server {
+	return newTestServerWithOpts(t, ServerOpts{ID: id, Transport: newTestTCPTransport(t)})
+}
+
+func TestServersOverTCP(t *testing.T) {
+	a := newTestTCPServer(t, "A")
+	b := newTestTCPServer(t, "B")
+	startServers(a, b)
+	connectServers(t, a, b)
+
+	reply, err := a.Request(onlyPeer(a).Addr, NewMessage(MessageGetStatusType, nil), time.Second)
+	assert.Nil(t, err)
+	assert.IsType(t, &StatusMessage{}, reply.Data)
+}
+
+func TestDuplicateConnectionDropped(t *testing.T) {
+	a := newTestTCPServer(t, "A")
+	b := newTestTCPServer(t, "B")
+	startServers(a, b)
+
+	connectServers(t, a, b)
+	assert.NotNil(t, a.Transport.Connect(b.Transport))
+	// the other way round it is the same node; its key gives it away
+	assert.NotNil(t, b.Transport.Connect(a.Transport))
+
+	assert.Equal(t, 1, len(a.Transport.Peers()))
+	assert.Equal(t, 1, len(b.Transport.Peers()))
+	assert.Equal(t, 1, peerCount(a))
+	assert.Equal(t, 1, peerCount(b))
+}
+
+func TestTCPTransportRejectsSelfConnection(t *testing.T) {
+	s := newTestTCPServer(t, "S")
+	startServers(s)
+
+	addr := string(s.Transport.Addr())
+	assert.ErrorIs(t, s.dial(addr), ErrSelfConnection)
+	assert.True(t, s.isKnownPeerAddr(addr))
+	assert.Empty(t, s.Transport.Peers())
+}
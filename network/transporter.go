@@ -1,12 +1,45 @@
 package network
 
+import "errors"
+
+// Transport carries msgs between nodes; the server runs on top of any implementation
 type Transport interface {
-	Connect(Transport) error
-	SendMsg(NetAddr, []byte) error
+	Start() error
+	// Connect opens a connection to the node behind tr
+	Connect(tr Transport) error
+	Disconnect(NetAddr) error
+	SendMsg(NetAddr, *Message) error
 	//the extra parameter is to exclude a peer from broadcasting
-	Broadcast([]byte, NetAddr) error
+	Broadcast(*Message, NetAddr) error
 	Consume() <-chan RPC
+	// PeerEvents reports connections coming up and going away
+	// the event of a new connection is always sent before any of its msgs show up in Consume
+	PeerEvents() <-chan PeerEvent
 	Addr() NetAddr
-	Peers() map[NetAddr]Transport
-	AddPeer(tr Transport) 
+	Peers() []NetAddr
+	// Close stops listening and drops every connection; no msgs or events are delivered once it returned
+	Close() error
+}
+
+var ErrTransportClosed = errors.New("transport closed")
+
+// Dialer is implemented by transports that can connect to a plain address, like the ones in the address book
+type Dialer interface {
+	Dial(addr string) error
 }
+
+type PeerEvent struct {
+	Addr      NetAddr
+	Connected bool
+	// we opened the connection
+	Outgoing bool
+	// address we connected to; only set for outgoing connections
+	DialedAddr string
+	// network address the connection comes from if the transport knows it
+	RemoteAddr string
+}
+
+var (
+	_ Transport = (*TCPTransport)(nil)
+	_ Transport = (*LocalTransport)(nil)
+)
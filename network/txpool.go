@@ -1,12 +1,20 @@
 package network
 
 import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"os"
 	"sync"
+	"time"
 
 	"github.com/EggsyOnCode/xenolith/core"
 	"github.com/EggsyOnCode/xenolith/core_types"
 )
 
+// the pending tx are written to this file in the data dir on shutdown
+const mempoolFileName = "mempool.dat"
+
 type TxPool struct {
 	all     *TxSortedMap
 	pending *TxSortedMap
@@ -40,15 +48,87 @@ func (p *TxPool) Contains(hash core_types.Hash) bool {
 	return p.all.Contains(hash)
 }
 
+// Get returns the tx with the given hash; nil if it isn't in the pool
+func (p *TxPool) Get(hash core_types.Hash) *core.Transaction {
+	return p.all.Get(hash)
+}
+
 // Pending returns a slice of transactions that are in the pending pool
 func (p *TxPool) Pending() []*core.Transaction {
 	return p.pending.txx.Data
 }
 
+// All returns the tx of the pool, pending or not
+func (p *TxPool) All() []*core.Transaction {
+	p.all.lock.RLock()
+	defer p.all.lock.RUnlock()
+	txx := make([]*core.Transaction, 0, len(p.all.lookup))
+	for _, tx := range p.all.lookup {
+		txx = append(txx, tx)
+	}
+	return txx
+}
+
 func (p *TxPool) ClearPending() {
 	p.pending.Clear()
 }
 
+// PendingHashes returns the hashes of at most max pending tx, oldest first
+func (p *TxPool) PendingHashes(max int) []core_types.Hash {
+	p.pending.lock.RLock()
+	defer p.pending.lock.RUnlock()
+	txx := p.pending.txx.Data
+	if len(txx) > max {
+		txx = txx[:max]
+	}
+	hashes := make([]core_types.Hash, 0, len(txx))
+	for _, tx := range txx {
+		hashes = append(hashes, tx.Hash(core.TxHasher{}))
+	}
+	return hashes
+}
+
+// Save writes the pending tx to path so a restarted node picks them up again; the file is replaced atomically
+func (p *TxPool) Save(path string) error {
+	p.pending.lock.RLock()
+	txx := append([]*core.Transaction{}, p.pending.txx.Data...)
+	p.pending.lock.RUnlock()
+
+	buf := &bytes.Buffer{}
+	if err := gob.NewEncoder(buf).Encode(txx); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Load adds the tx saved to path to the pool; tx that aren't signed are left out
+func (p *TxPool) Load(path string) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	txx := []*core.Transaction{}
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&txx); err != nil {
+		return fmt.Errorf("failed to decode mempool at %s: %w", path, err)
+	}
+	for _, tx := range txx {
+		if ok, _ := tx.Verify(); !ok {
+			continue
+		}
+		tx.SetTimeStamp(time.Now().Unix())
+		p.Add(tx)
+	}
+	return nil
+}
+
 func (p *TxPool) PendingCount() int {
 	return p.pending.Count()
 }
@@ -0,0 +1,249 @@
+// Package simulator runs several servers in one process over local transports and lets the
+// links between them misbehave: msgs can be delayed, lost, duplicated, reordered or cut off by partitions
+package simulator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/EggsyOnCode/xenolith/network"
+	"github.com/go-kit/log"
+)
+
+// Config decides what happens to every msg sent between two nodes
+type Config struct {
+	// every msg is on its way for at least this long
+	Latency time.Duration
+	// up to this much is added to the latency of each msg at random; msgs overtake each other
+	// without it msgs between two nodes arrive in the order they were sent
+	Jitter time.Duration
+	// share of msgs lost on the way; between 0 and 1
+	DropRate float64
+	// share of msgs delivered twice; between 0 and 1
+	DuplicateRate float64
+	// runs with the same seed make the same decisions for the same msgs
+	Seed int64
+}
+
+// Network is a set of nodes wired up over local transports
+type Network struct {
+	mu    sync.Mutex
+	cfg   Config
+	rng   *rand.Rand
+	nodes map[string]*network.Server
+	// msgs sent one way between two nodes, kept in order
+	wires map[[2]network.NetAddr]chan delivery
+	// named partitions; the group every node of a partition is in
+	partitions map[string]map[network.NetAddr]int
+	// closed by Stop; the wires stop handing over msgs
+	quitCh  chan struct{}
+	stopped bool
+}
+
+func New(cfg Config) *Network {
+	return &Network{
+		cfg:        cfg,
+		rng:        rand.New(rand.NewSource(cfg.Seed)),
+		nodes:      make(map[string]*network.Server),
+		wires:      make(map[[2]network.NetAddr]chan delivery),
+		partitions: make(map[string]map[network.NetAddr]int),
+		quitCh:     make(chan struct{}),
+	}
+}
+
+// Stop stops every node; msgs still on their way are lost
+func (n *Network) Stop(ctx context.Context) error {
+	n.mu.Lock()
+	if n.stopped {
+		n.mu.Unlock()
+		return nil
+	}
+	n.stopped = true
+	close(n.quitCh)
+	n.mu.Unlock()
+
+	errs := []error{}
+	for _, s := range n.Nodes() {
+		if err := s.Stop(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("stopping %s: %w", s.ID, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// SetConfig changes the faults for msgs sent from now on; msgs on their way keep their fate
+func (n *Network) SetConfig(cfg Config) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.cfg = cfg
+}
+
+// AddNode creates a server on a local transport named after opts.ID and starts it
+func (n *Network) AddNode(opts network.ServerOpts) (*network.Server, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.stopped {
+		return nil, fmt.Errorf("network stopped")
+	}
+	if _, ok := n.nodes[opts.ID]; ok {
+		return nil, fmt.Errorf("node %s already exists", opts.ID)
+	}
+
+	tr := network.NewLocalTransport(network.NetAddr(opts.ID))
+	tr.SetLink(n.link)
+	opts.Transport = tr
+	if opts.Logger == nil {
+		opts.Logger = log.NewNopLogger()
+	}
+	s, err := network.NewServer(opts)
+	if err != nil {
+		return nil, err
+	}
+	go s.Start()
+
+	n.nodes[opts.ID] = s
+	return s, nil
+}
+
+func (n *Network) Node(id string) *network.Server {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.nodes[id]
+}
+
+// Nodes returns the nodes sorted by id
+func (n *Network) Nodes() []*network.Server {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	nodes := make([]*network.Server, 0, len(n.nodes))
+	for _, s := range n.nodes {
+		nodes = append(nodes, s)
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].ID < nodes[j].ID
+	})
+	return nodes
+}
+
+// Connect opens a connection from node a to node b; the handshake runs over the faulty link like any other msg
+func (n *Network) Connect(a, b string) error {
+	from, to := n.Node(a), n.Node(b)
+	if from == nil || to == nil {
+		return fmt.Errorf("can't connect unknown nodes %s and %s", a, b)
+	}
+	return from.Transport.Connect(to.Transport)
+}
+
+// ConnectAll connects every node to every other one
+func (n *Network) ConnectAll() error {
+	nodes := n.Nodes()
+	for i, a := range nodes {
+		for _, b := range nodes[i+1:] {
+			if err := n.Connect(a.ID, b.ID); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Partition cuts the nodes of each group off from the nodes of the other groups until the partition is healed
+// nodes in none of the groups are left alone; several partitions can be in place at once
+func (n *Network) Partition(name string, groups ...[]string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	partition := make(map[network.NetAddr]int)
+	for i, group := range groups {
+		for _, id := range group {
+			partition[network.NetAddr(id)] = i
+		}
+	}
+	n.partitions[name] = partition
+}
+
+// Heal lifts the partition; msgs dropped while it was in place stay lost
+func (n *Network) Heal(name string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	delete(n.partitions, name)
+}
+
+// partitioned reports whether any partition keeps from and to apart
+func (n *Network) partitioned(from, to network.NetAddr) bool {
+	for _, partition := range n.partitions {
+		a, okA := partition[from]
+		b, okB := partition[to]
+		if okA && okB && a != b {
+			return true
+		}
+	}
+	return false
+}
+
+type delivery struct {
+	at      time.Time
+	deliver func()
+}
+
+// wire hands over the msgs from one node to another one after the other
+func (n *Network) wire(from, to network.NetAddr) chan delivery {
+	key := [2]network.NetAddr{from, to}
+	if ch, ok := n.wires[key]; ok {
+		return ch
+	}
+	ch := make(chan delivery, 1024)
+	n.wires[key] = ch
+	go func() {
+		for {
+			select {
+			case d := <-ch:
+				time.Sleep(time.Until(d.at))
+				d.deliver()
+			case <-n.quitCh:
+				return
+			}
+		}
+	}()
+	return ch
+}
+
+// link is what every msg between the nodes goes through
+func (n *Network) link(from, to network.NetAddr, msg *network.Message, deliver func()) {
+	n.mu.Lock()
+	if n.stopped || n.partitioned(from, to) || n.rng.Float64() < n.cfg.DropRate {
+		n.mu.Unlock()
+		return
+	}
+	copies := 1
+	if n.rng.Float64() < n.cfg.DuplicateRate {
+		copies = 2
+	}
+
+	if n.cfg.Jitter == 0 {
+		wire := n.wire(from, to)
+		at := time.Now().Add(n.cfg.Latency)
+		n.mu.Unlock()
+		for i := 0; i < copies; i++ {
+			select {
+			case wire <- delivery{at: at, deliver: deliver}:
+			case <-n.quitCh:
+				return
+			}
+		}
+		return
+	}
+
+	delays := make([]time.Duration, copies)
+	for i := range delays {
+		delays[i] = n.cfg.Latency + time.Duration(n.rng.Int63n(int64(n.cfg.Jitter)))
+	}
+	n.mu.Unlock()
+	for _, delay := range delays {
+		time.AfterFunc(delay, deliver)
+	}
+}
@@ -0,0 +1,229 @@
+package simulator
+
+import (
+	"context"
+	"math/big"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/EggsyOnCode/xenolith/core"
+	"github.com/EggsyOnCode/xenolith/crypto_lib"
+	"github.com/EggsyOnCode/xenolith/network"
+	"github.com/stretchr/testify/assert"
+)
+
+// a network stopped once the test is done
+func newNetwork(t *testing.T, cfg Config) *Network {
+	n := New(cfg)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		assert.Nil(t, n.Stop(ctx))
+	})
+	return n
+}
+
+func addNode(t *testing.T, n *Network, id string, validator bool) *network.Server {
+	// blocks are mined right away
+	opts := network.ServerOpts{ID: id, BlockTime: time.Hour, GenesisTarget: new(big.Int).Lsh(big.NewInt(1), 256)}
+	if validator {
+		opts.PrivateKey = crypto_lib.GeneratePrivateKey()
+	}
+	s, err := n.AddNode(opts)
+	assert.Nil(t, err)
+	return s
+}
+
+// connects every node to every other one and waits until they are all through the handshake
+func connectAll(t *testing.T, n *Network) {
+	assert.Nil(t, n.ConnectAll())
+	nodes := n.Nodes()
+	assert.Eventually(t, func() bool {
+		for _, s := range nodes {
+			if len(s.Peers()) != len(nodes)-1 {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+// empty if the node isn't that high yet
+func blockHash(s *network.Server, height uint32) string {
+	header, err := s.Chain().GetHeaders(height)
+	if err != nil {
+		return ""
+	}
+	return core.BlockHasher{}.Hash(header).String()
+}
+
+func TestLinkFaults(t *testing.T) {
+	n := New(Config{DropRate: 1})
+	delivered := atomic.Int32{}
+	deliver := func() { delivered.Add(1) }
+	deliveredEventually := func(count int32) {
+		assert.Eventually(t, func() bool {
+			return delivered.Load() == count
+		}, time.Second, time.Millisecond)
+	}
+
+	n.link("A", "B", nil, deliver)
+	assert.Never(t, func() bool {
+		return delivered.Load() > 0
+	}, 50*time.Millisecond, time.Millisecond)
+
+	n.SetConfig(Config{DuplicateRate: 1})
+	n.link("A", "B", nil, deliver)
+	deliveredEventually(2)
+
+	n.SetConfig(Config{Latency: 50 * time.Millisecond, Jitter: 10 * time.Millisecond})
+	n.link("A", "B", nil, deliver)
+	assert.Equal(t, int32(2), delivered.Load())
+	deliveredEventually(3)
+}
+
+func TestLinkKeepsOrderWithoutJitter(t *testing.T) {
+	n := New(Config{Latency: time.Millisecond})
+	got := make(chan int, 100)
+	for i := 0; i < 100; i++ {
+		i := i
+		n.link("A", "B", nil, func() { got <- i })
+	}
+	for i := 0; i < 100; i++ {
+		select {
+		case j := <-got:
+			assert.Equal(t, i, j)
+		case <-time.After(time.Second):
+			t.Fatal("msg not delivered")
+		}
+	}
+}
+
+func TestPartitions(t *testing.T) {
+	n := New(Config{})
+	n.Partition("split", []string{"A", "B"}, []string{"C"})
+	n.Partition("isolate", []string{"D"}, []string{"A", "B", "C"})
+
+	assert.False(t, n.partitioned("A", "B"))
+	assert.True(t, n.partitioned("A", "C"))
+	assert.True(t, n.partitioned("C", "B"))
+	assert.True(t, n.partitioned("D", "A"))
+	// E is in none of the groups
+	assert.False(t, n.partitioned("E", "C"))
+
+	n.Heal("split")
+	assert.False(t, n.partitioned("A", "C"))
+	assert.True(t, n.partitioned("D", "C"))
+}
+
+func TestNodeCatchesUpOnceHealed(t *testing.T) {
+	n := newNetwork(t, Config{Latency: time.Millisecond})
+	a := addNode(t, n, "A", true)
+	b := addNode(t, n, "B", false)
+	connectAll(t, n)
+
+	n.Partition("split", []string{"A"}, []string{"B"})
+	assert.Nil(t, a.ProduceBlock())
+	assert.Never(t, func() bool {
+		return b.Chain().Height() > 0
+	}, 200*time.Millisecond, 10*time.Millisecond)
+
+	// b misses the first block for good but fetches it once it learns of the second
+	n.Heal("split")
+	assert.Nil(t, a.ProduceBlock())
+	assert.Eventually(t, func() bool {
+		return b.Chain().Height() == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, blockHash(a, 2), blockHash(b, 2))
+}
+
+// TestChainReorg in core, played out across nodes: two validators that never hear of each other build
+// competing chains and the node hearing of both follows the one that gets ahead by enough blocks
+// the chain has no place for blocks whose parent it hasn't seen yet, so the links keep msgs in order
+// the losing chain carries a tx; it goes back into the mempool of the node that switched over
+func TestReorgAcrossNodes(t *testing.T) {
+	n := newNetwork(t, Config{Latency: time.Millisecond})
+	x := addNode(t, n, "X", true)
+	y := addNode(t, n, "Y", true)
+	c := addNode(t, n, "C", false)
+	connectAll(t, n)
+
+	waitForHeight := func(height uint32, hash string) {
+		assert.Eventually(t, func() bool {
+			return c.Chain().Height() == height && blockHash(c, height) == hash
+		}, 5*time.Second, 10*time.Millisecond)
+	}
+
+	// the tx only ever leaves x inside its first block
+	priv := crypto_lib.GeneratePrivateKey()
+	tx := core.NewTransaction(nil)
+	tx.From = priv.PublicKey()
+	assert.Nil(t, tx.Sign(priv))
+	hash := tx.Hash(core.TxHasher{})
+	n.Partition("x-alone", []string{"X"}, []string{"Y", "C"})
+	x.Mempool().Add(tx)
+	assert.Nil(t, x.ProduceBlock())
+	n.Heal("x-alone")
+
+	// c relays whatever it gets; the validator that isn't building is cut off so it doesn't build on the other chain
+	n.Partition("y-offline", []string{"Y"}, []string{"X", "C"})
+	for i := uint32(2); i <= 3; i++ {
+		assert.Nil(t, x.ProduceBlock())
+		waitForHeight(i, blockHash(x, i))
+	}
+	assert.Equal(t, blockHash(x, 1), blockHash(c, 1))
+	assert.False(t, c.Mempool().Contains(hash))
+	n.Heal("y-offline")
+	n.Partition("x-offline", []string{"X"}, []string{"Y", "C"})
+
+	// the competing chain is kept on the side until it gets ahead
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, y.ProduceBlock())
+	}
+	assert.Never(t, func() bool {
+		return c.Chain().Height() != 3 || blockHash(c, 1) != blockHash(x, 1)
+	}, 200*time.Millisecond, 10*time.Millisecond)
+
+	assert.Nil(t, y.ProduceBlock())
+	waitForHeight(4, blockHash(y, 4))
+	for i := uint32(1); i <= 4; i++ {
+		assert.Equal(t, blockHash(y, i), blockHash(c, i))
+	}
+	assert.True(t, c.Mempool().Contains(hash))
+
+	// c isn't stuck in the reorg; it takes the next block like any other
+	assert.Nil(t, y.ProduceBlock())
+	waitForHeight(5, blockHash(y, 5))
+}
+
+func TestGossipOverFaultyLinks(t *testing.T) {
+	n := newNetwork(t, Config{})
+	a := addNode(t, n, "A", true)
+	addNode(t, n, "B", false)
+	addNode(t, n, "C", false)
+	addNode(t, n, "D", false)
+	connectAll(t, n)
+
+	n.SetConfig(Config{
+		Latency:       time.Millisecond,
+		Jitter:        10 * time.Millisecond,
+		DuplicateRate: 0.3,
+		Seed:          1,
+	})
+	for i := 0; i < 5; i++ {
+		assert.Nil(t, a.ProduceBlock())
+	}
+
+	assert.Eventually(t, func() bool {
+		for _, s := range n.Nodes() {
+			if s.Chain().Height() != 5 {
+				return false
+			}
+		}
+		return true
+	}, 10*time.Second, 10*time.Millisecond)
+	for _, s := range n.Nodes() {
+		assert.Equal(t, blockHash(a, 5), blockHash(s, 5))
+	}
+}